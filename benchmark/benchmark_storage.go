@@ -25,7 +25,7 @@ func init() {
 }
 
 func newRPCClient(addr string) *RPCStorage {
-	rpc_storage := NewRPCStorage([]string{addr}, nil)
+	rpc_storage := NewRPCStorage([]string{addr}, nil, nil, false, nil)
 	return rpc_storage
 }
 
@@ -9,6 +9,9 @@ CREATE TABLE `group` (
   `super` tinyint(4) NOT NULL DEFAULT '0',
   `name` varchar(255) DEFAULT NULL,
   `notice` varchar(255) DEFAULT NULL COMMENT '公告',
+  `announcement` tinyint(1) NOT NULL DEFAULT '0' COMMENT '仅群主和管理员可以发言',
+  `mute` tinyint(1) NOT NULL DEFAULT '0' COMMENT '全员禁言',
+  `mute_until` int(11) NOT NULL DEFAULT '0' COMMENT '全员禁言的截止时间,单位：秒, 0表示一直有效',
   `deleted` tinyint(1) NOT NULL COMMENT '删除标志',  
   PRIMARY KEY (`id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -19,6 +22,7 @@ CREATE TABLE `group_member` (
   `timestamp` int(11) DEFAULT NULL COMMENT '入群时间,单位：秒',
   `nickname` varchar(255) DEFAULT NULL COMMENT '群内昵称',
   `mute` tinyint(1) DEFAULT '0' COMMENT '群内禁言',
+  `role` tinyint(4) NOT NULL DEFAULT '0' COMMENT '0:普通成员 1:管理员 2:群主',
   `deleted` tinyint(1) NOT NULL COMMENT '删除标志',
   PRIMARY KEY (`group_id`,`uid`),
   KEY `idx_group_member_uid` (`uid`)
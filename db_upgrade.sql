@@ -0,0 +1,11 @@
+use gobelieve;
+
+-- 已经部署的数据库升级, 新建的数据库直接使用db.sql
+-- 群组管理(群主,管理员,仅管理员发言)和全员禁言
+ALTER TABLE `group` ADD COLUMN `announcement` tinyint(1) NOT NULL DEFAULT '0' COMMENT '仅群主和管理员可以发言' AFTER `notice`;
+ALTER TABLE `group` ADD COLUMN `mute` tinyint(1) NOT NULL DEFAULT '0' COMMENT '全员禁言' AFTER `announcement`;
+ALTER TABLE `group` ADD COLUMN `mute_until` int(11) NOT NULL DEFAULT '0' COMMENT '全员禁言的截止时间,单位：秒, 0表示一直有效' AFTER `mute`;
+ALTER TABLE `group_member` ADD COLUMN `role` tinyint(4) NOT NULL DEFAULT '0' COMMENT '0:普通成员 1:管理员 2:群主' AFTER `mute`;
+
+-- 旧数据的群主
+UPDATE `group_member` m JOIN `group` g ON m.group_id = g.id AND m.uid = g.master SET m.role = 2;
@@ -50,7 +50,12 @@ type Config struct {
 	MySqlDataSource string `toml:"mysqldb_datasource"`
 	PendingRoot     string `toml:"pending_root"`
 
-	KefuAppId int64 `toml:"kefu_appid"`
+	KefuAppId           int64  `toml:"kefu_appid"`            //包含此app的客服消息都允许发送
+	CustomerService     bool   `toml:"customer_service"`      //顾客的消息发送给商店, 由im分配客服
+	CustomerStrategy    string `toml:"customer_strategy"`     //round_robin(默认), least_busy
+	CustomerMaxSessions int    `toml:"customer_max_sessions"` //客服同时接待的会话数量, 默认10
+
+	CustomerApps []*server.CustomerAppConfig `toml:"customer_app"` //允许互相发送客服消息的app
 
 	Redis RedisConfig `toml:"redis"`
 
@@ -63,15 +68,45 @@ type Config struct {
 	CertFile   string `toml:"cert_file"`
 	KeyFile    string `toml:"key_file"`
 
-	StorageRpcAddrs     []string `toml:"storage_rpc_addrs"`
-	GroupStorageRpcAdrs []string `toml:"group_storage_rpc_addrs"`
-	RouteAddrs          []string `toml:"route_addrs"`
-	GroupRouteAddrs     []string `toml:"group_route_addrs"` //可选配置项， 超群群的route server
-
-	GroupDeliverCount int    `toml:"group_deliver_count"` //群组消息投递并发数量,默认4
-	WordFile          string `toml:"word_file"`           //关键词字典文件
-	EnableFriendship  bool   `toml:"enable_friendship"`   //验证好友关系
-	EnableBlacklist   bool   `toml:"enable_blacklist"`    //验证是否在对方的黑名单中
+	StorageRpcAddrs        []string `toml:"storage_rpc_addrs"`
+	StorageStandbyRpcAddrs []string `toml:"storage_standby_rpc_addrs"` //备用的ims, 只接收迁移的用户
+	GroupStorageRpcAdrs    []string `toml:"group_storage_rpc_addrs"`
+	StorageHashRing        bool     `toml:"storage_hash_ring"` //一致性hash选择ims, 默认uid%len
+	RouteAddrs             []string `toml:"route_addrs"`
+	GroupRouteAddrs        []string `toml:"group_route_addrs"` //可选配置项， 超群群的route server
+	RouteAddrsKey          string   `toml:"route_addrs_key"`   //可选配置项, route server地址的redis集合,动态增加和删除route server
+
+	GroupDeliverCount    int                      `toml:"group_deliver_count"`    //群组消息投递并发数量,默认4
+	GroupHybridThreshold int                      `toml:"group_hybrid_threshold"` //普通群成员数量达到此值时消息只保存一次, 默认0不启用
+	WordFile             string                   `toml:"word_file"`              //关键词字典文件
+	WordReloadInterval   int                      `toml:"word_reload_interval"`   //检查字典文件修改的间隔(秒), 默认0只在SIGHUP时重新加载
+	WordLists            []*server.WordListConfig `toml:"word_list"`              //单个app的关键词字典
+
+	ModerationURL        string   `toml:"moderation_url"`         //消息保存之前调用的审核接口
+	ModerationTimeout    int      `toml:"moderation_timeout"`     //审核接口的超时时间(毫秒), 默认500
+	ModerationFailClosed bool     `toml:"moderation_fail_closed"` //审核接口调用失败时拒绝发送, 默认发送
+	ModerationCmds       []string `toml:"moderation_cmds"`        //需要审核的命令, 默认全部
+
+	RateLimits          []*server.RateLimitConfig `toml:"rate_limit"`            //按照命令限制用户和app的发送频率
+	RateLimitDisconnect int                       `toml:"rate_limit_disconnect"` //连续被限制的次数达到此值时断开连接, 默认0不断开
+	EnableFriendship    bool                      `toml:"enable_friendship"`     //验证好友关系
+	EnableBlacklist     bool                      `toml:"enable_blacklist"`      //验证是否在对方的黑名单中
+
+	StrangerMessageLimit int                            `toml:"stranger_message_limit"` //好友模式下每个非好友可以发送的消息请求数量, 默认0禁止发送
+	StrangerPolicies     []*server.StrangerPolicyConfig `toml:"stranger_policy"`        //单个app的消息请求数量
+
+	GroupNotification bool `toml:"group_notification"` //群组成员变化,解散和升级时自动发送群通知
+
+	RoomMembers bool `toml:"room_members"` //聊天室成员上报到route server, 支持查询聊天室成员
+	RoomBacklog bool `toml:"room_backlog"` //进入聊天室时补发route server缓存的最近消息
+
+	RoomRateLimit  int `toml:"room_rate_limit"`  //每个聊天室每秒发送给本机客户端的消息数量, 默认0不限制
+	RoomSampleRate int `toml:"room_sample_rate"` //超过频率限制后每n条消息发送一条, 默认10
+
+	GroupStore           string `toml:"group_store"`            //mysql(默认), http, memory
+	GroupStoreURL        string `toml:"group_store_url"`        //http
+	RelationshipStore    string `toml:"relationship_store"`     //mysql(默认), http, memory
+	RelationshipStoreURL string `toml:"relationship_store_url"` //http
 
 	MemoryLimit string `toml:"memory_limit"` //rss超过limit，不接受新的链接
 
@@ -29,20 +29,54 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func StartHttpServer(addr string, app_route *server.AppRoute, app *server.App, redis_pool *redis.Pool, server_summary *server.ServerSummary, rpc_storage *server.RPCStorage) {
+func StartHttpServer(addr string, app_route *server.AppRoute, app *server.App, redis_pool *redis.Pool, server_summary *server.ServerSummary, rpc_storage *server.RPCStorage, conversation_mutes *server.ConversationMutes, group_admin *server.GroupAdmin, room_moderation *server.RoomModeration, customer_apps *server.CustomerApps, customer_service *server.CustomerService, message_requests *server.MessageRequests, word_filter *server.WordFilter, hybrid_groups *server.HybridGroups) {
 	http.HandleFunc("/stack", server.Stack)
-	handler.Handle2("/summary", server.Summary, app_route, server_summary)
+	handler.Handle3("/summary", server.Summary, app_route, server_summary, app)
 	handler.Handle2("/post_group_notification", server.PostGroupNotification, app, rpc_storage)
 	handler.Handle3("/post_peer_message", server.PostPeerMessage, app, server_summary, rpc_storage)
 	handler.Handle3("/post_group_message", server.PostGroupMessage, app, server_summary, rpc_storage)
-	handler.Handle2("/post_system_message", server.SendSystemMessage, app, rpc_storage)
+	handler.Handle3("/post_system_message", server.SendSystemMessage, app, rpc_storage, word_filter)
 	handler.Handle("/post_notification", server.SendNotification, app)
 	handler.Handle("/post_room_message", server.SendRoomMessage, app)
-	handler.Handle2("/post_customer_message", server.SendCustomerMessage, app, rpc_storage)
+	handler.Handle3("/post_customer_message", server.SendCustomerMessage, app, rpc_storage, customer_apps)
 	handler.Handle("/post_realtime_message", server.SendRealtimeMessage, app)
 	handler.Handle2("/get_offline_count", server.GetOfflineCount, redis_pool, rpc_storage)
 	handler.Handle("/load_latest_message", server.LoadLatestMessage, rpc_storage)
 	handler.Handle("/load_history_message", server.LoadHistoryMessage, rpc_storage)
+	handler.Handle("/migrate_storage_user", server.MigrateStorageUser, rpc_storage)
+	handler.Handle("/migrate_storage_range", server.MigrateStorageRange, rpc_storage)
+	handler.Handle("/migrate_storage_range_status", server.MigrateStorageRangeStatus, rpc_storage)
+	handler.Handle("/presence", server.GetPresence, redis_pool)
+	handler.Handle("/set_conversation_mute", server.SetConversationMute, conversation_mutes)
+	handler.Handle("/remove_conversation_mute", server.RemoveConversationMute, conversation_mutes)
+	handler.Handle("/get_conversation_mutes", server.GetConversationMutes, conversation_mutes)
+	handler.Handle("/mute_group_member", server.MuteGroupMember, group_admin)
+	handler.Handle("/set_group_member_role", server.SetGroupMemberRole, group_admin)
+	handler.Handle("/set_group_announcement", server.SetGroupAnnouncement, group_admin)
+	handler.Handle("/mute_group", server.MuteGroup, group_admin)
+	handler.Handle("/get_group_dead_letters", server.GetGroupDeadLetters, app)
+	handler.Handle("/replay_group_dead_letters", server.ReplayGroupDeadLetters, app)
+	handler.Handle("/enable_group_hybrid", server.EnableGroupHybrid, hybrid_groups)
+	handler.Handle("/get_room_members", server.GetRoomMembers, app)
+	handler.Handle("/kick_room_member", server.KickRoomMember, room_moderation)
+	handler.Handle("/ban_room_member", server.BanRoomMember, room_moderation)
+	handler.Handle("/unban_room_member", server.UnbanRoomMember, room_moderation)
+	handler.Handle("/set_room_slow_mode", server.SetRoomSlowMode, room_moderation)
+	if customer_service != nil {
+		handler.Handle("/add_customer_agent", server.AddCustomerAgent, customer_service)
+		handler.Handle("/remove_customer_agent", server.RemoveCustomerAgent, customer_service)
+		handler.Handle("/set_customer_agent_status", server.SetCustomerAgentStatus, customer_service)
+		handler.Handle("/set_customer_store", server.SetCustomerStore, customer_service)
+		handler.Handle("/get_customer_agents", server.GetCustomerAgents, customer_service)
+		handler.Handle("/get_customer_sessions", server.GetCustomerSessions, customer_service)
+		handler.Handle("/transfer_customer_session", server.TransferCustomerSession, customer_service)
+		handler.Handle("/close_customer_session", server.CloseCustomerSession, customer_service)
+	}
+
+	if message_requests != nil {
+		handler.Handle("/get_message_requests", server.GetMessageRequests, message_requests)
+		handler.Handle("/remove_message_request", server.RemoveMessageRequest, message_requests)
+	}
 
 	handler := handler.LoggingHandler{Handler: http.DefaultServeMux}
 
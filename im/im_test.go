@@ -18,13 +18,6 @@ func TestFilter(t *testing.T) {
 	}
 	filter.AddWord("长者")
 
-	msg := &server.IMMessage{}
-
-	//TODO
-	//msg.content = "{\"text\": \"\\u6211\\u4e3a\\u5171*\\u4ea7\\u515a\\u7eed\\u4e00\\u79d2\"}"
-	server.FilterDirtyWord(filter, msg)
-	//log.Println("msg:", string(msg.content))
-
 	s := "我为共*产党续一秒"
 	t1 := filter.RemoveNoise(s)
 	log.Println(filter.Replace(t1, '*'))
@@ -22,8 +22,11 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
 	"path"
 	"runtime"
+	"syscall"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
@@ -33,7 +36,6 @@ import (
 	"github.com/GoBelieveIO/im_service/router"
 	"github.com/GoBelieveIO/im_service/server"
 	"github.com/GoBelieveIO/im_service/storage"
-	"github.com/importcjj/sensitive"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -110,9 +112,13 @@ func print_config(config *Config) {
 	log.Info("mysql datasource:", config.MySqlDataSource)
 
 	log.Info("storage addresses:", config.StorageRpcAddrs)
+	log.Info("storage standby addresses:", config.StorageStandbyRpcAddrs)
+	log.Info("storage hash ring:", config.StorageHashRing)
 	log.Info("route addressed:", config.RouteAddrs)
 	log.Info("group route addressed:", config.GroupRouteAddrs)
+	log.Info("route addresses key:", config.RouteAddrsKey)
 	log.Info("kefu appid:", config.KefuAppId)
+	log.Info("customer app pairs:", len(config.CustomerApps))
 	log.Info("pending root:", config.PendingRoot)
 
 	log.Infof("ws address:%s wss address:%s", config.WsAddress, config.WssAddress)
@@ -129,6 +135,16 @@ func print_config(config *Config) {
 		config.Log.Filename, config.Log.Level, config.Log.Backup, config.Log.Age, config.Log.Caller)
 }
 
+// SIGHUP重新加载关键词字典
+func reloadOnSignal(word_filter *server.WordFilter) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		log.Info("reload word files")
+		word_filter.Reload()
+	}
+}
+
 func main() {
 	fmt.Printf("Version:     %s\nBuilt:       %s\nGo version:  %s\nGit branch:  %s\nGit commit:  %s\n", VERSION, BUILD_TIME, GO_VERSION, GIT_BRANCH, GIT_COMMIT_ID)
 	runtime.GOMAXPROCS(runtime.NumCPU())
@@ -153,29 +169,37 @@ func main() {
 
 	auth := NewAuth(config.AuthMethod, redis_pool)
 
-	rpc_storage := server.NewRPCStorage(config.StorageRpcAddrs, config.GroupStorageRpcAdrs)
+	rpc_storage := server.NewRPCStorage(config.StorageRpcAddrs, config.StorageStandbyRpcAddrs, config.GroupStorageRpcAdrs, config.StorageHashRing, redis_pool)
 
-	var group_service *server.GroupService
-	if len(config.MySqlDataSource) > 0 {
-		group_service = server.NewGroupService(redis_pool, config.MySqlDataSource, config.redis_config())
-		group_service.Start()
+	group_store, err := server.NewGroupStore(config.GroupStore, config.MySqlDataSource, config.GroupStoreURL)
+	if err != nil {
+		log.Fatal("group store:", err)
 	}
+	group_service := server.NewGroupServiceWithStore(redis_pool, group_store, config.redis_config())
 
 	app_route := server.NewAppRoute()
 	app := &server.App{}
+	room_moderation := server.NewRoomModeration(app, app_route, redis_pool)
 	dispatch_app_message := func(appid, uid int64, msg *protocol.Message) {
 		app_route.SendPeerMessage(appid, uid, msg)
 	}
 	dispatch_room_message := func(appid, room_id int64, msg *protocol.Message) {
+		if msg.Cmd == protocol.MSG_ROOM_CONTROL {
+			room_moderation.HandleControl(appid, msg.Body.(*server.RoomControl))
+			return
+		}
 		app_route.SendRoomMessage(appid, room_id, msg)
 	}
+	dispatch_presence := func(appid, uid int64, msg *protocol.Message) {
+		app_route.SendPresence(appid, uid, msg)
+	}
 	dispatch_group_message := func(appid, group_id int64, msg *protocol.Message) {
 		loader := app.GetGroupLoader(group_id)
 		loader.DispatchMessage(msg, group_id, appid)
 	}
 	route_channels := make([]server.RouteChannel, 0)
 	for _, addr := range config.RouteAddrs {
-		channel := router.NewChannel(addr, dispatch_app_message, dispatch_group_message, dispatch_room_message)
+		channel := router.NewChannel(addr, dispatch_app_message, dispatch_group_message, dispatch_room_message, dispatch_presence)
 		channel.Start()
 		route_channels = append(route_channels, channel)
 	}
@@ -184,7 +208,7 @@ func main() {
 	if len(config.GroupRouteAddrs) > 0 {
 		group_route_channels = make([]server.RouteChannel, 0)
 		for _, addr := range config.GroupRouteAddrs {
-			channel := router.NewChannel(addr, dispatch_app_message, dispatch_group_message, dispatch_room_message)
+			channel := router.NewChannel(addr, dispatch_app_message, dispatch_group_message, dispatch_room_message, dispatch_presence)
 			channel.Start()
 			group_route_channels = append(group_route_channels, channel)
 		}
@@ -192,11 +216,14 @@ func main() {
 		group_route_channels = route_channels
 	}
 
+	//没有启用的群组时和之前相同, 每个成员保存完整的消息
+	hybrid_groups := server.NewHybridGroups(redis_pool, config.GroupHybridThreshold)
 	group_message_delivers := make([]*server.GroupMessageDeliver, config.GroupDeliverCount)
 	for i := 0; i < config.GroupDeliverCount; i++ {
 		q := fmt.Sprintf("q%d", i)
 		r := path.Join(config.PendingRoot, q)
 		deliver := server.NewGroupMessageDeliver(r, group_service.GroupManager, app, rpc_storage)
+		deliver.EnableHybrid(hybrid_groups)
 		deliver.Start()
 		group_message_delivers[i] = deliver
 	}
@@ -209,11 +236,44 @@ func main() {
 	}
 
 	app.Init(app_route, route_channels, group_route_channels, group_message_delivers, group_loaders)
+	if config.GroupNotification {
+		group_service.EnableNotification(app, rpc_storage, server_summary)
+	}
+	group_service.EnableChangedNotification(app_route)
+	//内存存储的修改直接生效, 不需要读取群组事件
+	if config.GroupStore != server.STORE_MEMORY {
+		group_service.Start()
+	}
+	//免打扰的设置由route server在推送时读取, im只提供http接口
+	conversation_mutes := server.NewConversationMutes(redis_pool)
+	if config.RoomMembers {
+		app.EnableRoomMembers()
+	}
+	if config.RoomBacklog {
+		app.EnableRoomBacklog()
+	}
+	if config.RoomRateLimit > 0 {
+		app_route.RoomLimiter().SetRateLimit(config.RoomRateLimit, config.RoomSampleRate)
+	}
 
-	var filter *sensitive.Filter
-	if len(config.WordFile) > 0 {
-		filter = sensitive.New()
-		filter.LoadWordDict(config.WordFile)
+	if len(config.RouteAddrsKey) > 0 {
+		app.EnableDynamicRoute(func(addr string) server.RouteChannel {
+			channel := router.NewChannel(addr, dispatch_app_message, dispatch_group_message, dispatch_room_message, dispatch_presence)
+			channel.Start()
+			return channel
+		})
+		go server.WatchRouteAddrs(app, redis_pool, config.RouteAddrsKey)
+	}
+
+	var word_filter *server.WordFilter
+	if len(config.WordFile) > 0 || len(config.WordLists) > 0 {
+		word_filter = server.NewWordFilter(config.WordFile, config.WordLists, redis_pool)
+		word_filter.Reload()
+		go word_filter.ReviewLoop()
+		if config.WordReloadInterval > 0 {
+			go word_filter.Watch(config.WordReloadInterval)
+		}
+		go reloadOnSignal(word_filter)
 	}
 
 	go server.ListenRedis(app_route, config.redis_config())
@@ -224,17 +284,66 @@ func main() {
 	}
 
 	var relationship_pool *server.RelationshipPool
+	var message_requests *server.MessageRequests
 	if config.EnableFriendship || config.EnableBlacklist {
-		relationship_pool = server.NewRelationshipPool(config.MySqlDataSource, redis_pool)
-		relationship_pool.Start()
+		relationship_store, err := server.NewRelationshipStore(config.RelationshipStore, config.MySqlDataSource, config.RelationshipStoreURL)
+		if err != nil {
+			log.Fatal("relationship store:", err)
+		}
+		relationship_pool = server.NewRelationshipPoolWithStore(relationship_store, redis_pool)
+		if config.EnableFriendship && (config.StrangerMessageLimit > 0 || len(config.StrangerPolicies) > 0) {
+			message_requests = server.NewMessageRequests(redis_pool, app, rpc_storage, config.StrangerMessageLimit, config.StrangerPolicies)
+			relationship_pool.SetFriendObserver(message_requests.Unlock)
+		}
+		if config.RelationshipStore != server.STORE_MEMORY {
+			relationship_pool.Start()
+		}
+	}
+
+	group_admin := server.NewGroupAdmin(group_service)
+	var customer_service *server.CustomerService
+	if config.CustomerService && config.KefuAppId != 0 {
+		customer_service = server.NewCustomerService(config.KefuAppId, config.CustomerStrategy, config.CustomerMaxSessions, redis_pool, app, rpc_storage)
+		customer_service.Run()
 	}
 
-	go StartHttpServer(config.HttpListenAddress, app_route, app, redis_pool, server_summary, rpc_storage)
+	customer_apps := server.NewCustomerApps(config.KefuAppId, config.CustomerApps)
+	go StartHttpServer(config.HttpListenAddress, app_route, app, redis_pool, server_summary, rpc_storage, conversation_mutes, group_admin, room_moderation, customer_apps, customer_service, message_requests, word_filter, hybrid_groups)
+
+	var moderation_hook *server.ModerationHook
+	if len(config.ModerationURL) > 0 {
+		moderation_hook, err = server.NewModerationHook(config.ModerationURL, config.ModerationTimeout, config.ModerationFailClosed, config.ModerationCmds)
+		if err != nil {
+			log.Fatal("moderation:", err)
+		}
+	}
 
-	server := server.NewServer(group_service.GroupManager, filter, redis_pool,
+	var rate_limiter *server.RateLimiter
+	if len(config.RateLimits) > 0 {
+		rate_limiter, err = server.NewRateLimiter(config.RateLimits)
+		if err != nil {
+			log.Fatal("rate limit:", err)
+		}
+		go rate_limiter.RecycleLoop()
+	}
+
+	server := server.NewServer(group_service.GroupManager, word_filter, redis_pool,
 		server_summary, relationship_pool, auth,
 		rpc_storage, sync_c, group_sync_c, app_route, app,
-		config.EnableBlacklist, config.EnableFriendship, config.KefuAppId)
+		config.EnableBlacklist, config.EnableFriendship, customer_apps)
+	server.SetRoomModeration(room_moderation)
+	if customer_service != nil {
+		server.SetCustomerService(customer_service)
+	}
+	if message_requests != nil {
+		server.SetMessageRequests(message_requests)
+	}
+	if moderation_hook != nil {
+		server.SetModerationHook(moderation_hook)
+	}
+	if rate_limiter != nil {
+		server.SetRateLimiter(rate_limiter, config.RateLimitDisconnect)
+	}
 	listener := &Listener{
 		server_summary: server_summary,
 		low_memory:     &low_memory,
@@ -23,6 +23,9 @@ import (
 	"log"
 
 	"github.com/BurntSushi/toml"
+
+	"github.com/GoBelieveIO/im_service/router"
+	"github.com/GoBelieveIO/im_service/server"
 )
 
 type RedisConfig struct {
@@ -45,8 +48,24 @@ type Config struct {
 	PushDisabled      bool   `toml:"push_disabled"`
 	HttpListenAddress string `toml:"http_listen_address"`
 
+	//用户上下线事件的redis stream, 为空时不写入
+	PresenceStream       string `toml:"presence_stream"`
+	PresenceStreamMaxLen int    `toml:"presence_stream_maxlen"`
+	PresenceDebounce     int    `toml:"presence_debounce"` //毫秒
+
+	RoomMemberBroadcast bool `toml:"room_member_broadcast"` //用户进入和离开聊天室时通知聊天室成员
+	RoomBacklogSize     int  `toml:"room_backlog_size"`     //每个聊天室缓存的最近消息数量, 0不缓存
+	RoomBacklogSeconds  int  `toml:"room_backlog_seconds"`  //只缓存最近多少秒的消息, 0不限制
+
+	RoomBacklogs []*router.RoomBacklogConfig `toml:"room_backlog"` //单个app的配置
+
 	Redis RedisConfig `toml:"redis"`
 	Log   LogConfig   `toml:"log"`
+
+	PushSinks  []*server.PushSinkConfig  `toml:"push_sink"`
+	PushRoutes []*server.PushRouteConfig `toml:"push_route"`
+
+	CustomerPushRoutes []*server.CustomerPushRouteConfig `toml:"customer_push_route"`
 }
 
 func read_route_cfg(cfg_path string) *Config {
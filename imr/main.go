@@ -31,6 +31,7 @@ import (
 
 	"github.com/GoBelieveIO/im_service/handler"
 	"github.com/GoBelieveIO/im_service/router"
+	srv "github.com/GoBelieveIO/im_service/server"
 	"github.com/gomodule/redigo/redis"
 	log "github.com/sirupsen/logrus"
 )
@@ -108,6 +109,9 @@ func NewRedisPool(server, password string, db int) *redis.Pool {
 func StartHttpServer(addr string, server *router.Server) {
 	handler.Handle("/online", router.GetOnlineStatus, server)
 	handler.Handle("/all_online", router.GetOnlineClients, server)
+	handler.Handle("/presence", router.GetPresence, server)
+	handler.Handle("/push_summary", router.GetPushSummary, server)
+	handler.Handle("/room_members", router.GetRoomMembers, server)
 
 	handler := handler.LoggingHandler{Handler: http.DefaultServeMux}
 
@@ -167,14 +171,45 @@ func main() {
 
 	log.Infof("push disabled:%t", config.PushDisabled)
 
+	log.Infof("presence stream:%s maxlen:%d debounce:%dms",
+		config.PresenceStream, config.PresenceStreamMaxLen, config.PresenceDebounce)
+
+	log.Infof("room member broadcast:%t", config.RoomMemberBroadcast)
+	log.Infof("room backlog size:%d seconds:%d", config.RoomBacklogSize, config.RoomBacklogSeconds)
+	for _, c := range config.RoomBacklogs {
+		log.Infof("room backlog appid:%d size:%d seconds:%d", c.AppID, c.Size, c.Seconds)
+	}
+
 	log.Infof("log filename:%s level:%s backup:%d age:%d caller:%t",
 		config.Log.Filename, config.Log.Level, config.Log.Backup, config.Log.Age, config.Log.Caller)
 
 	redis_pool := NewRedisPool(config.Redis.Address, config.Redis.Password,
 		config.Redis.Db)
 
-	server := router.NewServer(redis_pool, config.PushDisabled)
+	for _, sink := range config.PushSinks {
+		log.Infof("push sink:%s type:%s url:%s path:%s", sink.Name, sink.Type, sink.URL, sink.Path)
+	}
+	for _, route := range config.PushRoutes {
+		log.Infof("push route appids:%v sink:%s app queue:%t", route.AppIDs, route.Sink, route.AppQueue)
+	}
+	push_service, err := srv.NewPushService(redis_pool, config.PushSinks, config.PushRoutes, config.CustomerPushRoutes)
+	if err != nil {
+		log.Fatal("push service err:", err)
+	}
+
+	server := router.NewServer(redis_pool, push_service, config.PushDisabled)
 	server.RunPushService()
+	server.RunPresenceService()
+	if config.PresenceStream != "" {
+		debounce := time.Duration(config.PresenceDebounce) * time.Millisecond
+		server.EnablePresenceStream(config.PresenceStream, config.PresenceStreamMaxLen, debounce)
+	}
+	if config.RoomMemberBroadcast {
+		server.EnableRoomMemberBroadcast()
+	}
+	if config.RoomBacklogSize > 0 || len(config.RoomBacklogs) > 0 {
+		server.EnableRoomBacklog(config.RoomBacklogSize, config.RoomBacklogSeconds, config.RoomBacklogs)
+	}
 	if config.HttpListenAddress != "" {
 		go StartHttpServer(config.HttpListenAddress, server)
 	}
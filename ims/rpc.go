@@ -20,6 +20,7 @@
 package main
 
 import (
+	"fmt"
 	"sync/atomic"
 
 	. "github.com/GoBelieveIO/im_service/protocol"
@@ -35,6 +36,9 @@ type RPCStorage struct {
 
 func (rpc *RPCStorage) SyncMessage(sync_key *rpc_storage.SyncHistory, result *rpc_storage.PeerHistoryMessage) error {
 	atomic.AddInt64(&rpc.server_summary.nrequests, 1)
+	if err := rpc.storage.CheckMoved(sync_key.Uid); err != nil {
+		return err
+	}
 	messages, last_msgid, hasMore := rpc.storage.LoadHistoryMessagesV3(sync_key.AppID, sync_key.Uid, sync_key.LastMsgID, rpc.limit, rpc.hard_limit)
 
 	historyMessages := make([]*rpc_storage.HistoryMessage, 0, 10)
@@ -82,7 +86,10 @@ func (rpc *RPCStorage) SavePeerMessage(m *rpc_storage.PeerMessage, result *rpc_s
 	atomic.AddInt64(&rpc.server_summary.peer_message_count, 1)
 	msg := &Message{Cmd: int(m.Cmd), Version: DEFAULT_VERSION}
 	msg.FromData(m.Raw)
-	msgid, prev_msgid := rpc.storage.SavePeerMessage(m.AppID, m.Uid, m.DeviceID, msg)
+	msgid, prev_msgid, err := rpc.storage.SavePeerMessageIfOwned(m.AppID, m.Uid, m.DeviceID, msg)
+	if err != nil {
+		return err
+	}
 	result.MsgID = msgid
 	result.PrevMsgID = prev_msgid
 	return nil
@@ -93,7 +100,10 @@ func (rpc *RPCStorage) SavePeerGroupMessage(m *rpc_storage.PeerGroupMessage, res
 	atomic.AddInt64(&rpc.server_summary.peer_message_count, 1)
 	msg := &Message{Cmd: int(m.Cmd), Version: DEFAULT_VERSION}
 	msg.FromData(m.Raw)
-	r := rpc.storage.SavePeerGroupMessage(m.AppID, m.Members, m.DeviceID, msg)
+	r, err := rpc.storage.SavePeerGroupMessageIfOwned(m.AppID, m.Members, m.DeviceID, msg)
+	if err != nil {
+		return err
+	}
 
 	result.MessageIDs = make([]*rpc_storage.HistoryMessageID, 0, len(r)/2)
 	for i := 0; i < len(r); i += 2 {
@@ -115,8 +125,32 @@ func (rpc *RPCStorage) SaveGroupMessage(m *rpc_storage.GroupMessage, result *rpc
 	return nil
 }
 
+func (rpc *RPCStorage) LoadGroupMessages(r *rpc_storage.GroupMessageRequest, result *rpc_storage.LatestMessage) error {
+	atomic.AddInt64(&rpc.server_summary.nrequests, 1)
+
+	historyMessages := make([]*rpc_storage.HistoryMessage, 0, len(r.MsgIDs))
+	for _, msgid := range r.MsgIDs {
+		msg := rpc.storage.LoadGroupMessage(r.AppID, r.GroupID, msgid)
+		if msg == nil {
+			continue
+		}
+		hm := &rpc_storage.HistoryMessage{}
+		hm.MsgID = msgid
+		hm.Cmd = int32(msg.Cmd)
+
+		msg.Version = DEFAULT_VERSION
+		hm.Raw = msg.ToData()
+		historyMessages = append(historyMessages, hm)
+	}
+	result.Messages = historyMessages
+	return nil
+}
+
 func (rpc *RPCStorage) GetNewCount(sync_key *rpc_storage.SyncHistory, new_count *int64) error {
 	atomic.AddInt64(&rpc.server_summary.nrequests, 1)
+	if err := rpc.storage.CheckMoved(sync_key.Uid); err != nil {
+		return err
+	}
 	count := rpc.storage.GetNewCount(sync_key.AppID, sync_key.Uid, sync_key.LastMsgID)
 	*new_count = int64(count)
 	return nil
@@ -124,6 +158,9 @@ func (rpc *RPCStorage) GetNewCount(sync_key *rpc_storage.SyncHistory, new_count
 
 func (rpc *RPCStorage) GetLatestMessage(r *rpc_storage.HistoryRequest, l *rpc_storage.LatestMessage) error {
 	atomic.AddInt64(&rpc.server_summary.nrequests, 1)
+	if err := rpc.storage.CheckMoved(r.Uid); err != nil {
+		return err
+	}
 	messages := rpc.storage.LoadLatestMessages(r.AppID, r.Uid, int(r.Limit))
 
 	historyMessages := make([]*rpc_storage.HistoryMessage, 0, 10)
@@ -142,6 +179,72 @@ func (rpc *RPCStorage) GetLatestMessage(r *rpc_storage.HistoryRequest, l *rpc_st
 	return nil
 }
 
+func (rpc *RPCStorage) FreezeUser(u *rpc_storage.MigrationUser, result *rpc_storage.MigrationUser) error {
+	atomic.AddInt64(&rpc.server_summary.nrequests, 1)
+	last_ids, err := rpc.storage.FreezeUser(u.Uid)
+	if err != nil {
+		return err
+	}
+	result.Uid = u.Uid
+	result.LastIDs = last_ids
+	return nil
+}
+
+func (rpc *RPCStorage) ExportPeerMessages(r *rpc_storage.ExportRequest, result *rpc_storage.ExportMessage) error {
+	atomic.AddInt64(&rpc.server_summary.nrequests, 1)
+	messages, next_id := rpc.storage.LoadPeerChain(r.AppID, r.Uid, r.LastID, int(r.Limit))
+
+	historyMessages := make([]*rpc_storage.HistoryMessage, 0, len(messages))
+	for _, emsg := range messages {
+		hm := &rpc_storage.HistoryMessage{}
+		hm.MsgID = emsg.MsgId
+		hm.DeviceID = emsg.DeviceId
+		hm.Cmd = int32(emsg.Msg.Cmd)
+
+		emsg.Msg.Version = DEFAULT_VERSION
+		hm.Raw = emsg.Msg.ToData()
+		historyMessages = append(historyMessages, hm)
+	}
+	result.Messages = historyMessages
+	result.NextID = next_id
+	return nil
+}
+
+func (rpc *RPCStorage) ImportPeerMessages(m *rpc_storage.ImportMessage, result *rpc_storage.ImportMessageID) error {
+	atomic.AddInt64(&rpc.server_summary.nrequests, 1)
+	messages := make([]*rpc_storage.EMessage, 0, len(m.Messages))
+	for _, hm := range m.Messages {
+		msg := &Message{Cmd: int(hm.Cmd), Version: DEFAULT_VERSION}
+		if !msg.FromData(hm.Raw) {
+			return fmt.Errorf("invalid message:%d", hm.MsgID)
+		}
+		messages = append(messages, &rpc_storage.EMessage{MsgId: hm.MsgID, DeviceId: hm.DeviceID, Msg: msg})
+	}
+
+	msgids, err := rpc.storage.ImportPeerMessages(m.AppID, m.Uid, messages)
+	if err != nil {
+		return err
+	}
+	result.MessageIDs = msgids
+	return nil
+}
+
+func (rpc *RPCStorage) ResetPeerUser(u *rpc_storage.MigrationUser, result *int) error {
+	atomic.AddInt64(&rpc.server_summary.nrequests, 1)
+	return rpc.storage.ResetUser(u.Uid)
+}
+
+func (rpc *RPCStorage) ListPeerUsers(r *rpc_storage.UserListRequest, result *rpc_storage.UserList) error {
+	atomic.AddInt64(&rpc.server_summary.nrequests, 1)
+	result.Uids = rpc.storage.ListUsers(r.Cursor, int(r.Limit))
+	return nil
+}
+
+func (rpc *RPCStorage) ReleaseUser(u *rpc_storage.MigrationUser, result *int) error {
+	atomic.AddInt64(&rpc.server_summary.nrequests, 1)
+	return rpc.storage.ReleaseUser(u.Uid, u.Address, u.LastIDs)
+}
+
 func (rpc *RPCStorage) Ping(int, *int) error {
 	return nil
 }
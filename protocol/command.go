@@ -64,6 +64,48 @@ const MSG_NOTIFICATION = 36
 // 消息的meta信息
 const MSG_METADATA = 37
 
+// 客户端->服务端, 订阅联系人的在线状态
+const MSG_SUBSCRIBE_PRESENCE = 38
+
+// 服务端->客户端, 联系人在线状态变化
+const MSG_PRESENCE = 39
+
+// 服务端->客户端, 超级群同步时@自己的消息数量, 在MSG_SYNC_GROUP_END之前发送
+const MSG_SYNC_GROUP_MENTION = 40
+
+// 客户端->服务端, 获取群组信息
+const MSG_GET_GROUP_INFO = 41
+
+// 服务端->客户端, 群组信息(json)
+const MSG_GROUP_INFO = 42
+
+// 客户端->服务端, 分页获取群组成员
+const MSG_GET_GROUP_MEMBERS = 43
+
+// 服务端->客户端, 群组成员列表(json)
+const MSG_GROUP_MEMBERS = 44
+
+// 服务端->客户端, 群组信息或者成员发生变化, 客户端按需重新获取
+const MSG_GROUP_CHANGED = 45
+
+// 客户端->服务端, 分页获取聊天室成员
+const MSG_GET_ROOM_MEMBERS = 46
+
+// 服务端->客户端, 聊天室成员列表(json)
+const MSG_ROOM_MEMBERS = 47
+
+// 客户端->服务端, 获取聊天室成员数量
+const MSG_GET_ROOM_MEMBER_COUNT = 48
+
+// 服务端->客户端, 聊天室成员数量
+const MSG_ROOM_MEMBER_COUNT = 49
+
+// 服务端->客户端, 用户进入或者离开聊天室
+const MSG_ROOM_MEMBER_CHANGED = 50
+
+// 服务端->客户端, 被踢出或者封禁, 已经离开聊天室
+const MSG_ROOM_KICKED = 51
+
 // im实例使用
 const MSG_PENDING_GROUP_MESSAGE = 251
 
@@ -97,11 +139,38 @@ const MSG_SUBSCRIBE_ROOM = 136
 const MSG_UNSUBSCRIBE_ROOM = 137
 const MSG_PUBLISH_ROOM = 138
 
+// 用户在线状态变化
+const MSG_PUBLISH_PRESENCE = 139
+
+// 聊天室成员, 由聊天室所属的route server汇总
+const MSG_SUBSCRIBE_ROOM_MEMBER = 140
+const MSG_UNSUBSCRIBE_ROOM_MEMBER = 141
+const MSG_QUERY_ROOM_MEMBERS = 142
+const MSG_ROOM_MEMBERS_RESULT = 143
+
+// 聊天室最近的消息, 保存在聊天室所属的route server
+const MSG_QUERY_ROOM_BACKLOG = 144
+const MSG_ROOM_BACKLOG_RESULT = 145
+
+// im上有客户端订阅了用户的在线状态, 发送给用户所属的route server
+const MSG_WATCH_PRESENCE = 146
+const MSG_UNWATCH_PRESENCE = 147
+
 // 主从同步消息
 const MSG_STORAGE_SYNC_BEGIN = 220
 const MSG_STORAGE_SYNC_MESSAGE = 221
 const MSG_STORAGE_SYNC_MESSAGE_BATCH = 222
 
+// 带有@成员列表的群组消息, 只在im和ims之间使用
+// 消息体固定为version3的格式, 同步给客户端时转换为MSG_GROUP_IM
+const MSG_GROUP_IM_MENTION = 244
+
+// im之间通过route server转发的聊天室管理消息
+const MSG_ROOM_CONTROL = 245
+
+// 保存在个人消息队列中的普通群消息引用, 消息本体保存在群组消息队列中
+const MSG_GROUP_IM_REF = 246
+
 // 内部文件存储使用
 // 超级群消息队列 代替MSG_GROUP_IM_LIST
 const MSG_GROUP_OFFLINE = 247
@@ -22,6 +22,14 @@ package protocol
 // ---------------------------------------------------
 const DEFAULT_VERSION = 2
 
+// version3:群组消息添加@成员列表
+// 只用于带有@的群消息和支持的客户端, im和ims之间仍然使用DEFAULT_VERSION
+const MENTION_VERSION = 3
+
+// version3:客户端支持群组变化(MSG_GROUP_CHANGED), 聊天室成员进出(MSG_ROOM_MEMBER_CHANGED)
+// 和被踢出聊天室(MSG_ROOM_KICKED)的通知
+const CHANGED_NOTIFICATION_VERSION = 3
+
 // 消息标志
 // 文本消息 c <-> s
 const MESSAGE_FLAG_TEXT = 0x01
@@ -41,6 +49,12 @@ const MESSAGE_FLAG_PUSH = 0x10
 // 超级群消息 c <- s
 const MESSAGE_FLAG_SUPER_GROUP = 0x20
 
+// 群消息@了当前用户 c <- s
+const MESSAGE_FLAG_MENTION = 0x40
+
+// 进入聊天室时补发的最近消息 c <- s
+const MESSAGE_FLAG_BACKLOG = 0x80
+
 const MSG_HEADER_SIZE = 12
 
 var message_descriptions map[int]string = make(map[int]string)
@@ -82,8 +96,25 @@ func init() {
 
 	message_descriptions[MSG_NOTIFICATION] = "MSG_NOTIFICATION"
 	message_descriptions[MSG_METADATA] = "MSG_METADATA"
+	message_descriptions[MSG_SUBSCRIBE_PRESENCE] = "MSG_SUBSCRIBE_PRESENCE"
+	message_descriptions[MSG_PRESENCE] = "MSG_PRESENCE"
+	message_descriptions[MSG_SYNC_GROUP_MENTION] = "MSG_SYNC_GROUP_MENTION"
+	message_descriptions[MSG_GET_GROUP_INFO] = "MSG_GET_GROUP_INFO"
+	message_descriptions[MSG_GROUP_INFO] = "MSG_GROUP_INFO"
+	message_descriptions[MSG_GET_GROUP_MEMBERS] = "MSG_GET_GROUP_MEMBERS"
+	message_descriptions[MSG_GROUP_MEMBERS] = "MSG_GROUP_MEMBERS"
+	message_descriptions[MSG_GROUP_CHANGED] = "MSG_GROUP_CHANGED"
+	message_descriptions[MSG_GET_ROOM_MEMBERS] = "MSG_GET_ROOM_MEMBERS"
+	message_descriptions[MSG_ROOM_MEMBERS] = "MSG_ROOM_MEMBERS"
+	message_descriptions[MSG_GET_ROOM_MEMBER_COUNT] = "MSG_GET_ROOM_MEMBER_COUNT"
+	message_descriptions[MSG_ROOM_MEMBER_COUNT] = "MSG_ROOM_MEMBER_COUNT"
+	message_descriptions[MSG_ROOM_MEMBER_CHANGED] = "MSG_ROOM_MEMBER_CHANGED"
+	message_descriptions[MSG_ROOM_KICKED] = "MSG_ROOM_KICKED"
 
 	message_descriptions[MSG_PENDING_GROUP_MESSAGE] = "MSG_PENDING_GROUP_MESSAGE"
+	message_descriptions[MSG_ROOM_CONTROL] = "MSG_ROOM_CONTROL"
+	message_descriptions[MSG_GROUP_IM_REF] = "MSG_GROUP_IM_REF"
+	message_descriptions[MSG_GROUP_IM_MENTION] = "MSG_GROUP_IM_MENTION"
 
 	external_messages[MSG_AUTH_TOKEN] = true
 	external_messages[MSG_ACK] = true
@@ -99,6 +130,11 @@ func init() {
 	external_messages[MSG_SYNC_KEY] = true
 	external_messages[MSG_GROUP_SYNC_KEY] = true
 	external_messages[MSG_METADATA] = true
+	external_messages[MSG_SUBSCRIBE_PRESENCE] = true
+	external_messages[MSG_GET_GROUP_INFO] = true
+	external_messages[MSG_GET_GROUP_MEMBERS] = true
+	external_messages[MSG_GET_ROOM_MEMBERS] = true
+	external_messages[MSG_GET_ROOM_MEMBER_COUNT] = true
 
 	message_descriptions[MSG_IM] = "MSG_IM"
 	message_descriptions[MSG_GROUP_NOTIFICATION] = "MSG_GROUP_NOTIFICATION"
@@ -118,6 +154,15 @@ func init() {
 	message_descriptions[MSG_SUBSCRIBE_ROOM] = "MSG_SUBSCRIBE_ROOM"
 	message_descriptions[MSG_UNSUBSCRIBE_ROOM] = "MSG_UNSUBSCRIBE_ROOM"
 	message_descriptions[MSG_PUBLISH_ROOM] = "MSG_PUBLISH_ROOM"
+	message_descriptions[MSG_PUBLISH_PRESENCE] = "MSG_PUBLISH_PRESENCE"
+	message_descriptions[MSG_SUBSCRIBE_ROOM_MEMBER] = "MSG_SUBSCRIBE_ROOM_MEMBER"
+	message_descriptions[MSG_UNSUBSCRIBE_ROOM_MEMBER] = "MSG_UNSUBSCRIBE_ROOM_MEMBER"
+	message_descriptions[MSG_QUERY_ROOM_MEMBERS] = "MSG_QUERY_ROOM_MEMBERS"
+	message_descriptions[MSG_ROOM_MEMBERS_RESULT] = "MSG_ROOM_MEMBERS_RESULT"
+	message_descriptions[MSG_QUERY_ROOM_BACKLOG] = "MSG_QUERY_ROOM_BACKLOG"
+	message_descriptions[MSG_ROOM_BACKLOG_RESULT] = "MSG_ROOM_BACKLOG_RESULT"
+	message_descriptions[MSG_WATCH_PRESENCE] = "MSG_WATCH_PRESENCE"
+	message_descriptions[MSG_UNWATCH_PRESENCE] = "MSG_UNWATCH_PRESENCE"
 
 	message_descriptions[MSG_STORAGE_SYNC_BEGIN] = "MSG_STORAGE_SYNC_BEGIN"
 	message_descriptions[MSG_STORAGE_SYNC_MESSAGE] = "MSG_STORAGE_SYNC_MESSAGE"
@@ -71,6 +71,18 @@ func (app_route *AppRoute) GetUsers() map[int64]set.IntSet {
 	return r
 }
 
+// appid:room_id:uids
+func (app_route *AppRoute) GetRoomMembers() map[int64]map[int64]set.IntSet {
+	app_route.mutex.Lock()
+	defer app_route.mutex.Unlock()
+
+	r := make(map[int64]map[int64]set.IntSet)
+	for appid, route := range app_route.apps {
+		r[appid] = route.GetAllRoomMembers()
+	}
+	return r
+}
+
 type ClientSet = set.Set[*Client]
 
 func NewClientSet() ClientSet {
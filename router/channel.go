@@ -21,8 +21,10 @@ package router
 
 import (
 	"bytes"
+	"errors"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -33,47 +35,110 @@ import (
 )
 
 type Subscriber struct {
-	uids     map[int64]int
-	room_ids map[int64]int
+	uids      map[int64]int
+	platforms map[int64]map[int8]int //uid:平台号:连接数量
+	room_ids  map[int64]int
+
+	room_members map[int64]map[int64]int //room_id:uid:连接数量
+
+	watches map[int64]int //订阅了此用户在线状态的连接数量
 }
 
 func NewSubscriber() *Subscriber {
 	s := new(Subscriber)
 	s.uids = make(map[int64]int)
+	s.platforms = make(map[int64]map[int8]int)
 	s.room_ids = make(map[int64]int)
+	s.room_members = make(map[int64]map[int64]int)
+	s.watches = make(map[int64]int)
 	return s
 }
 
+func platformMask(counts map[int8]int) int32 {
+	var mask int32
+	for platform_id, c := range counts {
+		if c > 0 {
+			mask |= server.PlatformMask(platform_id)
+		}
+	}
+	return mask
+}
+
+func copyPlatforms(counts map[int8]int) map[int8]int {
+	r := make(map[int8]int, len(counts))
+	for platform_id, c := range counts {
+		r[platform_id] = c
+	}
+	return r
+}
+
+// 查询聊天室成员的超时时间
+const ROOM_QUERY_TIMEOUT = 3 * time.Second
+
 type Channel struct {
-	addr string
-	wt   chan *Message
+	addr     string
+	wt       chan *Message
+	close_ch chan bool
 
 	mutex       sync.Mutex
 	subscribers map[int64]*Subscriber
 
+	//订阅的修改和订阅消息的发送顺序一致, 避免旧的取消订阅消息在新的订阅消息之后发送
+	//重连时ReSubscribe只使用mutex, 不会被阻塞
+	sub_mutex sync.Mutex
+
 	dispatch       func(appid, uid int64, msg *Message)
 	dispatch_group func(appid, group_id int64, msg *Message)
 	dispatch_room  func(appid, room_id int64, msg *Message)
+
+	dispatch_presence func(appid, uid int64, msg *Message)
+
+	query_id     int64
+	query_mutex  sync.Mutex
+	room_queries map[int64]chan *RouteRoomMembers //query_id:等待结果的channel
+
+	backlog_queries map[int64]chan *RouteRoomBacklog
 }
 
 func NewChannel(addr string, f func(appid, uid int64, msg *Message),
-	f2 func(appid, group_id int64, msg *Message), f3 func(appid, room_id int64, msg *Message)) *Channel {
+	f2 func(appid, group_id int64, msg *Message), f3 func(appid, room_id int64, msg *Message),
+	f4 func(appid, uid int64, msg *Message)) *Channel {
 	channel := new(Channel)
 	channel.subscribers = make(map[int64]*Subscriber)
+	channel.room_queries = make(map[int64]chan *RouteRoomMembers)
+	channel.backlog_queries = make(map[int64]chan *RouteRoomBacklog)
 	channel.dispatch = f
 	channel.dispatch_group = f2
 	channel.dispatch_room = f3
+	channel.dispatch_presence = f4
 	channel.addr = addr
 	channel.wt = make(chan *Message, 10)
+	channel.close_ch = make(chan bool)
 	return channel
 }
 
+// route server从集群中移除
+func (channel *Channel) Close() {
+	close(channel.close_ch)
+}
+
+// channel已经关闭时返回false
+func (channel *Channel) send(msg *Message) bool {
+	select {
+	case channel.wt <- msg:
+		return true
+	case <-channel.close_ch:
+		log.Infof("channel:%s closed, drop message:%s", channel.addr, Command(msg.Cmd))
+		return false
+	}
+}
+
 func (channel *Channel) Address() string {
 	return channel.addr
 }
 
-// 返回添加前的计数
-func (channel *Channel) AddSubscribe(appid, uid int64, online bool) (int, int) {
+// 返回添加前的计数, 以及添加前后在线平台的位掩码
+func (channel *Channel) AddSubscribe(appid, uid int64, platform_id int8, online bool) (int, int, int32, int32) {
 	channel.mutex.Lock()
 	defer channel.mutex.Unlock()
 	subscriber, ok := channel.subscribers[appid]
@@ -93,16 +158,28 @@ func (channel *Channel) AddSubscribe(appid, uid int64, online bool) (int, int) {
 	}
 	c1 += 1
 	subscriber.uids[uid] = c2<<16 | c1
-	return count & 0xffff, count >> 16 & 0xffff
+
+	if platform_id == server.PLATFORM_NONE {
+		mask := platformMask(subscriber.platforms[uid])
+		return count & 0xffff, count >> 16 & 0xffff, mask, mask
+	}
+	counts, ok := subscriber.platforms[uid]
+	if !ok {
+		counts = make(map[int8]int)
+		subscriber.platforms[uid] = counts
+	}
+	old_mask := platformMask(counts)
+	counts[platform_id] += 1
+	return count & 0xffff, count >> 16 & 0xffff, old_mask, platformMask(counts)
 }
 
-// 返回删除前的计数
-func (channel *Channel) RemoveSubscribe(appid, uid int64, online bool) (int, int) {
+// 返回删除前的计数, 以及删除前后在线平台的位掩码
+func (channel *Channel) RemoveSubscribe(appid, uid int64, platform_id int8, online bool) (int, int, int32, int32) {
 	channel.mutex.Lock()
 	defer channel.mutex.Unlock()
 	subscriber, ok := channel.subscribers[appid]
 	if !ok {
-		return 0, 0
+		return 0, 0, 0, 0
 	}
 
 	count, ok := subscriber.uids[uid]
@@ -124,7 +201,22 @@ func (channel *Channel) RemoveSubscribe(appid, uid int64, online bool) (int, int
 			delete(subscriber.uids, uid)
 		}
 	}
-	return count & 0xffff, count >> 16 & 0xffff
+
+	counts := subscriber.platforms[uid]
+	old_mask := platformMask(counts)
+	if platform_id == server.PLATFORM_NONE {
+		//不计入在线平台
+	} else if counts[platform_id] > 1 {
+		counts[platform_id] -= 1
+	} else {
+		delete(counts, platform_id)
+	}
+	new_mask := platformMask(counts)
+	if c1 <= 0 {
+		delete(subscriber.platforms, uid)
+		new_mask = 0
+	}
+	return count & 0xffff, count >> 16 & 0xffff, old_mask, new_mask
 }
 
 func (channel *Channel) GetAllSubscriber() map[int64]*Subscriber {
@@ -137,6 +229,9 @@ func (channel *Channel) GetAllSubscriber() map[int64]*Subscriber {
 		for uid, c := range s.uids {
 			sub.uids[uid] = c
 		}
+		for uid, counts := range s.platforms {
+			sub.platforms[uid] = copyPlatforms(counts)
+		}
 
 		subs[appid] = sub
 	}
@@ -144,8 +239,11 @@ func (channel *Channel) GetAllSubscriber() map[int64]*Subscriber {
 }
 
 // online表示用户不再接受推送通知(apns, gcm)
-func (channel *Channel) Subscribe(appid int64, uid int64, online bool) {
-	count, online_count := channel.AddSubscribe(appid, uid, online)
+func (channel *Channel) Subscribe(appid int64, uid int64, platform_id int8, online bool) {
+	channel.sub_mutex.Lock()
+	defer channel.sub_mutex.Unlock()
+
+	count, online_count, old_mask, mask := channel.AddSubscribe(appid, uid, platform_id, online)
 	log.Info("sub count:", count, online_count)
 	if count == 0 {
 		//新用户上线
@@ -153,34 +251,45 @@ func (channel *Channel) Subscribe(appid int64, uid int64, online bool) {
 		if online {
 			on = 1
 		}
-		id := &SubscribeMessage{appid: appid, uid: uid, online: int8(on)}
+		id := &SubscribeMessage{appid: appid, uid: uid, online: int8(on), platforms: mask}
 		msg := &Message{Cmd: MSG_SUBSCRIBE, Body: id}
-		channel.wt <- msg
-	} else if online_count == 0 && online {
-		//手机端上线
-		id := &SubscribeMessage{appid: appid, uid: uid, online: 1}
+		channel.send(msg)
+	} else if (online_count == 0 && online) || old_mask != mask {
+		//手机端上线或者新平台上线
+		on := 0
+		if online_count > 0 || online {
+			on = 1
+		}
+		id := &SubscribeMessage{appid: appid, uid: uid, online: int8(on), platforms: mask}
 		msg := &Message{Cmd: MSG_SUBSCRIBE, Body: id}
-		channel.wt <- msg
+		channel.send(msg)
 	}
 }
 
-func (channel *Channel) Unsubscribe(appid int64, uid int64, online bool) {
-	count, online_count := channel.RemoveSubscribe(appid, uid, online)
+func (channel *Channel) Unsubscribe(appid int64, uid int64, platform_id int8, online bool) {
+	channel.sub_mutex.Lock()
+	defer channel.sub_mutex.Unlock()
+
+	count, online_count, old_mask, mask := channel.RemoveSubscribe(appid, uid, platform_id, online)
 	log.Info("unsub count:", count, online_count)
 	if count == 1 {
 		//用户断开全部连接
 		id := &RouteUserID{appid: appid, uid: uid}
 		msg := &Message{Cmd: MSG_UNSUBSCRIBE, Body: id}
-		channel.wt <- msg
-	} else if count > 1 && online_count == 1 && online {
-		//手机端断开连接,pc/web端还未断开连接
-		id := &SubscribeMessage{appid: appid, uid: uid, online: 0}
+		channel.send(msg)
+	} else if count > 1 && ((online_count == 1 && online) || old_mask != mask) {
+		//手机端断开连接或者某个平台全部断开,其它平台还未断开连接
+		on := 0
+		if online_count > 1 || (online_count == 1 && !online) {
+			on = 1
+		}
+		id := &SubscribeMessage{appid: appid, uid: uid, online: int8(on), platforms: mask}
 		msg := &Message{Cmd: MSG_SUBSCRIBE, Body: id}
-		channel.wt <- msg
+		channel.send(msg)
 	}
 }
 
-func (channel *Channel) PublishMessage(appid int64, uid int64, msg *Message) {
+func (channel *Channel) PublishMessage(appid int64, uid int64, msg *Message) bool {
 	now := time.Now().UnixNano()
 
 	mbuffer := new(bytes.Buffer)
@@ -193,10 +302,10 @@ func (channel *Channel) PublishMessage(appid int64, uid int64, msg *Message) {
 		amsg.msgid = meta.SyncKey()
 		amsg.prev_msgid = meta.PrevSyncKey()
 	}
-	channel.Publish(amsg)
+	return channel.Publish(amsg)
 }
 
-func (channel *Channel) PublishGroupMessage(appid int64, group_id int64, msg *Message) {
+func (channel *Channel) PublishGroupMessage(appid int64, group_id int64, msg *Message) bool {
 	now := time.Now().UnixNano()
 
 	mbuffer := new(bytes.Buffer)
@@ -209,31 +318,31 @@ func (channel *Channel) PublishGroupMessage(appid int64, group_id int64, msg *Me
 		amsg.msgid = meta.SyncKey()
 		amsg.prev_msgid = meta.PrevSyncKey()
 	}
-	channel.PublishGroup(amsg)
+	return channel.PublishGroup(amsg)
 }
 
-func (channel *Channel) PublishRoomMessage(appid int64, room_id int64, m *Message) {
+func (channel *Channel) PublishRoomMessage(appid int64, room_id int64, m *Message) bool {
 	mbuffer := new(bytes.Buffer)
 	WriteMessage(mbuffer, m)
 	msg_buf := mbuffer.Bytes()
 	amsg := &RouteMessage{appid: appid, receiver: room_id, msg: msg_buf}
-	channel.PublishRoom(amsg)
+	return channel.PublishRoom(amsg)
 }
 
-func (channel *Channel) Publish(amsg *RouteMessage) {
+func (channel *Channel) Publish(amsg *RouteMessage) bool {
 	msg := &Message{Cmd: MSG_PUBLISH, Body: amsg}
-	channel.wt <- msg
+	return channel.send(msg)
 }
 
-func (channel *Channel) PublishGroup(amsg *RouteMessage) {
+func (channel *Channel) PublishGroup(amsg *RouteMessage) bool {
 	msg := &Message{Cmd: MSG_PUBLISH_GROUP, Body: amsg}
-	channel.wt <- msg
+	return channel.send(msg)
 }
 
 func (channel *Channel) Push(appid int64, receivers []int64, msg *Message) {
 	p := &BatchPushMessage{appid: appid, receivers: receivers, msg: msg}
 	m := &Message{Cmd: MSG_PUSH, Body: p}
-	channel.wt <- m
+	channel.send(m)
 }
 
 // 返回添加前的计数
@@ -286,28 +395,380 @@ func (channel *Channel) GetAllRoomSubscriber() []*RouteRoomID {
 }
 
 func (channel *Channel) SubscribeRoom(appid int64, room_id int64) {
+	channel.sub_mutex.Lock()
+	defer channel.sub_mutex.Unlock()
+
 	count := channel.AddSubscribeRoom(appid, room_id)
 	log.Info("sub room count:", count)
 	if count == 0 {
 		id := &RouteRoomID{appid: appid, room_id: room_id}
 		msg := &Message{Cmd: MSG_SUBSCRIBE_ROOM, Body: id}
-		channel.wt <- msg
+		channel.send(msg)
 	}
 }
 
 func (channel *Channel) UnsubscribeRoom(appid int64, room_id int64) {
+	channel.sub_mutex.Lock()
+	defer channel.sub_mutex.Unlock()
+
 	count := channel.RemoveSubscribeRoom(appid, room_id)
 	log.Info("unsub room count:", count)
 	if count == 1 {
 		id := &RouteRoomID{appid: appid, room_id: room_id}
 		msg := &Message{Cmd: MSG_UNSUBSCRIBE_ROOM, Body: id}
-		channel.wt <- msg
+		channel.send(msg)
+	}
+}
+
+func copyRoomMembers(members map[int64]int) map[int64]int {
+	r := make(map[int64]int, len(members))
+	for uid, c := range members {
+		r[uid] = c
+	}
+	return r
+}
+
+// 返回添加前用户在聊天室中的连接数量
+func (channel *Channel) AddSubscribeRoomMember(appid, room_id, uid int64) int {
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+	subscriber, ok := channel.subscribers[appid]
+	if !ok {
+		subscriber = NewSubscriber()
+		channel.subscribers[appid] = subscriber
+	}
+	members, ok := subscriber.room_members[room_id]
+	if !ok {
+		members = make(map[int64]int)
+		subscriber.room_members[room_id] = members
+	}
+	count := members[uid]
+	members[uid] = count + 1
+	return count
+}
+
+// 返回删除前用户在聊天室中的连接数量
+func (channel *Channel) RemoveSubscribeRoomMember(appid, room_id, uid int64) int {
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+	subscriber, ok := channel.subscribers[appid]
+	if !ok {
+		return 0
+	}
+	members, ok := subscriber.room_members[room_id]
+	if !ok {
+		return 0
+	}
+	count := members[uid]
+	if count > 1 {
+		members[uid] = count - 1
+	} else {
+		delete(members, uid)
+		if len(members) == 0 {
+			delete(subscriber.room_members, room_id)
+		}
+	}
+	return count
+}
+
+func (channel *Channel) SubscribeRoomMember(appid, room_id, uid int64) {
+	channel.sub_mutex.Lock()
+	defer channel.sub_mutex.Unlock()
+
+	count := channel.AddSubscribeRoomMember(appid, room_id, uid)
+	if count == 0 {
+		m := &RouteRoomMember{appid: appid, room_id: room_id, uid: uid}
+		channel.send(&Message{Cmd: MSG_SUBSCRIBE_ROOM_MEMBER, Body: m})
+	}
+}
+
+func (channel *Channel) UnsubscribeRoomMember(appid, room_id, uid int64) {
+	channel.sub_mutex.Lock()
+	defer channel.sub_mutex.Unlock()
+
+	count := channel.RemoveSubscribeRoomMember(appid, room_id, uid)
+	if count == 1 {
+		m := &RouteRoomMember{appid: appid, room_id: room_id, uid: uid}
+		channel.send(&Message{Cmd: MSG_UNSUBSCRIBE_ROOM_MEMBER, Body: m})
+	}
+}
+
+func (channel *Channel) GetAllRoomMemberSubscriber() []*RouteRoomMember {
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+
+	subs := make([]*RouteRoomMember, 0, 100)
+	for appid, s := range channel.subscribers {
+		for room_id, members := range s.room_members {
+			for uid := range members {
+				subs = append(subs, &RouteRoomMember{appid: appid, room_id: room_id, uid: uid})
+			}
+		}
+	}
+	return subs
+}
+
+// 返回增加前的订阅数量
+func (channel *Channel) AddWatch(appid, uid int64) int {
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+	subscriber, ok := channel.subscribers[appid]
+	if !ok {
+		subscriber = NewSubscriber()
+		channel.subscribers[appid] = subscriber
+	}
+	count := subscriber.watches[uid]
+	subscriber.watches[uid] = count + 1
+	return count
+}
+
+// 返回删除前的订阅数量
+func (channel *Channel) RemoveWatch(appid, uid int64) int {
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+	subscriber, ok := channel.subscribers[appid]
+	if !ok {
+		return 0
+	}
+	count := subscriber.watches[uid]
+	if count > 1 {
+		subscriber.watches[uid] = count - 1
+	} else {
+		delete(subscriber.watches, uid)
+	}
+	return count
+}
+
+// route server只给订阅了用户在线状态的im发送状态变化
+func (channel *Channel) WatchPresence(appid, uid int64) {
+	channel.sub_mutex.Lock()
+	defer channel.sub_mutex.Unlock()
+
+	count := channel.AddWatch(appid, uid)
+	if count == 0 {
+		id := &RouteUserID{appid: appid, uid: uid}
+		channel.send(&Message{Cmd: MSG_WATCH_PRESENCE, Body: id})
+	}
+}
+
+func (channel *Channel) UnwatchPresence(appid, uid int64) {
+	channel.sub_mutex.Lock()
+	defer channel.sub_mutex.Unlock()
+
+	count := channel.RemoveWatch(appid, uid)
+	if count == 1 {
+		id := &RouteUserID{appid: appid, uid: uid}
+		channel.send(&Message{Cmd: MSG_UNWATCH_PRESENCE, Body: id})
+	}
+}
+
+func (channel *Channel) GetAllWatches() []*RouteUserID {
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+
+	ids := make([]*RouteUserID, 0, 100)
+	for appid, s := range channel.subscribers {
+		for uid := range s.watches {
+			ids = append(ids, &RouteUserID{appid: appid, uid: uid})
+		}
+	}
+	return ids
+}
+
+// 等待route server返回聊天室的成员, limit为0时只返回成员数量
+func (channel *Channel) QueryRoomMembers(appid, room_id int64, offset, limit int) (int, []int64, error) {
+	query_id := atomic.AddInt64(&channel.query_id, 1)
+	ch := make(chan *RouteRoomMembers, 1)
+
+	channel.query_mutex.Lock()
+	channel.room_queries[query_id] = ch
+	channel.query_mutex.Unlock()
+
+	defer func() {
+		channel.query_mutex.Lock()
+		delete(channel.room_queries, query_id)
+		channel.query_mutex.Unlock()
+	}()
+
+	q := &RouteRoomQuery{appid: appid, room_id: room_id, query_id: query_id, offset: int32(offset), limit: int32(limit)}
+	channel.send(&Message{Cmd: MSG_QUERY_ROOM_MEMBERS, Body: q})
+
+	select {
+	case r := <-ch:
+		return int(r.total), r.uids, nil
+	case <-time.After(ROOM_QUERY_TIMEOUT):
+		return 0, nil, errors.New("query room members timeout")
+	case <-channel.close_ch:
+		return 0, nil, errors.New("channel closed")
+	}
+}
+
+func (channel *Channel) DispatchRoomMembers(r *RouteRoomMembers) {
+	channel.query_mutex.Lock()
+	ch, ok := channel.room_queries[r.query_id]
+	channel.query_mutex.Unlock()
+	if !ok {
+		log.Warningf("room members query:%d expired", r.query_id)
+		return
+	}
+	select {
+	case ch <- r:
+	default:
 	}
 }
 
-func (channel *Channel) PublishRoom(amsg *RouteMessage) {
+func (channel *Channel) PublishRoom(amsg *RouteMessage) bool {
 	msg := &Message{Cmd: MSG_PUBLISH_ROOM, Body: amsg}
-	channel.wt <- msg
+	return channel.send(msg)
+}
+
+func (channel *Channel) Subscriptions() *server.RouteSubscriptions {
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+
+	subs := server.NewRouteSubscriptions()
+	for appid, s := range channel.subscribers {
+		for uid, c := range s.uids {
+			subs.Users[server.RouteID{AppID: appid, ID: uid}] = c
+		}
+		for uid, counts := range s.platforms {
+			subs.Platforms[server.RouteID{AppID: appid, ID: uid}] = copyPlatforms(counts)
+		}
+		for room_id, c := range s.room_ids {
+			subs.Rooms[server.RouteID{AppID: appid, ID: room_id}] = c
+		}
+		for room_id, members := range s.room_members {
+			subs.RoomMembers[server.RouteID{AppID: appid, ID: room_id}] = copyRoomMembers(members)
+		}
+		for uid, c := range s.watches {
+			subs.Watches[server.RouteID{AppID: appid, ID: uid}] = c
+		}
+	}
+	return subs
+}
+
+// route server节点变化之后,替换当前channel的订阅
+// 只对变化的用户和聊天室发送订阅/取消订阅的消息
+// 消息发送完成之前阻塞其它的订阅, 保证之后的订阅消息在取消订阅的消息之后发送
+func (channel *Channel) ResetSubscriptions(subs *server.RouteSubscriptions) {
+	channel.sub_mutex.Lock()
+	defer channel.sub_mutex.Unlock()
+
+	msgs := make([]*Message, 0, 100)
+
+	channel.mutex.Lock()
+	subscribers := make(map[int64]*Subscriber)
+	for id, c := range subs.Users {
+		subscriber, ok := subscribers[id.AppID]
+		if !ok {
+			subscriber = NewSubscriber()
+			subscribers[id.AppID] = subscriber
+		}
+		subscriber.uids[id.ID] = c
+		counts := copyPlatforms(subs.Platforms[id])
+		subscriber.platforms[id.ID] = counts
+		mask := platformMask(counts)
+
+		//低16位表示总数量 高16位表示online的数量
+		online := c>>16&0xffff > 0
+		var origin int
+		var origin_mask int32
+		if s, ok := channel.subscribers[id.AppID]; ok {
+			origin = s.uids[id.ID]
+			origin_mask = platformMask(s.platforms[id.ID])
+		}
+		if origin == 0 || (origin>>16&0xffff > 0) != online || origin_mask != mask {
+			on := 0
+			if online {
+				on = 1
+			}
+			sub := &SubscribeMessage{appid: id.AppID, uid: id.ID, online: int8(on), platforms: mask}
+			msgs = append(msgs, &Message{Cmd: MSG_SUBSCRIBE, Body: sub})
+		}
+	}
+	for id, c := range subs.Rooms {
+		subscriber, ok := subscribers[id.AppID]
+		if !ok {
+			subscriber = NewSubscriber()
+			subscribers[id.AppID] = subscriber
+		}
+		subscriber.room_ids[id.ID] = c
+
+		if s, ok := channel.subscribers[id.AppID]; !ok || s.room_ids[id.ID] == 0 {
+			room_id := &RouteRoomID{appid: id.AppID, room_id: id.ID}
+			msgs = append(msgs, &Message{Cmd: MSG_SUBSCRIBE_ROOM, Body: room_id})
+		}
+	}
+	for id, members := range subs.RoomMembers {
+		subscriber, ok := subscribers[id.AppID]
+		if !ok {
+			subscriber = NewSubscriber()
+			subscribers[id.AppID] = subscriber
+		}
+		subscriber.room_members[id.ID] = copyRoomMembers(members)
+
+		var origin map[int64]int
+		if s, ok := channel.subscribers[id.AppID]; ok {
+			origin = s.room_members[id.ID]
+		}
+		for uid := range members {
+			if origin[uid] == 0 {
+				m := &RouteRoomMember{appid: id.AppID, room_id: id.ID, uid: uid}
+				msgs = append(msgs, &Message{Cmd: MSG_SUBSCRIBE_ROOM_MEMBER, Body: m})
+			}
+		}
+	}
+	for id, c := range subs.Watches {
+		subscriber, ok := subscribers[id.AppID]
+		if !ok {
+			subscriber = NewSubscriber()
+			subscribers[id.AppID] = subscriber
+		}
+		subscriber.watches[id.ID] = c
+
+		if s, ok := channel.subscribers[id.AppID]; !ok || s.watches[id.ID] == 0 {
+			uid := &RouteUserID{appid: id.AppID, uid: id.ID}
+			msgs = append(msgs, &Message{Cmd: MSG_WATCH_PRESENCE, Body: uid})
+		}
+	}
+
+	for appid, s := range channel.subscribers {
+		for uid := range s.uids {
+			if _, ok := subs.Users[server.RouteID{AppID: appid, ID: uid}]; !ok {
+				id := &RouteUserID{appid: appid, uid: uid}
+				msgs = append(msgs, &Message{Cmd: MSG_UNSUBSCRIBE, Body: id})
+			}
+		}
+		for room_id := range s.room_ids {
+			if _, ok := subs.Rooms[server.RouteID{AppID: appid, ID: room_id}]; !ok {
+				id := &RouteRoomID{appid: appid, room_id: room_id}
+				msgs = append(msgs, &Message{Cmd: MSG_UNSUBSCRIBE_ROOM, Body: id})
+			}
+		}
+		for room_id, members := range s.room_members {
+			current := subs.RoomMembers[server.RouteID{AppID: appid, ID: room_id}]
+			for uid := range members {
+				if current[uid] == 0 {
+					m := &RouteRoomMember{appid: appid, room_id: room_id, uid: uid}
+					msgs = append(msgs, &Message{Cmd: MSG_UNSUBSCRIBE_ROOM_MEMBER, Body: m})
+				}
+			}
+		}
+		for uid := range s.watches {
+			if _, ok := subs.Watches[server.RouteID{AppID: appid, ID: uid}]; !ok {
+				id := &RouteUserID{appid: appid, uid: uid}
+				msgs = append(msgs, &Message{Cmd: MSG_UNWATCH_PRESENCE, Body: id})
+			}
+		}
+	}
+	channel.subscribers = subscribers
+	channel.mutex.Unlock()
+
+	log.Infof("channel:%s reset subscriptions users:%d rooms:%d changed:%d",
+		channel.addr, len(subs.Users), len(subs.Rooms), len(msgs))
+	for _, msg := range msgs {
+		channel.send(msg)
+	}
 }
 
 func (channel *Channel) ReSubscribe(conn *net.TCPConn, seq int) int {
@@ -321,7 +782,8 @@ func (channel *Channel) ReSubscribe(conn *net.TCPConn, seq int) int {
 				on = 1
 			}
 
-			id := &SubscribeMessage{appid: appid, uid: uid, online: int8(on)}
+			mask := platformMask(sub.platforms[uid])
+			id := &SubscribeMessage{appid: appid, uid: uid, online: int8(on), platforms: mask}
 			msg := &Message{Cmd: MSG_SUBSCRIBE, Body: id}
 
 			seq = seq + 1
@@ -343,6 +805,70 @@ func (channel *Channel) ReSubscribeRoom(conn *net.TCPConn, seq int) int {
 	return seq
 }
 
+// 等待route server返回聊天室最近的消息
+func (channel *Channel) QueryRoomBacklog(appid, room_id int64) ([]*Message, error) {
+	query_id := atomic.AddInt64(&channel.query_id, 1)
+	ch := make(chan *RouteRoomBacklog, 1)
+
+	channel.query_mutex.Lock()
+	channel.backlog_queries[query_id] = ch
+	channel.query_mutex.Unlock()
+
+	defer func() {
+		channel.query_mutex.Lock()
+		delete(channel.backlog_queries, query_id)
+		channel.query_mutex.Unlock()
+	}()
+
+	q := &RouteRoomQuery{appid: appid, room_id: room_id, query_id: query_id}
+	channel.send(&Message{Cmd: MSG_QUERY_ROOM_BACKLOG, Body: q})
+
+	var r *RouteRoomBacklog
+	select {
+	case r = <-ch:
+	case <-time.After(ROOM_QUERY_TIMEOUT):
+		return nil, errors.New("query room backlog timeout")
+	case <-channel.close_ch:
+		return nil, errors.New("channel closed")
+	}
+
+	msgs := make([]*Message, 0, len(r.msgs))
+	for _, b := range r.msgs {
+		msg := protocol.ReceiveMessage(bytes.NewBuffer(b))
+		if msg == nil {
+			log.Warning("invalid room backlog message")
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+func (channel *Channel) DispatchRoomBacklog(r *RouteRoomBacklog) {
+	channel.query_mutex.Lock()
+	ch, ok := channel.backlog_queries[r.query_id]
+	channel.query_mutex.Unlock()
+	if !ok {
+		log.Warningf("room backlog query:%d expired", r.query_id)
+		return
+	}
+	select {
+	case ch <- r:
+	default:
+	}
+}
+
+func (channel *Channel) ReSubscribeRoomMember(conn *net.TCPConn, seq int) int {
+	subs := channel.GetAllRoomMemberSubscriber()
+	for _, m := range subs {
+		msg := &Message{Cmd: MSG_SUBSCRIBE_ROOM_MEMBER, Body: m}
+		seq = seq + 1
+		msg.Seq = seq
+		SendMessage(conn, msg)
+	}
+	return seq
+}
+
 func (channel *Channel) DispatchMessage(amsg *RouteMessage) {
 	now := time.Now().UnixNano()
 	d := now - amsg.timestamp
@@ -412,6 +938,23 @@ func (channel *Channel) DispatchGroupMessage(amsg *RouteMessage) {
 	channel.dispatch_group(amsg.appid, amsg.receiver, msg)
 }
 
+func (channel *Channel) DispatchPresence(p *RoutePresence) {
+	log.Infof("dispatch presence appid:%d uid:%d platforms:%d", p.appid, p.uid, p.platforms)
+	msg := &Message{Cmd: MSG_PRESENCE, Body: server.NewPresence(p.uid, p.platforms, p.last_seen)}
+	channel.dispatch_presence(p.appid, p.uid, msg)
+}
+
+func (channel *Channel) ReSubscribePresence(conn *net.TCPConn, seq int) int {
+	ids := channel.GetAllWatches()
+	for _, id := range ids {
+		msg := &Message{Cmd: MSG_WATCH_PRESENCE, Body: id}
+		seq = seq + 1
+		msg.Seq = seq
+		SendMessage(conn, msg)
+	}
+	return seq
+}
+
 func (channel *Channel) RunOnce(conn *net.TCPConn) {
 	defer conn.Close()
 
@@ -419,6 +962,8 @@ func (channel *Channel) RunOnce(conn *net.TCPConn) {
 	seq := 0
 	seq = channel.ReSubscribe(conn, seq)
 	seq = channel.ReSubscribeRoom(conn, seq)
+	seq = channel.ReSubscribeRoomMember(conn, seq)
+	seq = channel.ReSubscribePresence(conn, seq)
 
 	go func() {
 		for {
@@ -443,6 +988,15 @@ func (channel *Channel) RunOnce(conn *net.TCPConn) {
 				if channel.dispatch_group != nil {
 					channel.DispatchGroupMessage(amsg)
 				}
+			} else if msg.Cmd == MSG_PUBLISH_PRESENCE {
+				p := msg.Body.(*RoutePresence)
+				if channel.dispatch_presence != nil {
+					channel.DispatchPresence(p)
+				}
+			} else if msg.Cmd == MSG_ROOM_MEMBERS_RESULT {
+				channel.DispatchRoomMembers(msg.Body.(*RouteRoomMembers))
+			} else if msg.Cmd == MSG_ROOM_BACKLOG_RESULT {
+				channel.DispatchRoomBacklog(msg.Body.(*RouteRoomBacklog))
 			} else {
 				log.Error("unknown message cmd:", msg.Cmd)
 			}
@@ -454,6 +1008,9 @@ func (channel *Channel) RunOnce(conn *net.TCPConn) {
 		case <-closed_ch:
 			log.Info("channel closed")
 			return
+		case <-channel.close_ch:
+			log.Info("channel removed:", channel.addr)
+			return
 		case msg := <-channel.wt:
 			seq = seq + 1
 			msg.Seq = seq
@@ -466,9 +1023,18 @@ func (channel *Channel) RunOnce(conn *net.TCPConn) {
 	}
 }
 
+func (channel *Channel) isClosed() bool {
+	select {
+	case <-channel.close_ch:
+		return true
+	default:
+		return false
+	}
+}
+
 func (channel *Channel) Run() {
 	nsleep := 100
-	for {
+	for !channel.isClosed() {
 		conn, err := net.Dial("tcp", channel.addr)
 		if err != nil {
 			log.Info("connect route server error:", err)
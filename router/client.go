@@ -39,6 +39,8 @@ type Client struct {
 	app_route *AppRoute
 
 	observer ClientObserver
+
+	presence_watches map[RouteUserID]bool //此im订阅的用户在线状态, 由Server.presence_mutex保护
 }
 
 func NewClient(conn *net.TCPConn, observer ClientObserver) *Client {
@@ -46,6 +48,7 @@ func NewClient(conn *net.TCPConn, observer ClientObserver) *Client {
 	client.conn = conn
 	client.wt = make(chan *protocol.Message, 10)
 	client.app_route = NewAppRoute()
+	client.presence_watches = make(map[RouteUserID]bool)
 	client.observer = observer
 	return client
 }
@@ -68,6 +71,17 @@ func (client *Client) IsAppUserOnline(id *RouteUserID) bool {
 	return route.IsUserOnline(id.uid)
 }
 
+// 用户在此im上的在线平台
+func (client *Client) GetAppUserPlatforms(id *RouteUserID) int32 {
+	route := client.app_route.FindRoute(id.appid)
+	if route == nil {
+		return 0
+	}
+
+	platforms, _ := route.GetUserPlatforms(id.uid)
+	return platforms
+}
+
 func (client *Client) ContainAppRoomID(id *RouteRoomID) bool {
 	route := client.app_route.FindRoute(id.appid)
 	if route == nil {
@@ -0,0 +1,240 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package router
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/GoBelieveIO/im_service/protocol"
+	srv "github.com/GoBelieveIO/im_service/server"
+)
+
+// 异步写入redis, 避免阻塞im连接的读线程
+type PresenceService struct {
+	c          chan *RoutePresence
+	redis_pool *redis.Pool
+}
+
+func NewPresenceService(redis_pool *redis.Pool) *PresenceService {
+	s := &PresenceService{}
+	s.c = make(chan *RoutePresence, 10000)
+	s.redis_pool = redis_pool
+	return s
+}
+
+func (presence_service *PresenceService) Run() {
+	go presence_service.Save()
+}
+
+func (presence_service *PresenceService) Save() {
+	for p := range presence_service.c {
+		err := srv.SavePresence(presence_service.redis_pool, p.appid, p.uid, p.platforms, p.last_seen)
+		if err != nil {
+			log.Warningf("save presence appid:%d uid:%d err:%s", p.appid, p.uid, err)
+		}
+	}
+}
+
+func (presence_service *PresenceService) SavePresence(p *RoutePresence) {
+	select {
+	case presence_service.c <- p:
+	default:
+		log.Warningf("presence channel full, drop appid:%d uid:%d", p.appid, p.uid)
+	}
+}
+
+func mergePlatforms(clients map[*Client]int32) int32 {
+	var platforms int32
+	for _, p := range clients {
+		platforms |= p
+	}
+	return platforms
+}
+
+// 用户在所有im上的在线平台
+func (server *Server) GetUserPlatforms(appid, uid int64) int32 {
+	server.presence_mutex.Lock()
+	defer server.presence_mutex.Unlock()
+
+	return mergePlatforms(server.user_platforms[RouteUserID{appid: appid, uid: uid}])
+}
+
+// 用户在此im上的订阅变化之后调用, 返回变化前后用户在所有im上的在线平台
+// 调用者持有presence_mutex
+func (server *Server) updateUserPlatforms(client *Client, id RouteUserID) (int32, int32) {
+	clients := server.user_platforms[id]
+	old := mergePlatforms(clients)
+
+	platforms := client.GetAppUserPlatforms(&id)
+	if platforms != 0 {
+		if clients == nil {
+			clients = make(map[*Client]int32)
+			server.user_platforms[id] = clients
+		}
+		clients[client] = platforms
+	} else if clients != nil {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(server.user_platforms, id)
+		}
+	}
+	return old, mergePlatforms(server.user_platforms[id])
+}
+
+// 在线平台变化时保存到redis, 并通知订阅了此用户在线状态的im
+// 调用者持有presence_mutex, 发送不阻塞
+func (server *Server) publishPresence(appid, uid int64, platforms int32) {
+	p := &RoutePresence{appid: appid, uid: uid, platforms: platforms, last_seen: int32(time.Now().Unix())}
+	log.Infof("presence appid:%d uid:%d platforms:%d", appid, uid, platforms)
+	server.presence_service.SavePresence(p)
+	if server.presence_stream != nil {
+		server.presence_stream.Publish(p)
+	}
+
+	watchers := server.presence_watchers[RouteUserID{appid: appid, uid: uid}]
+	if len(watchers) == 0 {
+		return
+	}
+	msg := &Message{Cmd: MSG_PUBLISH_PRESENCE, Body: p}
+	for c := range watchers {
+		select {
+		case c.wt <- msg:
+		default:
+			log.Warningf("client write channel full, drop presence appid:%d uid:%d", appid, uid)
+		}
+	}
+}
+
+func (server *Server) HandleWatchPresence(client *Client, id *RouteUserID) {
+	server.presence_mutex.Lock()
+	defer server.presence_mutex.Unlock()
+
+	watchers, ok := server.presence_watchers[*id]
+	if !ok {
+		watchers = NewClientSet()
+		server.presence_watchers[*id] = watchers
+	}
+	watchers.Add(client)
+	client.presence_watches[*id] = true
+}
+
+func (server *Server) HandleUnwatchPresence(client *Client, id *RouteUserID) {
+	server.presence_mutex.Lock()
+	defer server.presence_mutex.Unlock()
+
+	server.unwatchPresence(client, *id)
+}
+
+// 调用者持有presence_mutex
+func (server *Server) unwatchPresence(client *Client, id RouteUserID) {
+	if watchers, ok := server.presence_watchers[id]; ok {
+		watchers.Remove(client)
+		if len(watchers) == 0 {
+			delete(server.presence_watchers, id)
+		}
+	}
+	delete(client.presence_watches, id)
+}
+
+// im断开之后, 只在此im上在线的用户变为离线
+func (server *Server) removeClientPresence(client *Client) {
+	server.presence_mutex.Lock()
+	defer server.presence_mutex.Unlock()
+
+	for id := range client.presence_watches {
+		server.unwatchPresence(client, id)
+	}
+
+	app_users := client.app_route.GetUsers()
+	for appid, users := range app_users {
+		for uid := range users {
+			id := RouteUserID{appid: appid, uid: uid}
+			clients := server.user_platforms[id]
+			if _, ok := clients[client]; !ok {
+				continue
+			}
+			old := mergePlatforms(clients)
+			delete(clients, client)
+			if len(clients) == 0 {
+				delete(server.user_platforms, id)
+			}
+			platforms := mergePlatforms(clients)
+			if old != platforms {
+				server.publishPresence(appid, uid, platforms)
+			}
+		}
+	}
+}
+
+// 批量查询用户的在线状态, 在线平台来自内存, 最后在线时间来自redis
+func GetPresence(w http.ResponseWriter, req *http.Request, server *Server) {
+	m, _ := url.ParseQuery(req.URL.RawQuery)
+
+	appid, err := strconv.ParseInt(m.Get("appid"), 10, 64)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid query param", w)
+		return
+	}
+
+	uids := make([]int64, 0, len(m["uid"]))
+	for _, s := range m["uid"] {
+		uid, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			log.Info("error:", err)
+			WriteHttpError(400, "invalid query param", w)
+			return
+		}
+		uids = append(uids, uid)
+	}
+	if len(uids) == 0 || len(uids) > srv.PRESENCE_QUERY_LIMIT {
+		WriteHttpError(400, "invalid uid count", w)
+		return
+	}
+
+	presences, err := srv.LoadPresences(server.redis_pool, appid, uids)
+	if err != nil {
+		log.Warning("load presences err:", err)
+		WriteHttpError(500, "server internal error", w)
+		return
+	}
+
+	now := int32(time.Now().Unix())
+	users := make([]interface{}, 0, len(presences))
+	for _, p := range presences {
+		obj := p.Object()
+		platforms := server.GetUserPlatforms(appid, obj["uid"].(int64))
+		obj["online"] = platforms != 0
+		obj["platforms"] = srv.PlatformList(platforms)
+		if platforms != 0 {
+			obj["last_seen"] = now
+		}
+		users = append(users, obj)
+	}
+	obj := make(map[string]interface{})
+	obj["users"] = users
+	WriteHttpObj(obj, w)
+}
@@ -0,0 +1,220 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package router
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+
+	srv "github.com/GoBelieveIO/im_service/server"
+)
+
+const PRESENCE_STREAM_MAXLEN = 100000
+
+// presence event
+const PRESENCE_EVENT_ONLINE = "user_online"
+const PRESENCE_EVENT_OFFLINE = "user_offline"
+const PRESENCE_EVENT_CHANGED = "user_platform_changed"
+
+type PresenceEvent struct {
+	Name      string `redis:"name"`
+	AppId     int64  `redis:"app_id"`
+	Uid       int64  `redis:"uid"`
+	Platforms string `redis:"platforms"` //在线的平台号,逗号分隔
+	Timestamp int64  `redis:"timestamp"`
+}
+
+type pendingPresence struct {
+	platforms int32
+	timestamp int64
+	deadline  time.Time
+}
+
+// 用户在线状态的变化写入redis stream, 供业务服务器消费
+// 状态在debounce时间内没有再变化才写入, 过滤频繁断开重连的连接
+// imr重启之后会重新写入在线用户的上线事件
+// im只向用户所属的imr上报在线平台, 同一个用户的事件只由一个imr写入
+// 旧版本的im没有上报平台, 所有imr都会写入它的用户的事件
+type PresenceStream struct {
+	c          chan *RoutePresence
+	redis_pool *redis.Pool
+	name       string
+	maxlen     int
+	debounce   time.Duration
+
+	pending map[RouteUserID]*pendingPresence
+	emitted map[RouteUserID]int32 //已经写入的在线平台, 离线的用户不保存
+}
+
+func NewPresenceStream(redis_pool *redis.Pool, name string, maxlen int, debounce time.Duration) *PresenceStream {
+	if maxlen <= 0 {
+		maxlen = PRESENCE_STREAM_MAXLEN
+	}
+	s := &PresenceStream{}
+	s.c = make(chan *RoutePresence, 10000)
+	s.redis_pool = redis_pool
+	s.name = name
+	s.maxlen = maxlen
+	s.debounce = debounce
+	s.pending = make(map[RouteUserID]*pendingPresence)
+	s.emitted = make(map[RouteUserID]int32)
+	return s
+}
+
+func (stream *PresenceStream) Publish(p *RoutePresence) {
+	select {
+	case stream.c <- p:
+	default:
+		log.Warningf("presence stream channel full, drop appid:%d uid:%d", p.appid, p.uid)
+	}
+}
+
+func (stream *PresenceStream) Run() {
+	go stream.run()
+}
+
+func (stream *PresenceStream) run() {
+	interval := stream.debounce / 2
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case p := <-stream.c:
+			id := RouteUserID{appid: p.appid, uid: p.uid}
+			//保留第一次变化的deadline, 一直频繁变化的用户也会按时写入
+			if pp, ok := stream.pending[id]; ok {
+				pp.platforms = p.platforms
+				pp.timestamp = int64(p.last_seen)
+			} else {
+				stream.pending[id] = &pendingPresence{
+					platforms: p.platforms,
+					timestamp: int64(p.last_seen),
+					deadline:  time.Now().Add(stream.debounce),
+				}
+			}
+			if stream.debounce == 0 {
+				stream.flush(time.Now())
+			}
+		case now := <-ticker.C:
+			stream.flush(now)
+		}
+	}
+}
+
+func (stream *PresenceStream) flush(now time.Time) {
+	ids := make([]RouteUserID, 0)
+	presences := make([]*pendingPresence, 0)
+	events := make([]*PresenceEvent, 0)
+	for id, p := range stream.pending {
+		if now.Before(p.deadline) {
+			continue
+		}
+		delete(stream.pending, id)
+
+		old := stream.emitted[id]
+		if old == p.platforms {
+			//在debounce时间内断开又重新连接
+			continue
+		}
+
+		var name string
+		if p.platforms == 0 {
+			name = PRESENCE_EVENT_OFFLINE
+		} else if old == 0 {
+			name = PRESENCE_EVENT_ONLINE
+		} else {
+			name = PRESENCE_EVENT_CHANGED
+		}
+
+		platform_ids := make([]string, 0, 2)
+		for _, platform_id := range srv.PlatformList(p.platforms) {
+			platform_ids = append(platform_ids, strconv.Itoa(platform_id))
+		}
+		e := &PresenceEvent{
+			Name:      name,
+			AppId:     id.appid,
+			Uid:       id.uid,
+			Platforms: strings.Join(platform_ids, ","),
+			Timestamp: p.timestamp,
+		}
+		ids = append(ids, id)
+		presences = append(presences, p)
+		events = append(events, e)
+	}
+
+	if len(events) == 0 {
+		return
+	}
+
+	//写入成功之后才更新emitted, 失败的事件在下一次flush时重试
+	saved := stream.save(events)
+	for i, id := range ids {
+		p := presences[i]
+		if !saved[i] {
+			if _, ok := stream.pending[id]; !ok {
+				stream.pending[id] = p
+			}
+			continue
+		}
+		if p.platforms == 0 {
+			delete(stream.emitted, id)
+		} else {
+			stream.emitted[id] = p.platforms
+		}
+	}
+}
+
+// 返回每个事件是否写入成功
+func (stream *PresenceStream) save(events []*PresenceEvent) []bool {
+	saved := make([]bool, len(events))
+
+	conn := stream.redis_pool.Get()
+	defer conn.Close()
+
+	for _, e := range events {
+		args := redis.Args{}.Add(stream.name).Add("MAXLEN").Add("~").Add(stream.maxlen).Add("*").AddFlat(e)
+		conn.Send("XADD", args...)
+	}
+	err := conn.Flush()
+	if err != nil {
+		log.Warning("xadd presence events err:", err)
+		return saved
+	}
+	count := 0
+	for i := range events {
+		_, err := conn.Receive()
+		if err != nil {
+			log.Warning("xadd presence event err:", err)
+			continue
+		}
+		saved[i] = true
+		count++
+	}
+	log.Infof("save presence events:%d/%d", count, len(events))
+	return saved
+}
@@ -0,0 +1,178 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package router
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/GoBelieveIO/im_service/protocol"
+)
+
+// 返回给im的消息总长度, 不能超过route消息的32K限制
+const ROOM_BACKLOG_MAX_BYTES = 30 * 1024
+
+// 单个app的配置, 覆盖默认的配置
+type RoomBacklogConfig struct {
+	AppID   int64 `toml:"appid"`
+	Size    int   `toml:"size"`    //保留的消息数量, 0表示不保留
+	Seconds int   `toml:"seconds"` //只保留最近的消息, 0表示不限制
+}
+
+type backlogMessage struct {
+	timestamp int64
+	msg       []byte
+}
+
+// 聊天室最近消息的环形缓冲区
+type roomRing struct {
+	msgs  []*backlogMessage
+	start int
+	count int
+}
+
+func (ring *roomRing) add(m *backlogMessage) {
+	size := len(ring.msgs)
+	if ring.count < size {
+		ring.msgs[(ring.start+ring.count)%size] = m
+		ring.count++
+	} else {
+		ring.msgs[ring.start] = m
+		ring.start = (ring.start + 1) % size
+	}
+}
+
+// 按照时间顺序返回after之后的消息
+func (ring *roomRing) list(after int64) []*backlogMessage {
+	size := len(ring.msgs)
+	msgs := make([]*backlogMessage, 0, ring.count)
+	for i := 0; i < ring.count; i++ {
+		m := ring.msgs[(ring.start+i)%size]
+		if m.timestamp >= after {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs
+}
+
+type RoomBacklog struct {
+	mutex   sync.Mutex
+	rooms   map[RouteRoomID]*roomRing
+	configs map[int64]*RoomBacklogConfig
+
+	default_config *RoomBacklogConfig
+}
+
+func NewRoomBacklog(size int, seconds int, configs []*RoomBacklogConfig) *RoomBacklog {
+	b := &RoomBacklog{}
+	b.rooms = make(map[RouteRoomID]*roomRing)
+	b.configs = make(map[int64]*RoomBacklogConfig)
+	for _, c := range configs {
+		b.configs[c.AppID] = c
+	}
+	b.default_config = &RoomBacklogConfig{Size: size, Seconds: seconds}
+	return b
+}
+
+func (b *RoomBacklog) config(appid int64) *RoomBacklogConfig {
+	if c, ok := b.configs[appid]; ok {
+		return c
+	}
+	return b.default_config
+}
+
+func (b *RoomBacklog) Add(appid int64, room_id int64, msg []byte) {
+	c := b.config(appid)
+	if c.Size <= 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	id := RouteRoomID{appid: appid, room_id: room_id}
+	ring, ok := b.rooms[id]
+	if !ok {
+		ring = &roomRing{msgs: make([]*backlogMessage, c.Size)}
+		b.rooms[id] = ring
+	}
+	ring.add(&backlogMessage{timestamp: time.Now().Unix(), msg: msg})
+}
+
+// 返回最近的消息, 总长度超过限制时丢弃较早的消息
+func (b *RoomBacklog) Get(appid int64, room_id int64) [][]byte {
+	c := b.config(appid)
+	var after int64
+	if c.Seconds > 0 {
+		after = time.Now().Unix() - int64(c.Seconds)
+	}
+
+	b.mutex.Lock()
+	ring, ok := b.rooms[RouteRoomID{appid: appid, room_id: room_id}]
+	var msgs []*backlogMessage
+	if ok {
+		msgs = ring.list(after)
+	}
+	b.mutex.Unlock()
+
+	total := 0
+	begin := len(msgs)
+	for begin > 0 && total+len(msgs[begin-1].msg)+2 <= ROOM_BACKLOG_MAX_BYTES {
+		begin--
+		total += len(msgs[begin].msg) + 2
+	}
+
+	r := make([][]byte, 0, len(msgs)-begin)
+	for _, m := range msgs[begin:] {
+		r = append(r, m.msg)
+	}
+	return r
+}
+
+// 所有的im都离开聊天室之后删除缓存的消息
+func (b *RoomBacklog) Remove(appid int64, room_id int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.rooms, RouteRoomID{appid: appid, room_id: room_id})
+}
+
+// 只缓存聊天室的聊天消息, 不包括im之间的管理消息
+func isRoomIM(msg []byte) bool {
+	if len(msg) < MSG_HEADER_SIZE {
+		return false
+	}
+	_, _, cmd, _, _ := ReadHeader(msg[:MSG_HEADER_SIZE])
+	return cmd == MSG_ROOM_IM
+}
+
+func (server *Server) EnableRoomBacklog(size int, seconds int, configs []*RoomBacklogConfig) {
+	server.room_backlog = NewRoomBacklog(size, seconds, configs)
+}
+
+func (server *Server) HandleQueryRoomBacklog(client *Client, q *RouteRoomQuery) {
+	r := &RouteRoomBacklog{appid: q.appid, room_id: q.room_id, query_id: q.query_id}
+	if server.room_backlog != nil {
+		r.msgs = server.room_backlog.Get(q.appid, q.room_id)
+	}
+	log.Infof("query room backlog appid:%d room id:%d count:%d", q.appid, q.room_id, len(r.msgs))
+	client.wt <- &Message{Cmd: MSG_ROOM_BACKLOG_RESULT, Body: r}
+}
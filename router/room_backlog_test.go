@@ -0,0 +1,76 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package router
+
+import (
+	"testing"
+)
+
+func TestRoomRing(t *testing.T) {
+	ring := &roomRing{msgs: make([]*backlogMessage, 3)}
+	if len(ring.list(0)) != 0 {
+		t.Fatal("empty ring")
+	}
+
+	for i := int64(1); i <= 5; i++ {
+		ring.add(&backlogMessage{timestamp: i, msg: []byte{byte(i)}})
+	}
+
+	//只保留最近的3条消息, 按照时间顺序返回
+	msgs := ring.list(0)
+	if len(msgs) != 3 {
+		t.Fatalf("message count:%d", len(msgs))
+	}
+	for i, m := range msgs {
+		if m.timestamp != int64(i+3) {
+			t.Errorf("index:%d timestamp:%d", i, m.timestamp)
+		}
+	}
+
+	msgs = ring.list(4)
+	if len(msgs) != 2 || msgs[0].timestamp != 4 || msgs[1].timestamp != 5 {
+		t.Errorf("messages after 4:%d", len(msgs))
+	}
+}
+
+func TestRoomBacklogMaxBytes(t *testing.T) {
+	b := NewRoomBacklog(10, 0, []*RoomBacklogConfig{{AppID: 2, Size: 0}})
+	for i := 0; i < 4; i++ {
+		msg := make([]byte, 10*1024)
+		msg[0] = byte(i)
+		b.Add(1, 100, msg)
+		b.Add(2, 100, msg)
+	}
+
+	//总长度超过限制时丢弃较早的消息
+	msgs := b.Get(1, 100)
+	if len(msgs) != 2 || msgs[0][0] != 2 || msgs[1][0] != 3 {
+		t.Errorf("backlog count:%d", len(msgs))
+	}
+
+	if len(b.Get(2, 100)) != 0 {
+		t.Error("backlog disabled by app config")
+	}
+
+	b.Remove(1, 100)
+	if len(b.Get(1, 100)) != 0 {
+		t.Error("backlog not removed")
+	}
+}
@@ -0,0 +1,287 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package router
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/GoBelieveIO/im_service/protocol"
+	srv "github.com/GoBelieveIO/im_service/server"
+	"github.com/GoBelieveIO/im_service/set"
+)
+
+func (client *Client) ContainAppRoomMember(appid, room_id, uid int64) bool {
+	route := client.app_route.FindRoute(appid)
+	if route == nil {
+		return false
+	}
+	return route.ContainRoomMember(room_id, uid)
+}
+
+func (client *Client) GetAppRoomMembers(appid, room_id int64) set.IntSet {
+	route := client.app_route.FindRoute(appid)
+	if route == nil {
+		return nil
+	}
+	return route.GetRoomMembers(room_id)
+}
+
+// 用户进入和离开聊天室时通知聊天室中的成员
+func (server *Server) EnableRoomMemberBroadcast() {
+	server.room_member_broadcast = true
+}
+
+// 用户所在的im数量增加1, 返回是否新进入聊天室
+// 调用者持有room_mutex
+func (server *Server) addRoomMember(appid, room_id, uid int64) bool {
+	id := RouteRoomID{appid: appid, room_id: room_id}
+	members, ok := server.room_members[id]
+	if !ok {
+		members = make(map[int64]int)
+		server.room_members[id] = members
+	}
+	count := members[uid]
+	members[uid] = count + 1
+	return count == 0
+}
+
+// 用户所在的im数量减少1, 返回是否离开了聊天室
+// 调用者持有room_mutex
+func (server *Server) removeRoomMember(appid, room_id, uid int64) bool {
+	id := RouteRoomID{appid: appid, room_id: room_id}
+	members, ok := server.room_members[id]
+	if !ok {
+		return false
+	}
+	count, ok := members[uid]
+	if !ok {
+		return false
+	}
+	if count > 1 {
+		members[uid] = count - 1
+		return false
+	}
+	delete(members, uid)
+	if len(members) == 0 {
+		delete(server.room_members, id)
+	}
+	return true
+}
+
+func (server *Server) GetRoomMemberCount(appid, room_id int64) int {
+	server.room_mutex.Lock()
+	defer server.room_mutex.Unlock()
+
+	return len(server.room_members[RouteRoomID{appid: appid, room_id: room_id}])
+}
+
+// 所有im上聊天室成员的并集, 按照uid排序
+func (server *Server) FindRoomMembers(appid, room_id int64) []int64 {
+	server.room_mutex.Lock()
+	members := server.room_members[RouteRoomID{appid: appid, room_id: room_id}]
+	uids := make([]int64, 0, len(members))
+	for uid := range members {
+		uids = append(uids, uid)
+	}
+	server.room_mutex.Unlock()
+
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids
+}
+
+func (server *Server) HandleSubscribeRoomMember(client *Client, m *RouteRoomMember) {
+	log.Infof("subscribe room member appid:%d room id:%d uid:%d", m.appid, m.room_id, m.uid)
+
+	server.room_mutex.Lock()
+	defer server.room_mutex.Unlock()
+
+	route := client.app_route.FindOrAddRoute(m.appid)
+	if !route.AddRoomMember(m.room_id, m.uid) {
+		return
+	}
+	if server.addRoomMember(m.appid, m.room_id, m.uid) {
+		server.publishRoomMemberChanged(m.appid, m.room_id, m.uid, srv.ROOM_MEMBER_ENTER)
+	}
+}
+
+func (server *Server) HandleUnsubscribeRoomMember(client *Client, m *RouteRoomMember) {
+	log.Infof("unsubscribe room member appid:%d room id:%d uid:%d", m.appid, m.room_id, m.uid)
+
+	server.room_mutex.Lock()
+	defer server.room_mutex.Unlock()
+
+	route := client.app_route.FindOrAddRoute(m.appid)
+	if !route.RemoveRoomMember(m.room_id, m.uid) {
+		return
+	}
+	if server.removeRoomMember(m.appid, m.room_id, m.uid) {
+		server.publishRoomMemberChanged(m.appid, m.room_id, m.uid, srv.ROOM_MEMBER_LEAVE)
+	}
+}
+
+// limit为0时只返回成员数量, 不需要排序
+func (server *Server) HandleQueryRoomMembers(client *Client, q *RouteRoomQuery) {
+	var total int
+	var uids []int64
+	if q.limit <= 0 {
+		total = server.GetRoomMemberCount(q.appid, q.room_id)
+	} else {
+		uids = server.FindRoomMembers(q.appid, q.room_id)
+		total = len(uids)
+
+		offset := int(q.offset)
+		limit := int(q.limit)
+		if offset < 0 {
+			offset = 0
+		} else if offset > len(uids) {
+			offset = len(uids)
+		}
+		if limit > srv.ROOM_MEMBERS_MAX_LIMIT {
+			limit = srv.ROOM_MEMBERS_MAX_LIMIT
+		}
+		end := offset + limit
+		if end > len(uids) {
+			end = len(uids)
+		}
+		uids = uids[offset:end]
+	}
+
+	r := &RouteRoomMembers{
+		appid:    q.appid,
+		room_id:  q.room_id,
+		query_id: q.query_id,
+		total:    int32(total),
+		uids:     uids,
+	}
+	select {
+	case client.wt <- &Message{Cmd: MSG_ROOM_MEMBERS_RESULT, Body: r}:
+	default:
+		log.Warningf("client write channel full, drop room members result appid:%d room id:%d", q.appid, q.room_id)
+	}
+}
+
+// 发送给订阅了此聊天室的所有im, 包括成员所在的im
+// 调用者持有room_mutex, 发送不阻塞
+func (server *Server) publishRoomMemberChanged(appid, room_id, uid int64, action int32) {
+	if !server.room_member_broadcast {
+		return
+	}
+
+	m := &Message{Cmd: MSG_ROOM_MEMBER_CHANGED, Version: DEFAULT_VERSION, Body: srv.NewRoomMemberChanged(room_id, uid, action)}
+	mbuffer := new(bytes.Buffer)
+	WriteMessage(mbuffer, m)
+	amsg := &RouteMessage{appid: appid, receiver: room_id, msg: mbuffer.Bytes()}
+	msg := &Message{Cmd: MSG_PUBLISH_ROOM, Body: amsg}
+
+	s := server.FindRoomClientSet(&RouteRoomID{appid: appid, room_id: room_id})
+	for c := range s {
+		select {
+		case c.wt <- msg:
+		default:
+			log.Warningf("client write channel full, drop room member changed appid:%d room id:%d uid:%d", appid, room_id, uid)
+		}
+	}
+}
+
+// im断开之后, 只在此im上的聊天室成员离开聊天室
+func (server *Server) removeClientRoomMembers(client *Client) {
+	server.room_mutex.Lock()
+	defer server.room_mutex.Unlock()
+
+	app_rooms := client.app_route.GetRoomMembers()
+	for appid, rooms := range app_rooms {
+		for room_id, uids := range rooms {
+			for uid := range uids {
+				if server.removeRoomMember(appid, room_id, uid) {
+					server.publishRoomMemberChanged(appid, room_id, uid, srv.ROOM_MEMBER_LEAVE)
+				}
+			}
+		}
+	}
+}
+
+// 聊天室所属的route server上才有完整的成员列表
+// GET /room_members?appid=&room_id=&offset=&limit=
+func GetRoomMembers(w http.ResponseWriter, req *http.Request, server *Server) {
+	m, _ := url.ParseQuery(req.URL.RawQuery)
+
+	appid, err := strconv.ParseInt(m.Get("appid"), 10, 64)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid query param", w)
+		return
+	}
+
+	room_id, err := strconv.ParseInt(m.Get("room_id"), 10, 64)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid query param", w)
+		return
+	}
+
+	offset, limit := 0, srv.ROOM_MEMBERS_DEFAULT_LIMIT
+	if m.Get("offset") != "" {
+		offset, err = strconv.Atoi(m.Get("offset"))
+		if err != nil || offset < 0 {
+			WriteHttpError(400, "invalid query param", w)
+			return
+		}
+	}
+	if m.Get("limit") != "" {
+		limit, err = strconv.Atoi(m.Get("limit"))
+		if err != nil || limit < 0 || limit > srv.ROOM_MEMBERS_MAX_LIMIT {
+			WriteHttpError(400, "invalid query param", w)
+			return
+		}
+	}
+
+	var uids []int64
+	var total int
+	if limit > 0 {
+		uids = server.FindRoomMembers(appid, room_id)
+		total = len(uids)
+	} else {
+		uids = []int64{}
+		total = server.GetRoomMemberCount(appid, room_id)
+	}
+	if offset > len(uids) {
+		offset = len(uids)
+	}
+	end := offset + limit
+	next_offset := end
+	if end >= total {
+		next_offset = -1
+	}
+	if end > len(uids) {
+		end = len(uids)
+	}
+
+	obj := make(map[string]interface{})
+	obj["total"] = total
+	obj["members"] = uids[offset:end]
+	obj["next_offset"] = next_offset
+	WriteHttpObj(obj, w)
+}
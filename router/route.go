@@ -30,6 +30,10 @@ type Route struct {
 	mutex    sync.Mutex
 	uids     map[int64]bool
 	room_ids set.IntSet
+
+	room_members map[int64]set.IntSet //room_id:此im上聊天室中的用户
+
+	platforms map[int64]int32 //在线平台的位掩码
 }
 
 func NewRoute(appid int64) *Route {
@@ -37,6 +41,8 @@ func NewRoute(appid int64) *Route {
 	r.appid = appid
 	r.uids = make(map[int64]bool)
 	r.room_ids = set.NewIntSet()
+	r.room_members = make(map[int64]set.IntSet)
+	r.platforms = make(map[int64]int32)
 	return r
 }
 
@@ -55,11 +61,13 @@ func (route *Route) IsUserOnline(uid int64) bool {
 	return route.uids[uid]
 }
 
-func (route *Route) AddUserID(uid int64, online bool) {
+// 旧版本的im没有上报平台, platforms为0
+func (route *Route) AddUserID(uid int64, online bool, platforms int32) {
 	route.mutex.Lock()
 	defer route.mutex.Unlock()
 
 	route.uids[uid] = online
+	route.platforms[uid] = platforms
 }
 
 func (route *Route) RemoveUserID(uid int64) {
@@ -67,6 +75,17 @@ func (route *Route) RemoveUserID(uid int64) {
 	defer route.mutex.Unlock()
 
 	delete(route.uids, uid)
+	delete(route.platforms, uid)
+}
+
+func (route *Route) GetUserPlatforms(uid int64) (int32, bool) {
+	route.mutex.Lock()
+	defer route.mutex.Unlock()
+
+	if _, ok := route.uids[uid]; !ok {
+		return 0, false
+	}
+	return route.platforms[uid], true
 }
 
 func (route *Route) GetUserIDs() set.IntSet {
@@ -100,3 +119,67 @@ func (route *Route) RemoveRoomID(room_id int64) {
 
 	route.room_ids.Remove(room_id)
 }
+
+// 返回用户之前是否不在聊天室中
+func (route *Route) AddRoomMember(room_id int64, uid int64) bool {
+	route.mutex.Lock()
+	defer route.mutex.Unlock()
+
+	uids, ok := route.room_members[room_id]
+	if !ok {
+		uids = set.NewIntSet()
+		route.room_members[room_id] = uids
+	}
+	if uids.IsMember(uid) {
+		return false
+	}
+	uids.Add(uid)
+	return true
+}
+
+// 返回用户之前是否在聊天室中
+func (route *Route) RemoveRoomMember(room_id int64, uid int64) bool {
+	route.mutex.Lock()
+	defer route.mutex.Unlock()
+
+	uids, ok := route.room_members[room_id]
+	if !ok || !uids.IsMember(uid) {
+		return false
+	}
+	uids.Remove(uid)
+	if uids.Count() == 0 {
+		delete(route.room_members, room_id)
+	}
+	return true
+}
+
+func (route *Route) ContainRoomMember(room_id int64, uid int64) bool {
+	route.mutex.Lock()
+	defer route.mutex.Unlock()
+
+	if uids, ok := route.room_members[room_id]; ok {
+		return uids.IsMember(uid)
+	}
+	return false
+}
+
+func (route *Route) GetRoomMembers(room_id int64) set.IntSet {
+	route.mutex.Lock()
+	defer route.mutex.Unlock()
+
+	if uids, ok := route.room_members[room_id]; ok {
+		return uids.Clone()
+	}
+	return nil
+}
+
+func (route *Route) GetAllRoomMembers() map[int64]set.IntSet {
+	route.mutex.Lock()
+	defer route.mutex.Unlock()
+
+	r := make(map[int64]set.IntSet)
+	for room_id, uids := range route.room_members {
+		r[room_id] = uids.Clone()
+	}
+	return r
+}
@@ -24,6 +24,7 @@ import (
 	"encoding/binary"
 
 	"github.com/GoBelieveIO/im_service/protocol"
+	srv "github.com/GoBelieveIO/im_service/server"
 )
 
 func init() {
@@ -36,6 +37,15 @@ func init() {
 	protocol.RegisterMessageCreator(protocol.MSG_SUBSCRIBE_ROOM, func() protocol.IMessage { return new(RouteRoomID) })
 	protocol.RegisterMessageCreator(protocol.MSG_UNSUBSCRIBE_ROOM, func() protocol.IMessage { return new(RouteRoomID) })
 	protocol.RegisterMessageCreator(protocol.MSG_PUBLISH_ROOM, func() protocol.IMessage { return new(RouteMessage) })
+	protocol.RegisterMessageCreator(protocol.MSG_PUBLISH_PRESENCE, func() protocol.IMessage { return new(RoutePresence) })
+	protocol.RegisterMessageCreator(protocol.MSG_SUBSCRIBE_ROOM_MEMBER, func() protocol.IMessage { return new(RouteRoomMember) })
+	protocol.RegisterMessageCreator(protocol.MSG_UNSUBSCRIBE_ROOM_MEMBER, func() protocol.IMessage { return new(RouteRoomMember) })
+	protocol.RegisterMessageCreator(protocol.MSG_QUERY_ROOM_MEMBERS, func() protocol.IMessage { return new(RouteRoomQuery) })
+	protocol.RegisterMessageCreator(protocol.MSG_ROOM_MEMBERS_RESULT, func() protocol.IMessage { return new(RouteRoomMembers) })
+	protocol.RegisterMessageCreator(protocol.MSG_QUERY_ROOM_BACKLOG, func() protocol.IMessage { return new(RouteRoomQuery) })
+	protocol.RegisterMessageCreator(protocol.MSG_ROOM_BACKLOG_RESULT, func() protocol.IMessage { return new(RouteRoomBacklog) })
+	protocol.RegisterMessageCreator(protocol.MSG_WATCH_PRESENCE, func() protocol.IMessage { return new(RouteUserID) })
+	protocol.RegisterMessageCreator(protocol.MSG_UNWATCH_PRESENCE, func() protocol.IMessage { return new(RouteUserID) })
 
 }
 
@@ -172,9 +182,10 @@ func (amsg *RouteMessage) FromData(buff []byte) bool {
 }
 
 type SubscribeMessage struct {
-	appid  int64
-	uid    int64
-	online int8 //1 or 0
+	appid     int64
+	uid       int64
+	online    int8  //1 or 0
+	platforms int32 //在线平台的位掩码, 0表示用户不属于此route server
 }
 
 func (sub *SubscribeMessage) ToData() []byte {
@@ -182,6 +193,7 @@ func (sub *SubscribeMessage) ToData() []byte {
 	binary.Write(buffer, binary.BigEndian, sub.appid)
 	binary.Write(buffer, binary.BigEndian, sub.uid)
 	binary.Write(buffer, binary.BigEndian, sub.online)
+	binary.Write(buffer, binary.BigEndian, sub.platforms)
 	buf := buffer.Bytes()
 	return buf
 }
@@ -195,10 +207,47 @@ func (sub *SubscribeMessage) FromData(buff []byte) bool {
 	binary.Read(buffer, binary.BigEndian, &sub.appid)
 	binary.Read(buffer, binary.BigEndian, &sub.uid)
 	binary.Read(buffer, binary.BigEndian, &sub.online)
+	if len(buff) >= 21 {
+		binary.Read(buffer, binary.BigEndian, &sub.platforms)
+	} else {
+		//旧版本的im没有此字段, 所有route server都记录为未知平台
+		sub.platforms = srv.PlatformMask(srv.PLATFORM_UNKNOWN)
+	}
 
 	return true
 }
 
+// 用户在线状态的变化, 广播给所有的im
+type RoutePresence struct {
+	appid     int64
+	uid       int64
+	platforms int32
+	last_seen int32
+}
+
+func (p *RoutePresence) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, p.appid)
+	binary.Write(buffer, binary.BigEndian, p.uid)
+	binary.Write(buffer, binary.BigEndian, p.platforms)
+	binary.Write(buffer, binary.BigEndian, p.last_seen)
+	buf := buffer.Bytes()
+	return buf
+}
+
+func (p *RoutePresence) FromData(buff []byte) bool {
+	if len(buff) < 24 {
+		return false
+	}
+
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &p.appid)
+	binary.Read(buffer, binary.BigEndian, &p.uid)
+	binary.Read(buffer, binary.BigEndian, &p.platforms)
+	binary.Read(buffer, binary.BigEndian, &p.last_seen)
+	return true
+}
+
 type RouteUserID struct {
 	appid int64
 	uid   int64
@@ -248,3 +297,164 @@ func (id *RouteRoomID) FromData(buff []byte) bool {
 
 	return true
 }
+
+type RouteRoomMember struct {
+	appid   int64
+	room_id int64
+	uid     int64
+}
+
+func (m *RouteRoomMember) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, m.appid)
+	binary.Write(buffer, binary.BigEndian, m.room_id)
+	binary.Write(buffer, binary.BigEndian, m.uid)
+	buf := buffer.Bytes()
+	return buf
+}
+
+func (m *RouteRoomMember) FromData(buff []byte) bool {
+	if len(buff) < 24 {
+		return false
+	}
+
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &m.appid)
+	binary.Read(buffer, binary.BigEndian, &m.room_id)
+	binary.Read(buffer, binary.BigEndian, &m.uid)
+	return true
+}
+
+// im查询聊天室成员, route server使用相同的query_id返回结果
+// limit为0时只返回成员数量
+type RouteRoomQuery struct {
+	appid    int64
+	room_id  int64
+	query_id int64
+	offset   int32
+	limit    int32
+}
+
+func (q *RouteRoomQuery) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, q.appid)
+	binary.Write(buffer, binary.BigEndian, q.room_id)
+	binary.Write(buffer, binary.BigEndian, q.query_id)
+	binary.Write(buffer, binary.BigEndian, q.offset)
+	binary.Write(buffer, binary.BigEndian, q.limit)
+	buf := buffer.Bytes()
+	return buf
+}
+
+func (q *RouteRoomQuery) FromData(buff []byte) bool {
+	if len(buff) < 32 {
+		return false
+	}
+
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &q.appid)
+	binary.Read(buffer, binary.BigEndian, &q.room_id)
+	binary.Read(buffer, binary.BigEndian, &q.query_id)
+	binary.Read(buffer, binary.BigEndian, &q.offset)
+	binary.Read(buffer, binary.BigEndian, &q.limit)
+	return true
+}
+
+// total为聊天室的成员总数, uids按照uid排序
+type RouteRoomMembers struct {
+	appid    int64
+	room_id  int64
+	query_id int64
+	total    int32
+	uids     []int64
+}
+
+func (m *RouteRoomMembers) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, m.appid)
+	binary.Write(buffer, binary.BigEndian, m.room_id)
+	binary.Write(buffer, binary.BigEndian, m.query_id)
+	binary.Write(buffer, binary.BigEndian, m.total)
+	count := uint16(len(m.uids))
+	binary.Write(buffer, binary.BigEndian, count)
+	for _, uid := range m.uids {
+		binary.Write(buffer, binary.BigEndian, uid)
+	}
+	buf := buffer.Bytes()
+	return buf
+}
+
+func (m *RouteRoomMembers) FromData(buff []byte) bool {
+	if len(buff) < 30 {
+		return false
+	}
+
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &m.appid)
+	binary.Read(buffer, binary.BigEndian, &m.room_id)
+	binary.Read(buffer, binary.BigEndian, &m.query_id)
+	binary.Read(buffer, binary.BigEndian, &m.total)
+
+	var count uint16
+	binary.Read(buffer, binary.BigEndian, &count)
+	if len(buff) < 30+int(count)*8 {
+		return false
+	}
+	uids := make([]int64, count)
+	for i := 0; i < int(count); i++ {
+		binary.Read(buffer, binary.BigEndian, &uids[i])
+	}
+	m.uids = uids
+	return true
+}
+
+// 聊天室最近的消息, msgs为序列化之后的消息, 按照时间排序
+type RouteRoomBacklog struct {
+	appid    int64
+	room_id  int64
+	query_id int64
+	msgs     [][]byte
+}
+
+func (b *RouteRoomBacklog) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, b.appid)
+	binary.Write(buffer, binary.BigEndian, b.room_id)
+	binary.Write(buffer, binary.BigEndian, b.query_id)
+	count := uint16(len(b.msgs))
+	binary.Write(buffer, binary.BigEndian, count)
+	for _, msg := range b.msgs {
+		var l int16 = int16(len(msg))
+		binary.Write(buffer, binary.BigEndian, l)
+		buffer.Write(msg)
+	}
+	buf := buffer.Bytes()
+	return buf
+}
+
+func (b *RouteRoomBacklog) FromData(buff []byte) bool {
+	if len(buff) < 26 {
+		return false
+	}
+
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &b.appid)
+	binary.Read(buffer, binary.BigEndian, &b.room_id)
+	binary.Read(buffer, binary.BigEndian, &b.query_id)
+
+	var count uint16
+	binary.Read(buffer, binary.BigEndian, &count)
+	msgs := make([][]byte, 0, count)
+	for i := 0; i < int(count); i++ {
+		var l int16
+		err := binary.Read(buffer, binary.BigEndian, &l)
+		if err != nil || int(l) > buffer.Len() || l < 0 {
+			return false
+		}
+		msg := make([]byte, l)
+		buffer.Read(msg)
+		msgs = append(msgs, msg)
+	}
+	b.msgs = msgs
+	return true
+}
@@ -123,3 +123,10 @@ func GetOnlineStatus(w http.ResponseWriter, req *http.Request, server *Server) {
 	b, _ := json.Marshal(resp)
 	w.Write(b)
 }
+
+// 各个推送出口的统计
+func GetPushSummary(w http.ResponseWriter, req *http.Request, server *Server) {
+	obj := make(map[string]interface{})
+	obj["sinks"] = server.push_service.Summary()
+	WriteHttpObj(obj, w)
+}
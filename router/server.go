@@ -21,6 +21,7 @@ package router
 
 import (
 	"sync"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
 	log "github.com/sirupsen/logrus"
@@ -34,13 +35,35 @@ type Server struct {
 	mutex         sync.Mutex
 	push_service  *srv.PushService
 	push_disabled bool
+
+	redis_pool       *redis.Pool
+	presence_mutex   sync.Mutex //保证在线状态变化的顺序
+	presence_service *PresenceService
+	presence_stream  *PresenceStream //为nil时不写入stream
+
+	//以下字段由presence_mutex保护
+	user_platforms    map[RouteUserID]map[*Client]int32 //用户在各个im上的在线平台
+	presence_watchers map[RouteUserID]ClientSet         //订阅了用户在线状态的im
+
+	room_mutex            sync.Mutex //保证聊天室成员变化的顺序
+	room_member_broadcast bool
+	room_members          map[RouteRoomID]map[int64]int //聊天室成员所在的im数量, 由room_mutex保护
+	room_backlog          *RoomBacklog                  //为nil时不保留聊天室的消息
+
+	conversation_mutes *srv.ConversationMutes
 }
 
-func NewServer(redis_pool *redis.Pool, push_disabled bool) *Server {
+func NewServer(redis_pool *redis.Pool, push_service *srv.PushService, push_disabled bool) *Server {
 	s := &Server{}
 	s.clients = NewClientSet()
-	s.push_service = srv.NewPushService(redis_pool)
+	s.push_service = push_service
 	s.push_disabled = push_disabled
+	s.redis_pool = redis_pool
+	s.presence_service = NewPresenceService(redis_pool)
+	s.user_platforms = make(map[RouteUserID]map[*Client]int32)
+	s.room_members = make(map[RouteRoomID]map[int64]int)
+	s.presence_watchers = make(map[RouteUserID]ClientSet)
+	s.conversation_mutes = srv.NewConversationMutes(redis_pool)
 	return s
 }
 
@@ -48,8 +71,19 @@ func (server *Server) RunPushService() {
 	server.push_service.Run()
 }
 
+func (server *Server) RunPresenceService() {
+	server.presence_service.Run()
+}
+
+func (server *Server) EnablePresenceStream(name string, maxlen int, debounce time.Duration) {
+	server.presence_stream = NewPresenceStream(server.redis_pool, name, maxlen, debounce)
+	server.presence_stream.Run()
+}
+
 func (server *Server) onClientClose(client *Client) {
 	server.RemoveClient(client)
+	server.removeClientPresence(client)
+	server.removeClientRoomMembers(client)
 }
 
 func (server *Server) onClientMessage(client *Client, msg *Message) {
@@ -71,22 +105,50 @@ func (server *Server) onClientMessage(client *Client, msg *Message) {
 		server.HandleUnsubscribeRoom(client, msg.Body.(*RouteRoomID))
 	case MSG_PUBLISH_ROOM:
 		server.HandlePublishRoom(client, msg.Body.(*RouteMessage))
+	case MSG_SUBSCRIBE_ROOM_MEMBER:
+		server.HandleSubscribeRoomMember(client, msg.Body.(*RouteRoomMember))
+	case MSG_UNSUBSCRIBE_ROOM_MEMBER:
+		server.HandleUnsubscribeRoomMember(client, msg.Body.(*RouteRoomMember))
+	case MSG_QUERY_ROOM_MEMBERS:
+		server.HandleQueryRoomMembers(client, msg.Body.(*RouteRoomQuery))
+	case MSG_QUERY_ROOM_BACKLOG:
+		server.HandleQueryRoomBacklog(client, msg.Body.(*RouteRoomQuery))
+	case MSG_WATCH_PRESENCE:
+		server.HandleWatchPresence(client, msg.Body.(*RouteUserID))
+	case MSG_UNWATCH_PRESENCE:
+		server.HandleUnwatchPresence(client, msg.Body.(*RouteUserID))
 	default:
 		log.Warning("unknown message cmd:", msg.Cmd)
 	}
 }
 
 func (server *Server) HandleSubscribe(client *Client, id *SubscribeMessage) {
-	log.Infof("subscribe appid:%d uid:%d online:%d", id.appid, id.uid, id.online)
+	log.Infof("subscribe appid:%d uid:%d online:%d platforms:%d", id.appid, id.uid, id.online, id.platforms)
+
+	server.presence_mutex.Lock()
+	defer server.presence_mutex.Unlock()
+
 	route := client.app_route.FindOrAddRoute(id.appid)
 	on := id.online != 0
-	route.AddUserID(id.uid, on)
+	route.AddUserID(id.uid, on, id.platforms)
+	old, platforms := server.updateUserPlatforms(client, RouteUserID{appid: id.appid, uid: id.uid})
+	if old != platforms {
+		server.publishPresence(id.appid, id.uid, platforms)
+	}
 }
 
 func (server *Server) HandleUnsubscribe(client *Client, id *RouteUserID) {
 	log.Infof("unsubscribe appid:%d uid:%d", id.appid, id.uid)
+
+	server.presence_mutex.Lock()
+	defer server.presence_mutex.Unlock()
+
 	route := client.app_route.FindOrAddRoute(id.appid)
 	route.RemoveUserID(id.uid)
+	old, platforms := server.updateUserPlatforms(client, *id)
+	if old != platforms {
+		server.publishPresence(id.appid, id.uid, platforms)
+	}
 }
 
 func (server *Server) HandlePublishGroup(client *Client, amsg *RouteMessage) {
@@ -119,6 +181,10 @@ func (server *Server) HandlePush(client *Client, pmsg *BatchPushMessage) {
 			off_members = append(off_members, uid)
 		}
 	}
+	//免打扰的会话只在这里过滤, 在线的用户不推送, 不需要读取设置
+	if len(off_members) > 0 {
+		off_members = server.conversation_mutes.FilterReceivers(pmsg.appid, off_members, pmsg.msg)
+	}
 
 	cmd := pmsg.msg.Cmd
 	if len(off_members) > 0 {
@@ -163,11 +229,18 @@ func (server *Server) HandleUnsubscribeRoom(client *Client, id *RouteRoomID) {
 	log.Infof("unsubscribe appid:%d room id:%d", id.appid, id.room_id)
 	route := client.app_route.FindOrAddRoute(id.appid)
 	route.RemoveRoomID(id.room_id)
+
+	if server.room_backlog != nil && len(server.FindRoomClientSet(id)) == 0 {
+		server.room_backlog.Remove(id.appid, id.room_id)
+	}
 }
 
 func (server *Server) HandlePublishRoom(client *Client, amsg *RouteMessage) {
 	log.Infof("publish room message appid:%d room id:%d", amsg.appid, amsg.receiver)
 	receiver := &RouteRoomID{appid: amsg.appid, room_id: amsg.receiver}
+	if server.room_backlog != nil && isRoomIM(amsg.msg) {
+		server.room_backlog.Add(amsg.appid, amsg.receiver, amsg.msg)
+	}
 	s := server.FindRoomClientSet(receiver)
 
 	msg := &Message{Cmd: MSG_PUBLISH_ROOM, Body: amsg}
@@ -75,13 +75,14 @@ func SendSuperGroupNotification(appid int64, gid int64,
 }
 
 func SendGroupIMMessage(im *IMMessage, appid int64, app *App, server_summary *ServerSummary, rpc_storage *RPCStorage) {
-	m := &Message{Cmd: MSG_GROUP_IM, Version: DEFAULT_VERSION, Body: im}
 	loader := app.GetGroupLoader(im.receiver)
 	group := loader.LoadGroup(im.receiver)
 	if group == nil {
 		log.Warning("can't find group:", im.receiver)
 		return
 	}
+	im.mentions = FilterMentions(group, im.sender, im.mentions)
+	m := &Message{Cmd: MSG_GROUP_IM, Version: groupMessageVersion(im), Body: im}
 	if group.super {
 		msgid, _, err := rpc_storage.SaveGroupMessage(appid, im.receiver, 0, m)
 		if err != nil {
@@ -109,9 +110,10 @@ func SendGroupIMMessage(im *IMMessage, appid int64, app *App, server_summary *Se
 			i += 1
 		}
 
+		gm.mentions = im.mentions
 		gm.content = im.content
 		deliver := app.GetGroupMessageDeliver(group.gid)
-		m := &Message{Cmd: MSG_PENDING_GROUP_MESSAGE, Body: gm}
+		m := &Message{Cmd: MSG_PENDING_GROUP_MESSAGE, Version: MENTION_VERSION, Body: gm}
 		deliver.SaveMessage(m, nil)
 	}
 	atomic.AddInt64(&server_summary.in_message_count, 1)
@@ -302,6 +304,18 @@ func PostGroupMessage(w http.ResponseWriter, req *http.Request, app *App, server
 		return
 	}
 
+	//@的成员, mention=1&mention=2
+	mentions := make([]int64, 0, len(m["mention"]))
+	for _, s := range m["mention"] {
+		uid, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			log.Info("error:", err)
+			WriteHttpError(400, "invalid param", w)
+			return
+		}
+		mentions = append(mentions, uid)
+	}
+
 	content := string(body)
 
 	im := &IMMessage{}
@@ -309,6 +323,7 @@ func PostGroupMessage(w http.ResponseWriter, req *http.Request, app *App, server
 	im.receiver = receiver
 	im.msgid = 0
 	im.timestamp = int32(time.Now().Unix())
+	im.mentions = mentions
 	im.content = content
 
 	SendGroupIMMessage(im, appid, app, server_summary, rpc_storage)
@@ -363,8 +378,7 @@ func LoadLatestMessage(w http.ResponseWriter, req *http.Request, rpc_storage *RP
 	msg_list := make([]map[string]interface{}, 0, len(messages))
 	for _, emsg := range messages {
 
-		msg := &Message{Cmd: int(emsg.Cmd), Version: DEFAULT_VERSION}
-		msg.FromData(emsg.Raw)
+		msg := decodeHistoryMessage(emsg)
 
 		if msg.Cmd == MSG_IM ||
 			msg.Cmd == MSG_GROUP_IM {
@@ -377,6 +391,9 @@ func LoadLatestMessage(w http.ResponseWriter, req *http.Request, rpc_storage *RP
 			obj["receiver"] = im.receiver
 			obj["command"] = msg.Cmd
 			obj["id"] = emsg.MsgID
+			if len(im.mentions) > 0 {
+				obj["mentions"] = im.mentions
+			}
 			msg_list = append(msg_list, obj)
 
 		} else if msg.Cmd == MSG_CUSTOMER_V2 {
@@ -443,8 +460,7 @@ func LoadHistoryMessage(w http.ResponseWriter, req *http.Request, rpc_storage *R
 
 	msg_list := make([]map[string]interface{}, 0, len(messages))
 	for _, emsg := range messages {
-		msg := &Message{Cmd: int(emsg.Cmd), Version: DEFAULT_VERSION}
-		msg.FromData(emsg.Raw)
+		msg := decodeHistoryMessage(emsg)
 		if msg.Cmd == MSG_IM ||
 			msg.Cmd == MSG_GROUP_IM {
 			im := msg.Body.(*IMMessage)
@@ -545,7 +561,7 @@ func SendNotification(w http.ResponseWriter, req *http.Request, app *App) {
 	w.WriteHeader(200)
 }
 
-func SendSystemMessage(w http.ResponseWriter, req *http.Request, app *App, rpc_storage *RPCStorage) {
+func SendSystemMessage(w http.ResponseWriter, req *http.Request, app *App, rpc_storage *RPCStorage, word_filter *WordFilter) {
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		WriteHttpError(400, err.Error(), w)
@@ -587,6 +603,19 @@ func SendSystemMessage(w http.ResponseWriter, req *http.Request, app *App, rpc_s
 			return
 		}
 	}
+
+	if word_filter != nil {
+		c, rejected, flagged := word_filter.Check(appid, content)
+		if rejected {
+			WriteHttpError(400, "content contains sensitive word", w)
+			return
+		}
+		if len(flagged) > 0 {
+			word_filter.Flag(appid, MSG_SYSTEM, 0, 0, c, flagged)
+		}
+		content = c
+	}
+
 	for i := range receivers {
 		uid := obj.Get("receivers").GetIndex(i).MustInt64()
 		sys := &SystemMessage{content}
@@ -650,7 +679,7 @@ func SendRoomMessage(w http.ResponseWriter, req *http.Request, app *App) {
 	w.WriteHeader(200)
 }
 
-func SendCustomerMessage(w http.ResponseWriter, req *http.Request, app *App, rpc_storage *RPCStorage) {
+func SendCustomerMessage(w http.ResponseWriter, req *http.Request, app *App, rpc_storage *RPCStorage, customer_apps *CustomerApps) {
 	body, err := io.ReadAll(req.Body)
 	if err != nil {
 		WriteHttpError(400, err.Error(), w)
@@ -699,6 +728,12 @@ func SendCustomerMessage(w http.ResponseWriter, req *http.Request, app *App, rpc
 		return
 	}
 
+	if !customer_apps.IsAllowed(sender_appid, receiver_appid) {
+		log.Warningf("customer message from app:%d to app:%d is not allowed", sender_appid, receiver_appid)
+		WriteHttpError(403, "app pair is not allowed", w)
+		return
+	}
+
 	cm := &CustomerMessageV2{}
 	cm.sender_appid = sender_appid
 	cm.sender = sender
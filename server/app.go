@@ -20,35 +20,61 @@
 package server
 
 import (
+	"errors"
+	"sync"
 	"sync/atomic"
 
+	log "github.com/sirupsen/logrus"
+
 	. "github.com/GoBelieveIO/im_service/protocol"
 )
 
 type RouteChannel interface {
 	Address() string
-	Subscribe(appid int64, uid int64, online bool)
-	Unsubscribe(appid int64, uid int64, online bool)
-	PublishMessage(appid int64, uid int64, msg *Message)
-	PublishGroupMessage(appid int64, group_id int64, msg *Message)
-	PublishRoomMessage(appid int64, room_id int64, m *Message)
+	Subscribe(appid int64, uid int64, platform_id int8, online bool)
+	Unsubscribe(appid int64, uid int64, platform_id int8, online bool)
+	//channel已经关闭(route server被移除)时返回false
+	PublishMessage(appid int64, uid int64, msg *Message) bool
+	PublishGroupMessage(appid int64, group_id int64, msg *Message) bool
+	PublishRoomMessage(appid int64, room_id int64, m *Message) bool
 	Push(appid int64, receivers []int64, msg *Message)
 	SubscribeRoom(appid int64, room_id int64)
 	UnsubscribeRoom(appid int64, room_id int64)
+	SubscribeRoomMember(appid int64, room_id int64, uid int64)
+	UnsubscribeRoomMember(appid int64, room_id int64, uid int64)
+	QueryRoomMembers(appid int64, room_id int64, offset int, limit int) (int, []int64, error)
+	QueryRoomBacklog(appid int64, room_id int64) ([]*Message, error)
+	WatchPresence(appid int64, uid int64)
+	UnwatchPresence(appid int64, uid int64)
 }
 
 type App struct {
 	app_route *AppRoute
 
+	//只保护下面的节点列表, 不能在持有锁的时候向channel发送消息
+	mutex sync.RWMutex
+	//订阅和route server节点的调整互斥, 订阅时持有读锁
+	//某个route server阻塞时只影响订阅, 不影响消息的发送
+	sub_mutex sync.RWMutex
 	// route server
 	route_channels []RouteChannel
 	// super group route server
 	group_route_channels []RouteChannel
+	// 没有单独配置超级群的route server
+	shared_group_route bool
+	// 为nil时使用id % len(route_channels)
+	route_ring        *HashRing
+	new_route_channel func(addr string) RouteChannel
 
 	current_deliver_index  uint64
 	group_message_delivers []*GroupMessageDeliver
 
 	group_loaders []*GroupLoader
+
+	// 聊天室成员上报到route server
+	room_members bool
+	// 进入聊天室时补发最近的消息
+	room_backlog bool
 }
 
 func (app *App) Init(
@@ -60,19 +86,46 @@ func (app *App) Init(
 	app.app_route = app_route
 	app.route_channels = route_channels
 	app.group_route_channels = group_route_channels
+	app.shared_group_route = isSameChannels(route_channels, group_route_channels)
 	app.group_message_delivers = group_message_delivers
 	app.group_loaders = group_loaders
 }
 
-func (app *App) GetChannel(uid int64) RouteChannel {
-	if uid < 0 {
-		uid = -uid
+func isSameChannels(a []RouteChannel, b []RouteChannel) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (app *App) getChannel(id int64) RouteChannel {
+	if app.route_ring != nil {
+		return app.route_channels[app.route_ring.Get(id)]
 	}
-	index := uid % int64(len(app.route_channels))
+	if id < 0 {
+		id = -id
+	}
+	index := id % int64(len(app.route_channels))
 	return app.route_channels[index]
 }
 
+func (app *App) GetChannel(uid int64) RouteChannel {
+	app.mutex.RLock()
+	defer app.mutex.RUnlock()
+	return app.getChannel(uid)
+}
+
 func (app *App) GetGroupChannel(group_id int64) RouteChannel {
+	app.mutex.RLock()
+	defer app.mutex.RUnlock()
+	if app.shared_group_route {
+		return app.getChannel(group_id)
+	}
 	if group_id < 0 {
 		group_id = -group_id
 	}
@@ -81,11 +134,118 @@ func (app *App) GetGroupChannel(group_id int64) RouteChannel {
 }
 
 func (app *App) GetRoomChannel(room_id int64) RouteChannel {
-	if room_id < 0 {
-		room_id = -room_id
+	app.mutex.RLock()
+	defer app.mutex.RUnlock()
+	return app.getChannel(room_id)
+}
+
+// 返回用户所属的route server和全部超级群的route server
+func (app *App) userChannels(uid int64) (RouteChannel, []RouteChannel) {
+	app.mutex.RLock()
+	defer app.mutex.RUnlock()
+	return app.getChannel(uid), app.group_route_channels
+}
+
+// 用户订阅所属的route server和全部超级群的route server
+func (app *App) SubscribeUser(appid int64, uid int64, platform_id int8, online bool) {
+	app.sub_mutex.RLock()
+	defer app.sub_mutex.RUnlock()
+
+	channel, group_channels := app.userChannels(uid)
+	channel.Subscribe(appid, uid, platform_id, online)
+
+	for _, c := range group_channels {
+		if c == channel {
+			continue
+		}
+		//在线状态只由用户所属的route server发布
+		c.Subscribe(appid, uid, PLATFORM_NONE, online)
 	}
-	index := room_id % int64(len(app.route_channels))
-	return app.route_channels[index]
+}
+
+func (app *App) UnsubscribeUser(appid int64, uid int64, platform_id int8, online bool) {
+	app.sub_mutex.RLock()
+	defer app.sub_mutex.RUnlock()
+
+	channel, group_channels := app.userChannels(uid)
+	channel.Unsubscribe(appid, uid, platform_id, online)
+
+	for _, c := range group_channels {
+		if c == channel {
+			continue
+		}
+		c.Unsubscribe(appid, uid, PLATFORM_NONE, online)
+	}
+}
+
+func (app *App) SubscribeRoom(appid int64, room_id int64) {
+	app.sub_mutex.RLock()
+	defer app.sub_mutex.RUnlock()
+	app.GetRoomChannel(room_id).SubscribeRoom(appid, room_id)
+}
+
+func (app *App) UnsubscribeRoom(appid int64, room_id int64) {
+	app.sub_mutex.RLock()
+	defer app.sub_mutex.RUnlock()
+	app.GetRoomChannel(room_id).UnsubscribeRoom(appid, room_id)
+}
+
+// route server需要先升级到支持聊天室成员的版本
+func (app *App) EnableRoomMembers() {
+	app.room_members = true
+}
+
+func (app *App) SubscribeRoomMember(appid int64, room_id int64, uid int64) {
+	if !app.room_members {
+		return
+	}
+	app.sub_mutex.RLock()
+	defer app.sub_mutex.RUnlock()
+	app.GetRoomChannel(room_id).SubscribeRoomMember(appid, room_id, uid)
+}
+
+func (app *App) UnsubscribeRoomMember(appid int64, room_id int64, uid int64) {
+	if !app.room_members {
+		return
+	}
+	app.sub_mutex.RLock()
+	defer app.sub_mutex.RUnlock()
+	app.GetRoomChannel(room_id).UnsubscribeRoomMember(appid, room_id, uid)
+}
+
+// 用户所属的route server只给订阅了在线状态的im发送状态变化
+func (app *App) WatchPresence(appid int64, uid int64) {
+	app.sub_mutex.RLock()
+	defer app.sub_mutex.RUnlock()
+	app.GetChannel(uid).WatchPresence(appid, uid)
+}
+
+func (app *App) UnwatchPresence(appid int64, uid int64) {
+	app.sub_mutex.RLock()
+	defer app.sub_mutex.RUnlock()
+	app.GetChannel(uid).UnwatchPresence(appid, uid)
+}
+
+// 返回聊天室的成员总数和按照uid排序的成员
+func (app *App) QueryRoomMembers(appid int64, room_id int64, offset int, limit int) (int, []int64, error) {
+	if !app.room_members {
+		return 0, nil, errors.New("room members disabled")
+	}
+	channel := app.GetRoomChannel(room_id)
+	return channel.QueryRoomMembers(appid, room_id, offset, limit)
+}
+
+// route server需要先升级到支持聊天室消息缓存的版本
+func (app *App) EnableRoomBacklog() {
+	app.room_backlog = true
+}
+
+func (app *App) QueryRoomBacklog(appid int64, room_id int64) ([]*Message, error) {
+	if !app.room_backlog {
+		return nil, nil
+	}
+	channel := app.GetRoomChannel(room_id)
+	return channel.QueryRoomBacklog(appid, room_id)
 }
 
 func (app *App) GetGroupLoader(group_id int64) *GroupLoader {
@@ -97,6 +257,10 @@ func (app *App) GetGroupLoader(group_id int64) *GroupLoader {
 	return app.group_loaders[index]
 }
 
+func (app *App) GroupMessageDelivers() []*GroupMessageDeliver {
+	return app.group_message_delivers
+}
+
 func (app *App) GetGroupMessageDeliver(group_id int64) *GroupMessageDeliver {
 	deliver_index := atomic.AddUint64(&app.current_deliver_index, 1)
 	index := deliver_index % uint64(len(app.group_message_delivers))
@@ -124,6 +288,7 @@ func (app *App) PushGroupMessage(appid int64, group *Group, m *Message) {
 		}
 	}
 
+	//免打扰的会话由route server过滤
 	for channel, receivers := range channels {
 		channel.Push(appid, receivers, m)
 	}
@@ -184,17 +349,36 @@ func (app *App) SendRoomMessage(appid int64, room_id int64, msg *Message, sender
 	app.app_route.sendRoomMessage(appid, sender_id, device_ID, room_id, msg)
 }
 
+// 获取channel之后节点被移除时, 重新选择route server发送一次
 func (app *App) PublishMessage(appid int64, uid int64, msg *Message) {
 	channel := app.GetChannel(uid)
-	channel.PublishMessage(appid, uid, msg)
+	if channel.PublishMessage(appid, uid, msg) {
+		return
+	}
+	if c := app.GetChannel(uid); c != channel && c.PublishMessage(appid, uid, msg) {
+		return
+	}
+	log.Warningf("route channel:%s closed, drop message:%s appid:%d uid:%d", channel.Address(), Command(msg.Cmd), appid, uid)
 }
 
 func (app *App) PublishGroupMessage(appid int64, group_id int64, msg *Message) {
 	channel := app.GetGroupChannel(group_id)
-	channel.PublishGroupMessage(appid, group_id, msg)
+	if channel.PublishGroupMessage(appid, group_id, msg) {
+		return
+	}
+	if c := app.GetGroupChannel(group_id); c != channel && c.PublishGroupMessage(appid, group_id, msg) {
+		return
+	}
+	log.Warningf("route channel:%s closed, drop message:%s appid:%d group:%d", channel.Address(), Command(msg.Cmd), appid, group_id)
 }
 
 func (app *App) PublishRoomMessage(appid int64, room_id int64, m *Message) {
 	channel := app.GetRoomChannel(room_id)
-	channel.PublishRoomMessage(appid, room_id, m)
+	if channel.PublishRoomMessage(appid, room_id, m) {
+		return
+	}
+	if c := app.GetRoomChannel(room_id); c != channel && c.PublishRoomMessage(appid, room_id, m) {
+		return
+	}
+	log.Warningf("route channel:%s closed, drop message:%s appid:%d room:%d", channel.Address(), Command(m.Cmd), appid, room_id)
 }
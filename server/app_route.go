@@ -37,16 +37,22 @@ type Sender struct {
 	deviceID int64
 }
 type AppRoute struct {
-	mutex sync.Mutex
-	apps  map[int64]*Route
+	mutex        sync.Mutex
+	apps         map[int64]*Route
+	room_limiter *RoomLimiter
 }
 
 func NewAppRoute() *AppRoute {
 	app_route := new(AppRoute)
 	app_route.apps = make(map[int64]*Route)
+	app_route.room_limiter = NewRoomLimiter()
 	return app_route
 }
 
+func (app_route *AppRoute) RoomLimiter() *RoomLimiter {
+	return app_route.room_limiter
+}
+
 func (app_route *AppRoute) FindOrAddRoute(appid int64) *Route {
 	app_route.mutex.Lock()
 	defer app_route.mutex.Unlock()
@@ -148,12 +154,22 @@ func (app_route *AppRoute) sendRoomMessage(appid int64, sender int64, device_ID
 	if len(clients) == 0 {
 		return false
 	}
+	//热门聊天室超过频率限制后采样发送
+	if !app_route.room_limiter.Allow(appid, room_id) {
+		return true
+	}
 	for c := range clients {
 		//不再发送给自己
 		if c.device_ID == device_ID && sender == c.uid {
 			continue
 		}
-		c.EnqueueNonBlockMessage(msg)
+		//version3(CHANGED_NOTIFICATION_VERSION)及以上的客户端才能解析成员进出聊天室的通知
+		if msg.Cmd == protocol.MSG_ROOM_MEMBER_CHANGED && c.version < protocol.CHANGED_NOTIFICATION_VERSION {
+			continue
+		}
+		if dropped_room, dropped := c.EnqueueRoomMessage(room_id, msg); dropped {
+			app_route.room_limiter.AddDrop(appid, dropped_room, 1)
+		}
 	}
 	return true
 }
@@ -51,6 +51,7 @@ func NewClient(conn Conn, server_summary *ServerSummary, observer ClientObserver
 
 	client.lwt = make(chan int, 1) //only need 1
 	client.messages = list.New()
+	client.room_messages = list.New()
 	client.server_summary = server_summary
 	client.observer = observer
 
@@ -101,16 +102,23 @@ func (client *Client) Read() {
 
 // 发送等待队列中的消息
 func (client *Client) SendMessages() {
-	var messages *list.List
+	var messages, room_messages *list.List
 	client.mutex.Lock()
-	if client.messages.Len() == 0 {
+	if client.messages.Len() == 0 && client.room_messages.Len() == 0 {
 		client.mutex.Unlock()
 		return
 	}
 	messages = client.messages
 	client.messages = list.New()
+	room_messages = client.room_messages
+	client.room_messages = list.New()
 	client.mutex.Unlock()
 
+	//聊天室消息最后发送
+	for e := room_messages.Front(); e != nil; e = e.Next() {
+		messages.PushBack(e.Value.(*roomMessage).msg)
+	}
+
 	e := messages.Front()
 	for e != nil {
 		msg := e.Value.(*Message)
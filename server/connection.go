@@ -44,6 +44,10 @@ const MESSAGE_QUEUE_LIMIT = 300
 // socket阻塞状态下消息的数量限制,此时socket可能已经被对端异常关闭
 const MESSAGE_QUEUE_BLOCK_LIMIT = 30
 
+// 聊天室消息的优先级低于其它消息, 使用单独的队列, 队列满时只丢弃聊天室消息
+const ROOM_MESSAGE_QUEUE_LIMIT = 100
+const ROOM_MESSAGE_QUEUE_BLOCK_LIMIT = 10
+
 type Conn interface {
 	Close() error
 
@@ -121,7 +125,9 @@ type Connection struct {
 
 	sync_count int64 //点对点消息同步计数，用于判断是否是首次同步
 	tc         int32 //write channel timeout count
-	blocking   int32 //write blocking
+
+	rate_limited int32 //连续被限制发送的次数
+	blocking     int32 //write blocking
 
 	wt  chan *Message
 	lwt chan int
@@ -138,14 +144,34 @@ type Connection struct {
 	device_id   string
 	device_ID   int64 //generated by device_id + platform_id
 	platform_id int8
-	room_id     int64
+	room_ids    []int64 //进入的聊天室, 旧版本的客户端最多一个
+	room_mutex  sync.Mutex
+
+	presence_uids []int64 //订阅在线状态的用户
 
-	messages *list.List //待发送的消息队列 FIFO
-	mutex    sync.Mutex
+	messages      *list.List //待发送的消息队列 FIFO
+	room_messages *list.List //待发送的聊天室消息队列, 在messages之后发送
+	mutex         sync.Mutex
 
 	server_summary *ServerSummary
 }
 
+func (client *Connection) IsInRoom(room_id int64) bool {
+	client.room_mutex.Lock()
+	defer client.room_mutex.Unlock()
+	return client.isInRoom(room_id)
+}
+
+// 调用者持有room_mutex
+func (client *Connection) isInRoom(room_id int64) bool {
+	for _, id := range client.room_ids {
+		if id == room_id {
+			return true
+		}
+	}
+	return false
+}
+
 func (client *Connection) Client() *Client {
 	p := unsafe.Pointer(client)
 	return (*Client)(p)
@@ -229,6 +255,51 @@ func (client *Connection) EnqueueNonBlockMessage(msg *Message) bool {
 	return client.EnqueueNonBlockContinueMessage(msg, nil)
 }
 
+type roomMessage struct {
+	room_id int64
+	msg     *Message
+}
+
+// 返回被丢弃的聊天室消息所属的聊天室
+func (client *Connection) EnqueueRoomMessage(room_id int64, msg *Message) (int64, bool) {
+	closed := atomic.LoadInt32(&client.closed)
+	if closed > 0 {
+		return 0, false
+	}
+
+	tc := atomic.LoadInt32(&client.tc)
+	if tc > 0 {
+		atomic.AddInt32(&client.tc, 1)
+		return room_id, true
+	}
+
+	blocking := atomic.LoadInt32(&client.blocking)
+	queue_limit := ROOM_MESSAGE_QUEUE_LIMIT
+	if blocking != 0 {
+		queue_limit = ROOM_MESSAGE_QUEUE_BLOCK_LIMIT
+	}
+
+	var dropped_room int64
+	dropped := false
+	client.mutex.Lock()
+	if client.room_messages.Len() >= queue_limit {
+		//队列阻塞，丢弃之前的聊天室消息
+		e := client.room_messages.Front()
+		dropped_room = e.Value.(*roomMessage).room_id
+		dropped = true
+		client.room_messages.Remove(e)
+	}
+	client.room_messages.PushBack(&roomMessage{room_id, msg})
+	client.mutex.Unlock()
+
+	//nonblock
+	select {
+	case client.lwt <- 1:
+	default:
+	}
+	return dropped_room, dropped
+}
+
 func (client *Connection) EnqueueMessage(msg *Message) bool {
 	closed := atomic.LoadInt32(&client.closed)
 	if closed > 0 {
@@ -293,6 +364,13 @@ func (client *Connection) send(m *Message) {
 			Body:    m.Body,
 		}
 	}
+	if im, ok := msg.Body.(*IMMessage); ok && msg.Cmd == MSG_GROUP_IM && im.IsMentioned(client.uid) {
+		//消息被多个连接共享,不能直接修改
+		if msg == m {
+			msg = &Message{Cmd: m.Cmd, Seq: m.Seq, Version: m.Version, Flag: m.Flag, Body: m.Body}
+		}
+		msg.Flag |= MESSAGE_FLAG_MENTION
+	}
 	msg.Seq = client.sequence
 
 	complete_c := make(chan int, 1)
@@ -0,0 +1,424 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bitly/go-simplejson"
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/GoBelieveIO/im_service/lru"
+	. "github.com/GoBelieveIO/im_service/protocol"
+)
+
+// 会话类型
+const CONVERSATION_PEER = "peer"
+const CONVERSATION_GROUP = "group"
+const CONVERSATION_CUSTOMER = "customer"
+
+// 缓存的有效时间, 其它进程修改之后最多延迟这么久生效
+const CONVERSATION_MUTE_CACHE_EXPIRE = 60 * time.Second
+const CONVERSATION_MUTE_CACHE_SIZE = 100000
+
+// 会话免打扰, 只影响离线推送, 消息依然保存和同步
+// begin,end: 每天的免打扰时段(分钟, 服务器本地时间), 相等时全天免打扰
+// until: 免打扰的截止时间(秒), 0表示一直有效
+type ConversationMute struct {
+	Until int64 `json:"until"`
+	Begin int   `json:"begin"`
+	End   int   `json:"end"`
+}
+
+func (mute *ConversationMute) IsMuted(now time.Time) bool {
+	if mute.Until > 0 && now.Unix() >= mute.Until {
+		return false
+	}
+	if mute.Begin == mute.End {
+		return true
+	}
+	minute := now.Hour()*60 + now.Minute()
+	if mute.Begin < mute.End {
+		return minute >= mute.Begin && minute < mute.End
+	}
+	//跨越零点
+	return minute >= mute.Begin || minute < mute.End
+}
+
+type muteKey struct {
+	appid int64
+	uid   int64
+	field string
+}
+
+// nil表示没有设置免打扰
+type cachedMute struct {
+	mute   *ConversationMute
+	expire time.Time
+}
+
+// 用户的会话免打扰设置, 保存在redis的hash中
+// key: conversation_mutes_{appid}_{uid} field: {type}_{id}, 客服会话为customer_{appid}_{id}
+type ConversationMutes struct {
+	redis_pool *redis.Pool
+
+	mutex sync.Mutex
+	cache *lru.Cache //muteKey:*cachedMute
+}
+
+func NewConversationMutes(redis_pool *redis.Pool) *ConversationMutes {
+	m := &ConversationMutes{redis_pool: redis_pool}
+	m.cache = lru.New(CONVERSATION_MUTE_CACHE_SIZE)
+	return m
+}
+
+func conversationMuteKey(appid int64, uid int64) string {
+	return fmt.Sprintf("conversation_mutes_%d_%d", appid, uid)
+}
+
+func conversationField(conv_type string, id int64) string {
+	return fmt.Sprintf("%s_%d", conv_type, id)
+}
+
+// 客服的两端可以属于不同的app
+func customerConversationField(appid int64, id int64) string {
+	return fmt.Sprintf("%s_%d_%d", CONVERSATION_CUSTOMER, appid, id)
+}
+
+func isConversationType(conv_type string) bool {
+	return conv_type == CONVERSATION_PEER || conv_type == CONVERSATION_GROUP || conv_type == CONVERSATION_CUSTOMER
+}
+
+func (m *ConversationMutes) load(appid int64, uid int64) (map[string]*ConversationMute, error) {
+	conn := m.redis_pool.Get()
+	defer conn.Close()
+
+	values, err := redis.StringMap(conn.Do("HGETALL", conversationMuteKey(appid, uid)))
+	if err != nil {
+		return nil, err
+	}
+
+	mutes := make(map[string]*ConversationMute)
+	for field, v := range values {
+		mute := &ConversationMute{}
+		err := json.Unmarshal([]byte(v), mute)
+		if err != nil {
+			log.Warningf("invalid conversation mute:%s %s", field, v)
+			continue
+		}
+		mutes[field] = mute
+	}
+	return mutes, nil
+}
+
+// 批量读取用户对同一个会话的免打扰设置, 缓存中没有的用户在一个pipeline中读取
+func (m *ConversationMutes) getMutes(appid int64, uids []int64, field string) (map[int64]*ConversationMute, error) {
+	now := time.Now()
+	mutes := make(map[int64]*ConversationMute)
+	missing := make([]int64, 0, len(uids))
+
+	m.mutex.Lock()
+	for _, uid := range uids {
+		if v, ok := m.cache.Get(muteKey{appid, uid, field}); ok {
+			c := v.(*cachedMute)
+			if now.Before(c.expire) {
+				if c.mute != nil {
+					mutes[uid] = c.mute
+				}
+				continue
+			}
+		}
+		missing = append(missing, uid)
+	}
+	m.mutex.Unlock()
+
+	if len(missing) == 0 {
+		return mutes, nil
+	}
+
+	conn := m.redis_pool.Get()
+	defer conn.Close()
+
+	for _, uid := range missing {
+		conn.Send("HMGET", conversationMuteKey(appid, uid), field)
+	}
+	err := conn.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	loaded := make([]*ConversationMute, len(missing))
+	for i := range missing {
+		values, err := redis.Values(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 0 {
+			continue
+		}
+		b, ok := values[0].([]byte)
+		if !ok {
+			continue
+		}
+		mute := &ConversationMute{}
+		err = json.Unmarshal(b, mute)
+		if err != nil {
+			log.Warningf("invalid conversation mute:%s %s", field, b)
+			continue
+		}
+		loaded[i] = mute
+	}
+
+	expire := now.Add(CONVERSATION_MUTE_CACHE_EXPIRE)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i, uid := range missing {
+		m.cache.Add(muteKey{appid, uid, field}, &cachedMute{mute: loaded[i], expire: expire})
+		if loaded[i] != nil {
+			mutes[uid] = loaded[i]
+		}
+	}
+	return mutes, nil
+}
+
+// 过滤掉免打扰的接收者, 群消息中被@的成员依然推送
+// 只在route server推送之前调用, 读取失败时不影响推送
+func (m *ConversationMutes) FilterReceivers(appid int64, receivers []int64, msg *Message) []int64 {
+	field, ok := pushConversation(msg)
+	if !ok {
+		return receivers
+	}
+	var im *IMMessage
+	if msg.Cmd == MSG_GROUP_IM {
+		im = msg.Body.(*IMMessage)
+	}
+
+	mutes, err := m.getMutes(appid, receivers, field)
+	if err != nil {
+		log.Warning("get conversation mutes err:", err)
+		return receivers
+	}
+	if len(mutes) == 0 {
+		return receivers
+	}
+
+	now := time.Now()
+	r := make([]int64, 0, len(receivers))
+	for _, uid := range receivers {
+		if im != nil && im.IsMentioned(uid) {
+			r = append(r, uid)
+			continue
+		}
+		if mute, ok := mutes[uid]; ok && mute.IsMuted(now) {
+			log.Infof("conversation muted appid:%d uid:%d %s", appid, uid, field)
+			continue
+		}
+		r = append(r, uid)
+	}
+	return r
+}
+
+func (m *ConversationMutes) SetMute(appid int64, uid int64, field string, mute *ConversationMute) error {
+	b, err := json.Marshal(mute)
+	if err != nil {
+		return err
+	}
+
+	conn := m.redis_pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("HSET", conversationMuteKey(appid, uid), field, b)
+	if err != nil {
+		return err
+	}
+	m.invalidate(appid, uid, field)
+	return nil
+}
+
+func (m *ConversationMutes) RemoveMute(appid int64, uid int64, field string) error {
+	conn := m.redis_pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("HDEL", conversationMuteKey(appid, uid), field)
+	if err != nil {
+		return err
+	}
+	m.invalidate(appid, uid, field)
+	return nil
+}
+
+// 只清除本进程的缓存, 其它进程在缓存过期之后生效
+func (m *ConversationMutes) invalidate(appid int64, uid int64, field string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.cache.Remove(muteKey{appid, uid, field})
+}
+
+// 推送消息所属的会话, 点对点消息的会话id是对方的uid
+func pushConversation(msg *Message) (string, bool) {
+	switch msg.Cmd {
+	case MSG_IM:
+		return conversationField(CONVERSATION_PEER, msg.Body.(*IMMessage).sender), true
+	case MSG_GROUP_IM:
+		return conversationField(CONVERSATION_GROUP, msg.Body.(*IMMessage).receiver), true
+	case MSG_CUSTOMER_V2:
+		cm := msg.Body.(*CustomerMessageV2)
+		return customerConversationField(cm.sender_appid, cm.sender), true
+	default:
+		return "", false
+	}
+}
+
+// 返回appid, uid和会话在hash中的field
+// 客服会话的对方可以属于其它app, 由id_appid指定, 默认和appid相同
+func readConversationParams(obj *simplejson.Json) (int64, int64, string, error) {
+	appid, err := obj.Get("appid").Int64()
+	if err != nil {
+		return 0, 0, "", err
+	}
+	uid, err := obj.Get("uid").Int64()
+	if err != nil {
+		return 0, 0, "", err
+	}
+	conv_type, err := obj.Get("type").String()
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if !isConversationType(conv_type) {
+		return 0, 0, "", fmt.Errorf("invalid conversation type:%s", conv_type)
+	}
+	id, err := obj.Get("id").Int64()
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if conv_type == CONVERSATION_CUSTOMER {
+		id_appid := obj.Get("id_appid").MustInt64(appid)
+		return appid, uid, customerConversationField(id_appid, id), nil
+	}
+	return appid, uid, conversationField(conv_type, id), nil
+}
+
+// body: {"appid":, "uid":, "type":"peer|group|customer", "id":, "id_appid":, "until":, "begin":, "end":}
+func SetConversationMute(w http.ResponseWriter, req *http.Request, mutes *ConversationMutes) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		WriteHttpError(400, err.Error(), w)
+		return
+	}
+
+	obj, err := simplejson.NewJson(body)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+
+	appid, uid, field, err := readConversationParams(obj)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+
+	mute := &ConversationMute{}
+	mute.Until = obj.Get("until").MustInt64(0)
+	mute.Begin = obj.Get("begin").MustInt(0)
+	mute.End = obj.Get("end").MustInt(0)
+	if mute.Begin < 0 || mute.Begin >= 24*60 || mute.End < 0 || mute.End >= 24*60 {
+		WriteHttpError(400, "invalid time window", w)
+		return
+	}
+
+	err = mutes.SetMute(appid, uid, field, mute)
+	if err != nil {
+		log.Warning("set conversation mute err:", err)
+		WriteHttpError(500, "server internal error", w)
+		return
+	}
+	log.Infof("set conversation mute appid:%d uid:%d %s %+v", appid, uid, field, mute)
+	w.WriteHeader(200)
+}
+
+// body: {"appid":, "uid":, "type":"peer|group|customer", "id":, "id_appid":}
+func RemoveConversationMute(w http.ResponseWriter, req *http.Request, mutes *ConversationMutes) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		WriteHttpError(400, err.Error(), w)
+		return
+	}
+
+	obj, err := simplejson.NewJson(body)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+
+	appid, uid, field, err := readConversationParams(obj)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+
+	err = mutes.RemoveMute(appid, uid, field)
+	if err != nil {
+		log.Warning("remove conversation mute err:", err)
+		WriteHttpError(500, "server internal error", w)
+		return
+	}
+	log.Infof("remove conversation mute appid:%d uid:%d %s", appid, uid, field)
+	w.WriteHeader(200)
+}
+
+func GetConversationMutes(w http.ResponseWriter, req *http.Request, mutes *ConversationMutes) {
+	m, _ := url.ParseQuery(req.URL.RawQuery)
+
+	appid, err := strconv.ParseInt(m.Get("appid"), 10, 64)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid query param", w)
+		return
+	}
+
+	uid, err := strconv.ParseInt(m.Get("uid"), 10, 64)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid query param", w)
+		return
+	}
+
+	r, err := mutes.load(appid, uid)
+	if err != nil {
+		log.Warning("load conversation mutes err:", err)
+		WriteHttpError(500, "server internal error", w)
+		return
+	}
+
+	obj := make(map[string]interface{})
+	obj["mutes"] = r
+	WriteHttpObj(obj, w)
+}
@@ -0,0 +1,74 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/GoBelieveIO/im_service/protocol"
+)
+
+func TestConversationMuteWindow(t *testing.T) {
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local)
+
+	mute := &ConversationMute{Begin: 22 * 60, End: 8 * 60}
+	if !mute.IsMuted(day.Add(23 * time.Hour)) {
+		t.Error("23:00 should be muted")
+	}
+	if !mute.IsMuted(day.Add(7 * time.Hour)) {
+		t.Error("07:00 should be muted")
+	}
+	if mute.IsMuted(day.Add(12 * time.Hour)) {
+		t.Error("12:00 should not be muted")
+	}
+
+	mute = &ConversationMute{Until: day.Unix()}
+	if mute.IsMuted(day) {
+		t.Error("mute expired")
+	}
+	if !mute.IsMuted(day.Add(-time.Second)) {
+		t.Error("mute should be valid before until")
+	}
+}
+
+func TestPushConversation(t *testing.T) {
+	im := &IMMessage{sender: 1, receiver: 2}
+	field, ok := pushConversation(&Message{Cmd: MSG_IM, Body: im})
+	if !ok || field != "peer_1" {
+		t.Errorf("peer field:%s", field)
+	}
+
+	field, ok = pushConversation(&Message{Cmd: MSG_GROUP_IM, Body: im})
+	if !ok || field != "group_2" {
+		t.Errorf("group field:%s", field)
+	}
+
+	cm := &CustomerMessageV2{IMMessage: IMMessage{sender: 1, receiver: 2}, sender_appid: 7, receiver_appid: 8}
+	field, ok = pushConversation(&Message{Cmd: MSG_CUSTOMER_V2, Body: cm})
+	if !ok || field != "customer_7_1" {
+		t.Errorf("customer field:%s", field)
+	}
+
+	_, ok = pushConversation(&Message{Cmd: MSG_SYSTEM, Body: &SystemMessage{}})
+	if ok {
+		t.Error("system message has no conversation")
+	}
+}
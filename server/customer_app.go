@@ -0,0 +1,58 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+// 允许发送客服消息(MSG_CUSTOMER_V2)的app, bidirectional时两个方向都允许
+type CustomerAppConfig struct {
+	SenderAppID   int64 `toml:"sender_appid"`
+	ReceiverAppID int64 `toml:"receiver_appid"`
+	Bidirectional bool  `toml:"bidirectional"`
+}
+
+type customerAppPair struct {
+	sender_appid   int64
+	receiver_appid int64
+}
+
+// 跨app消息的白名单
+type CustomerApps struct {
+	kefu_appid int64 //兼容旧的配置, 包含kefu_appid的消息都允许
+	pairs      map[customerAppPair]bool
+}
+
+func NewCustomerApps(kefu_appid int64, configs []*CustomerAppConfig) *CustomerApps {
+	apps := &CustomerApps{}
+	apps.kefu_appid = kefu_appid
+	apps.pairs = make(map[customerAppPair]bool)
+	for _, config := range configs {
+		apps.pairs[customerAppPair{config.SenderAppID, config.ReceiverAppID}] = true
+		if config.Bidirectional {
+			apps.pairs[customerAppPair{config.ReceiverAppID, config.SenderAppID}] = true
+		}
+	}
+	return apps
+}
+
+func (apps *CustomerApps) IsAllowed(sender_appid int64, receiver_appid int64) bool {
+	if apps.kefu_appid != 0 && (sender_appid == apps.kefu_appid || receiver_appid == apps.kefu_appid) {
+		return true
+	}
+	return apps.pairs[customerAppPair{sender_appid, receiver_appid}]
+}
@@ -0,0 +1,57 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"testing"
+)
+
+func TestCustomerAppsIsAllowed(t *testing.T) {
+	configs := []*CustomerAppConfig{
+		{SenderAppID: 1, ReceiverAppID: 2},
+		{SenderAppID: 3, ReceiverAppID: 4, Bidirectional: true},
+	}
+	apps := NewCustomerApps(100, configs)
+
+	cases := []struct {
+		sender_appid   int64
+		receiver_appid int64
+		allowed        bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{3, 4, true},
+		{4, 3, true},
+		{1, 3, false},
+		{100, 5, true},
+		{5, 100, true},
+	}
+	for _, c := range cases {
+		if apps.IsAllowed(c.sender_appid, c.receiver_appid) != c.allowed {
+			t.Errorf("sender appid:%d receiver appid:%d allowed:%t", c.sender_appid, c.receiver_appid, !c.allowed)
+		}
+	}
+
+	//没有配置kefu_appid时只使用白名单
+	apps = NewCustomerApps(0, nil)
+	if apps.IsAllowed(0, 0) || apps.IsAllowed(1, 2) {
+		t.Error("empty allow list")
+	}
+}
@@ -41,8 +41,8 @@ func (server *Server) HandleCustomerMessageV2(client *Client, message *Message)
 		return
 	}
 
-	//限制在客服app和普通app之间
-	if msg.sender_appid != server.kefu_appid && msg.receiver_appid != server.kefu_appid {
+	//限制在配置的app之间
+	if !server.customer_apps.IsAllowed(msg.sender_appid, msg.receiver_appid) {
 		log.Warningf("invalid appid, customer message sender:%d %d receiver:%d %d",
 			msg.sender_appid, msg.sender, msg.receiver_appid, msg.receiver)
 		return
@@ -51,35 +51,56 @@ func (server *Server) HandleCustomerMessageV2(client *Client, message *Message)
 	log.Infof("customer message v2 sender:%d %d receiver:%d %d",
 		msg.sender_appid, msg.sender, msg.receiver_appid, msg.receiver)
 
+	if !server.filterContent(client, seq, MSG_CUSTOMER_V2, msg.receiver, &msg.content) {
+		return
+	}
 	msg.timestamp = int32(time.Now().Unix())
 
-	m := &Message{Cmd: MSG_CUSTOMER_V2, Version: DEFAULT_VERSION, Body: msg}
+	//顾客发给商店的消息, 转发给分配的客服
+	//只修改客服收到的消息, 顾客自己的消息仍然发给商店
+	receiver_msg := msg
+	if server.customer_service != nil && server.customer_service.IsStoreMessage(msg) {
+		agent, err := server.customer_service.RouteMessage(msg)
+		if err != nil {
+			log.Warning("route customer message err:", err)
+			return
+		}
+		if agent == 0 {
+			server.sendWaitingCustomerMessage(client, message)
+			return
+		}
+		agent_msg := *msg
+		agent_msg.receiver = agent
+		receiver_msg = &agent_msg
+	}
 
-	msgid, prev_msgid, err := server.rpc_storage.SaveMessage(msg.receiver_appid, msg.receiver, client.device_ID, m)
+	m := &Message{Cmd: MSG_CUSTOMER_V2, Version: DEFAULT_VERSION, Body: receiver_msg}
+	msgid, prev_msgid, err := server.rpc_storage.SaveMessage(receiver_msg.receiver_appid, receiver_msg.receiver, client.device_ID, m)
 	if err != nil {
 		log.Warning("save customer message err:", err)
 		return
 	}
 
-	msgid2, prev_msgid2, err := server.rpc_storage.SaveMessage(msg.sender_appid, msg.sender, client.device_ID, m)
+	m2 := &Message{Cmd: MSG_CUSTOMER_V2, Version: DEFAULT_VERSION, Body: msg}
+	msgid2, prev_msgid2, err := server.rpc_storage.SaveMessage(msg.sender_appid, msg.sender, client.device_ID, m2)
 	if err != nil {
 		log.Warning("save customer message err:", err)
 		return
 	}
 
-	server.app.PushMessage(msg.receiver_appid, msg.receiver, m)
+	server.app.PushMessage(receiver_msg.receiver_appid, receiver_msg.receiver, m)
 
 	meta := &Metadata{sync_key: msgid, prev_sync_key: prev_msgid}
-	m1 := &Message{Cmd: MSG_CUSTOMER_V2, Version: DEFAULT_VERSION, Flag: message.Flag | MESSAGE_FLAG_PUSH, Body: msg, Meta: meta}
-	server.SendAppMessage(client, msg.receiver_appid, msg.receiver, m1)
+	m1 := &Message{Cmd: MSG_CUSTOMER_V2, Version: DEFAULT_VERSION, Flag: message.Flag | MESSAGE_FLAG_PUSH, Body: receiver_msg, Meta: meta}
+	server.SendAppMessage(client, receiver_msg.receiver_appid, receiver_msg.receiver, m1)
 
 	notify := &Message{Cmd: MSG_SYNC_NOTIFY, Body: &SyncKey{msgid}}
-	server.SendAppMessage(client, msg.receiver_appid, msg.receiver, notify)
+	server.SendAppMessage(client, receiver_msg.receiver_appid, receiver_msg.receiver, notify)
 
 	//发送给自己的其它登录点
 	meta = &Metadata{sync_key: msgid2, prev_sync_key: prev_msgid2}
-	m2 := &Message{Cmd: MSG_CUSTOMER_V2, Version: DEFAULT_VERSION, Flag: message.Flag | MESSAGE_FLAG_PUSH, Body: msg, Meta: meta}
-	server.SendMessage(client, client.uid, m2)
+	m3 := &Message{Cmd: MSG_CUSTOMER_V2, Version: DEFAULT_VERSION, Flag: message.Flag | MESSAGE_FLAG_PUSH, Body: msg, Meta: meta}
+	server.SendMessage(client, client.uid, m3)
 
 	notify = &Message{Cmd: MSG_SYNC_NOTIFY, Body: &SyncKey{msgid2}}
 	server.SendMessage(client, client.uid, notify)
@@ -88,3 +109,25 @@ func (server *Server) HandleCustomerMessageV2(client *Client, message *Message)
 	ack := &Message{Cmd: MSG_ACK, Body: &MessageACK{seq: int32(seq)}, Meta: meta}
 	client.EnqueueMessage(ack)
 }
+
+// 排队中的消息只保存在顾客的消息队列中, 分配客服之后再转发
+func (server *Server) sendWaitingCustomerMessage(client *Client, message *Message) {
+	msg := message.Body.(*CustomerMessageV2)
+	m := &Message{Cmd: MSG_CUSTOMER_V2, Version: DEFAULT_VERSION, Body: msg}
+	msgid, prev_msgid, err := server.rpc_storage.SaveMessage(msg.sender_appid, msg.sender, client.device_ID, m)
+	if err != nil {
+		log.Warning("save customer message err:", err)
+		return
+	}
+
+	meta := &Metadata{sync_key: msgid, prev_sync_key: prev_msgid}
+	m1 := &Message{Cmd: MSG_CUSTOMER_V2, Version: DEFAULT_VERSION, Flag: message.Flag | MESSAGE_FLAG_PUSH, Body: msg, Meta: meta}
+	server.SendMessage(client, client.uid, m1)
+
+	notify := &Message{Cmd: MSG_SYNC_NOTIFY, Body: &SyncKey{msgid}}
+	server.SendMessage(client, client.uid, notify)
+
+	meta = &Metadata{sync_key: msgid, prev_sync_key: prev_msgid}
+	ack := &Message{Cmd: MSG_ACK, Body: &MessageACK{seq: int32(message.Seq)}, Meta: meta}
+	client.EnqueueMessage(ack)
+}
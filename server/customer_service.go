@@ -0,0 +1,915 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bitly/go-simplejson"
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/GoBelieveIO/im_service/protocol"
+)
+
+const CUSTOMER_STRATEGY_ROUND_ROBIN = "round_robin"
+const CUSTOMER_STRATEGY_LEAST_BUSY = "least_busy"
+
+// 客服同时接待的默认会话数量
+const CUSTOMER_DEFAULT_MAX_SESSIONS = 10
+
+// 排队期间每个顾客最多保存的消息数量
+const CUSTOMER_WAITING_MESSAGE_LIMIT = 100
+
+// 检查排队队列的间隔(秒), 客服上线时没有事件通知
+const CUSTOMER_QUEUE_INTERVAL = 5
+
+// 会话事件, 以系统消息的方式发送给顾客和客服
+const CUSTOMER_SESSION_QUEUE = "queue"
+const CUSTOMER_SESSION_OPEN = "open"
+const CUSTOMER_SESSION_TRANSFER = "transfer"
+const CUSTOMER_SESSION_CLOSE = "close"
+
+var errCustomerAgentNotFound = errors.New("agent not found")
+var errCustomerSessionNotFound = errors.New("session not found")
+
+type customerAgent struct {
+	uid          int64
+	online       bool
+	available    bool
+	sessions     int
+	max_sessions int
+}
+
+func (agent *customerAgent) idle() bool {
+	return agent.online && agent.available && agent.sessions < agent.max_sessions
+}
+
+// 客服的分配和排队, 状态保存在redis中, 所有im共享
+// 顾客发给客服app的消息, receiver为商店id, 由im转发给分配的客服
+type CustomerService struct {
+	kefu_appid   int64
+	strategy     string
+	max_sessions int
+
+	redis_pool  *redis.Pool
+	app         *App
+	rpc_storage *RPCStorage
+}
+
+func NewCustomerService(kefu_appid int64, strategy string, max_sessions int, redis_pool *redis.Pool, app *App, rpc_storage *RPCStorage) *CustomerService {
+	if strategy != CUSTOMER_STRATEGY_LEAST_BUSY {
+		strategy = CUSTOMER_STRATEGY_ROUND_ROBIN
+	}
+	if max_sessions <= 0 {
+		max_sessions = CUSTOMER_DEFAULT_MAX_SESSIONS
+	}
+	cs := &CustomerService{}
+	cs.kefu_appid = kefu_appid
+	cs.strategy = strategy
+	cs.max_sessions = max_sessions
+	cs.redis_pool = redis_pool
+	cs.app = app
+	cs.rpc_storage = rpc_storage
+	return cs
+}
+
+func (cs *CustomerService) storeKey(store_id int64) string {
+	return fmt.Sprintf("customer_stores_%d_%d", cs.kefu_appid, store_id)
+}
+
+func (cs *CustomerService) storeAgentsKey(store_id int64) string {
+	return fmt.Sprintf("customer_store_agents_%d_%d", cs.kefu_appid, store_id)
+}
+
+func (cs *CustomerService) storeSessionsKey(store_id int64) string {
+	return fmt.Sprintf("customer_store_sessions_%d_%d", cs.kefu_appid, store_id)
+}
+
+// 有序集合, score为开始排队的时间
+func (cs *CustomerService) queueKey(store_id int64) string {
+	return fmt.Sprintf("customer_queue_%d_%d", cs.kefu_appid, store_id)
+}
+
+func (cs *CustomerService) queuedStoresKey() string {
+	return fmt.Sprintf("customer_queued_stores_%d", cs.kefu_appid)
+}
+
+func (cs *CustomerService) agentKey(agent int64) string {
+	return fmt.Sprintf("customer_agents_%d_%d", cs.kefu_appid, agent)
+}
+
+func (cs *CustomerService) agentSessionsKey(agent int64) string {
+	return fmt.Sprintf("customer_agent_sessions_%d_%d", cs.kefu_appid, agent)
+}
+
+func (cs *CustomerService) sessionKey(store_id int64, appid int64, uid int64) string {
+	return fmt.Sprintf("customer_sessions_%d_%d_%d_%d", cs.kefu_appid, store_id, appid, uid)
+}
+
+func (cs *CustomerService) waitingKey(store_id int64, appid int64, uid int64) string {
+	return fmt.Sprintf("customer_waiting_%d_%d_%d_%d", cs.kefu_appid, store_id, appid, uid)
+}
+
+func customerMember(appid int64, uid int64) string {
+	return fmt.Sprintf("%d_%d", appid, uid)
+}
+
+func parseCustomerMember(member string) (int64, int64, error) {
+	var appid, uid int64
+	_, err := fmt.Sscanf(member, "%d_%d", &appid, &uid)
+	return appid, uid, err
+}
+
+func (cs *CustomerService) getStrategy(conn redis.Conn, store_id int64) string {
+	strategy, err := redis.String(conn.Do("HGET", cs.storeKey(store_id), "strategy"))
+	if err != nil {
+		return cs.strategy
+	}
+	return strategy
+}
+
+// 客服的在线状态来自imr写入的presence
+func (cs *CustomerService) loadAgents(conn redis.Conn, store_id int64) ([]*customerAgent, error) {
+	uids, err := redis.Int64s(conn.Do("SMEMBERS", cs.storeAgentsKey(store_id)))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+
+	//所有客服的状态在一次请求中读取
+	for _, uid := range uids {
+		conn.Send("HMGET", cs.agentKey(uid), "max_sessions", "available")
+		conn.Send("SCARD", cs.agentSessionsKey(uid))
+	}
+	err = conn.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	agents := make([]*customerAgent, 0, len(uids))
+	for _, uid := range uids {
+		reply, err := redis.Values(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		sessions, err := redis.Int(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		var max_sessions, available int
+		_, err = redis.Scan(reply, &max_sessions, &available)
+		if err != nil {
+			return nil, err
+		}
+		if max_sessions <= 0 {
+			max_sessions = cs.max_sessions
+		}
+		agent := &customerAgent{uid: uid, available: available != 0, sessions: sessions, max_sessions: max_sessions}
+		agents = append(agents, agent)
+	}
+
+	presences, err := LoadPresences(cs.redis_pool, cs.kefu_appid, uids)
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range presences {
+		agents[i].online = p.platforms != 0
+	}
+	return agents, nil
+}
+
+// 返回nil表示没有空闲的客服
+func (cs *CustomerService) selectAgent(conn redis.Conn, store_id int64, exclude int64) (*customerAgent, error) {
+	agents, err := cs.loadAgents(conn, store_id)
+	if err != nil {
+		return nil, err
+	}
+	idles := make([]*customerAgent, 0, len(agents))
+	for _, agent := range agents {
+		if agent.uid != exclude && agent.idle() {
+			idles = append(idles, agent)
+		}
+	}
+	if len(idles) == 0 {
+		return nil, nil
+	}
+
+	if cs.getStrategy(conn, store_id) == CUSTOMER_STRATEGY_LEAST_BUSY {
+		agent := idles[0]
+		for _, a := range idles[1:] {
+			if a.sessions < agent.sessions {
+				agent = a
+			}
+		}
+		return agent, nil
+	}
+
+	n, err := redis.Int64(conn.Do("HINCRBY", cs.storeKey(store_id), "round_robin", 1))
+	if err != nil {
+		return nil, err
+	}
+	return idles[n%int64(len(idles))], nil
+}
+
+func (cs *CustomerService) getSessionAgent(conn redis.Conn, store_id int64, appid int64, uid int64) (int64, error) {
+	agent, err := redis.Int64(conn.Do("HGET", cs.sessionKey(store_id, appid, uid), "agent"))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return agent, err
+}
+
+// 会话已经存在时返回{客服, 0}, 客服的会话数量已满时返回{0, 0}, 分配成功返回{客服, 1}
+// KEYS[1]:会话 KEYS[2]:客服的会话集合 KEYS[3]:商店的会话集合 KEYS[4]:排队队列
+// ARGV[1]:客服 ARGV[2]:客服的最大会话数量 ARGV[3]:客服会话集合的member ARGV[4]:顾客 ARGV[5]:时间
+var openCustomerSessionScript = redis.NewScript(4, `
+local agent = redis.call("HGET", KEYS[1], "agent")
+if agent then
+  return {tonumber(agent), 0}
+end
+if redis.call("SCARD", KEYS[2]) >= tonumber(ARGV[2]) then
+  return {0, 0}
+end
+redis.call("HSET", KEYS[1], "agent", ARGV[1], "timestamp", ARGV[5])
+redis.call("SADD", KEYS[2], ARGV[3])
+redis.call("SADD", KEYS[3], ARGV[4])
+redis.call("ZREM", KEYS[4], ARGV[4])
+return {tonumber(ARGV[1]), 1}
+`)
+
+// 检查客服的会话数量和创建会话在同一个脚本中执行, 多个im同时分配时不会超过max_sessions
+// 返回会话的客服, 客服的会话数量已满时返回0
+func (cs *CustomerService) openSession(conn redis.Conn, store_id int64, appid int64, uid int64, agent *customerAgent) (int64, bool, error) {
+	member := customerMember(appid, uid)
+	reply, err := redis.Int64s(openCustomerSessionScript.Do(conn, cs.sessionKey(store_id, appid, uid),
+		cs.agentSessionsKey(agent.uid), cs.storeSessionsKey(store_id), cs.queueKey(store_id),
+		agent.uid, agent.max_sessions, fmt.Sprintf("%d_%s", store_id, member), member, time.Now().Unix()))
+	if err != nil {
+		return 0, false, err
+	}
+	if len(reply) != 2 {
+		return 0, false, fmt.Errorf("invalid open session reply:%v", reply)
+	}
+	return reply[0], reply[1] == 1, nil
+}
+
+func (cs *CustomerService) sendSessionEvent(event string, store_id int64, appid int64, uid int64, agent int64, from_agent int64) {
+	obj := make(map[string]interface{})
+	obj["event"] = event
+	obj["store_id"] = store_id
+	obj["customer_appid"] = appid
+	obj["customer_id"] = uid
+	if agent != 0 {
+		obj["agent"] = agent
+	}
+	if from_agent != 0 {
+		obj["from_agent"] = from_agent
+	}
+	obj["timestamp"] = time.Now().Unix()
+	v := make(map[string]interface{})
+	v["customer_session"] = obj
+	b, _ := json.Marshal(v)
+	content := string(b)
+
+	cs.sendSystemMessage(appid, uid, content)
+	if agent != 0 {
+		cs.sendSystemMessage(cs.kefu_appid, agent, content)
+	}
+	if from_agent != 0 {
+		cs.sendSystemMessage(cs.kefu_appid, from_agent, content)
+	}
+	log.Infof("customer session %s store:%d customer:%d %d agent:%d", event, store_id, appid, uid, agent)
+}
+
+func (cs *CustomerService) sendSystemMessage(appid int64, uid int64, content string) {
+	msg := &Message{Cmd: MSG_SYSTEM, Body: &SystemMessage{content}}
+	msgid, _, err := cs.rpc_storage.SaveMessage(appid, uid, 0, msg)
+	if err != nil {
+		log.Warning("save customer session message err:", err)
+		return
+	}
+	cs.app.PushMessage(appid, uid, msg)
+	notify := &Message{Cmd: MSG_SYNC_NOTIFY, Body: &SyncNotify{sync_key: msgid}}
+	cs.app.SendAnonymousMessage(appid, uid, notify)
+}
+
+// 发送给客服, 顾客的消息已经保存
+func (cs *CustomerService) deliverMessage(msg *CustomerMessageV2) {
+	m := &Message{Cmd: MSG_CUSTOMER_V2, Version: DEFAULT_VERSION, Body: msg}
+	msgid, _, err := cs.rpc_storage.SaveMessage(msg.receiver_appid, msg.receiver, 0, m)
+	if err != nil {
+		log.Warning("save customer message err:", err)
+		return
+	}
+	cs.app.PushMessage(msg.receiver_appid, msg.receiver, m)
+	notify := &Message{Cmd: MSG_SYNC_NOTIFY, Body: &SyncNotify{sync_key: msgid}}
+	cs.app.SendAnonymousMessage(msg.receiver_appid, msg.receiver, notify)
+}
+
+// 顾客发给客服app的消息
+func (cs *CustomerService) IsStoreMessage(msg *CustomerMessageV2) bool {
+	return msg.receiver_appid == cs.kefu_appid && msg.sender_appid != cs.kefu_appid
+}
+
+// 返回会话的客服, 没有空闲的客服时顾客进入排队队列, 返回0
+func (cs *CustomerService) RouteMessage(msg *CustomerMessageV2) (int64, error) {
+	store_id := msg.receiver
+	conn := cs.redis_pool.Get()
+	defer conn.Close()
+
+	agent, err := cs.getSessionAgent(conn, store_id, msg.sender_appid, msg.sender)
+	if err != nil || agent != 0 {
+		return agent, err
+	}
+
+	selected, err := cs.selectAgent(conn, store_id, 0)
+	if err != nil {
+		return 0, err
+	}
+	if selected != nil {
+		agent, opened, err := cs.openSession(conn, store_id, msg.sender_appid, msg.sender, selected)
+		if err != nil {
+			return 0, err
+		}
+		if opened {
+			cs.sendSessionEvent(CUSTOMER_SESSION_OPEN, store_id, msg.sender_appid, msg.sender, agent, 0)
+			cs.flushWaitingMessages(conn, store_id, msg.sender_appid, msg.sender, agent)
+		}
+		//agent为0时客服的会话已满, 进入排队
+		if agent != 0 {
+			return agent, nil
+		}
+	}
+
+	member := customerMember(msg.sender_appid, msg.sender)
+	added, err := redis.Int(conn.Do("ZADD", cs.queueKey(store_id), "NX", time.Now().Unix(), member))
+	if err != nil {
+		return 0, err
+	}
+	waiting_key := cs.waitingKey(store_id, msg.sender_appid, msg.sender)
+	conn.Send("RPUSH", waiting_key, msg.ToData())
+	conn.Send("LTRIM", waiting_key, -CUSTOMER_WAITING_MESSAGE_LIMIT, -1)
+	conn.Send("SADD", cs.queuedStoresKey(), store_id)
+	_, err = conn.Do("")
+	if err != nil {
+		return 0, err
+	}
+	if added > 0 {
+		cs.sendSessionEvent(CUSTOMER_SESSION_QUEUE, store_id, msg.sender_appid, msg.sender, 0, 0)
+	}
+	return 0, nil
+}
+
+// 排队期间的消息转发给分配的客服
+func (cs *CustomerService) flushWaitingMessages(conn redis.Conn, store_id int64, appid int64, uid int64, agent int64) {
+	key := cs.waitingKey(store_id, appid, uid)
+	conn.Send("MULTI")
+	conn.Send("LRANGE", key, 0, -1)
+	conn.Send("DEL", key)
+	reply, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		log.Warning("load customer waiting messages err:", err)
+		return
+	}
+	buffs, _ := redis.ByteSlices(reply[0], nil)
+	for _, buff := range buffs {
+		msg := &CustomerMessageV2{}
+		if !msg.FromData(buff) {
+			continue
+		}
+		msg.receiver = agent
+		cs.deliverMessage(msg)
+	}
+}
+
+// 按照排队的顺序分配空闲的客服
+func (cs *CustomerService) dispatchQueue(store_id int64) error {
+	conn := cs.redis_pool.Get()
+	defer conn.Close()
+
+	for {
+		selected, err := cs.selectAgent(conn, store_id, 0)
+		if err != nil || selected == nil {
+			return err
+		}
+
+		reply, err := redis.Strings(conn.Do("ZPOPMIN", cs.queueKey(store_id)))
+		if err != nil {
+			return err
+		}
+		if len(reply) < 2 {
+			_, err = conn.Do("SREM", cs.queuedStoresKey(), store_id)
+			return err
+		}
+		member, score := reply[0], reply[1]
+		appid, uid, err := parseCustomerMember(member)
+		if err != nil {
+			log.Warning("invalid customer queue member:", member)
+			continue
+		}
+
+		agent, opened, err := cs.openSession(conn, store_id, appid, uid, selected)
+		if err != nil || agent == 0 {
+			//保持原来的排队顺序
+			_, e := conn.Do("ZADD", cs.queueKey(store_id), "NX", score, member)
+			if e != nil {
+				log.Errorf("requeue customer:%s store:%d err:%s", member, store_id, e)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if opened {
+			cs.sendSessionEvent(CUSTOMER_SESSION_OPEN, store_id, appid, uid, agent, 0)
+		}
+		cs.flushWaitingMessages(conn, store_id, appid, uid, agent)
+	}
+}
+
+func (cs *CustomerService) dispatchQueues() {
+	conn := cs.redis_pool.Get()
+	store_ids, err := redis.Int64s(conn.Do("SMEMBERS", cs.queuedStoresKey()))
+	conn.Close()
+	if err != nil {
+		log.Warning("load customer queued stores err:", err)
+		return
+	}
+	for _, store_id := range store_ids {
+		err = cs.dispatchQueue(store_id)
+		if err != nil {
+			log.Warningf("dispatch customer queue store:%d err:%s", store_id, err)
+		}
+	}
+}
+
+func (cs *CustomerService) Run() {
+	go func() {
+		ticker := time.NewTicker(CUSTOMER_QUEUE_INTERVAL * time.Second)
+		for range ticker.C {
+			cs.dispatchQueues()
+		}
+	}()
+}
+
+func (cs *CustomerService) AddAgent(store_id int64, agent int64, max_sessions int) error {
+	conn := cs.redis_pool.Get()
+	defer conn.Close()
+
+	conn.Send("SADD", cs.storeAgentsKey(store_id), agent)
+	conn.Send("HSETNX", cs.agentKey(agent), "available", 1)
+	if max_sessions > 0 {
+		conn.Send("HSET", cs.agentKey(agent), "max_sessions", max_sessions)
+	}
+	_, err := conn.Do("")
+	if err != nil {
+		return err
+	}
+	return cs.dispatchQueue(store_id)
+}
+
+// 已经分配的会话不会转移
+func (cs *CustomerService) RemoveAgent(store_id int64, agent int64) error {
+	conn := cs.redis_pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SREM", cs.storeAgentsKey(store_id), agent)
+	return err
+}
+
+// 暂停后不再分配新的会话
+func (cs *CustomerService) SetAgentAvailable(agent int64, available bool) error {
+	conn := cs.redis_pool.Get()
+	defer conn.Close()
+
+	v := 0
+	if available {
+		v = 1
+	}
+	_, err := conn.Do("HSET", cs.agentKey(agent), "available", v)
+	if err != nil {
+		return err
+	}
+	if available {
+		go cs.dispatchQueues()
+	}
+	return nil
+}
+
+func (cs *CustomerService) SetStrategy(store_id int64, strategy string) error {
+	conn := cs.redis_pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HSET", cs.storeKey(store_id), "strategy", strategy)
+	return err
+}
+
+// agent为0时分配其它空闲的客服
+func (cs *CustomerService) TransferSession(store_id int64, appid int64, uid int64, agent int64) (int64, error) {
+	conn := cs.redis_pool.Get()
+	defer conn.Close()
+
+	from_agent, err := cs.getSessionAgent(conn, store_id, appid, uid)
+	if err != nil {
+		return 0, err
+	}
+	if from_agent == 0 {
+		return 0, errCustomerSessionNotFound
+	}
+
+	if agent == 0 {
+		selected, err := cs.selectAgent(conn, store_id, from_agent)
+		if err != nil {
+			return 0, err
+		}
+		if selected != nil {
+			agent = selected.uid
+		}
+	} else {
+		var ok bool
+		ok, err = redis.Bool(conn.Do("SISMEMBER", cs.storeAgentsKey(store_id), agent))
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			agent = 0
+		}
+	}
+	if agent == 0 || agent == from_agent {
+		return 0, errCustomerAgentNotFound
+	}
+
+	member := fmt.Sprintf("%d_%s", store_id, customerMember(appid, uid))
+	conn.Send("HSET", cs.sessionKey(store_id, appid, uid), "agent", agent, "timestamp", time.Now().Unix())
+	conn.Send("SMOVE", cs.agentSessionsKey(from_agent), cs.agentSessionsKey(agent), member)
+	_, err = conn.Do("")
+	if err != nil {
+		return 0, err
+	}
+	cs.sendSessionEvent(CUSTOMER_SESSION_TRANSFER, store_id, appid, uid, agent, from_agent)
+	return agent, nil
+}
+
+func (cs *CustomerService) CloseSession(store_id int64, appid int64, uid int64) error {
+	conn := cs.redis_pool.Get()
+	defer conn.Close()
+
+	agent, err := cs.getSessionAgent(conn, store_id, appid, uid)
+	if err != nil {
+		return err
+	}
+	if agent == 0 {
+		return errCustomerSessionNotFound
+	}
+
+	member := customerMember(appid, uid)
+	conn.Send("DEL", cs.sessionKey(store_id, appid, uid))
+	conn.Send("SREM", cs.agentSessionsKey(agent), fmt.Sprintf("%d_%s", store_id, member))
+	conn.Send("SREM", cs.storeSessionsKey(store_id), member)
+	_, err = conn.Do("")
+	if err != nil {
+		return err
+	}
+	cs.sendSessionEvent(CUSTOMER_SESSION_CLOSE, store_id, appid, uid, agent, 0)
+
+	//客服有了空闲
+	go func() {
+		err := cs.dispatchQueue(store_id)
+		if err != nil {
+			log.Warningf("dispatch customer queue store:%d err:%s", store_id, err)
+		}
+	}()
+	return nil
+}
+
+func (cs *CustomerService) GetAgents(store_id int64) ([]map[string]interface{}, error) {
+	conn := cs.redis_pool.Get()
+	defer conn.Close()
+
+	agents, err := cs.loadAgents(conn, store_id)
+	if err != nil {
+		return nil, err
+	}
+	objs := make([]map[string]interface{}, 0, len(agents))
+	for _, agent := range agents {
+		obj := make(map[string]interface{})
+		obj["agent"] = agent.uid
+		obj["online"] = agent.online
+		obj["available"] = agent.available
+		obj["sessions"] = agent.sessions
+		obj["max_sessions"] = agent.max_sessions
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+// 返回商店的会话和排队的顾客
+func (cs *CustomerService) GetSessions(store_id int64) ([]map[string]interface{}, []map[string]interface{}, error) {
+	conn := cs.redis_pool.Get()
+	defer conn.Close()
+
+	members, err := redis.Strings(conn.Do("SMEMBERS", cs.storeSessionsKey(store_id)))
+	if err != nil {
+		return nil, nil, err
+	}
+	sessions := make([]map[string]interface{}, 0, len(members))
+	for _, member := range members {
+		appid, uid, err := parseCustomerMember(member)
+		if err != nil {
+			continue
+		}
+		reply, err := redis.Values(conn.Do("HMGET", cs.sessionKey(store_id, appid, uid), "agent", "timestamp"))
+		if err != nil {
+			return nil, nil, err
+		}
+		var agent, timestamp int64
+		_, err = redis.Scan(reply, &agent, &timestamp)
+		if err != nil {
+			return nil, nil, err
+		}
+		obj := make(map[string]interface{})
+		obj["customer_appid"] = appid
+		obj["customer_id"] = uid
+		obj["agent"] = agent
+		obj["timestamp"] = timestamp
+		sessions = append(sessions, obj)
+	}
+
+	reply, err := redis.Strings(conn.Do("ZRANGE", cs.queueKey(store_id), 0, -1, "WITHSCORES"))
+	if err != nil {
+		return nil, nil, err
+	}
+	queue := make([]map[string]interface{}, 0, len(reply)/2)
+	for i := 0; i+1 < len(reply); i += 2 {
+		appid, uid, err := parseCustomerMember(reply[i])
+		if err != nil {
+			continue
+		}
+		timestamp, _ := strconv.ParseInt(reply[i+1], 10, 64)
+		obj := make(map[string]interface{})
+		obj["customer_appid"] = appid
+		obj["customer_id"] = uid
+		obj["timestamp"] = timestamp
+		queue = append(queue, obj)
+	}
+	return sessions, queue, nil
+}
+
+func readCustomerRequest(req *http.Request) (*simplejson.Json, int64, error) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	obj, err := simplejson.NewJson(body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	store_id, err := obj.Get("store_id").Int64()
+	if err != nil {
+		return nil, 0, err
+	}
+	return obj, store_id, nil
+}
+
+// body: {"store_id":, "agent":, "max_sessions":}
+func AddCustomerAgent(w http.ResponseWriter, req *http.Request, cs *CustomerService) {
+	obj, store_id, err := readCustomerRequest(req)
+	agent := int64(0)
+	if err == nil {
+		agent, err = obj.Get("agent").Int64()
+	}
+	if err != nil || agent == 0 {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+	max_sessions := obj.Get("max_sessions").MustInt(0)
+
+	err = cs.AddAgent(store_id, agent, max_sessions)
+	if err != nil {
+		log.Warningf("add customer agent:%d store:%d err:%s", agent, store_id, err)
+		WriteHttpError(500, "server internal error", w)
+		return
+	}
+	log.Infof("add customer agent:%d store:%d", agent, store_id)
+	w.WriteHeader(200)
+}
+
+// body: {"store_id":, "agent":}
+func RemoveCustomerAgent(w http.ResponseWriter, req *http.Request, cs *CustomerService) {
+	obj, store_id, err := readCustomerRequest(req)
+	agent := int64(0)
+	if err == nil {
+		agent, err = obj.Get("agent").Int64()
+	}
+	if err != nil || agent == 0 {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+
+	err = cs.RemoveAgent(store_id, agent)
+	if err != nil {
+		log.Warningf("remove customer agent:%d store:%d err:%s", agent, store_id, err)
+		WriteHttpError(500, "server internal error", w)
+		return
+	}
+	log.Infof("remove customer agent:%d store:%d", agent, store_id)
+	w.WriteHeader(200)
+}
+
+// body: {"agent":, "available":true/false}
+func SetCustomerAgentStatus(w http.ResponseWriter, req *http.Request, cs *CustomerService) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		WriteHttpError(400, err.Error(), w)
+		return
+	}
+
+	obj, err := simplejson.NewJson(body)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+
+	agent, err := obj.Get("agent").Int64()
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+	available, err := obj.Get("available").Bool()
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+
+	err = cs.SetAgentAvailable(agent, available)
+	if err != nil {
+		log.Warningf("set customer agent:%d status err:%s", agent, err)
+		WriteHttpError(500, "server internal error", w)
+		return
+	}
+	log.Infof("set customer agent:%d available:%t", agent, available)
+	w.WriteHeader(200)
+}
+
+// body: {"store_id":, "strategy":"round_robin"/"least_busy"}
+func SetCustomerStore(w http.ResponseWriter, req *http.Request, cs *CustomerService) {
+	obj, store_id, err := readCustomerRequest(req)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+	strategy := obj.Get("strategy").MustString("")
+	if strategy != CUSTOMER_STRATEGY_ROUND_ROBIN && strategy != CUSTOMER_STRATEGY_LEAST_BUSY {
+		WriteHttpError(400, "invalid strategy", w)
+		return
+	}
+
+	err = cs.SetStrategy(store_id, strategy)
+	if err != nil {
+		log.Warningf("set customer store:%d strategy err:%s", store_id, err)
+		WriteHttpError(500, "server internal error", w)
+		return
+	}
+	log.Infof("set customer store:%d strategy:%s", store_id, strategy)
+	w.WriteHeader(200)
+}
+
+// GET /get_customer_agents?store_id=
+func GetCustomerAgents(w http.ResponseWriter, req *http.Request, cs *CustomerService) {
+	m, _ := url.ParseQuery(req.URL.RawQuery)
+
+	store_id, err := strconv.ParseInt(m.Get("store_id"), 10, 64)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid query param", w)
+		return
+	}
+
+	agents, err := cs.GetAgents(store_id)
+	if err != nil {
+		log.Warningf("get customer store:%d agents err:%s", store_id, err)
+		WriteHttpError(500, "server internal error", w)
+		return
+	}
+	obj := make(map[string]interface{})
+	obj["agents"] = agents
+	WriteHttpObj(obj, w)
+}
+
+// GET /get_customer_sessions?store_id=
+func GetCustomerSessions(w http.ResponseWriter, req *http.Request, cs *CustomerService) {
+	m, _ := url.ParseQuery(req.URL.RawQuery)
+
+	store_id, err := strconv.ParseInt(m.Get("store_id"), 10, 64)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid query param", w)
+		return
+	}
+
+	sessions, queue, err := cs.GetSessions(store_id)
+	if err != nil {
+		log.Warningf("get customer store:%d sessions err:%s", store_id, err)
+		WriteHttpError(500, "server internal error", w)
+		return
+	}
+	obj := make(map[string]interface{})
+	obj["sessions"] = sessions
+	obj["queue"] = queue
+	WriteHttpObj(obj, w)
+}
+
+func readCustomerSessionRequest(req *http.Request) (*simplejson.Json, int64, int64, int64, error) {
+	obj, store_id, err := readCustomerRequest(req)
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	appid, err := obj.Get("customer_appid").Int64()
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	uid, err := obj.Get("customer_id").Int64()
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	return obj, store_id, appid, uid, nil
+}
+
+// body: {"store_id":, "customer_appid":, "customer_id":, "agent":}, agent为空时分配其它空闲的客服
+func TransferCustomerSession(w http.ResponseWriter, req *http.Request, cs *CustomerService) {
+	obj, store_id, appid, uid, err := readCustomerSessionRequest(req)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+	agent := obj.Get("agent").MustInt64(0)
+
+	agent, err = cs.TransferSession(store_id, appid, uid, agent)
+	if err == errCustomerSessionNotFound || err == errCustomerAgentNotFound {
+		WriteHttpError(400, err.Error(), w)
+		return
+	} else if err != nil {
+		log.Warningf("transfer customer session store:%d customer:%d %d err:%s", store_id, appid, uid, err)
+		WriteHttpError(500, "server internal error", w)
+		return
+	}
+	res := make(map[string]interface{})
+	res["agent"] = agent
+	WriteHttpObj(res, w)
+}
+
+// body: {"store_id":, "customer_appid":, "customer_id":}
+func CloseCustomerSession(w http.ResponseWriter, req *http.Request, cs *CustomerService) {
+	_, store_id, appid, uid, err := readCustomerSessionRequest(req)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+
+	err = cs.CloseSession(store_id, appid, uid)
+	if err == errCustomerSessionNotFound {
+		WriteHttpError(400, err.Error(), w)
+		return
+	} else if err != nil {
+		log.Warningf("close customer session store:%d customer:%d %d err:%s", store_id, appid, uid, err)
+		WriteHttpError(500, "server internal error", w)
+		return
+	}
+	w.WriteHeader(200)
+}
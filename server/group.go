@@ -29,13 +29,25 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// 群成员角色
+const GROUP_ROLE_MEMBER = 0
+const GROUP_ROLE_ADMIN = 1
+const GROUP_ROLE_OWNER = 2
+
 type Group struct {
-	gid   int64
-	appid int64
-	super bool //超大群
-	mutex sync.Mutex
-	//key:成员id value:入群时间|(mute<<31)
+	gid          int64
+	appid        int64
+	super        bool  //超大群
+	announcement bool  //仅群主和管理员可以发言
+	mute         bool  //全员禁言, 群主和管理员除外
+	mute_until   int64 //全员禁言的截止时间(秒), 0表示一直有效
+	name         string
+	notice       string //群公告
+	mutex        sync.Mutex
+	//key:成员id value:入群时间|(mute<<31)|(role<<32)
 	members map[int64]int64
+	//key:成员id value:群内昵称
+	nicknames map[int64]string
 
 	ts int //访问时间
 }
@@ -93,6 +105,37 @@ func (group *Group) RemoveMember(uid int64) {
 	members := group.cloneMembers()
 	delete(members, uid)
 	group.members = members
+
+	if _, ok := group.nicknames[uid]; ok {
+		group.setNickname(uid, "")
+	}
+}
+
+func (group *Group) GetNickname(uid int64) string {
+	return group.nicknames[uid]
+}
+
+func (group *Group) SetMemberNickname(uid int64, nickname string) {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	if _, ok := group.members[uid]; !ok {
+		return
+	}
+	group.setNickname(uid, nickname)
+}
+
+// 在副本修改, without lock
+func (group *Group) setNickname(uid int64, nickname string) {
+	nicknames := make(map[int64]string)
+	for k, v := range group.nicknames {
+		nicknames[k] = v
+	}
+	if nickname == "" {
+		delete(nicknames, uid)
+	} else {
+		nicknames[uid] = nickname
+	}
+	group.nicknames = nicknames
 }
 
 func (group *Group) SetMemberMute(uid int64, mute bool) {
@@ -107,7 +150,20 @@ func (group *Group) SetMemberMute(uid int64, mute bool) {
 	}
 
 	if val, ok := group.members[uid]; ok {
-		group.members[uid] = (val & 0x7FFFFFFF) | (m << 31)
+		members := group.cloneMembers()
+		members[uid] = (val &^ (1 << 31)) | (m << 31)
+		group.members = members
+	}
+}
+
+func (group *Group) SetMemberRole(uid int64, role int) {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+
+	if val, ok := group.members[uid]; ok {
+		members := group.cloneMembers()
+		members[uid] = (val & 0xFFFFFFFF) | (int64(role&0x03) << 32)
+		group.members = members
 	}
 }
 
@@ -126,16 +182,98 @@ func (group *Group) GetMemberMute(uid int64) bool {
 	return int((t>>31)&0x01) != 0
 }
 
+func (group *Group) GetMemberRole(uid int64) int {
+	t := group.members[uid]
+	return int((t >> 32) & 0x03)
+}
+
+// 群主和管理员
+func (group *Group) IsAdmin(uid int64) bool {
+	return group.IsMember(uid) && group.GetMemberRole(uid) >= GROUP_ROLE_ADMIN
+}
+
+func (group *Group) SetAnnouncement(announcement bool) {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	group.announcement = announcement
+}
+
+func (group *Group) IsAnnouncement() bool {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	return group.announcement
+}
+
+// 仅群主和管理员可以发言的模式下, 普通成员不能发送消息
+func (group *Group) CanSpeak(uid int64) bool {
+	if !group.IsAnnouncement() {
+		return true
+	}
+	return group.GetMemberRole(uid) >= GROUP_ROLE_ADMIN
+}
+
+func (group *Group) SetMute(mute bool, mute_until int64) {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	group.mute = mute
+	group.mute_until = mute_until
+}
+
+func (group *Group) MuteUntil() int64 {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	return group.mute_until
+}
+
+func (group *Group) IsMuted(now int64) bool {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	if !group.mute {
+		return false
+	}
+	return group.mute_until == 0 || now < group.mute_until
+}
+
 func (group *Group) IsEmpty() bool {
 	return len(group.members) == 0
 }
 
-func LoadGroup(db *sql.DB, group_id int64) (*Group, error) {
-	stmtIns, err := db.Prepare("SELECT id, appid, super FROM `group` WHERE id=? AND deleted=0")
+// 没有执行db_upgrade.sql的旧表, 缺少announcement, mute, mute_until, role字段
+const GROUP_SQL = "SELECT id, appid, master, super, announcement, mute, mute_until, name, notice FROM `group` WHERE id=? AND deleted=0"
+const GROUP_SQL_LEGACY = "SELECT id, appid, master, super, name, notice FROM `group` WHERE id=? AND deleted=0"
+const GROUP_MEMBER_SQL = "SELECT uid, timestamp, mute, role FROM group_member WHERE group_id=? AND deleted=0"
+const GROUP_MEMBER_SQL_LEGACY = "SELECT uid, timestamp, mute FROM group_member WHERE group_id=? AND deleted=0"
+
+// 1054: Unknown column
+func isUnknownColumn(err error) bool {
+	if e, ok := err.(*mysql.MySQLError); ok {
+		return e.Number == 1054
+	}
+	return false
+}
+
+func prepareStmt(db *sql.DB, query string) (*sql.Stmt, error) {
+	stmtIns, err := db.Prepare(query)
 	if err == mysql.ErrInvalidConn {
 		log.Info("db prepare error:", err)
-		stmtIns, err = db.Prepare("SELECT id, appid, super FROM `group` WHERE id=? AND deleted=0")
+		stmtIns, err = db.Prepare(query)
 	}
+	return stmtIns, err
+}
+
+// 字段不存在时使用旧的查询语句, 返回是否为旧表
+func prepareGroupStmt(db *sql.DB, query string, legacy_query string) (*sql.Stmt, bool, error) {
+	stmtIns, err := prepareStmt(db, query)
+	if isUnknownColumn(err) {
+		log.Warning("table not upgraded, execute db_upgrade.sql:", err)
+		stmtIns, err = prepareStmt(db, legacy_query)
+		return stmtIns, true, err
+	}
+	return stmtIns, false, err
+}
+
+func LoadGroup(db *sql.DB, group_id int64) (*Group, error) {
+	stmtIns, legacy, err := prepareGroupStmt(db, GROUP_SQL, GROUP_SQL_LEGACY)
 	if err != nil {
 		log.Info("db prepare error:", err)
 		return nil, err
@@ -146,10 +284,19 @@ func LoadGroup(db *sql.DB, group_id int64) (*Group, error) {
 	var group *Group
 	var id int64
 	var appid int64
+	var master sql.NullInt64
 	var super int8
+	var announcement int8
+	var mute int8
+	var mute_until int64
+	var name, notice sql.NullString
 
 	row := stmtIns.QueryRow(group_id)
-	err = row.Scan(&id, &appid, &super)
+	if legacy {
+		err = row.Scan(&id, &appid, &master, &super, &name, &notice)
+	} else {
+		err = row.Scan(&id, &appid, &master, &super, &announcement, &mute, &mute_until, &name, &notice)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -160,22 +307,35 @@ func LoadGroup(db *sql.DB, group_id int64) (*Group, error) {
 		return nil, err
 	}
 
+	nicknames, err := LoadGroupMemberNicknames(db, id)
+	if err != nil {
+		log.Info("error:", err)
+		return nil, err
+	}
+
+	//兼容没有设置role的旧数据
+	if t, ok := members[master.Int64]; ok && master.Valid {
+		members[master.Int64] = (t & 0xFFFFFFFF) | (GROUP_ROLE_OWNER << 32)
+	}
+
 	if super != 0 {
 		group = NewSuperGroup(id, appid, members)
 	} else {
 		group = NewGroup(id, appid, members)
 	}
+	group.announcement = announcement != 0
+	group.mute = mute != 0
+	group.mute_until = mute_until
+	group.name = name.String
+	group.notice = notice.String
+	group.nicknames = nicknames
 
 	log.Info("load group success:", group_id)
 	return group, nil
 }
 
 func LoadGroupMember(db *sql.DB, group_id int64) (map[int64]int64, error) {
-	stmtIns, err := db.Prepare("SELECT uid, timestamp, mute FROM group_member WHERE group_id=? AND deleted=0")
-	if err == mysql.ErrInvalidConn {
-		log.Info("db prepare error:", err)
-		stmtIns, err = db.Prepare("SELECT uid, timestamp, mute FROM group_member WHERE group_id=? AND deleted=0")
-	}
+	stmtIns, legacy, err := prepareGroupStmt(db, GROUP_MEMBER_SQL, GROUP_MEMBER_SQL_LEGACY)
 	if err != nil {
 		log.Info("db prepare error:", err)
 		return nil, err
@@ -188,8 +348,40 @@ func LoadGroupMember(db *sql.DB, group_id int64) (map[int64]int64, error) {
 		var uid int64
 		var timestamp int64
 		var mute int64
-		rows.Scan(&uid, &timestamp, &mute)
-		members[uid] = timestamp | (mute << 31)
+		var role int64
+		if legacy {
+			rows.Scan(&uid, &timestamp, &mute)
+		} else {
+			rows.Scan(&uid, &timestamp, &mute, &role)
+		}
+		members[uid] = timestamp | (mute << 31) | ((role & 0x03) << 32)
 	}
 	return members, nil
 }
+
+func LoadGroupMemberNicknames(db *sql.DB, group_id int64) (map[int64]string, error) {
+	stmtIns, err := db.Prepare("SELECT uid, nickname FROM group_member WHERE group_id=? AND deleted=0 AND nickname IS NOT NULL AND nickname != ''")
+	if err == mysql.ErrInvalidConn {
+		log.Info("db prepare error:", err)
+		stmtIns, err = db.Prepare("SELECT uid, nickname FROM group_member WHERE group_id=? AND deleted=0 AND nickname IS NOT NULL AND nickname != ''")
+	}
+	if err != nil {
+		log.Info("db prepare error:", err)
+		return nil, err
+	}
+
+	defer stmtIns.Close()
+	nicknames := make(map[int64]string)
+	rows, err := stmtIns.Query(group_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid int64
+		var nickname string
+		rows.Scan(&uid, &nickname)
+		nicknames[uid] = nickname
+	}
+	return nicknames, nil
+}
@@ -0,0 +1,315 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/bitly/go-simplejson"
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+const GROUP_MANAGER_STREAM_MAXLEN = 100000
+
+// 和业务服务器使用相同的action id序列, 保证所有im按顺序处理群组事件
+// KEYS[1]:groups_actions KEYS[2]:group_manager_stream ARGV[1]:maxlen ARGV[2...]:事件字段
+var publishGroupEventScript = redis.NewScript(2, `
+local prefix = "0"
+local prev_id = 0
+local actions = redis.call("GET", KEYS[1])
+if actions then
+  local i = string.find(actions, ":")
+  prefix = string.sub(actions, 1, i - 1)
+  prev_id = tonumber(string.sub(actions, i + 1))
+end
+local action_id = prev_id + 1
+redis.call("SET", KEYS[1], prefix .. ":" .. action_id)
+redis.call("XADD", KEYS[2], "MAXLEN", "~", ARGV[1], "*", "action_id", action_id, "previous_action_id", prev_id, unpack(ARGV, 2))
+return action_id
+`)
+
+var errGroupPermission = errors.New("permission denied")
+var errGroupNonexist = errors.New("group nonexists")
+var errNotGroupMember = errors.New("not group member")
+var errInvalidRole = errors.New("invalid role")
+
+func PublishGroupEvent(redis_pool *redis.Pool, fields ...interface{}) error {
+	conn := redis_pool.Get()
+	defer conn.Close()
+
+	args := redis.Args{}.Add("groups_actions").Add(GROUP_MANAGER_STREAM_NAME).Add(GROUP_MANAGER_STREAM_MAXLEN).Add(fields...)
+	_, err := publishGroupEventScript.Do(conn, args...)
+	return err
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// 群主和管理员的操作
+type GroupAdmin struct {
+	group_service *GroupService
+}
+
+func NewGroupAdmin(group_service *GroupService) *GroupAdmin {
+	return &GroupAdmin{group_service: group_service}
+}
+
+// 检查操作者的权限, 管理员只能操作普通成员
+func (admin *GroupAdmin) checkOperator(appid int64, group_id int64, operator int64, member int64) (*Group, error) {
+	group := admin.group_service.LoadGroup(group_id)
+	if group == nil || group.appid != appid {
+		return nil, errGroupNonexist
+	}
+	if !group.IsAdmin(operator) {
+		return nil, errGroupPermission
+	}
+	if member != 0 {
+		if !group.IsMember(member) {
+			return nil, errNotGroupMember
+		}
+		if group.GetMemberRole(member) >= group.GetMemberRole(operator) {
+			return nil, errGroupPermission
+		}
+	}
+	return group, nil
+}
+
+func (admin *GroupAdmin) SetMemberMute(appid int64, group_id int64, operator int64, member int64, mute bool) error {
+	_, err := admin.checkOperator(appid, group_id, operator, member)
+	if err != nil {
+		return err
+	}
+
+	err = admin.group_service.store.SetMemberMute(group_id, member, mute)
+	if err != nil {
+		return err
+	}
+
+	return PublishGroupEvent(admin.group_service.redis_pool,
+		"name", GROUP_EVENT_MEMBER_MUTE, "app_id", appid, "group_id", group_id, "operator", operator,
+		"member_id", member, "mute", boolToInt(mute))
+}
+
+// 只有群主可以设置管理员
+func (admin *GroupAdmin) SetMemberRole(appid int64, group_id int64, operator int64, member int64, role int) error {
+	if role != GROUP_ROLE_MEMBER && role != GROUP_ROLE_ADMIN {
+		return errInvalidRole
+	}
+	group, err := admin.checkOperator(appid, group_id, operator, member)
+	if err != nil {
+		return err
+	}
+	if group.GetMemberRole(operator) != GROUP_ROLE_OWNER {
+		return errGroupPermission
+	}
+
+	err = admin.group_service.store.SetMemberRole(group_id, member, role)
+	if err != nil {
+		return err
+	}
+
+	return PublishGroupEvent(admin.group_service.redis_pool,
+		"name", GROUP_EVENT_MEMBER_ROLE, "app_id", appid, "group_id", group_id, "operator", operator,
+		"member_id", member, "role", role)
+}
+
+func (admin *GroupAdmin) SetAnnouncement(appid int64, group_id int64, operator int64, announcement bool) error {
+	_, err := admin.checkOperator(appid, group_id, operator, 0)
+	if err != nil {
+		return err
+	}
+
+	err = admin.group_service.store.SetAnnouncement(group_id, announcement)
+	if err != nil {
+		return err
+	}
+
+	return PublishGroupEvent(admin.group_service.redis_pool,
+		"name", GROUP_EVENT_ANNOUNCEMENT, "app_id", appid, "group_id", group_id, "operator", operator,
+		"announcement", boolToInt(announcement))
+}
+
+// duration: 禁言的时长(秒), 0表示一直有效
+func (admin *GroupAdmin) SetGroupMute(appid int64, group_id int64, operator int64, mute bool, duration int64) error {
+	_, err := admin.checkOperator(appid, group_id, operator, 0)
+	if err != nil {
+		return err
+	}
+
+	var mute_until int64
+	if mute && duration > 0 {
+		mute_until = time.Now().Unix() + duration
+	}
+
+	err = admin.group_service.store.SetGroupMute(group_id, mute, mute_until)
+	if err != nil {
+		return err
+	}
+
+	return PublishGroupEvent(admin.group_service.redis_pool,
+		"name", GROUP_EVENT_MUTE, "app_id", appid, "group_id", group_id, "operator", operator,
+		"mute", boolToInt(mute), "mute_until", mute_until)
+}
+
+func readGroupAdminRequest(req *http.Request) (*simplejson.Json, int64, int64, int64, error) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+
+	obj, err := simplejson.NewJson(body)
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+
+	appid, err := obj.Get("appid").Int64()
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	group_id, err := obj.Get("group_id").Int64()
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	operator, err := obj.Get("operator").Int64()
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	return obj, appid, group_id, operator, nil
+}
+
+func writeGroupAdminError(err error, w http.ResponseWriter) {
+	if err == errGroupPermission {
+		WriteHttpError(403, err.Error(), w)
+	} else if err == errGroupNonexist || err == errNotGroupMember || err == errInvalidRole {
+		WriteHttpError(400, err.Error(), w)
+	} else {
+		WriteHttpError(500, "server internal error", w)
+	}
+}
+
+// body: {"appid":, "group_id":, "operator":, "member":, "mute":true}
+func MuteGroupMember(w http.ResponseWriter, req *http.Request, admin *GroupAdmin) {
+	obj, appid, group_id, operator, err := readGroupAdminRequest(req)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+	member, err := obj.Get("member").Int64()
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+	mute := obj.Get("mute").MustBool(false)
+
+	err = admin.SetMemberMute(appid, group_id, operator, member, mute)
+	if err != nil {
+		log.Warningf("mute group:%d member:%d operator:%d err:%s", group_id, member, operator, err)
+		writeGroupAdminError(err, w)
+		return
+	}
+	log.Infof("mute group:%d member:%d operator:%d mute:%t", group_id, member, operator, mute)
+	w.WriteHeader(200)
+}
+
+// body: {"appid":, "group_id":, "operator":, "member":, "role":0|1}
+func SetGroupMemberRole(w http.ResponseWriter, req *http.Request, admin *GroupAdmin) {
+	obj, appid, group_id, operator, err := readGroupAdminRequest(req)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+	member, err := obj.Get("member").Int64()
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+	role, err := obj.Get("role").Int()
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+
+	err = admin.SetMemberRole(appid, group_id, operator, member, role)
+	if err != nil {
+		log.Warningf("set group:%d member:%d role operator:%d err:%s", group_id, member, operator, err)
+		writeGroupAdminError(err, w)
+		return
+	}
+	log.Infof("set group:%d member:%d role:%d operator:%d", group_id, member, role, operator)
+	w.WriteHeader(200)
+}
+
+// body: {"appid":, "group_id":, "operator":, "announcement":true}
+func SetGroupAnnouncement(w http.ResponseWriter, req *http.Request, admin *GroupAdmin) {
+	obj, appid, group_id, operator, err := readGroupAdminRequest(req)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+	announcement := obj.Get("announcement").MustBool(false)
+
+	err = admin.SetAnnouncement(appid, group_id, operator, announcement)
+	if err != nil {
+		log.Warningf("set group:%d announcement operator:%d err:%s", group_id, operator, err)
+		writeGroupAdminError(err, w)
+		return
+	}
+	log.Infof("set group:%d announcement:%t operator:%d", group_id, announcement, operator)
+	w.WriteHeader(200)
+}
+
+// body: {"appid":, "group_id":, "operator":, "mute":true, "duration":秒}
+func MuteGroup(w http.ResponseWriter, req *http.Request, admin *GroupAdmin) {
+	obj, appid, group_id, operator, err := readGroupAdminRequest(req)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+	mute := obj.Get("mute").MustBool(false)
+	duration := obj.Get("duration").MustInt64(0)
+	if duration < 0 {
+		WriteHttpError(400, "invalid duration", w)
+		return
+	}
+
+	err = admin.SetGroupMute(appid, group_id, operator, mute, duration)
+	if err != nil {
+		log.Warningf("mute group:%d operator:%d err:%s", group_id, operator, err)
+		writeGroupAdminError(err, w)
+		return
+	}
+	log.Infof("mute group:%d mute:%t duration:%d operator:%d", group_id, mute, duration, operator)
+	w.WriteHeader(200)
+}
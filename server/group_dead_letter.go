@@ -0,0 +1,320 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/bitly/go-simplejson"
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/GoBelieveIO/im_service/protocol"
+)
+
+// dead letter文件和pending_group_messages的格式相同, 消息id为消息在文件中的偏移
+func (storage *GroupMessageDeliver) deadLetterPath() string {
+	return fmt.Sprintf("%s/dead_letters", storage.root)
+}
+
+// dead letter和retry文件共用的格式
+func (storage *GroupMessageDeliver) openLetterFile(path string) *os.File {
+	log.Info("open/create letter file path:", path)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Fatal("open file:", err)
+	}
+	file_size, err := file.Seek(0, os.SEEK_END)
+	if err != nil {
+		log.Fatal("seek file")
+	}
+	if file_size < HEADER_SIZE && file_size > 0 {
+		log.Info("file header is't complete")
+		err = file.Truncate(0)
+		if err != nil {
+			log.Fatal("truncate file")
+		}
+		file_size = 0
+	}
+	if file_size == 0 {
+		storage.WriteHeader(file)
+	}
+	return file
+}
+
+func (storage *GroupMessageDeliver) openDeadLetterFile() {
+	storage.dl_file = storage.openLetterFile(storage.deadLetterPath())
+
+	letters := storage.readDeadLetters()
+	atomic.StoreInt64(&storage.dead_letter_count, int64(len(letters)))
+}
+
+func (storage *GroupMessageDeliver) saveDeadLetter(gm *PendingGroupMessage) {
+	storage.dl_mutex.Lock()
+	defer storage.dl_mutex.Unlock()
+
+	m := &Message{Cmd: MSG_PENDING_GROUP_MESSAGE, Version: MENTION_VERSION, Body: gm}
+	storage.writeMessage(storage.dl_file, m)
+	atomic.AddInt64(&storage.dead_letter_count, 1)
+}
+
+// read without lock
+func (storage *GroupMessageDeliver) readDeadLetters() []*EPendingGroupMessage {
+	return storage.readLetters(storage.deadLetterPath())
+}
+
+func (storage *GroupMessageDeliver) readLetters(path string) []*EPendingGroupMessage {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Error("open letter file err:", err)
+		return nil
+	}
+	defer file.Close()
+
+	_, err = file.Seek(HEADER_SIZE, os.SEEK_SET)
+	if err != nil {
+		log.Error("seek file err:", err)
+		return nil
+	}
+
+	letters := make([]*EPendingGroupMessage, 0)
+	for {
+		msgid, err := file.Seek(0, os.SEEK_CUR)
+		if err != nil {
+			log.Error("seek file err:", err)
+			break
+		}
+		msg := storage.ReadMessage(file)
+		if msg == nil {
+			break
+		}
+		if msg.Cmd != MSG_PENDING_GROUP_MESSAGE {
+			continue
+		}
+		letters = append(letters, &EPendingGroupMessage{msgid, msg.Body.(*PendingGroupMessage)})
+	}
+	return letters
+}
+
+func (storage *GroupMessageDeliver) LoadDeadLetters() []*EPendingGroupMessage {
+	storage.dl_mutex.Lock()
+	defer storage.dl_mutex.Unlock()
+	return storage.readDeadLetters()
+}
+
+// 重新加入发送队列的末尾, ids为空时重新发送所有的消息
+// 先加入发送队列再从dead letter中删除, 删除失败时消息可能会重复发送, 不会丢失
+// 剩余的消息写入新的文件, 消息id会发生变化
+func (storage *GroupMessageDeliver) ReplayDeadLetters(ids []int64) (int, error) {
+	replay_ids := make(map[int64]bool)
+	for _, id := range ids {
+		replay_ids[id] = true
+	}
+
+	replays := make(map[int64]bool)
+	letters := make([]*EPendingGroupMessage, 0)
+	for _, letter := range storage.LoadDeadLetters() {
+		if len(ids) == 0 || replay_ids[letter.msgid] {
+			replays[letter.msgid] = true
+			letters = append(letters, letter)
+		}
+	}
+	if len(letters) == 0 {
+		return 0, nil
+	}
+
+	//发送线程持有mutex时会写入dead letter, 不能在持有dl_mutex时调用SaveMessage
+	for _, letter := range letters {
+		m := &Message{Cmd: MSG_PENDING_GROUP_MESSAGE, Version: MENTION_VERSION, Body: letter.PendingGroupMessage}
+		storage.SaveMessage(m, nil)
+	}
+
+	err := storage.removeDeadLetters(replays)
+	if err != nil {
+		return 0, err
+	}
+	log.Infof("replay dead letters:%d remain:%d", len(letters), atomic.LoadInt64(&storage.dead_letter_count))
+	return len(letters), nil
+}
+
+// 剩余的消息写入新的文件
+func (storage *GroupMessageDeliver) removeDeadLetters(ids map[int64]bool) error {
+	storage.dl_mutex.Lock()
+	defer storage.dl_mutex.Unlock()
+
+	tmp_path := storage.deadLetterPath() + ".tmp"
+	file, err := os.OpenFile(tmp_path, os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	storage.WriteHeader(file)
+
+	//dead letter文件只会追加, 之前读到的消息id不会变化
+	var keeps int64
+	for _, letter := range storage.readDeadLetters() {
+		if ids[letter.msgid] {
+			continue
+		}
+		m := &Message{Cmd: MSG_PENDING_GROUP_MESSAGE, Version: MENTION_VERSION, Body: letter.PendingGroupMessage}
+		storage.writeMessage(file, m)
+		keeps++
+	}
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = os.Rename(tmp_path, storage.deadLetterPath())
+	if err != nil {
+		file.Close()
+		return err
+	}
+	storage.dl_file.Close()
+	storage.dl_file = file
+	atomic.StoreInt64(&storage.dead_letter_count, keeps)
+	return nil
+}
+
+// 未指定deliver时返回所有deliver的dead letter
+func getGroupDelivers(app *App, index int64, all bool) ([]*GroupMessageDeliver, []int, error) {
+	delivers := app.GroupMessageDelivers()
+	if all {
+		indexes := make([]int, len(delivers))
+		for i := range delivers {
+			indexes[i] = i
+		}
+		return delivers, indexes, nil
+	}
+	if index < 0 || index >= int64(len(delivers)) {
+		return nil, nil, fmt.Errorf("invalid deliver:%d", index)
+	}
+	return []*GroupMessageDeliver{delivers[index]}, []int{int(index)}, nil
+}
+
+// GET /get_group_dead_letters?deliver=
+func GetGroupDeadLetters(w http.ResponseWriter, req *http.Request, app *App) {
+	m, _ := url.ParseQuery(req.URL.RawQuery)
+
+	index, err := strconv.ParseInt(m.Get("deliver"), 10, 64)
+	all := m.Get("deliver") == ""
+	if err != nil && !all {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid query param", w)
+		return
+	}
+
+	delivers, indexes, err := getGroupDelivers(app, index, all)
+	if err != nil {
+		WriteHttpError(400, err.Error(), w)
+		return
+	}
+
+	letters := make([]map[string]interface{}, 0)
+	for i, deliver := range delivers {
+		for _, letter := range deliver.LoadDeadLetters() {
+			gm := letter.PendingGroupMessage
+			obj := make(map[string]interface{})
+			obj["deliver"] = indexes[i]
+			obj["id"] = letter.msgid
+			obj["appid"] = gm.appid
+			obj["group_id"] = gm.gid
+			obj["sender"] = gm.sender
+			obj["timestamp"] = gm.timestamp
+			obj["members"] = gm.members
+			obj["mentions"] = gm.mentions
+			obj["content"] = gm.content
+			letters = append(letters, obj)
+		}
+	}
+
+	obj := make(map[string]interface{})
+	obj["dead_letters"] = letters
+	WriteHttpObj(obj, w)
+}
+
+// body: {"deliver":, "ids":[]}, 未指定deliver时重新发送所有deliver的dead letter
+func ReplayGroupDeadLetters(w http.ResponseWriter, req *http.Request, app *App) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		WriteHttpError(400, err.Error(), w)
+		return
+	}
+
+	obj, err := simplejson.NewJson(body)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+
+	var index int64
+	_, ok := obj.CheckGet("deliver")
+	all := !ok
+	if !all {
+		index, err = obj.Get("deliver").Int64()
+		if err != nil {
+			log.Info("error:", err)
+			WriteHttpError(400, "invalid json format", w)
+			return
+		}
+	}
+
+	var ids []int64
+	id_array, _ := obj.Get("ids").Array()
+	for i := range id_array {
+		id, err := obj.Get("ids").GetIndex(i).Int64()
+		if err != nil {
+			log.Info("error:", err)
+			WriteHttpError(400, "invalid json format", w)
+			return
+		}
+		ids = append(ids, id)
+	}
+	if all && len(ids) > 0 {
+		WriteHttpError(400, "ids require deliver", w)
+		return
+	}
+
+	delivers, _, err := getGroupDelivers(app, index, all)
+	if err != nil {
+		WriteHttpError(400, err.Error(), w)
+		return
+	}
+
+	count := 0
+	for _, deliver := range delivers {
+		n, err := deliver.ReplayDeadLetters(ids)
+		if err != nil {
+			log.Error("replay dead letters err:", err)
+			WriteHttpError(500, "server internal error", w)
+			return
+		}
+		count += n
+	}
+
+	res := make(map[string]interface{})
+	res["count"] = count
+	WriteHttpObj(res, w)
+}
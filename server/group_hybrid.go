@@ -0,0 +1,157 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bitly/go-simplejson"
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/GoBelieveIO/im_service/lru"
+)
+
+// 启用了引用消息的普通群, 所有im共享
+const GROUP_HYBRID_KEY = "hybrid_groups"
+
+// 未启用的群组的缓存时间, 通过http接口启用之后最多延迟这么久生效
+const GROUP_HYBRID_CACHE_EXPIRE = 60 * time.Second
+const GROUP_HYBRID_CACHE_SIZE = 100000
+
+// 普通群的消息是否只保存一次, 个人消息队列中只保存引用
+// 群组启用之后不会再关闭, 成员数量在阈值附近变化时不会来回切换
+// 启用之前的消息仍然是完整的副本, 不需要迁移数据
+type HybridGroups struct {
+	redis_pool *redis.Pool
+	threshold  int //成员数量达到此值时自动启用, 0表示只能通过http接口启用
+
+	mutex sync.Mutex
+	cache *lru.Cache //gid:启用时为true, 未启用时为过期时间
+}
+
+func NewHybridGroups(redis_pool *redis.Pool, threshold int) *HybridGroups {
+	h := &HybridGroups{redis_pool: redis_pool, threshold: threshold}
+	h.cache = lru.New(GROUP_HYBRID_CACHE_SIZE)
+	return h
+}
+
+func (h *HybridGroups) cached(gid int64, now time.Time) (bool, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	v, ok := h.cache.Get(gid)
+	if !ok {
+		return false, false
+	}
+	if expire, ok := v.(time.Time); ok {
+		return false, now.Before(expire)
+	}
+	return true, true
+}
+
+func (h *HybridGroups) setCache(gid int64, hybrid bool, now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if hybrid {
+		h.cache.Add(gid, true)
+	} else {
+		h.cache.Add(gid, now.Add(GROUP_HYBRID_CACHE_EXPIRE))
+	}
+}
+
+// 读取失败时保存完整的消息, 完整的消息总是可以同步
+func (h *HybridGroups) IsHybrid(gid int64, member_count int) bool {
+	now := time.Now()
+	auto := h.threshold > 0 && member_count >= h.threshold
+	hybrid, ok := h.cached(gid, now)
+	if hybrid || (ok && !auto) {
+		return hybrid
+	}
+
+	conn := h.redis_pool.Get()
+	defer conn.Close()
+
+	hybrid, err := redis.Bool(conn.Do("SISMEMBER", GROUP_HYBRID_KEY, gid))
+	if err != nil {
+		log.Warning("sismember err:", err)
+		return false
+	}
+	if !hybrid && auto {
+		_, err = conn.Do("SADD", GROUP_HYBRID_KEY, gid)
+		if err != nil {
+			log.Warning("sadd err:", err)
+			return false
+		}
+		log.Infof("group:%d members:%d enable hybrid", gid, member_count)
+		hybrid = true
+	}
+	h.setCache(gid, hybrid, now)
+	return hybrid
+}
+
+func (h *HybridGroups) Enable(gid int64) error {
+	conn := h.redis_pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SADD", GROUP_HYBRID_KEY, gid)
+	if err != nil {
+		return err
+	}
+	h.setCache(gid, true, time.Now())
+	return nil
+}
+
+// 已有的群组显式启用, 所有的ims和im升级之后才能调用
+// body: {"group_id":}
+func EnableGroupHybrid(w http.ResponseWriter, req *http.Request, h *HybridGroups) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		WriteHttpError(400, err.Error(), w)
+		return
+	}
+
+	obj, err := simplejson.NewJson(body)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+
+	group_id, err := obj.Get("group_id").Int64()
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+
+	err = h.Enable(group_id)
+	if err != nil {
+		log.Warning("enable group hybrid err:", err)
+		WriteHttpError(500, "server internal error", w)
+		return
+	}
+	log.Infof("enable group:%d hybrid", group_id)
+	w.WriteHeader(200)
+}
@@ -0,0 +1,147 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/GoBelieveIO/im_service/protocol"
+)
+
+// 超级群成员分页的默认数量和最大数量
+const GROUP_MEMBERS_DEFAULT_LIMIT = 100
+const GROUP_MEMBERS_MAX_LIMIT = 500
+
+// 从缓存中加载群组, 只有群组成员可以获取
+func (server *Server) loadMemberGroup(client *Client, seq int, group_id int64) *Group {
+	group := server.app.GetGroupLoader(group_id).LoadGroup(group_id)
+	if group == nil || group.appid != client.appid {
+		log.Warning("can't find group:", group_id)
+		ack := &Message{Cmd: MSG_ACK, Body: &MessageACK{seq: int32(seq), status: ACK_GROUP_NONEXIST}}
+		client.EnqueueMessage(ack)
+		return nil
+	}
+
+	if !group.IsMember(client.uid) {
+		log.Warningf("uid:%d is not group:%d member", client.uid, group_id)
+		ack := &Message{Cmd: MSG_ACK, Body: &MessageACK{seq: int32(seq), status: ACK_NOT_GROUP_MEMBER}}
+		client.EnqueueMessage(ack)
+		return nil
+	}
+	return group
+}
+
+func (server *Server) HandleGetGroupInfo(client *Client, msg *Message) {
+	req := msg.Body.(*GroupInfoRequest)
+	if client.uid == 0 {
+		return
+	}
+
+	group := server.loadMemberGroup(client, msg.Seq, req.group_id)
+	if group == nil {
+		return
+	}
+
+	obj := make(map[string]interface{})
+	obj["group_id"] = group.gid
+	obj["name"] = group.name
+	obj["notice"] = group.notice
+	obj["super"] = group.super
+	obj["announcement"] = group.IsAnnouncement()
+	obj["mute"] = group.IsMuted(time.Now().Unix())
+	obj["mute_until"] = group.MuteUntil()
+	obj["member_count"] = len(group.Members())
+	content, _ := json.Marshal(obj)
+
+	info := &GroupInfo{group_id: group.gid, content: string(content)}
+	client.EnqueueMessage(&Message{Cmd: MSG_GROUP_INFO, Body: info})
+}
+
+// 普通群返回所有的成员, 超级群按照uid排序分页
+func (server *Server) HandleGetGroupMembers(client *Client, msg *Message) {
+	req := msg.Body.(*GroupMembersRequest)
+	if client.uid == 0 {
+		return
+	}
+
+	group := server.loadMemberGroup(client, msg.Seq, req.group_id)
+	if group == nil {
+		return
+	}
+
+	members := group.Members()
+	uids := make([]int64, 0, len(members))
+	for uid := range members {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+
+	offset := 0
+	limit := len(uids)
+	if group.super {
+		offset = int(req.offset)
+		limit = int(req.limit)
+		if offset < 0 {
+			offset = 0
+		}
+		if limit <= 0 {
+			limit = GROUP_MEMBERS_DEFAULT_LIMIT
+		} else if limit > GROUP_MEMBERS_MAX_LIMIT {
+			limit = GROUP_MEMBERS_MAX_LIMIT
+		}
+	}
+
+	if offset > len(uids) {
+		offset = len(uids)
+	}
+	end := offset + limit
+	next_offset := end
+	if end >= len(uids) {
+		end = len(uids)
+		next_offset = -1
+	}
+
+	objs := make([]map[string]interface{}, 0, end-offset)
+	for _, uid := range uids[offset:end] {
+		t := members[uid]
+		obj := make(map[string]interface{})
+		obj["uid"] = uid
+		obj["timestamp"] = t & 0x7FFFFFFF
+		obj["mute"] = (t>>31)&0x01 != 0
+		obj["role"] = (t >> 32) & 0x03
+		if nickname := group.GetNickname(uid); nickname != "" {
+			obj["nickname"] = nickname
+		}
+		objs = append(objs, obj)
+	}
+	content, _ := json.Marshal(objs)
+
+	m := &GroupMembers{
+		group_id:    group.gid,
+		total:       int32(len(uids)),
+		next_offset: int32(next_offset),
+		content:     string(content),
+	}
+	client.EnqueueMessage(&Message{Cmd: MSG_GROUP_MEMBERS, Body: m})
+}
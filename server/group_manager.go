@@ -20,12 +20,9 @@
 package server
 
 import (
-	"database/sql"
 	"sync"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
-
 	log "github.com/sirupsen/logrus"
 )
 
@@ -41,6 +38,10 @@ const GROUP_EVENT_CHANGED = "group_changed"
 const GROUP_EVENT_MEMBER_ADD = "group_member_add"
 const GROUP_EVENT_MEMBER_REMOVE = "group_member_remove"
 const GROUP_EVENT_MEMBER_MUTE = "group_member_mute"
+const GROUP_EVENT_MEMBER_ROLE = "group_member_role"
+const GROUP_EVENT_ANNOUNCEMENT = "group_announcement"
+const GROUP_EVENT_MUTE = "group_mute"
+const GROUP_EVENT_MEMBER_NICKNAME = "group_member_nickname"
 
 type GroupEvent struct {
 	Id               string //stream entry id
@@ -52,25 +53,24 @@ type GroupEvent struct {
 	MemberId         int64  `redis:"member_id"`
 	IsSuper          bool   `redis:"super"`
 	IsMute           bool   `redis:"mute"`
+	Role             int    `redis:"role"`
+	IsAnnouncement   bool   `redis:"announcement"`
+	MuteUntil        int64  `redis:"mute_until"`
+	Operator         int64  `redis:"operator"` //操作者
+	Nickname         string `redis:"nickname"`
 }
 
 type GroupManager struct {
 	mutex  sync.Mutex
 	groups map[int64]*Group
 
-	db *sql.DB
+	store GroupStore
 }
 
-func NewGroupManager(mysqldb_datasource string) *GroupManager {
+func NewGroupManager(store GroupStore) *GroupManager {
 	m := new(GroupManager)
 	m.groups = make(map[int64]*Group)
-
-	db, err := sql.Open("mysql", mysqldb_datasource)
-	if err != nil {
-		log.Fatal("open db:", err)
-	}
-	m.db = db
-
+	m.store = store
 	return m
 }
 
@@ -83,7 +83,7 @@ func (group_manager *GroupManager) LoadGroup(gid int64) *Group {
 		return group
 	}
 	group_manager.mutex.Unlock()
-	group, err := LoadGroup(group_manager.db, gid)
+	group, err := group_manager.store.LoadGroup(gid)
 	if err != nil {
 		log.Warningf("load group:%d err:%s", gid, err)
 		return nil
@@ -254,6 +254,82 @@ func (group_manager *GroupManager) HandleMute(event *GroupEvent) {
 	}
 }
 
+func (group_manager *GroupManager) HandleRole(event *GroupEvent) {
+	gid := event.GroupId
+	uid := event.MemberId
+	role := event.Role
+
+	if gid == 0 || uid == 0 || role < GROUP_ROLE_MEMBER || role > GROUP_ROLE_OWNER {
+		log.Infof("invalid group event:%s, group id:%d member id:%d role:%d",
+			event.Name, gid, uid, role)
+		return
+	}
+
+	group := group_manager.FindGroup(gid)
+	if group != nil {
+		group.SetMemberRole(uid, role)
+		log.Infof("set group member gid:%d uid:%d role:%d", gid, uid, role)
+	} else {
+		log.Infof("can't find group:%d\n", gid)
+	}
+}
+
+func (group_manager *GroupManager) HandleAnnouncement(event *GroupEvent) {
+	gid := event.GroupId
+	announcement := event.IsAnnouncement
+
+	if gid == 0 {
+		log.Infof("invalid group event:%s, group id:%d", event.Name, gid)
+		return
+	}
+
+	group := group_manager.FindGroup(gid)
+	if group != nil {
+		group.SetAnnouncement(announcement)
+		log.Infof("set group gid:%d announcement:%t", gid, announcement)
+	} else {
+		log.Infof("can't find group:%d\n", gid)
+	}
+}
+
+func (group_manager *GroupManager) HandleGroupMute(event *GroupEvent) {
+	gid := event.GroupId
+	is_mute := event.IsMute
+	mute_until := event.MuteUntil
+
+	if gid == 0 {
+		log.Infof("invalid group event:%s, group id:%d", event.Name, gid)
+		return
+	}
+
+	group := group_manager.FindGroup(gid)
+	if group != nil {
+		group.SetMute(is_mute, mute_until)
+		log.Infof("set group gid:%d mute:%t until:%d", gid, is_mute, mute_until)
+	} else {
+		log.Infof("can't find group:%d\n", gid)
+	}
+}
+
+func (group_manager *GroupManager) HandleNickname(event *GroupEvent) {
+	gid := event.GroupId
+	uid := event.MemberId
+
+	if gid == 0 || uid == 0 {
+		log.Infof("invalid group event:%s, group id:%d member id:%d",
+			event.Name, gid, uid)
+		return
+	}
+
+	group := group_manager.FindGroup(gid)
+	if group != nil {
+		group.SetMemberNickname(uid, event.Nickname)
+		log.Infof("set group member gid:%d uid:%d nickname:%s", gid, uid, event.Nickname)
+	} else {
+		log.Infof("can't find group:%d\n", gid)
+	}
+}
+
 func (group_manager *GroupManager) Recycle() {
 	group_manager.mutex.Lock()
 	defer group_manager.mutex.Unlock()
@@ -30,8 +30,14 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// 发送失败的重试次数, 重试间隔从1s开始每次加倍
+const GROUP_DELIVER_MAX_RETRY = 5
+const GROUP_DELIVER_RETRY_INTERVAL = time.Second
+
 // 后台发送普通群消息
 // 普通群消息首先保存到临时文件中，之后按照保存到文件中的顺序依次派发
+// 发送失败的成员保存到retry文件中, 由单独的goroutine重试
+// 多次重试仍然发送失败的消息保存到dead letter文件中, 之后通过http接口重新发送
 type GroupMessageDeliver struct {
 	GroupMessageFile
 
@@ -42,6 +48,20 @@ type GroupMessageDeliver struct {
 	callbacks           map[int64]chan *Metadata //返回保存到ims的消息id
 	callbackid_to_msgid map[int64]int64          //callback -> msgid
 
+	pending_count       int64 //等待发送的消息数量
+	retry_count         int64 //重试的次数
+	retry_pending_count int64 //等待重试的消息数量
+	dead_letter_count   int64 //dead letter文件中的消息数量
+
+	dl_mutex sync.Mutex //dead letter文件的锁
+	dl_file  *os.File
+
+	retry_mutex sync.Mutex //retry文件和retries的锁
+	retry_file  *os.File
+	retries     []*groupRetry
+
+	hybrid_groups *HybridGroups //为nil时不使用引用消息
+
 	group_manager *GroupManager
 	app           *App
 	rpc_storage   *RPCStorage
@@ -69,9 +89,17 @@ func NewGroupMessageDeliver(root string, group_manager *GroupManager, app *App,
 	storage.openWriteFile()
 	storage.openCursorFile()
 	storage.readLatestMessageID()
+	storage.openDeadLetterFile()
+	storage.openRetryFile()
+	storage.pending_count = storage.countPendingMessages()
 	return storage
 }
 
+// ims需要先升级到支持MSG_GROUP_IM_REF的版本, 在Start之前设置, 发送线程读取时不加锁
+func (storage *GroupMessageDeliver) EnableHybrid(hybrid_groups *HybridGroups) {
+	storage.hybrid_groups = hybrid_groups
+}
+
 func (storage *GroupMessageDeliver) ClearCallback() {
 	storage.cb_mutex.Lock()
 	defer storage.cb_mutex.Unlock()
@@ -117,6 +145,7 @@ func (storage *GroupMessageDeliver) SaveMessage(msg *Message, ch chan *Metadata)
 	defer storage.mutex.Unlock()
 	msgid := storage.saveMessage(msg)
 	atomic.StoreInt64(&storage.latest_msgid, msgid)
+	atomic.AddInt64(&storage.pending_count, 1)
 
 	var callback_id int64
 	if ch != nil {
@@ -139,11 +168,18 @@ func (storage *GroupMessageDeliver) sendMessage(appid int64, uid int64, sender i
 	return true
 }
 
-func (storage *GroupMessageDeliver) sendGroupMessage(gm *PendingGroupMessage) (*Metadata, bool) {
-	msg := &IMMessage{sender: gm.sender, receiver: gm.gid, timestamp: gm.timestamp, content: gm.content}
-	m := &Message{Cmd: MSG_GROUP_IM, Version: DEFAULT_VERSION, Body: msg}
+// 返回保存失败的成员, 发送者的消息id保存在metadata中
+// ref不为nil时个人消息队列中只保存消息的引用
+func (storage *GroupMessageDeliver) sendGroupMessage(gm *PendingGroupMessage, ref *Message, metadata *Metadata) []int64 {
+	msg := &IMMessage{sender: gm.sender, receiver: gm.gid, timestamp: gm.timestamp, mentions: gm.mentions, content: gm.content}
+	m := &Message{Cmd: MSG_GROUP_IM, Version: groupMessageVersion(msg), Body: msg}
+	stored := m
+	if ref != nil {
+		stored = ref
+	}
 
-	metadata := &Metadata{}
+	var failed []int64
+	group_members := make(map[int64]int64)
 
 	batch_members := make(map[int64][]int64)
 	for _, member := range gm.members {
@@ -159,21 +195,23 @@ func (storage *GroupMessageDeliver) sendGroupMessage(gm *PendingGroupMessage) (*
 
 	for _, mb := range batch_members {
 
-		r, err := storage.rpc_storage.SavePeerGroupMessage(gm.appid, mb, gm.device_ID, m)
+		r, err := storage.rpc_storage.SavePeerGroupMessage(gm.appid, mb, gm.device_ID, stored)
 		if err != nil {
 			log.Errorf("save peer group message:%d %d err:%s", gm.sender, gm.gid, err)
-			return nil, false
+			failed = append(failed, mb...)
+			continue
 		}
 		if len(r) != len(mb) {
 			log.Errorf("save peer group message err:%d %d", len(r), len(mb))
-			return nil, false
+			failed = append(failed, mb...)
+			continue
 		}
 
 		for i := 0; i < len(r); i++ {
 			msgid, prev_msgid := r[i].MsgID, r[i].PrevMsgID
 			member := mb[i]
 			meta := &Metadata{sync_key: msgid, prev_sync_key: prev_msgid}
-			mm := &Message{Cmd: MSG_GROUP_IM, Version: DEFAULT_VERSION,
+			mm := &Message{Cmd: MSG_GROUP_IM, Version: m.Version,
 				Flag: MESSAGE_FLAG_PUSH, Body: msg, Meta: meta}
 			storage.sendMessage(gm.appid, member, gm.sender, gm.device_ID, mm)
 
@@ -184,16 +222,58 @@ func (storage *GroupMessageDeliver) sendGroupMessage(gm *PendingGroupMessage) (*
 				metadata.sync_key = msgid
 				metadata.prev_sync_key = prev_msgid
 			}
+			group_members[member] = 0
 		}
 	}
 
-	group_members := make(map[int64]int64)
-	for _, member := range gm.members {
-		group_members[member] = 0
+	//只推送给保存成功的成员
+	if len(group_members) > 0 {
+		group := NewGroup(gm.gid, gm.appid, group_members)
+		storage.app.PushGroupMessage(gm.appid, group, m)
+	}
+	return failed
+}
+
+// 启用的群组的消息首先保存到群组消息队列中, 个人消息队列中只保存消息的引用
+func (storage *GroupMessageDeliver) isHybrid(gm *PendingGroupMessage) bool {
+	if storage.hybrid_groups == nil {
+		return false
+	}
+	return storage.hybrid_groups.IsHybrid(gm.gid, len(gm.members))
+}
+
+func (storage *GroupMessageDeliver) saveGroupMessageRef(gm *PendingGroupMessage) *Message {
+	msg := &IMMessage{sender: gm.sender, receiver: gm.gid, timestamp: gm.timestamp, mentions: gm.mentions, content: gm.content}
+	m := &Message{Cmd: MSG_GROUP_IM, Version: groupMessageVersion(msg), Body: msg}
+	msgid, _, err := storage.rpc_storage.SaveGroupMessage(gm.appid, gm.gid, gm.device_ID, m)
+	if err != nil {
+		log.Errorf("save group message:%d %d err:%s", gm.sender, gm.gid, err)
+		return nil
+	}
+	return NewGroupMessageRef(gm.gid, msgid)
+}
+
+// 发送失败的成员加入重试队列, 之后只重试失败的成员, 避免重复保存
+func (storage *GroupMessageDeliver) sendGroupMessageOnce(gm *PendingGroupMessage) *Metadata {
+	metadata := &Metadata{}
+	hybrid := storage.isHybrid(gm)
+	var ref *Message
+	if hybrid {
+		ref = storage.saveGroupMessageRef(gm)
+		if ref == nil {
+			storage.addRetry(gm, hybrid, nil)
+			return metadata
+		}
+	}
+
+	failed := storage.sendGroupMessage(gm, ref, metadata)
+	if len(failed) > 0 {
+		log.Warningf("send group message:%d %d failure, members:%d retry later", gm.sender, gm.gid, len(failed))
+		retry := *gm
+		retry.members = failed
+		storage.addRetry(&retry, hybrid, ref)
 	}
-	group := NewGroup(gm.gid, gm.appid, group_members)
-	storage.app.PushGroupMessage(gm.appid, group, m)
-	return metadata, true
+	return metadata
 }
 
 func (storage *GroupMessageDeliver) sendPendingMessage() {
@@ -207,15 +287,11 @@ func (storage *GroupMessageDeliver) sendPendingMessage() {
 		}
 		gm := m.PendingGroupMessage
 		msgid := m.msgid
-		meta, r := storage.sendGroupMessage(gm)
-		if !r {
-			log.Warning("send group message failure")
-			break
-		}
-
+		meta := storage.sendGroupMessageOnce(gm)
 		storage.DoCallback(msgid, meta)
-		storage.latest_sended_msgid = msgid
+		atomic.StoreInt64(&storage.latest_sended_msgid, msgid)
 		storage.saveCursor()
+		atomic.AddInt64(&storage.pending_count, -1)
 	}
 }
 
@@ -239,11 +315,41 @@ func (storage *GroupMessageDeliver) flushPendingMessage() {
 				//truncate file
 				storage.truncateFile()
 				storage.ClearCallback()
+				atomic.StoreInt64(&storage.pending_count, 0)
 			}
 		}
 	}
 }
 
+func (storage *GroupMessageDeliver) countPendingMessages() int64 {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var count int64
+	for range storage.readPendingMessages(ctx) {
+		count++
+	}
+	return count
+}
+
+func (storage *GroupMessageDeliver) Summary() map[string]interface{} {
+	latest_msgid := atomic.LoadInt64(&storage.latest_msgid)
+	latest_sended_msgid := atomic.LoadInt64(&storage.latest_sended_msgid)
+	lag := latest_msgid - latest_sended_msgid
+	if lag < 0 {
+		lag = 0
+	}
+
+	obj := make(map[string]interface{})
+	obj["pending_count"] = atomic.LoadInt64(&storage.pending_count)
+	obj["latest_msgid"] = latest_msgid
+	obj["latest_sended_msgid"] = latest_sended_msgid
+	obj["cursor_lag"] = lag
+	obj["retry_count"] = atomic.LoadInt64(&storage.retry_count)
+	obj["retry_pending_count"] = atomic.LoadInt64(&storage.retry_pending_count)
+	obj["dead_letter_count"] = atomic.LoadInt64(&storage.dead_letter_count)
+	return obj
+}
+
 func (storage *GroupMessageDeliver) run() {
 	log.Info("group message deliver running")
 
@@ -267,4 +373,5 @@ func (storage *GroupMessageDeliver) run() {
 
 func (storage *GroupMessageDeliver) Start() {
 	go storage.run()
+	go storage.retryLoop()
 }
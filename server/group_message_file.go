@@ -255,7 +255,12 @@ func (storage *GroupMessageFile) WriteHeader(file *os.File) {
 
 // save without lock
 func (storage *GroupMessageFile) saveMessage(msg *Message) int64 {
-	msgid, err := storage.file.Seek(0, os.SEEK_END)
+	return storage.writeMessage(storage.file, msg)
+}
+
+// 消息追加到文件末尾, 返回消息在文件中的偏移
+func (storage *GroupMessageFile) writeMessage(file *os.File, msg *Message) int64 {
+	msgid, err := file.Seek(0, os.SEEK_END)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -275,7 +280,7 @@ func (storage *GroupMessageFile) saveMessage(msg *Message) int64 {
 	binary.Write(buffer, binary.BigEndian, int32(MAGIC))
 	buf := buffer.Bytes()
 
-	n, err := storage.file.Write(buf)
+	n, err := file.Write(buf)
 	if err != nil {
 		log.Fatal("file write err:", err)
 	}
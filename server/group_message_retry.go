@@ -0,0 +1,191 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/GoBelieveIO/im_service/protocol"
+)
+
+// 等待重试的消息数量超过此值时直接保存到dead letter
+const GROUP_DELIVER_RETRY_LIMIT = 10000
+
+// 发送失败的成员等待重试, 不阻塞之后的消息
+type groupRetry struct {
+	gm      *PendingGroupMessage
+	hybrid  bool
+	ref     *Message //已经保存到群组消息队列中的消息引用
+	retries int
+	ts      time.Time //下次重试的时间
+}
+
+// retry文件和dead letter文件的格式相同, 每轮重试之后重写为仍然等待重试的成员
+// 重启之后重新加载文件中的消息, 最后一轮重试中发送成功的成员可能会重复发送
+func (storage *GroupMessageDeliver) retryPath() string {
+	return fmt.Sprintf("%s/retry_letters", storage.root)
+}
+
+func (storage *GroupMessageDeliver) openRetryFile() {
+	storage.retry_file = storage.openLetterFile(storage.retryPath())
+
+	//消息引用没有保存, 重启之后直接保存完整的消息, 避免群组消息队列中重复保存
+	now := time.Now()
+	for _, letter := range storage.readLetters(storage.retryPath()) {
+		r := &groupRetry{gm: letter.PendingGroupMessage, retries: 1, ts: now.Add(GROUP_DELIVER_RETRY_INTERVAL)}
+		storage.retries = append(storage.retries, r)
+	}
+	atomic.StoreInt64(&storage.retry_pending_count, int64(len(storage.retries)))
+}
+
+// 第一次发送失败之后加入重试队列
+func (storage *GroupMessageDeliver) addRetry(gm *PendingGroupMessage, hybrid bool, ref *Message) {
+	storage.retry_mutex.Lock()
+	defer storage.retry_mutex.Unlock()
+
+	if len(storage.retries) >= GROUP_DELIVER_RETRY_LIMIT {
+		log.Errorf("retry queue full, save group message:%d %d members:%d to dead letter", gm.sender, gm.gid, len(gm.members))
+		storage.saveDeadLetter(gm)
+		return
+	}
+
+	m := &Message{Cmd: MSG_PENDING_GROUP_MESSAGE, Version: MENTION_VERSION, Body: gm}
+	storage.writeMessage(storage.retry_file, m)
+	r := &groupRetry{gm: gm, hybrid: hybrid, ref: ref, retries: 1, ts: time.Now().Add(GROUP_DELIVER_RETRY_INTERVAL)}
+	storage.retries = append(storage.retries, r)
+	atomic.StoreInt64(&storage.retry_pending_count, int64(len(storage.retries)))
+}
+
+// 取出到达重试时间的消息
+func (storage *GroupMessageDeliver) popRetries(now time.Time) []*groupRetry {
+	storage.retry_mutex.Lock()
+	defer storage.retry_mutex.Unlock()
+
+	due := make([]*groupRetry, 0)
+	remains := make([]*groupRetry, 0, len(storage.retries))
+	for _, r := range storage.retries {
+		if now.Before(r.ts) {
+			remains = append(remains, r)
+		} else {
+			due = append(due, r)
+		}
+	}
+	storage.retries = remains
+	return due
+}
+
+// 重试之后仍然失败的消息重新加入队列
+// 发送成功的成员和保存到dead letter的消息从retry文件中删除
+func (storage *GroupMessageDeliver) pushRetries(retries []*groupRetry) {
+	storage.retry_mutex.Lock()
+	defer storage.retry_mutex.Unlock()
+
+	storage.retries = append(storage.retries, retries...)
+	atomic.StoreInt64(&storage.retry_pending_count, int64(len(storage.retries)))
+
+	err := storage.rewriteRetryFile()
+	if err != nil {
+		log.Error("rewrite retry file err:", err)
+	}
+}
+
+// 队列中的消息写入新的文件, 调用者持有retry_mutex
+func (storage *GroupMessageDeliver) rewriteRetryFile() error {
+	tmp_path := storage.retryPath() + ".tmp"
+	file, err := os.OpenFile(tmp_path, os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	storage.WriteHeader(file)
+
+	for _, r := range storage.retries {
+		m := &Message{Cmd: MSG_PENDING_GROUP_MESSAGE, Version: MENTION_VERSION, Body: r.gm}
+		storage.writeMessage(file, m)
+	}
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = os.Rename(tmp_path, storage.retryPath())
+	if err != nil {
+		file.Close()
+		return err
+	}
+	storage.retry_file.Close()
+	storage.retry_file = file
+	return nil
+}
+
+func (storage *GroupMessageDeliver) retry(r *groupRetry) bool {
+	atomic.AddInt64(&storage.retry_count, 1)
+	if r.hybrid && r.ref == nil {
+		r.ref = storage.saveGroupMessageRef(r.gm)
+		if r.ref == nil {
+			return false
+		}
+	}
+
+	failed := storage.sendGroupMessage(r.gm, r.ref, &Metadata{})
+	if len(failed) == 0 {
+		return true
+	}
+	//只保留仍然失败的成员, 之后重写retry文件
+	gm := *r.gm
+	gm.members = failed
+	r.gm = &gm
+	return false
+}
+
+// 重试间隔从GROUP_DELIVER_RETRY_INTERVAL开始每次加倍
+func (storage *GroupMessageDeliver) retryLoop() {
+	ticker := time.NewTicker(GROUP_DELIVER_RETRY_INTERVAL)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		due := storage.popRetries(now)
+		if len(due) == 0 {
+			continue
+		}
+
+		remains := make([]*groupRetry, 0)
+		for _, r := range due {
+			if storage.retry(r) {
+				continue
+			}
+			if r.retries >= GROUP_DELIVER_MAX_RETRY {
+				log.Errorf("send group message:%d %d failure, save %d members to dead letter", r.gm.sender, r.gm.gid, len(r.gm.members))
+				storage.saveDeadLetter(r.gm)
+				continue
+			}
+			interval := GROUP_DELIVER_RETRY_INTERVAL << uint(r.retries)
+			log.Warningf("send group message:%d %d failure, members:%d retry after:%s", r.gm.sender, r.gm.gid, len(r.gm.members), interval)
+			r.retries++
+			r.ts = time.Now().Add(interval)
+			remains = append(remains, r)
+		}
+		storage.pushRetries(remains)
+	}
+}
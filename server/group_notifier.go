@@ -0,0 +1,276 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/GoBelieveIO/im_service/protocol"
+	"github.com/GoBelieveIO/im_service/set"
+)
+
+// 同一个事件只通知一次, 所有im都会读到同一个事件
+const GROUP_NOTIFICATION_EXPIRE = 24 * 60 * 60
+
+// 保存失败之后重试的次数和间隔(秒), 重试失败之后释放事件
+const GROUP_NOTIFICATION_RETRY = 3
+const GROUP_NOTIFICATION_RETRY_INTERVAL = 5
+
+type groupNotification struct {
+	event   *GroupEvent
+	prefix  string          //groups_actions的前缀, 和action_id一起唯一标识事件
+	members map[int64]int64 //nil表示群组没有缓存, 从GroupStore加载
+	super   bool
+
+	acquired bool       //已经获取事件, 由当前im负责通知
+	pending  set.IntSet //重试时还没有保存通知的成员
+	retries  int
+}
+
+// 根据群组事件生成群通知消息
+type GroupNotifier struct {
+	c              chan *groupNotification
+	store          GroupStore
+	redis_pool     *redis.Pool
+	app            *App
+	rpc_storage    *RPCStorage
+	server_summary *ServerSummary
+}
+
+func NewGroupNotifier(store GroupStore, redis_pool *redis.Pool, app *App, rpc_storage *RPCStorage, server_summary *ServerSummary) *GroupNotifier {
+	n := &GroupNotifier{}
+	n.c = make(chan *groupNotification, 10000)
+	n.store = store
+	n.redis_pool = redis_pool
+	n.app = app
+	n.rpc_storage = rpc_storage
+	n.server_summary = server_summary
+	return n
+}
+
+func isNotificationEvent(name string) bool {
+	return name == GROUP_EVENT_MEMBER_ADD || name == GROUP_EVENT_MEMBER_REMOVE ||
+		name == GROUP_EVENT_DISBAND || name == GROUP_EVENT_UPGRADE
+}
+
+func (notifier *GroupNotifier) Notify(prefix string, event *GroupEvent, members map[int64]int64, super bool) {
+	notifier.enqueue(&groupNotification{event: event, prefix: prefix, members: members, super: super})
+}
+
+func (notifier *GroupNotifier) enqueue(n *groupNotification) {
+	select {
+	case notifier.c <- n:
+	default:
+		atomic.AddInt64(&notifier.server_summary.group_notification_dropped_count, 1)
+		log.Errorf("group notification channel full, drop action:%s:%d group:%d",
+			n.prefix, n.event.ActionId, n.event.GroupId)
+		if n.acquired {
+			notifier.release(n)
+		}
+	}
+}
+
+func (notifier *GroupNotifier) Run() {
+	go notifier.run()
+}
+
+func (notifier *GroupNotifier) run() {
+	for n := range notifier.c {
+		notifier.send(n)
+	}
+}
+
+func groupNotificationKey(prefix string, action_id int64) string {
+	return fmt.Sprintf("group_notification_%s_%d", prefix, action_id)
+}
+
+// 返回false表示事件已经被其它im或者之前的读取通知过
+// 获取之后由当前im负责重试, 重试失败时释放
+func (notifier *GroupNotifier) acquire(prefix string, action_id int64) (bool, error) {
+	conn := notifier.redis_pool.Get()
+	defer conn.Close()
+
+	key := groupNotificationKey(prefix, action_id)
+	_, err := redis.String(conn.Do("SET", key, 1, "EX", GROUP_NOTIFICATION_EXPIRE, "NX"))
+	if err == redis.ErrNil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func groupNotificationContent(event *GroupEvent) string {
+	obj := make(map[string]interface{})
+	obj["group_id"] = event.GroupId
+	obj["actor"] = event.Operator
+	if event.MemberId != 0 {
+		obj["target"] = event.MemberId
+	}
+	obj["action_id"] = event.ActionId
+	obj["timestamp"] = time.Now().Unix()
+	if event.Name == GROUP_EVENT_UPGRADE {
+		obj["super"] = event.IsSuper
+	}
+
+	v := make(map[string]interface{})
+	v[event.Name] = obj
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// 释放之后重新读取群组事件(im重启)时可以再次通知
+func (notifier *GroupNotifier) release(n *groupNotification) {
+	conn := notifier.redis_pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", groupNotificationKey(n.prefix, n.event.ActionId))
+	if err != nil {
+		log.Warning("release group notification err:", err)
+	}
+}
+
+func (notifier *GroupNotifier) retry(n *groupNotification) {
+	if n.retries >= GROUP_NOTIFICATION_RETRY {
+		log.Errorf("group notification action:%s:%d group:%d failed, pending members:%d",
+			n.prefix, n.event.ActionId, n.event.GroupId, len(n.pending))
+		atomic.AddInt64(&notifier.server_summary.group_notification_dropped_count, 1)
+		if n.acquired {
+			notifier.release(n)
+		}
+		return
+	}
+	n.retries++
+	time.AfterFunc(GROUP_NOTIFICATION_RETRY_INTERVAL*time.Second, func() {
+		notifier.enqueue(n)
+	})
+}
+
+func (notifier *GroupNotifier) send(n *groupNotification) {
+	event := n.event
+	if event.ActionId == 0 {
+		log.Warningf("group event:%s without action id, ignore notification", event.Name)
+		return
+	}
+
+	//解散之后无法从GroupStore加载成员, 由缓存了群组的im通知
+	if n.members == nil && event.Name == GROUP_EVENT_DISBAND {
+		log.Warningf("group:%d not cached, leave disband notification action:%s:%d to other im",
+			event.GroupId, n.prefix, event.ActionId)
+		return
+	}
+
+	if !n.acquired {
+		ok, err := notifier.acquire(n.prefix, event.ActionId)
+		if err != nil {
+			log.Warningf("acquire group notification action:%s:%d err:%s", n.prefix, event.ActionId, err)
+			notifier.retry(n)
+			return
+		}
+		if !ok {
+			log.Infof("group action:%s:%d notified", n.prefix, event.ActionId)
+			return
+		}
+		n.acquired = true
+	}
+
+	if n.pending == nil {
+		members := n.members
+		if members == nil {
+			group, err := notifier.store.LoadGroup(event.GroupId)
+			if err == errGroupNotFound {
+				log.Warningf("group:%d not found, drop notification action:%s:%d", event.GroupId, n.prefix, event.ActionId)
+				atomic.AddInt64(&notifier.server_summary.group_notification_dropped_count, 1)
+				notifier.release(n)
+				return
+			} else if err != nil {
+				log.Warningf("load group:%d err:%s", event.GroupId, err)
+				notifier.retry(n)
+				return
+			}
+			members = group.Members()
+			n.super = group.super
+		}
+
+		s := set.NewIntSet()
+		for uid := range members {
+			s.Add(uid)
+		}
+		//被移除的成员也需要收到通知
+		if event.MemberId != 0 {
+			s.Add(event.MemberId)
+		}
+		n.pending = s
+	}
+
+	content := groupNotificationContent(event)
+	msg := &Message{Cmd: MSG_GROUP_NOTIFICATION, Body: &GroupNotification{content}}
+	count := len(n.pending)
+	if n.super {
+		msgid, _, err := notifier.rpc_storage.SaveGroupMessage(event.AppId, event.GroupId, 0, msg)
+		if err != nil {
+			log.Warningf("save group notification:%d err:%s", event.GroupId, err)
+			notifier.retry(n)
+			return
+		}
+		for member := range n.pending {
+			notify := &Message{Cmd: MSG_SYNC_GROUP_NOTIFY, Body: &GroupSyncNotify{event.GroupId, msgid}}
+			notifier.app.SendAnonymousMessage(event.AppId, member, notify)
+		}
+	} else if !notifier.savePeerNotification(n, msg) {
+		notifier.retry(n)
+		return
+	}
+	log.Infof("group notification action:%s:%d group:%d members:%d", n.prefix, event.ActionId, event.GroupId, count)
+}
+
+// 成员按照所在的ims节点分批保存, 保存成功的成员从pending中删除, 重试时不会重复保存
+func (notifier *GroupNotifier) savePeerNotification(n *groupNotification, msg *Message) bool {
+	event := n.event
+	batch_members := make(map[int64][]int64)
+	for member := range n.pending {
+		index := notifier.rpc_storage.GetStorageRPCIndex(member)
+		batch_members[index] = append(batch_members[index], member)
+	}
+
+	for _, mb := range batch_members {
+		r, err := notifier.rpc_storage.SavePeerGroupMessage(event.AppId, mb, 0, msg)
+		if err != nil {
+			log.Warningf("save group notification:%d members:%d err:%s", event.GroupId, len(mb), err)
+			continue
+		}
+		if len(r) != len(mb) {
+			log.Warningf("save group notification:%d err:%d %d", event.GroupId, len(r), len(mb))
+			continue
+		}
+		for i, member := range mb {
+			n.pending.Remove(member)
+			notify := &Message{Cmd: MSG_SYNC_NOTIFY, Body: &SyncNotify{sync_key: r[i].MsgID}}
+			notifier.app.SendAnonymousMessage(event.AppId, member, notify)
+		}
+	}
+	return len(n.pending) == 0
+}
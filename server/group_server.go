@@ -30,8 +30,11 @@ import (
 	. "github.com/GoBelieveIO/im_service/protocol"
 )
 
+// 单条群消息最多@的成员数量
+const GROUP_MENTION_LIMIT = 100
+
 func (server *Server) HandleSuperGroupMessage(client *Client, msg *IMMessage, group *Group) (int64, int64, error) {
-	m := &Message{Cmd: MSG_GROUP_IM, Version: DEFAULT_VERSION, Body: msg}
+	m := &Message{Cmd: MSG_GROUP_IM, Version: groupMessageVersion(msg), Body: msg}
 	msgid, prev_msgid, err := server.rpc_storage.SaveGroupMessage(client.appid, msg.receiver, client.device_ID, m)
 	if err != nil {
 		log.Errorf("save group message:%d %d err:%s", msg.sender, msg.receiver, err)
@@ -67,9 +70,10 @@ func (server *Server) HandleGroupMessage(client *Client, im *IMMessage, group *G
 		i += 1
 	}
 
+	gm.mentions = im.mentions
 	gm.content = im.content
 	deliver := server.app.GetGroupMessageDeliver(group.gid)
-	m := &Message{Cmd: MSG_PENDING_GROUP_MESSAGE, Body: gm}
+	m := &Message{Cmd: MSG_PENDING_GROUP_MESSAGE, Version: MENTION_VERSION, Body: gm}
 
 	c := make(chan *Metadata, 1)
 	callback_id := deliver.SaveMessage(m, c)
@@ -83,6 +87,27 @@ func (server *Server) HandleGroupMessage(client *Client, im *IMMessage, group *G
 	}
 }
 
+// 去掉重复的和不在群内的成员, 不能@自己
+func FilterMentions(group *Group, sender int64, mentions []int64) []int64 {
+	if len(mentions) == 0 {
+		return nil
+	}
+	r := make([]int64, 0, len(mentions))
+	m := make(map[int64]bool)
+	for _, uid := range mentions {
+		if m[uid] || uid == sender || !group.IsMember(uid) {
+			continue
+		}
+		m[uid] = true
+		r = append(r, uid)
+		if len(r) >= GROUP_MENTION_LIMIT {
+			log.Warningf("group:%d sender:%d mention count exceed limit", group.gid, sender)
+			break
+		}
+	}
+	return r
+}
+
 func (server *Server) HandleGroupIMMessage(client *Client, message *Message) {
 	msg := message.Body.(*IMMessage)
 	seq := message.Seq
@@ -95,8 +120,8 @@ func (server *Server) HandleGroupIMMessage(client *Client, message *Message) {
 		log.Warningf("im message sender:%d client uid:%d\n", msg.sender, client.uid)
 		return
 	}
-	if message.Flag&MESSAGE_FLAG_TEXT != 0 {
-		FilterDirtyWord(server.filter, msg)
+	if !server.filterContent(client, message.Seq, MSG_GROUP_IM, msg.receiver, &msg.content) {
+		return
 	}
 
 	msg.timestamp = int32(time.Now().Unix())
@@ -118,10 +143,28 @@ func (server *Server) HandleGroupIMMessage(client *Client, message *Message) {
 	}
 
 	if group.GetMemberMute(msg.sender) {
+		ack := &Message{Cmd: MSG_ACK, Body: &MessageACK{seq: int32(seq), status: ACK_GROUP_MEMBER_MUTED}}
+		client.EnqueueMessage(ack)
 		log.Warningf("sender:%d is mute in group", msg.sender)
 		return
 	}
 
+	if group.IsMuted(time.Now().Unix()) && !group.IsAdmin(msg.sender) {
+		ack := &Message{Cmd: MSG_ACK, Body: &MessageACK{seq: int32(seq), status: ACK_GROUP_MUTED}}
+		client.EnqueueMessage(ack)
+		log.Warningf("sender:%d group:%d is muted", msg.sender, msg.receiver)
+		return
+	}
+
+	if !group.CanSpeak(msg.sender) {
+		ack := &Message{Cmd: MSG_ACK, Body: &MessageACK{seq: int32(seq), status: ACK_GROUP_ANNOUNCEMENT_ONLY}}
+		client.EnqueueMessage(ack)
+		log.Warningf("sender:%d can't speak in announcement group:%d", msg.sender, msg.receiver)
+		return
+	}
+
+	msg.mentions = FilterMentions(group, msg.sender, msg.mentions)
+
 	var meta *Metadata
 	var flag int
 	if group.super {
@@ -186,19 +229,28 @@ func (server *Server) HandleGroupSync(client *Client, msg *Message) {
 	messages := gh.Messages
 
 	sk := &GroupSyncKey{sync_key: last_id, group_id: group_id}
+	mention := &GroupMentionCount{group_id: group_id}
 	client.EnqueueMessage(&Message{Cmd: MSG_SYNC_GROUP_BEGIN, Body: sk})
 	for i := len(messages) - 1; i >= 0; i-- {
 		msg := messages[i]
 		log.Info("message:", msg.MsgID, Command(msg.Cmd))
-		m := &Message{Cmd: int(msg.Cmd), Version: DEFAULT_VERSION}
-		m.FromData(msg.Raw)
+		m := decodeHistoryMessage(msg)
 		sk.sync_key = msg.MsgID
 		if client.isSender(m, msg.DeviceID) {
 			m.Flag |= MESSAGE_FLAG_SELF
 		}
+		if im, ok := m.Body.(*IMMessage); ok && m.Cmd == MSG_GROUP_IM && im.IsMentioned(client.uid) {
+			mention.count += 1
+			mention.last_mention_id = msg.MsgID
+		}
 		client.EnqueueMessage(m)
 	}
 
+	//支持@成员列表的客户端才会收到@计数
+	if mention.count > 0 && client.version >= MENTION_VERSION {
+		client.EnqueueMessage(&Message{Cmd: MSG_SYNC_GROUP_MENTION, Body: mention})
+	}
+
 	if gh.LastMsgID < last_id && gh.LastMsgID > 0 {
 		sk.sync_key = gh.LastMsgID
 		log.Warningf("group:%d client last id:%d server last id:%d", group_id, last_id, gh.LastMsgID)
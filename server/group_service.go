@@ -27,6 +27,9 @@ import (
 
 	"github.com/gomodule/redigo/redis"
 
+	. "github.com/GoBelieveIO/im_service/protocol"
+	"github.com/GoBelieveIO/im_service/set"
+
 	_ "github.com/go-sql-driver/mysql"
 
 	log "github.com/sirupsen/logrus"
@@ -37,13 +40,26 @@ type GroupService struct {
 	redis_pool   *redis.Pool
 	redis_config *RedisConfig
 
+	action_prefix string //groups_actions的前缀, 业务服务器重置action id时改变
 	action_id     int64
 	last_entry_id string
 	dirty         bool
+
+	notifier *GroupNotifier //可选, 群组事件生成群通知消息
+
+	app_route *AppRoute //可选, 通知在线的群组成员群组发生变化
 }
 
 func NewGroupService(redis_pool *redis.Pool, mysqldb_datasource string, redis_config *RedisConfig) *GroupService {
-	gm := NewGroupManager(mysqldb_datasource)
+	store, err := NewGroupStore(STORE_MYSQL, mysqldb_datasource, "")
+	if err != nil {
+		log.Fatal("open db:", err)
+	}
+	return NewGroupServiceWithStore(redis_pool, store, redis_config)
+}
+
+func NewGroupServiceWithStore(redis_pool *redis.Pool, store GroupStore, redis_config *RedisConfig) *GroupService {
+	gm := NewGroupManager(store)
 	m := &GroupService{GroupManager: gm}
 	m.action_id = 0
 	m.last_entry_id = ""
@@ -62,6 +78,19 @@ func (group_manager *GroupService) handleEvent(event *GroupEvent) {
 		//reload later
 		group_manager.dirty = true
 		log.Warning("action nonsequence:", group_manager.action_id, prev_id, action_id)
+		//action id被重置, 使用新的前缀
+		if prev_id == 0 {
+			if prefix, _, err := group_manager.getActionID(); err == nil {
+				group_manager.action_prefix = prefix
+			}
+		}
+	}
+
+	//成员变化之前的群组成员, 增删成员时会复制members, 不会影响这里的members
+	var members map[int64]int64
+	group := group_manager.FindGroup(event.GroupId)
+	if group != nil {
+		members = group.Members()
 	}
 
 	if event.Name == GROUP_EVENT_CREATE {
@@ -78,42 +107,119 @@ func (group_manager *GroupService) handleEvent(event *GroupEvent) {
 		group_manager.HandleMemberRemove(event)
 	} else if event.Name == GROUP_EVENT_MEMBER_MUTE {
 		group_manager.HandleMute(event)
+	} else if event.Name == GROUP_EVENT_MEMBER_ROLE {
+		group_manager.HandleRole(event)
+	} else if event.Name == GROUP_EVENT_ANNOUNCEMENT {
+		group_manager.HandleAnnouncement(event)
+	} else if event.Name == GROUP_EVENT_MUTE {
+		group_manager.HandleGroupMute(event)
+	} else if event.Name == GROUP_EVENT_MEMBER_NICKNAME {
+		group_manager.HandleNickname(event)
 	} else {
 		log.Warning("unknow event:", event.Name)
 	}
+
+	if group_manager.app_route != nil && event.Name != GROUP_EVENT_CREATE {
+		super := group != nil && group.super
+		if g := group_manager.FindGroup(event.GroupId); g != nil && g.super {
+			super = true
+		}
+		group_manager.notifyChanged(event, members, super)
+	}
+
+	if group_manager.notifier != nil && isNotificationEvent(event.Name) {
+		super := false
+		if group != nil {
+			if event.Name == GROUP_EVENT_MEMBER_ADD || event.Name == GROUP_EVENT_UPGRADE {
+				members = group.Members()
+			}
+			super = group.super
+		}
+		group_manager.notifier.Notify(group_manager.action_prefix, event, members, super)
+	}
 	group_manager.action_id = action_id
 	group_manager.last_entry_id = event.Id
 }
 
-func (group_manager *GroupService) getActionID() (int64, error) {
+// 成员变化等群组事件转换为群通知消息
+// Start之后读取到的事件才会生成通知, 启动之前创建notifier才不会遗漏
+func (group_manager *GroupService) EnableNotification(app *App, rpc_storage *RPCStorage, server_summary *ServerSummary) {
+	group_manager.notifier = NewGroupNotifier(group_manager.store, group_manager.redis_pool, app, rpc_storage, server_summary)
+	group_manager.notifier.Run()
+}
+
+// 群组信息变化时通知本机在线的成员
+// app_route在处理群组事件的goroutine中读取, 没有加锁, 只能在Start之前设置
+func (group_manager *GroupService) EnableChangedNotification(app_route *AppRoute) {
+	group_manager.app_route = app_route
+}
+
+// 通知本机在线的群组成员(包括被移除的成员), 客户端收到后按需重新获取群组信息
+// 超级群成员太多, 只通知事件相关的成员
+func (group_manager *GroupService) notifyChanged(event *GroupEvent, members map[int64]int64, super bool) {
+	route := group_manager.app_route.FindRoute(event.AppId)
+	if route == nil {
+		return
+	}
+
+	s := set.NewIntSet()
+	if !super {
+		for uid := range members {
+			s.Add(uid)
+		}
+		if group := group_manager.FindGroup(event.GroupId); group != nil {
+			for uid := range group.Members() {
+				s.Add(uid)
+			}
+		}
+	}
+	if event.MemberId != 0 {
+		s.Add(event.MemberId)
+	}
+
+	changed := &GroupChanged{group_id: event.GroupId, action_id: event.ActionId, event: event.Name}
+	msg := &Message{Cmd: MSG_GROUP_CHANGED, Body: changed}
+	for uid := range s {
+		clients := route.FindClientSet(uid)
+		for c := range clients {
+			//旧版本的客户端不支持MSG_GROUP_CHANGED
+			if c.version < CHANGED_NOTIFICATION_VERSION {
+				continue
+			}
+			c.EnqueueNonBlockMessage(msg)
+		}
+	}
+}
+
+func (group_manager *GroupService) getActionID() (string, int64, error) {
 	conn := group_manager.redis_pool.Get()
 	defer conn.Close()
 
 	actions, err := redis.String(conn.Do("GET", "groups_actions"))
 	if err != nil && err != redis.ErrNil {
 		log.Info("hget error:", err)
-		return 0, err
+		return "", 0, err
 	}
 	if actions == "" {
-		return 0, nil
+		return "0", 0, nil
 	} else {
 		arr := strings.Split(actions, ":")
 		if len(arr) != 2 {
 			log.Error("groups_actions invalid:", actions)
-			return 0, errors.New("groups actions invalid")
+			return "", 0, errors.New("groups actions invalid")
 		}
 		_, err := strconv.ParseInt(arr[0], 10, 64)
 		if err != nil {
 			log.Info("error:", err, actions)
-			return 0, err
+			return "", 0, err
 		}
 
 		action_id, err := strconv.ParseInt(arr[1], 10, 64)
 		if err != nil {
 			log.Info("error:", err, actions)
-			return 0, err
+			return "", 0, err
 		}
-		return action_id, nil
+		return arr[0], action_id, nil
 	}
 }
 
@@ -151,7 +257,7 @@ func (group_manager *GroupService) getLastEntryID() (string, error) {
 func (group_manager *GroupService) load() {
 	//循环直到成功
 	for {
-		action_id, err := group_manager.getActionID()
+		prefix, action_id, err := group_manager.getActionID()
 		if err != nil {
 			time.Sleep(1 * time.Second)
 			continue
@@ -162,6 +268,7 @@ func (group_manager *GroupService) load() {
 			continue
 		}
 		group_manager.last_entry_id = entry_id
+		group_manager.action_prefix = prefix
 		group_manager.action_id = action_id
 		group_manager.dirty = false
 		log.Info("group action id:", action_id)
@@ -0,0 +1,359 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const STORE_MYSQL = "mysql"
+const STORE_HTTP = "http"
+const STORE_MEMORY = "memory"
+
+const STORE_HTTP_TIMEOUT = 5 //秒
+
+var errGroupNotFound = errors.New("group not found")
+
+// 群组数据的存储, 群组的变化通过group_manager_stream通知
+type GroupStore interface {
+	LoadGroup(group_id int64) (*Group, error)
+
+	SetMemberMute(group_id int64, uid int64, mute bool) error
+	SetMemberRole(group_id int64, uid int64, role int) error
+	SetAnnouncement(group_id int64, announcement bool) error
+	SetGroupMute(group_id int64, mute bool, mute_until int64) error
+}
+
+func NewGroupStore(store_type string, mysqldb_datasource string, url string) (GroupStore, error) {
+	switch store_type {
+	case "", STORE_MYSQL:
+		db, err := sql.Open("mysql", mysqldb_datasource)
+		if err != nil {
+			return nil, err
+		}
+		return NewMySQLGroupStore(db), nil
+	case STORE_HTTP:
+		if url == "" {
+			return nil, errors.New("group store url is empty")
+		}
+		return NewHTTPGroupStore(url), nil
+	case STORE_MEMORY:
+		store := NewMemoryGroupStore()
+		//memory时url为初始群组数据的json文件
+		if url != "" {
+			err := store.LoadFile(url)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown group store:%s", store_type)
+	}
+}
+
+type MySQLGroupStore struct {
+	db *sql.DB
+}
+
+func NewMySQLGroupStore(db *sql.DB) *MySQLGroupStore {
+	return &MySQLGroupStore{db: db}
+}
+
+func (store *MySQLGroupStore) LoadGroup(group_id int64) (*Group, error) {
+	group, err := LoadGroup(store.db, group_id)
+	if err == sql.ErrNoRows {
+		return nil, errGroupNotFound
+	}
+	return group, err
+}
+
+func (store *MySQLGroupStore) SetMemberMute(group_id int64, uid int64, mute bool) error {
+	_, err := store.db.Exec("UPDATE group_member SET mute=? WHERE group_id=? AND uid=?", boolToInt(mute), group_id, uid)
+	return err
+}
+
+func (store *MySQLGroupStore) SetMemberRole(group_id int64, uid int64, role int) error {
+	_, err := store.db.Exec("UPDATE group_member SET role=? WHERE group_id=? AND uid=?", role, group_id, uid)
+	return err
+}
+
+func (store *MySQLGroupStore) SetAnnouncement(group_id int64, announcement bool) error {
+	_, err := store.db.Exec("UPDATE `group` SET announcement=? WHERE id=?", boolToInt(announcement), group_id)
+	return err
+}
+
+func (store *MySQLGroupStore) SetGroupMute(group_id int64, mute bool, mute_until int64) error {
+	_, err := store.db.Exec("UPDATE `group` SET mute=?, mute_until=? WHERE id=?", boolToInt(mute), mute_until, group_id)
+	return err
+}
+
+// 群组数据由用户服务提供
+// GET {url}/groups/{group_id}
+// POST {url}/groups/{group_id} {"announcement":} or {"mute":, "mute_until":}
+// POST {url}/groups/{group_id}/members/{uid} {"mute":} or {"role":}
+type HTTPGroupStore struct {
+	url    string
+	client *http.Client
+}
+
+type httpGroupMember struct {
+	Uid       int64  `json:"uid"`
+	Timestamp int64  `json:"timestamp"`
+	Mute      bool   `json:"mute"`
+	Role      int    `json:"role"`
+	Nickname  string `json:"nickname"`
+}
+
+type httpGroup struct {
+	Id           int64              `json:"id"`
+	AppId        int64              `json:"appid"`
+	Super        bool               `json:"super"`
+	Announcement bool               `json:"announcement"`
+	Mute         bool               `json:"mute"`
+	MuteUntil    int64              `json:"mute_until"`
+	Name         string             `json:"name"`
+	Notice       string             `json:"notice"`
+	Members      []*httpGroupMember `json:"members"`
+}
+
+func NewHTTPGroupStore(url string) *HTTPGroupStore {
+	client := &http.Client{Timeout: STORE_HTTP_TIMEOUT * time.Second}
+	return &HTTPGroupStore{url: url, client: client}
+}
+
+func (store *HTTPGroupStore) LoadGroup(group_id int64) (*Group, error) {
+	resp, err := store.client.Get(fmt.Sprintf("%s/groups/%d", store.url, group_id))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errGroupNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("load group:%d status:%d", group_id, resp.StatusCode)
+	}
+
+	g := &httpGroup{}
+	err = json.NewDecoder(resp.Body).Decode(g)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make(map[int64]int64)
+	nicknames := make(map[int64]string)
+	for _, m := range g.Members {
+		members[m.Uid] = m.Timestamp | (int64(boolToInt(m.Mute)) << 31) | (int64(m.Role&0x03) << 32)
+		if m.Nickname != "" {
+			nicknames[m.Uid] = m.Nickname
+		}
+	}
+
+	var group *Group
+	if g.Super {
+		group = NewSuperGroup(group_id, g.AppId, members)
+	} else {
+		group = NewGroup(group_id, g.AppId, members)
+	}
+	group.announcement = g.Announcement
+	group.mute = g.Mute
+	group.mute_until = g.MuteUntil
+	group.name = g.Name
+	group.notice = g.Notice
+	group.nicknames = nicknames
+	return group, nil
+}
+
+func (store *HTTPGroupStore) post(path string, obj map[string]interface{}) error {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	resp, err := store.client.Post(store.url+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("post %s status:%d", path, resp.StatusCode)
+	}
+	return nil
+}
+
+func (store *HTTPGroupStore) SetMemberMute(group_id int64, uid int64, mute bool) error {
+	return store.post(fmt.Sprintf("/groups/%d/members/%d", group_id, uid), map[string]interface{}{"mute": mute})
+}
+
+func (store *HTTPGroupStore) SetMemberRole(group_id int64, uid int64, role int) error {
+	return store.post(fmt.Sprintf("/groups/%d/members/%d", group_id, uid), map[string]interface{}{"role": role})
+}
+
+func (store *HTTPGroupStore) SetAnnouncement(group_id int64, announcement bool) error {
+	return store.post(fmt.Sprintf("/groups/%d", group_id), map[string]interface{}{"announcement": announcement})
+}
+
+func (store *HTTPGroupStore) SetGroupMute(group_id int64, mute bool, mute_until int64) error {
+	return store.post(fmt.Sprintf("/groups/%d", group_id), map[string]interface{}{"mute": mute, "mute_until": mute_until})
+}
+
+// 内存中的群组数据, 用于测试和单机部署
+// 返回的Group和GroupManager中缓存的是同一个对象, 修改立即生效, 不需要读取group_manager_stream
+type MemoryGroupStore struct {
+	mutex  sync.Mutex
+	groups map[int64]*Group
+}
+
+func NewMemoryGroupStore() *MemoryGroupStore {
+	return &MemoryGroupStore{groups: make(map[int64]*Group)}
+}
+
+// {"groups":[{"id":, "appid":, "super":, "owner":, "admins":[], "members":[]}]}
+func (store *MemoryGroupStore) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var f struct {
+		Groups []struct {
+			ID      int64   `json:"id"`
+			AppID   int64   `json:"appid"`
+			Super   bool    `json:"super"`
+			Owner   int64   `json:"owner"`
+			Admins  []int64 `json:"admins"`
+			Members []int64 `json:"members"`
+		} `json:"groups"`
+	}
+	err = json.Unmarshal(data, &f)
+	if err != nil {
+		return err
+	}
+
+	for _, g := range f.Groups {
+		store.AddGroup(g.ID, g.AppID, g.Super, g.Owner)
+		for _, uid := range g.Members {
+			store.AddMember(g.ID, uid)
+		}
+		for _, uid := range g.Admins {
+			store.AddMember(g.ID, uid)
+			store.SetMemberRole(g.ID, uid, GROUP_ROLE_ADMIN)
+		}
+	}
+	return nil
+}
+
+func (store *MemoryGroupStore) findGroup(group_id int64) (*Group, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	group, ok := store.groups[group_id]
+	if !ok {
+		return nil, errGroupNotFound
+	}
+	return group, nil
+}
+
+func (store *MemoryGroupStore) LoadGroup(group_id int64) (*Group, error) {
+	return store.findGroup(group_id)
+}
+
+func (store *MemoryGroupStore) AddGroup(group_id int64, appid int64, super bool, owner int64) *Group {
+	members := make(map[int64]int64)
+	members[owner] = time.Now().Unix() | (GROUP_ROLE_OWNER << 32)
+	var group *Group
+	if super {
+		group = NewSuperGroup(group_id, appid, members)
+	} else {
+		group = NewGroup(group_id, appid, members)
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.groups[group_id] = group
+	return group
+}
+
+func (store *MemoryGroupStore) RemoveGroup(group_id int64) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.groups, group_id)
+}
+
+func (store *MemoryGroupStore) AddMember(group_id int64, uid int64) error {
+	group, err := store.findGroup(group_id)
+	if err != nil {
+		return err
+	}
+	group.AddMember(uid, int(time.Now().Unix()))
+	return nil
+}
+
+func (store *MemoryGroupStore) RemoveMember(group_id int64, uid int64) error {
+	group, err := store.findGroup(group_id)
+	if err != nil {
+		return err
+	}
+	group.RemoveMember(uid)
+	return nil
+}
+
+func (store *MemoryGroupStore) SetMemberMute(group_id int64, uid int64, mute bool) error {
+	group, err := store.findGroup(group_id)
+	if err != nil {
+		return err
+	}
+	group.SetMemberMute(uid, mute)
+	return nil
+}
+
+func (store *MemoryGroupStore) SetMemberRole(group_id int64, uid int64, role int) error {
+	group, err := store.findGroup(group_id)
+	if err != nil {
+		return err
+	}
+	group.SetMemberRole(uid, role)
+	return nil
+}
+
+func (store *MemoryGroupStore) SetAnnouncement(group_id int64, announcement bool) error {
+	group, err := store.findGroup(group_id)
+	if err != nil {
+		return err
+	}
+	group.SetAnnouncement(announcement)
+	return nil
+}
+
+func (store *MemoryGroupStore) SetGroupMute(group_id int64, mute bool, mute_until int64) error {
+	group, err := store.findGroup(group_id)
+	if err != nil {
+		return err
+	}
+	group.SetMute(mute, mute_until)
+	return nil
+}
@@ -0,0 +1,105 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemoryGroupStoreLoadFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "groups.json")
+	data := `{"groups":[{"id":10, "appid":7, "owner":1, "admins":[2], "members":[3, 4]}]}`
+	err := os.WriteFile(p, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewGroupStore(STORE_MEMORY, "", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	group, err := store.LoadGroup(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group.appid != 7 || group.super || len(group.Members()) != 4 {
+		t.Errorf("group:%+v", group)
+	}
+	if group.GetMemberRole(1) != GROUP_ROLE_OWNER || group.GetMemberRole(2) != GROUP_ROLE_ADMIN || group.GetMemberRole(3) != GROUP_ROLE_MEMBER {
+		t.Error("member role error")
+	}
+
+	//修改直接作用于GroupManager中的同一个对象
+	store.SetAnnouncement(10, true)
+	if !group.IsAnnouncement() || group.CanSpeak(3) || !group.CanSpeak(2) {
+		t.Error("announcement error")
+	}
+
+	_, err = store.LoadGroup(11)
+	if err != errGroupNotFound {
+		t.Errorf("load group 11 err:%v", err)
+	}
+}
+
+func TestGroupManagerMemoryStore(t *testing.T) {
+	store := NewMemoryGroupStore()
+	store.AddGroup(10, 7, false, 1)
+	store.AddMember(10, 2)
+
+	gm := NewGroupManager(store)
+	group := gm.LoadGroup(10)
+	if group == nil || !group.IsMember(2) {
+		t.Fatal("load group from memory store")
+	}
+	store.RemoveMember(10, 2)
+	if gm.FindGroup(10).IsMember(2) {
+		t.Error("member 2 should be removed")
+	}
+}
+
+func TestMemoryRelationshipStore(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "relationship.json")
+	data := `{"friends":[{"appid":7, "uid":1, "friend_uid":2}], "blacklist":[{"appid":7, "uid":2, "friend_uid":3}]}`
+	err := os.WriteFile(p, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewRelationshipStore(STORE_MEMORY, "", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := NewRelationshipPoolWithStore(store, nil)
+	rs := rp.GetRelationship(7, 1, 2)
+	if !rs.IsMyFriend() || rs.IsYourFriend() {
+		t.Errorf("relationship 1-2:%v", rs)
+	}
+	if !rp.GetRelationship(7, 3, 2).IsInYourBlacklist() {
+		t.Error("3 should be in 2's blacklist")
+	}
+
+	//内存存储不缓存, 修改立即生效
+	store.(*MemoryRelationshipStore).SetFriend(7, 2, 1, true)
+	if !rp.GetRelationship(7, 1, 2).IsYourFriend() {
+		t.Error("2 should be 1's friend")
+	}
+}
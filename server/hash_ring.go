@@ -0,0 +1,69 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// 每个节点在环上的虚拟节点数量
+const DEFAULT_HASH_RING_REPLICAS = 160
+
+// 一致性hash环, 节点只和地址相关, 和配置中的顺序无关
+// 增加或者删除节点时,只有少量的用户需要迁移
+type HashRing struct {
+	hashes []uint32
+	nodes  map[uint32]int //hash:节点的索引
+}
+
+func NewHashRing(addrs []string, replicas int) *HashRing {
+	if replicas <= 0 {
+		replicas = DEFAULT_HASH_RING_REPLICAS
+	}
+	ring := &HashRing{nodes: make(map[uint32]int)}
+	for index, addr := range addrs {
+		for i := 0; i < replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s#%d", addr, i)))
+			if _, ok := ring.nodes[h]; ok {
+				continue
+			}
+			ring.nodes[h] = index
+			ring.hashes = append(ring.hashes, h)
+		}
+	}
+	sort.Slice(ring.hashes, func(i, j int) bool { return ring.hashes[i] < ring.hashes[j] })
+	return ring
+}
+
+// 返回key所属节点的索引
+func (ring *HashRing) Get(key int64) int {
+	if len(ring.hashes) == 0 {
+		return 0
+	}
+	h := crc32.ChecksumIEEE([]byte(strconv.FormatInt(key, 10)))
+	i := sort.Search(len(ring.hashes), func(i int) bool { return ring.hashes[i] >= h })
+	if i == len(ring.hashes) {
+		i = 0
+	}
+	return ring.nodes[ring.hashes[i]]
+}
@@ -0,0 +1,67 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"testing"
+)
+
+func TestHashRingOrder(t *testing.T) {
+	addrs1 := []string{"127.0.0.1:13333", "127.0.0.1:13334", "127.0.0.1:13335"}
+	addrs2 := []string{"127.0.0.1:13335", "127.0.0.1:13333", "127.0.0.1:13334"}
+	ring1 := NewHashRing(addrs1, 0)
+	ring2 := NewHashRing(addrs2, 0)
+	for uid := int64(1); uid < 10000; uid++ {
+		if addrs1[ring1.Get(uid)] != addrs2[ring2.Get(uid)] {
+			t.Fatalf("uid:%d %s != %s", uid, addrs1[ring1.Get(uid)], addrs2[ring2.Get(uid)])
+		}
+	}
+}
+
+func TestHashRingAddNode(t *testing.T) {
+	addrs := []string{"127.0.0.1:13333", "127.0.0.1:13334", "127.0.0.1:13335"}
+	ring := NewHashRing(addrs, 0)
+	ring2 := NewHashRing(append(addrs, "127.0.0.1:13336"), 0)
+
+	moved := 0
+	count := 100000
+	for uid := int64(1); uid <= int64(count); uid++ {
+		index := ring.Get(uid)
+		index2 := ring2.Get(uid)
+		if index == index2 {
+			continue
+		}
+		//只有新节点负责的用户需要迁移
+		if index2 != 3 {
+			t.Fatalf("uid:%d moved from:%d to:%d", uid, index, index2)
+		}
+		moved++
+	}
+	if moved < count/8 || moved > count*3/8 {
+		t.Errorf("moved users:%d", moved)
+	}
+}
+
+func TestHashRingEmpty(t *testing.T) {
+	ring := NewHashRing(nil, 0)
+	if ring.Get(100) != 0 {
+		t.Error("empty ring")
+	}
+}
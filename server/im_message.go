@@ -37,9 +37,21 @@ const ACK_NOT_YOUR_FRIEND = 2
 const ACK_IN_YOUR_BLACKLIST = 3
 const ACK_NOT_GROUP_MEMBER = 64
 const ACK_GROUP_NONEXIST = 65
+const ACK_GROUP_ANNOUNCEMENT_ONLY = 66
+const ACK_GROUP_MEMBER_MUTED = 67    //成员被禁言
+const ACK_GROUP_MUTED = 68           //全员禁言
+const ACK_ROOM_LIMIT = 69            //进入的聊天室数量超过限制
+const ACK_ROOM_BANNED = 70           //被禁止进入聊天室
+const ACK_ROOM_SLOW_MODE = 71        //慢速模式, 发送消息的间隔太短
+const ACK_MESSAGE_REQUEST_LIMIT = 72 //发给非好友的消息数量超过限制
+const ACK_SENSITIVE_WORD = 73        //消息包含禁止发送的关键词
+const ACK_MODERATION_REJECTED = 74   //审核接口拒绝发送
+const ACK_RATE_LIMITED = 75          //发送消息的频率超过限制
+const ACK_NOT_ROOM_MEMBER = 76       //不在聊天室中(没有进入或者已经被踢出)
 
 // version1:IMMessage添加时间戳字段
 // version2:MessageACK添加status字段
+// version3:IMMessage添加@成员列表
 func init() {
 	protocol.RegisterMessageCreator(protocol.MSG_AUTH_TOKEN, func() protocol.IMessage { return new(AuthenticationToken) })
 	protocol.RegisterMessageCreator(protocol.MSG_RT, func() protocol.IMessage { return new(RTMessage) })
@@ -63,9 +75,24 @@ func init() {
 	protocol.RegisterMessageCreator(protocol.MSG_NOTIFICATION, func() protocol.IMessage { return new(SystemMessage) })
 	protocol.RegisterMessageCreator(protocol.MSG_METADATA, func() protocol.IMessage { return new(Metadata) })
 	protocol.RegisterMessageCreator(protocol.MSG_AUTH_STATUS, func() protocol.IMessage { return new(AuthenticationStatus) })
-	protocol.RegisterMessageCreator(protocol.MSG_PENDING_GROUP_MESSAGE, func() protocol.IMessage { return new(PendingGroupMessage) })
+	protocol.RegisterMessageCreator(protocol.MSG_SUBSCRIBE_PRESENCE, func() protocol.IMessage { return new(PresenceSubscription) })
+	protocol.RegisterMessageCreator(protocol.MSG_PRESENCE, func() protocol.IMessage { return new(Presence) })
+	protocol.RegisterMessageCreator(protocol.MSG_SYNC_GROUP_MENTION, func() protocol.IMessage { return new(GroupMentionCount) })
+	protocol.RegisterMessageCreator(protocol.MSG_GET_GROUP_INFO, func() protocol.IMessage { return new(GroupInfoRequest) })
+	protocol.RegisterMessageCreator(protocol.MSG_GROUP_INFO, func() protocol.IMessage { return new(GroupInfo) })
+	protocol.RegisterMessageCreator(protocol.MSG_GET_GROUP_MEMBERS, func() protocol.IMessage { return new(GroupMembersRequest) })
+	protocol.RegisterMessageCreator(protocol.MSG_GROUP_MEMBERS, func() protocol.IMessage { return new(GroupMembers) })
+	protocol.RegisterMessageCreator(protocol.MSG_GROUP_CHANGED, func() protocol.IMessage { return new(GroupChanged) })
+	protocol.RegisterMessageCreator(protocol.MSG_GET_ROOM_MEMBERS, func() protocol.IMessage { return new(RoomMembersRequest) })
+	protocol.RegisterMessageCreator(protocol.MSG_ROOM_MEMBERS, func() protocol.IMessage { return new(RoomMembers) })
+	protocol.RegisterMessageCreator(protocol.MSG_GET_ROOM_MEMBER_COUNT, func() protocol.IMessage { return new(Room) })
+	protocol.RegisterMessageCreator(protocol.MSG_ROOM_MEMBER_COUNT, func() protocol.IMessage { return new(RoomMemberCount) })
+	protocol.RegisterMessageCreator(protocol.MSG_ROOM_MEMBER_CHANGED, func() protocol.IMessage { return new(RoomMemberChanged) })
+	protocol.RegisterMessageCreator(protocol.MSG_ROOM_KICKED, func() protocol.IMessage { return new(Room) })
+	protocol.RegisterMessageCreator(protocol.MSG_ROOM_CONTROL, func() protocol.IMessage { return new(RoomControl) })
 
 	protocol.RegisterMessageCreatorV(protocol.MSG_ACK, func() protocol.IVersionMessage { return new(MessageACK) })
+	protocol.RegisterMessageCreatorV(protocol.MSG_PENDING_GROUP_MESSAGE, func() protocol.IVersionMessage { return new(PendingGroupMessage) })
 
 }
 
@@ -326,6 +353,7 @@ type RoomMessage struct {
 }
 
 // 待发送的群组消息临时存储结构
+// MENTION_VERSION: 成员列表之后添加@成员列表, 只保存在本地文件中
 type PendingGroupMessage struct {
 	appid     int64
 	sender    int64
@@ -333,11 +361,12 @@ type PendingGroupMessage struct {
 	gid       int64
 	timestamp int32
 
-	members []int64 //需要接受此消息的成员列表
-	content string
+	members  []int64 //需要接受此消息的成员列表
+	mentions []int64 //@的成员列表
+	content  string
 }
 
-func (gm *PendingGroupMessage) ToData() []byte {
+func (gm *PendingGroupMessage) ToData(version int) []byte {
 	buffer := new(bytes.Buffer)
 	binary.Write(buffer, binary.BigEndian, gm.appid)
 	binary.Write(buffer, binary.BigEndian, gm.sender)
@@ -351,12 +380,20 @@ func (gm *PendingGroupMessage) ToData() []byte {
 		binary.Write(buffer, binary.BigEndian, uid)
 	}
 
+	if version >= protocol.MENTION_VERSION {
+		count = int16(len(gm.mentions))
+		binary.Write(buffer, binary.BigEndian, count)
+		for _, uid := range gm.mentions {
+			binary.Write(buffer, binary.BigEndian, uid)
+		}
+	}
+
 	buffer.Write([]byte(gm.content))
 	buf := buffer.Bytes()
 	return buf
 }
 
-func (gm *PendingGroupMessage) FromData(buff []byte) bool {
+func (gm *PendingGroupMessage) FromData(version int, buff []byte) bool {
 	if len(buff) < 38 {
 		return false
 	}
@@ -370,7 +407,7 @@ func (gm *PendingGroupMessage) FromData(buff []byte) bool {
 	var count int16
 	binary.Read(buffer, binary.BigEndian, &count)
 
-	if len(buff) < int(38+count*8) {
+	if count < 0 || len(buff) < 38+int(count)*8 {
 		return false
 	}
 
@@ -380,8 +417,390 @@ func (gm *PendingGroupMessage) FromData(buff []byte) bool {
 		binary.Read(buffer, binary.BigEndian, &uid)
 		gm.members[i] = uid
 	}
-	offset := 38 + count*8
+	offset := 38 + int(count)*8
+
+	if version >= protocol.MENTION_VERSION {
+		if len(buff) < offset+2 {
+			return false
+		}
+		binary.Read(buffer, binary.BigEndian, &count)
+		if count < 0 || len(buff) < offset+2+int(count)*8 {
+			return false
+		}
+		gm.mentions = make([]int64, count)
+		for i := 0; i < int(count); i++ {
+			var uid int64
+			binary.Read(buffer, binary.BigEndian, &uid)
+			gm.mentions[i] = uid
+		}
+		offset += 2 + int(count)*8
+	}
 	gm.content = string(buff[offset:])
 
 	return true
 }
+
+// 订阅联系人的在线状态, 新的列表替换之前的订阅
+type PresenceSubscription struct {
+	uids []int64
+}
+
+func (sub *PresenceSubscription) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	count := int16(len(sub.uids))
+	binary.Write(buffer, binary.BigEndian, count)
+	for _, uid := range sub.uids {
+		binary.Write(buffer, binary.BigEndian, uid)
+	}
+	buf := buffer.Bytes()
+	return buf
+}
+
+func (sub *PresenceSubscription) FromData(buff []byte) bool {
+	if len(buff) < 2 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	var count int16
+	binary.Read(buffer, binary.BigEndian, &count)
+	if count < 0 || len(buff) < 2+int(count)*8 {
+		return false
+	}
+
+	sub.uids = make([]int64, count)
+	for i := 0; i < int(count); i++ {
+		binary.Read(buffer, binary.BigEndian, &sub.uids[i])
+	}
+	return true
+}
+
+// 用户的在线状态
+type Presence struct {
+	uid       int64
+	platforms int32 //在线平台的位掩码, 0表示离线
+	last_seen int32 //最后在线的时间
+}
+
+func NewPresence(uid int64, platforms int32, last_seen int32) *Presence {
+	return &Presence{uid: uid, platforms: platforms, last_seen: last_seen}
+}
+
+func (p *Presence) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, p.uid)
+	binary.Write(buffer, binary.BigEndian, p.platforms)
+	binary.Write(buffer, binary.BigEndian, p.last_seen)
+	buf := buffer.Bytes()
+	return buf
+}
+
+func (p *Presence) FromData(buff []byte) bool {
+	if len(buff) < 16 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &p.uid)
+	binary.Read(buffer, binary.BigEndian, &p.platforms)
+	binary.Read(buffer, binary.BigEndian, &p.last_seen)
+	return true
+}
+
+// 超级群中@自己的消息数量
+type GroupMentionCount struct {
+	group_id        int64
+	count           int32
+	last_mention_id int64 //最后一条@自己的消息id
+}
+
+func (m *GroupMentionCount) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, m.group_id)
+	binary.Write(buffer, binary.BigEndian, m.count)
+	binary.Write(buffer, binary.BigEndian, m.last_mention_id)
+	buf := buffer.Bytes()
+	return buf
+}
+
+func (m *GroupMentionCount) FromData(buff []byte) bool {
+	if len(buff) < 20 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &m.group_id)
+	binary.Read(buffer, binary.BigEndian, &m.count)
+	binary.Read(buffer, binary.BigEndian, &m.last_mention_id)
+	return true
+}
+
+type GroupInfoRequest struct {
+	group_id int64
+}
+
+func (r *GroupInfoRequest) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, r.group_id)
+	buf := buffer.Bytes()
+	return buf
+}
+
+func (r *GroupInfoRequest) FromData(buff []byte) bool {
+	if len(buff) < 8 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &r.group_id)
+	return true
+}
+
+// 群组信息, content为json格式
+type GroupInfo struct {
+	group_id int64
+	content  string
+}
+
+func (info *GroupInfo) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, info.group_id)
+	buffer.Write([]byte(info.content))
+	buf := buffer.Bytes()
+	return buf
+}
+
+func (info *GroupInfo) FromData(buff []byte) bool {
+	if len(buff) < 8 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &info.group_id)
+	info.content = string(buff[8:])
+	return true
+}
+
+// 超级群按照uid分页查询成员, 普通群返回全部成员
+// limit为0时使用GROUP_MEMBERS_DEFAULT_LIMIT
+type GroupMembersRequest struct {
+	group_id int64
+	offset   int32
+	limit    int32
+}
+
+func (r *GroupMembersRequest) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, r.group_id)
+	binary.Write(buffer, binary.BigEndian, r.offset)
+	binary.Write(buffer, binary.BigEndian, r.limit)
+	buf := buffer.Bytes()
+	return buf
+}
+
+func (r *GroupMembersRequest) FromData(buff []byte) bool {
+	if len(buff) < 16 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &r.group_id)
+	binary.Read(buffer, binary.BigEndian, &r.offset)
+	binary.Read(buffer, binary.BigEndian, &r.limit)
+	return true
+}
+
+// 群组成员, content为json数组, next_offset为-1表示没有更多的成员
+type GroupMembers struct {
+	group_id    int64
+	total       int32
+	next_offset int32
+	content     string
+}
+
+func (m *GroupMembers) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, m.group_id)
+	binary.Write(buffer, binary.BigEndian, m.total)
+	binary.Write(buffer, binary.BigEndian, m.next_offset)
+	buffer.Write([]byte(m.content))
+	buf := buffer.Bytes()
+	return buf
+}
+
+func (m *GroupMembers) FromData(buff []byte) bool {
+	if len(buff) < 16 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &m.group_id)
+	binary.Read(buffer, binary.BigEndian, &m.total)
+	binary.Read(buffer, binary.BigEndian, &m.next_offset)
+	m.content = string(buff[16:])
+	return true
+}
+
+// 群组发生变化, event为群组事件的名称
+type GroupChanged struct {
+	group_id  int64
+	action_id int64
+	event     string
+}
+
+func (c *GroupChanged) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, c.group_id)
+	binary.Write(buffer, binary.BigEndian, c.action_id)
+	buffer.Write([]byte(c.event))
+	buf := buffer.Bytes()
+	return buf
+}
+
+func (c *GroupChanged) FromData(buff []byte) bool {
+	if len(buff) < 16 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &c.group_id)
+	binary.Read(buffer, binary.BigEndian, &c.action_id)
+	c.event = string(buff[16:])
+	return true
+}
+
+// 按照uid分页查询聊天室成员, limit为0时使用ROOM_MEMBERS_DEFAULT_LIMIT
+type RoomMembersRequest struct {
+	room_id int64
+	offset  int32
+	limit   int32
+}
+
+func (r *RoomMembersRequest) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, r.room_id)
+	binary.Write(buffer, binary.BigEndian, r.offset)
+	binary.Write(buffer, binary.BigEndian, r.limit)
+	buf := buffer.Bytes()
+	return buf
+}
+
+func (r *RoomMembersRequest) FromData(buff []byte) bool {
+	if len(buff) < 16 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &r.room_id)
+	binary.Read(buffer, binary.BigEndian, &r.offset)
+	binary.Read(buffer, binary.BigEndian, &r.limit)
+	return true
+}
+
+// 聊天室成员, content为uid的json数组, next_offset为-1表示没有更多的成员
+type RoomMembers struct {
+	room_id     int64
+	total       int32
+	next_offset int32
+	content     string
+}
+
+func (m *RoomMembers) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, m.room_id)
+	binary.Write(buffer, binary.BigEndian, m.total)
+	binary.Write(buffer, binary.BigEndian, m.next_offset)
+	buffer.Write([]byte(m.content))
+	buf := buffer.Bytes()
+	return buf
+}
+
+func (m *RoomMembers) FromData(buff []byte) bool {
+	if len(buff) < 16 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &m.room_id)
+	binary.Read(buffer, binary.BigEndian, &m.total)
+	binary.Read(buffer, binary.BigEndian, &m.next_offset)
+	m.content = string(buff[16:])
+	return true
+}
+
+type RoomMemberCount struct {
+	room_id int64
+	count   int32
+}
+
+func (c *RoomMemberCount) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, c.room_id)
+	binary.Write(buffer, binary.BigEndian, c.count)
+	buf := buffer.Bytes()
+	return buf
+}
+
+func (c *RoomMemberCount) FromData(buff []byte) bool {
+	if len(buff) < 12 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &c.room_id)
+	binary.Read(buffer, binary.BigEndian, &c.count)
+	return true
+}
+
+const ROOM_MEMBER_ENTER = 1
+const ROOM_MEMBER_LEAVE = 2
+
+// 用户的第一个连接进入聊天室或者最后一个连接离开聊天室
+type RoomMemberChanged struct {
+	room_id int64
+	uid     int64
+	action  int32
+}
+
+func NewRoomMemberChanged(room_id int64, uid int64, action int32) *RoomMemberChanged {
+	return &RoomMemberChanged{room_id: room_id, uid: uid, action: action}
+}
+
+func (c *RoomMemberChanged) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, c.room_id)
+	binary.Write(buffer, binary.BigEndian, c.uid)
+	binary.Write(buffer, binary.BigEndian, c.action)
+	buf := buffer.Bytes()
+	return buf
+}
+
+func (c *RoomMemberChanged) FromData(buff []byte) bool {
+	if len(buff) < 20 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &c.room_id)
+	binary.Read(buffer, binary.BigEndian, &c.uid)
+	binary.Read(buffer, binary.BigEndian, &c.action)
+	return true
+}
+
+// 聊天室管理消息, value: 封禁的截止时间或者慢速模式的间隔
+type RoomControl struct {
+	room_id int64
+	uid     int64
+	action  int32
+	value   int64
+}
+
+func (c *RoomControl) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, c.room_id)
+	binary.Write(buffer, binary.BigEndian, c.uid)
+	binary.Write(buffer, binary.BigEndian, c.action)
+	binary.Write(buffer, binary.BigEndian, c.value)
+	buf := buffer.Bytes()
+	return buf
+}
+
+func (c *RoomControl) FromData(buff []byte) bool {
+	if len(buff) < 28 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &c.room_id)
+	binary.Read(buffer, binary.BigEndian, &c.uid)
+	binary.Read(buffer, binary.BigEndian, &c.action)
+	binary.Read(buffer, binary.BigEndian, &c.value)
+	return true
+}
@@ -33,6 +33,7 @@ func init() {
 	protocol.RegisterMessageCreator(protocol.MSG_CUSTOMER_, func() protocol.IMessage { return new(IgnoreMessage) })
 	protocol.RegisterMessageCreator(protocol.MSG_CUSTOMER_SUPPORT_, func() protocol.IMessage { return new(IgnoreMessage) })
 	protocol.RegisterMessageCreator(protocol.MSG_CUSTOMER_V2, func() protocol.IMessage { return new(CustomerMessageV2) })
+	protocol.RegisterMessageCreator(protocol.MSG_GROUP_IM_MENTION, func() protocol.IMessage { return new(MentionIMMessage) })
 
 	protocol.RegisterMessageCreatorV(protocol.MSG_GROUP_IM, func() protocol.IVersionMessage { return new(IMMessage) })
 	protocol.RegisterMessageCreatorV(protocol.MSG_IM, func() protocol.IVersionMessage { return new(IMMessage) })
@@ -69,6 +70,7 @@ type IMMessage struct {
 	receiver  int64
 	timestamp int32
 	msgid     int32
+	mentions  []int64 //群消息@的成员列表, MENTION_VERSION
 	content   string
 }
 
@@ -118,20 +120,96 @@ func (im *IMMessage) FromDataV1(buff []byte) bool {
 	return true
 }
 
+func (message *IMMessage) ToDataV3() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, message.sender)
+	binary.Write(buffer, binary.BigEndian, message.receiver)
+	binary.Write(buffer, binary.BigEndian, message.timestamp)
+	binary.Write(buffer, binary.BigEndian, message.msgid)
+	count := int16(len(message.mentions))
+	binary.Write(buffer, binary.BigEndian, count)
+	for _, uid := range message.mentions {
+		binary.Write(buffer, binary.BigEndian, uid)
+	}
+	buffer.Write([]byte(message.content))
+	buf := buffer.Bytes()
+	return buf
+}
+
+func (im *IMMessage) FromDataV3(buff []byte) bool {
+	if len(buff) < 26 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &im.sender)
+	binary.Read(buffer, binary.BigEndian, &im.receiver)
+	binary.Read(buffer, binary.BigEndian, &im.timestamp)
+	binary.Read(buffer, binary.BigEndian, &im.msgid)
+
+	var count int16
+	binary.Read(buffer, binary.BigEndian, &count)
+	if count < 0 || len(buff) < 26+int(count)*8 {
+		return false
+	}
+	if count > 0 {
+		im.mentions = make([]int64, count)
+		for i := 0; i < int(count); i++ {
+			binary.Read(buffer, binary.BigEndian, &im.mentions[i])
+		}
+	}
+	offset := 26 + int(count)*8
+	im.content = string(buff[offset:])
+	return true
+}
+
 func (im *IMMessage) ToData(version int) []byte {
 	if version == 0 {
 		return im.ToDataV0()
-	} else {
+	} else if version < protocol.MENTION_VERSION {
 		return im.ToDataV1()
+	} else {
+		return im.ToDataV3()
 	}
 }
 
 func (im *IMMessage) FromData(version int, buff []byte) bool {
 	if version == 0 {
 		return im.FromDataV0(buff)
-	} else {
+	} else if version < protocol.MENTION_VERSION {
 		return im.FromDataV1(buff)
+	} else {
+		return im.FromDataV3(buff)
+	}
+}
+
+// 带有@成员列表的群消息通过route server转发时使用MENTION_VERSION编码
+func groupMessageVersion(im *IMMessage) int {
+	if len(im.mentions) > 0 {
+		return protocol.MENTION_VERSION
+	}
+	return protocol.DEFAULT_VERSION
+}
+
+// 带有@成员的群消息保存到ims时使用的消息体, 和消息头的版本无关
+type MentionIMMessage struct {
+	IMMessage
+}
+
+func (im *MentionIMMessage) ToData() []byte {
+	return im.ToDataV3()
+}
+
+func (im *MentionIMMessage) FromData(buff []byte) bool {
+	return im.FromDataV3(buff)
+}
+
+func (im *IMMessage) IsMentioned(uid int64) bool {
+	for _, m := range im.mentions {
+		if m == uid {
+			return true
+		}
 	}
+	return false
 }
 
 func (im *IMMessage) Timestamp() int32 {
@@ -0,0 +1,332 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/bitly/go-simplejson"
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/GoBelieveIO/im_service/protocol"
+)
+
+// 未处理的消息请求保存的时间
+const MESSAGE_REQUEST_EXPIRE = 30 * 24 * 60 * 60
+
+// 单个app的陌生人消息策略, limit为0时禁止给非好友发送消息
+type StrangerPolicyConfig struct {
+	AppID int64 `toml:"appid"`
+	Limit int   `toml:"limit"`
+}
+
+// 好友模式下发给非好友的消息保存在接收者的消息请求中,
+// 成为好友之后(relationship事件)转入正常的消息队列
+type MessageRequests struct {
+	redis_pool  *redis.Pool
+	app         *App
+	rpc_storage *RPCStorage
+
+	default_limit int
+	limits        map[int64]int
+}
+
+func NewMessageRequests(redis_pool *redis.Pool, app *App, rpc_storage *RPCStorage, default_limit int, policies []*StrangerPolicyConfig) *MessageRequests {
+	r := &MessageRequests{}
+	r.redis_pool = redis_pool
+	r.app = app
+	r.rpc_storage = rpc_storage
+	r.default_limit = default_limit
+	r.limits = make(map[int64]int)
+	for _, p := range policies {
+		r.limits[p.AppID] = p.Limit
+	}
+	return r
+}
+
+// 每个陌生人最多可以发送的消息数量
+func (r *MessageRequests) Limit(appid int64) int {
+	if limit, ok := r.limits[appid]; ok {
+		return limit
+	}
+	return r.default_limit
+}
+
+// 有序集合, member为发送者, score为最近一条消息的时间
+func messageRequestsKey(appid int64, uid int64) string {
+	return fmt.Sprintf("message_requests_%d_%d", appid, uid)
+}
+
+func messageRequestKey(appid int64, uid int64, sender int64) string {
+	return fmt.Sprintf("message_request_msgs_%d_%d_%d", appid, uid, sender)
+}
+
+// 检查数量限制和保存消息在同一个脚本中执行, 超过限制时返回0
+// KEYS[1]:消息列表 KEYS[2]:消息请求集合 ARGV[1]:limit ARGV[2]:消息 ARGV[3]:过期时间 ARGV[4]:时间 ARGV[5]:发送者
+var addMessageRequestScript = redis.NewScript(2, `
+local count = redis.call("LLEN", KEYS[1])
+if count >= tonumber(ARGV[1]) then
+  return 0
+end
+redis.call("RPUSH", KEYS[1], ARGV[2])
+redis.call("EXPIRE", KEYS[1], ARGV[3])
+redis.call("ZADD", KEYS[2], ARGV[4], ARGV[5])
+redis.call("EXPIRE", KEYS[2], ARGV[3])
+return count + 1
+`)
+
+// 保存发送者的消息之前检查数量限制, Add时仍然会再次检查
+func (r *MessageRequests) Exceeded(appid int64, msg *IMMessage) (bool, error) {
+	conn := r.redis_pool.Get()
+	defer conn.Close()
+
+	key := messageRequestKey(appid, msg.receiver, msg.sender)
+	count, err := redis.Int(conn.Do("LLEN", key))
+	if err != nil {
+		return false, err
+	}
+	return count >= r.Limit(appid), nil
+}
+
+// 返回false表示超过了数量限制
+func (r *MessageRequests) Add(appid int64, msg *IMMessage) (bool, error) {
+	conn := r.redis_pool.Get()
+	defer conn.Close()
+
+	key := messageRequestKey(appid, msg.receiver, msg.sender)
+	requests_key := messageRequestsKey(appid, msg.receiver)
+	count, err := redis.Int(addMessageRequestScript.Do(conn, key, requests_key, r.Limit(appid),
+		msg.ToData(DEFAULT_VERSION), MESSAGE_REQUEST_EXPIRE, msg.timestamp, msg.sender))
+	if err != nil {
+		return false, err
+	}
+	if count == 0 {
+		return false, nil
+	}
+
+	//在线的接收者收到通知, 不保存
+	obj := make(map[string]interface{})
+	obj["sender"] = msg.sender
+	obj["count"] = count
+	obj["timestamp"] = msg.timestamp
+	v := make(map[string]interface{})
+	v["message_request"] = obj
+	b, _ := json.Marshal(v)
+	notify := &Message{Cmd: MSG_SYSTEM, Body: &SystemMessage{string(b)}}
+	r.app.SendAnonymousMessage(appid, msg.receiver, notify)
+	return true, nil
+}
+
+// 读取并删除, 多个im读到同一个relationship事件时只有一个im读到消息
+func (r *MessageRequests) remove(conn redis.Conn, appid int64, uid int64, sender int64) ([]*IMMessage, error) {
+	key := messageRequestKey(appid, uid, sender)
+	conn.Send("MULTI")
+	conn.Send("LRANGE", key, 0, -1)
+	conn.Send("DEL", key)
+	conn.Send("ZREM", messageRequestsKey(appid, uid), sender)
+	reply, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+	buffs, _ := redis.ByteSlices(reply[0], nil)
+	msgs := make([]*IMMessage, 0, len(buffs))
+	for _, buff := range buffs {
+		msg := &IMMessage{}
+		if msg.FromData(DEFAULT_VERSION, buff) {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+func (r *MessageRequests) Remove(appid int64, uid int64, sender int64) error {
+	conn := r.redis_pool.Get()
+	defer conn.Close()
+
+	_, err := r.remove(conn, appid, uid, sender)
+	return err
+}
+
+// 两个用户互为好友之后, 消息请求转入接收者的消息队列
+func (r *MessageRequests) Unlock(appid int64, uid int64, friend_uid int64) {
+	conn := r.redis_pool.Get()
+	defer conn.Close()
+
+	r.deliver(conn, appid, uid, friend_uid)
+	r.deliver(conn, appid, friend_uid, uid)
+}
+
+func (r *MessageRequests) deliver(conn redis.Conn, appid int64, uid int64, sender int64) {
+	msgs, err := r.remove(conn, appid, uid, sender)
+	if err != nil {
+		log.Warningf("remove message requests:%d %d err:%s", uid, sender, err)
+		return
+	}
+	for i, msg := range msgs {
+		m := &Message{Cmd: MSG_IM, Version: DEFAULT_VERSION, Body: msg}
+		msgid, _, err := r.rpc_storage.SaveMessage(appid, uid, 0, m)
+		if err != nil {
+			log.Errorf("save peer message:%d %d err:%v", msg.sender, msg.receiver, err)
+			r.requeue(conn, appid, uid, sender, msgs[i:])
+			return
+		}
+		r.app.PushMessage(appid, uid, m)
+		notify := &Message{Cmd: MSG_SYNC_NOTIFY, Body: &SyncNotify{sync_key: msgid}}
+		r.app.SendAnonymousMessage(appid, uid, notify)
+	}
+	if len(msgs) > 0 {
+		log.Infof("deliver message requests sender:%d receiver:%d count:%d", sender, uid, len(msgs))
+	}
+}
+
+// 保存失败的消息放回消息请求的头部, 下次成为好友或者读取时仍然存在
+func (r *MessageRequests) requeue(conn redis.Conn, appid int64, uid int64, sender int64, msgs []*IMMessage) {
+	key := messageRequestKey(appid, uid, sender)
+	requests_key := messageRequestsKey(appid, uid)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		conn.Send("LPUSH", key, msgs[i].ToData(DEFAULT_VERSION))
+	}
+	conn.Send("EXPIRE", key, MESSAGE_REQUEST_EXPIRE)
+	conn.Send("ZADD", requests_key, msgs[len(msgs)-1].timestamp, sender)
+	conn.Send("EXPIRE", requests_key, MESSAGE_REQUEST_EXPIRE)
+	_, err := conn.Do("")
+	if err != nil {
+		log.Errorf("requeue message requests:%d %d count:%d err:%s", uid, sender, len(msgs), err)
+		return
+	}
+	log.Warningf("requeue message requests:%d %d count:%d", uid, sender, len(msgs))
+}
+
+func (r *MessageRequests) Load(appid int64, uid int64) ([]map[string]interface{}, error) {
+	conn := r.redis_pool.Get()
+	defer conn.Close()
+
+	senders, err := redis.Int64s(conn.Do("ZREVRANGE", messageRequestsKey(appid, uid), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	requests := make([]map[string]interface{}, 0, len(senders))
+	for _, sender := range senders {
+		buffs, err := redis.ByteSlices(conn.Do("LRANGE", messageRequestKey(appid, uid, sender), 0, -1))
+		if err != nil {
+			return nil, err
+		}
+		//消息已经过期
+		if len(buffs) == 0 {
+			conn.Do("ZREM", messageRequestsKey(appid, uid), sender)
+			continue
+		}
+		msgs := make([]map[string]interface{}, 0, len(buffs))
+		for _, buff := range buffs {
+			msg := &IMMessage{}
+			if !msg.FromData(DEFAULT_VERSION, buff) {
+				continue
+			}
+			obj := make(map[string]interface{})
+			obj["content"] = msg.content
+			obj["timestamp"] = msg.timestamp
+			msgs = append(msgs, obj)
+		}
+		obj := make(map[string]interface{})
+		obj["sender"] = sender
+		obj["messages"] = msgs
+		requests = append(requests, obj)
+	}
+	return requests, nil
+}
+
+// GET /get_message_requests?appid=&uid=
+func GetMessageRequests(w http.ResponseWriter, req *http.Request, r *MessageRequests) {
+	m, _ := url.ParseQuery(req.URL.RawQuery)
+
+	appid, err := strconv.ParseInt(m.Get("appid"), 10, 64)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid query param", w)
+		return
+	}
+	uid, err := strconv.ParseInt(m.Get("uid"), 10, 64)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid query param", w)
+		return
+	}
+
+	requests, err := r.Load(appid, uid)
+	if err != nil {
+		log.Warning("load message requests err:", err)
+		WriteHttpError(500, "server internal error", w)
+		return
+	}
+	obj := make(map[string]interface{})
+	obj["requests"] = requests
+	WriteHttpObj(obj, w)
+}
+
+// 拒绝消息请求, body: {"appid":, "uid":, "sender":}
+func RemoveMessageRequest(w http.ResponseWriter, req *http.Request, r *MessageRequests) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		WriteHttpError(400, err.Error(), w)
+		return
+	}
+
+	obj, err := simplejson.NewJson(body)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+
+	appid, err := obj.Get("appid").Int64()
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+	uid, err := obj.Get("uid").Int64()
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+	sender, err := obj.Get("sender").Int64()
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+
+	err = r.Remove(appid, uid, sender)
+	if err != nil {
+		log.Warning("remove message request err:", err)
+		WriteHttpError(500, "server internal error", w)
+		return
+	}
+	log.Infof("remove message request uid:%d sender:%d", uid, sender)
+	w.WriteHeader(200)
+}
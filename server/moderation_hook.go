@@ -0,0 +1,144 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	. "github.com/GoBelieveIO/im_service/protocol"
+)
+
+const MODERATION_ACTION_ALLOW = "allow"
+const MODERATION_ACTION_REJECT = "reject"
+const MODERATION_ACTION_REWRITE = "rewrite"
+
+// 默认的超时时间(毫秒), 在消息发送的路径上同步调用
+const MODERATION_DEFAULT_TIMEOUT = 500
+
+// 可以审核的命令, 没有配置时审核全部
+var moderationCommands = map[string]int{
+	"im":       MSG_IM,
+	"group_im": MSG_GROUP_IM,
+	"room_im":  MSG_ROOM_IM,
+	"customer": MSG_CUSTOMER_V2,
+}
+
+type moderationRequest struct {
+	AppID    int64  `json:"appid"`
+	Cmd      int    `json:"cmd"`
+	Sender   int64  `json:"sender"`
+	Receiver int64  `json:"receiver"`
+	Content  string `json:"content"`
+}
+
+type moderationResponse struct {
+	Action  string `json:"action"`
+	Content string `json:"content"` //rewrite
+}
+
+// 消息保存之前调用的审核接口
+// 接口返回{"action":"allow"|"reject"|"rewrite", "content":""}
+type ModerationHook struct {
+	url         string
+	client      *http.Client
+	fail_closed bool         //接口调用失败时拒绝发送
+	cmds        map[int]bool //需要审核的命令
+}
+
+func NewModerationHook(url string, timeout int, fail_closed bool, cmds []string) (*ModerationHook, error) {
+	if timeout <= 0 {
+		timeout = MODERATION_DEFAULT_TIMEOUT
+	}
+	hook := &ModerationHook{}
+	hook.url = url
+	hook.client = &http.Client{Timeout: time.Duration(timeout) * time.Millisecond}
+	hook.fail_closed = fail_closed
+	hook.cmds = make(map[int]bool)
+	if len(cmds) == 0 {
+		for _, cmd := range moderationCommands {
+			hook.cmds[cmd] = true
+		}
+	}
+	for _, name := range cmds {
+		cmd, ok := moderationCommands[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid moderation cmd:%s", name)
+		}
+		hook.cmds[cmd] = true
+	}
+	return hook, nil
+}
+
+// 未配置的命令不调用审核接口, 例如聊天室消息量大时可以只审核单聊和群聊
+func (hook *ModerationHook) Enabled(cmd int) bool {
+	return hook.cmds[cmd]
+}
+
+func (hook *ModerationHook) call(r *moderationRequest) (*moderationResponse, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := hook.client.Post(hook.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("moderation:%s status:%d", hook.url, resp.StatusCode)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	res := &moderationResponse{}
+	err = json.Unmarshal(b, res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// 返回审核之后的内容, false表示拒绝发送
+func (hook *ModerationHook) Check(appid int64, cmd int, sender int64, receiver int64, content string) (string, bool, error) {
+	r := &moderationRequest{AppID: appid, Cmd: cmd, Sender: sender, Receiver: receiver, Content: content}
+	res, err := hook.call(r)
+	if err != nil {
+		return content, !hook.fail_closed, err
+	}
+
+	switch res.Action {
+	case MODERATION_ACTION_REJECT:
+		return content, false, nil
+	case MODERATION_ACTION_REWRITE:
+		return res.Content, true, nil
+	case MODERATION_ACTION_ALLOW, "":
+		return content, true, nil
+	default:
+		return content, !hook.fail_closed, fmt.Errorf("moderation unknown action:%s", res.Action)
+	}
+}
@@ -0,0 +1,52 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"testing"
+
+	. "github.com/GoBelieveIO/im_service/protocol"
+)
+
+func TestModerationHookEnabled(t *testing.T) {
+	hook, err := NewModerationHook("http://127.0.0.1/moderation", 0, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hook.Enabled(MSG_ROOM_IM) || !hook.Enabled(MSG_IM) {
+		t.Error("all commands should be moderated by default")
+	}
+
+	hook, err = NewModerationHook("http://127.0.0.1/moderation", 0, false, []string{"im", "group_im"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hook.Enabled(MSG_ROOM_IM) {
+		t.Error("room_im should not be moderated")
+	}
+	if !hook.Enabled(MSG_GROUP_IM) {
+		t.Error("group_im should be moderated")
+	}
+
+	_, err = NewModerationHook("http://127.0.0.1/moderation", 0, false, []string{"rt"})
+	if err == nil {
+		t.Error("rt should be invalid")
+	}
+}
@@ -13,7 +13,7 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func Summary(rw http.ResponseWriter, req *http.Request, app_route *AppRoute, server_summary *ServerSummary) {
+func Summary(rw http.ResponseWriter, req *http.Request, app_route *AppRoute, server_summary *ServerSummary, app *App) {
 	m, _ := url.ParseQuery(req.URL.RawQuery)
 
 	appid, _ := strconv.ParseInt(m.Get("appid"), 10, 64)
@@ -25,6 +25,19 @@ func Summary(rw http.ResponseWriter, req *http.Request, app_route *AppRoute, ser
 	obj["clientset_count"] = server_summary.clientset_count
 	obj["in_message_count"] = server_summary.in_message_count
 	obj["out_message_count"] = server_summary.out_message_count
+	obj["rate_limited_count"] = server_summary.rate_limited_count
+	obj["rate_limit_disconnect_count"] = server_summary.rate_limit_disconnect_count
+	obj["group_notification_dropped_count"] = server_summary.group_notification_dropped_count
+	room_sampled, room_dropped := app_route.RoomLimiter().DropCount()
+	obj["room_sampled_count"] = room_sampled
+	obj["room_dropped_count"] = room_dropped
+
+	delivers := app.GroupMessageDelivers()
+	deliver_objs := make([]map[string]interface{}, len(delivers))
+	for i, deliver := range delivers {
+		deliver_objs[i] = deliver.Summary()
+	}
+	obj["group_delivers"] = deliver_objs
 
 	if appid != 0 {
 		route := app_route.FindOrAddRoute(appid)
@@ -38,6 +51,7 @@ func Summary(rw http.ResponseWriter, req *http.Request, app_route *AppRoute, ser
 		app_obj["room_count"] = room_count
 		app_obj["room_client_count"] = room_client_count
 		app_obj["room_stat"] = room_stat
+		app_obj["room_drops"] = app_route.RoomLimiter().GetDrops(appid, 1000)
 		k := fmt.Sprintf("app_%d", appid)
 		obj[k] = app_obj
 	}
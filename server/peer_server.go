@@ -43,7 +43,14 @@ func (server *Server) HandleSync(client *Client, msg *Message) {
 
 	log.Infof("syncing message:%d %d %d %d", client.appid, client.uid, client.device_ID, last_id)
 
+	sync_id := last_id
+	last_id = server.rpc_storage.TranslateSyncKey(client.appid, client.uid, client.device_ID, sync_id)
 	ph, err := server.rpc_storage.SyncMessage(client.appid, client.uid, client.device_ID, last_id)
+	if _, _, moved := storage.ParseUserMovedError(err); moved {
+		//用户已经迁移到其它节点,转换同步点之后重试
+		last_id = server.rpc_storage.TranslateSyncKey(client.appid, client.uid, client.device_ID, sync_id)
+		ph, err = server.rpc_storage.SyncMessage(client.appid, client.uid, client.device_ID, last_id)
+	}
 	if err != nil {
 		log.Warning("sync message err:", err)
 		return
@@ -57,8 +64,7 @@ func (server *Server) HandleSync(client *Client, msg *Message) {
 	for i := len(messages) - 1; i >= 0; i-- {
 		msg := messages[i]
 		log.Info("message:", msg.MsgID, Command(msg.Cmd))
-		m := &Message{Cmd: int(msg.Cmd), Version: DEFAULT_VERSION}
-		m.FromData(msg.Raw)
+		m := decodeHistoryMessage(msg)
 		sk.sync_key = msg.MsgID
 		if client.isSender(m, msg.DeviceID) {
 			m.Flag |= MESSAGE_FLAG_SELF
@@ -117,6 +123,17 @@ func (server *Server) HandleIMMessage(client *Client, message *Message) {
 	if server.friend_permission || server.enable_blacklist {
 		rs = server.relationship_pool.GetRelationship(client.appid, client.uid, msg.receiver)
 	}
+	if server.friend_permission && server.message_requests != nil && (!rs.IsMyFriend() || !rs.IsYourFriend()) &&
+		server.message_requests.Limit(client.appid) > 0 {
+		if server.enable_blacklist && rs.IsInYourBlacklist() {
+			ack := &Message{Cmd: MSG_ACK, Version: client.version, Body: &MessageACK{seq: int32(seq), status: ACK_IN_YOUR_BLACKLIST}}
+			client.EnqueueMessage(ack)
+			log.Infof("relationship%d-%d:%d invalid, can't send message", msg.sender, msg.receiver, rs)
+			return
+		}
+		server.sendMessageRequest(client, message)
+		return
+	}
 	if server.friend_permission {
 		if !rs.IsMyFriend() {
 			ack := &Message{Cmd: MSG_ACK, Version: client.version, Body: &MessageACK{seq: int32(seq), status: ACK_NOT_MY_FRIEND}}
@@ -141,8 +158,8 @@ func (server *Server) HandleIMMessage(client *Client, message *Message) {
 		}
 	}
 
-	if message.Flag&MESSAGE_FLAG_TEXT != 0 {
-		FilterDirtyWord(server.filter, msg)
+	if !server.filterContent(client, seq, MSG_IM, msg.receiver, &msg.content) {
+		return
 	}
 	msg.timestamp = int32(time.Now().Unix())
 	m := &Message{Cmd: MSG_IM, Version: DEFAULT_VERSION, Body: msg}
@@ -187,6 +204,65 @@ func (server *Server) HandleIMMessage(client *Client, message *Message) {
 	log.Infof("peer message sender:%d receiver:%d msgid:%d\n", msg.sender, msg.receiver, msgid)
 }
 
+// 发给非好友的消息保存在接收者的消息请求中, 发送者的其它登录点正常同步
+// 先保存到发送者的消息队列再加入消息请求, 保存失败时客户端重发不会产生重复的消息请求
+func (server *Server) sendMessageRequest(client *Client, message *Message) {
+	msg := message.Body.(*IMMessage)
+	seq := message.Seq
+
+	if !server.filterContent(client, seq, MSG_IM, msg.receiver, &msg.content) {
+		return
+	}
+	msg.timestamp = int32(time.Now().Unix())
+
+	exceeded, err := server.message_requests.Exceeded(client.appid, msg)
+	if err != nil {
+		log.Errorf("check message request:%d %d err:%v", msg.sender, msg.receiver, err)
+		return
+	}
+	if exceeded {
+		server.sendMessageRequestLimit(client, seq, msg)
+		return
+	}
+
+	m := &Message{Cmd: MSG_IM, Version: DEFAULT_VERSION, Body: msg}
+	msgid, prev_msgid, err := server.rpc_storage.SaveMessage(client.appid, msg.sender, client.device_ID, m)
+	if err != nil {
+		log.Errorf("save peer message:%d %d err:%v", msg.sender, msg.receiver, err)
+		return
+	}
+
+	ok, err := server.message_requests.Add(client.appid, msg)
+	if err != nil {
+		log.Errorf("add message request:%d %d err:%v", msg.sender, msg.receiver, err)
+		return
+	}
+	if !ok {
+		//同时发送的消息超过了限制, 发送者的消息队列中已经保存
+		server.sendMessageRequestLimit(client, seq, msg)
+		return
+	}
+
+	meta := &Metadata{sync_key: msgid, prev_sync_key: prev_msgid}
+	m1 := &Message{Cmd: MSG_IM, Version: DEFAULT_VERSION, Flag: message.Flag | MESSAGE_FLAG_PUSH, Body: msg, Meta: meta}
+	server.SendMessage(client, client.uid, m1)
+	notify := &Message{Cmd: MSG_SYNC_NOTIFY, Body: &SyncKey{msgid}}
+	server.SendMessage(client, client.uid, notify)
+
+	meta = &Metadata{sync_key: msgid, prev_sync_key: prev_msgid}
+	ack := &Message{Cmd: MSG_ACK, Body: &MessageACK{seq: int32(seq)}, Meta: meta}
+	client.EnqueueMessage(ack)
+
+	atomic.AddInt64(&server.server_summary.in_message_count, 1)
+	log.Infof("message request sender:%d receiver:%d", msg.sender, msg.receiver)
+}
+
+func (server *Server) sendMessageRequestLimit(client *Client, seq int, msg *IMMessage) {
+	ack := &Message{Cmd: MSG_ACK, Version: client.version, Body: &MessageACK{seq: int32(seq), status: ACK_MESSAGE_REQUEST_LIMIT}}
+	client.EnqueueMessage(ack)
+	log.Infof("message request %d-%d exceed limit", msg.sender, msg.receiver)
+}
+
 func (server *Server) HandleUnreadCount(client *Client, msg *Message) {
 	u := msg.Body.(*MessageUnreadCount)
 	SetUserUnreadCount(server.redis_pool, client.appid, client.uid, u.count)
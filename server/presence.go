@@ -0,0 +1,276 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/GoBelieveIO/im_service/protocol"
+)
+
+// 单个连接最多订阅的联系人数量
+const PRESENCE_SUBSCRIBE_LIMIT = 200
+
+// http接口单次查询的用户数量
+const PRESENCE_QUERY_LIMIT = 500
+
+// 未知的平台号(旧版本的im没有上报平台)
+const PLATFORM_UNKNOWN = 0
+
+// 用户不属于此route server(超级群的route server), 订阅时不上报在线平台
+// 只有用户所属的route server记录在线状态
+const PLATFORM_NONE = -1
+
+// 在线平台的位掩码
+func PlatformMask(platform_id int8) int32 {
+	if platform_id <= 0 || platform_id > 30 {
+		return 1 << PLATFORM_UNKNOWN
+	}
+	return 1 << uint(platform_id)
+}
+
+func PlatformList(platforms int32) []int {
+	r := make([]int, 0, 2)
+	for i := 0; i < 31; i++ {
+		if platforms&(1<<uint(i)) != 0 {
+			r = append(r, i)
+		}
+	}
+	return r
+}
+
+func (p *Presence) Object() map[string]interface{} {
+	obj := make(map[string]interface{})
+	obj["uid"] = p.uid
+	obj["online"] = p.platforms != 0
+	obj["platforms"] = PlatformList(p.platforms)
+	obj["last_seen"] = p.last_seen
+	return obj
+}
+
+// 保存在用户的hash中, 由imr在用户的在线状态变化时写入
+func SavePresence(redis_pool *redis.Pool, appid int64, uid int64, platforms int32, last_seen int32) error {
+	conn := redis_pool.Get()
+	defer conn.Close()
+
+	key := fmt.Sprintf("users_%d_%d", appid, uid)
+	var err error
+	if platforms == 0 {
+		_, err = conn.Do("HMSET", key, "online_platforms", platforms, "last_seen", last_seen)
+	} else {
+		//在线时的last_seen由查询时的当前时间表示, 离线时才保存
+		_, err = conn.Do("HSET", key, "online_platforms", platforms)
+	}
+	return err
+}
+
+func LoadPresences(redis_pool *redis.Pool, appid int64, uids []int64) ([]*Presence, error) {
+	conn := redis_pool.Get()
+	defer conn.Close()
+
+	for _, uid := range uids {
+		key := fmt.Sprintf("users_%d_%d", appid, uid)
+		conn.Send("HMGET", key, "online_platforms", "last_seen")
+	}
+	err := conn.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	now := int32(time.Now().Unix())
+	presences := make([]*Presence, 0, len(uids))
+	for _, uid := range uids {
+		reply, err := redis.Values(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		var platforms, last_seen int32
+		_, err = redis.Scan(reply, &platforms, &last_seen)
+		if err != nil {
+			return nil, err
+		}
+		//在线的用户只在离线时保存last_seen
+		if platforms != 0 {
+			last_seen = now
+		}
+		presences = append(presences, NewPresence(uid, platforms, last_seen))
+	}
+	return presences, nil
+}
+
+// 第一个订阅者使用redis中的状态初始化缓存, 返回是否是第一个订阅者
+func (route *Route) AddPresenceWatcher(uid int64, client *Client, platforms int32) bool {
+	route.mutex.Lock()
+	defer route.mutex.Unlock()
+	set, ok := route.presence_watchers[uid]
+	if !ok {
+		set = NewClientSet()
+		route.presence_watchers[uid] = set
+		route.presences[uid] = platforms
+	}
+	set.Add(client)
+	return !ok
+}
+
+// 返回是否是最后一个订阅者
+func (route *Route) RemovePresenceWatcher(uid int64, client *Client) bool {
+	route.mutex.Lock()
+	defer route.mutex.Unlock()
+	if set, ok := route.presence_watchers[uid]; ok {
+		set.Remove(client)
+		if set.Count() == 0 {
+			delete(route.presence_watchers, uid)
+			delete(route.presences, uid)
+			return true
+		}
+	}
+	return false
+}
+
+// 多个route server会广播同一个用户的状态, 只有状态变化时返回订阅者
+func (route *Route) UpdatePresence(uid int64, platforms int32) ClientSet {
+	route.mutex.Lock()
+	defer route.mutex.Unlock()
+	set, ok := route.presence_watchers[uid]
+	if !ok {
+		return nil
+	}
+	if route.presences[uid] == platforms {
+		return nil
+	}
+	route.presences[uid] = platforms
+	return set.Clone()
+}
+
+func (app_route *AppRoute) SendPresence(appid int64, uid int64, msg *Message) bool {
+	route := app_route.FindRoute(appid)
+	if route == nil {
+		return false
+	}
+	p := msg.Body.(*Presence)
+	clients := route.UpdatePresence(uid, p.platforms)
+	for c := range clients {
+		c.EnqueueNonBlockMessage(msg)
+	}
+	return len(clients) > 0
+}
+
+func (server *Server) HandleSubscribePresence(client *Client, msg *Message) {
+	if client.uid == 0 {
+		log.Warning("client has't been authenticated")
+		return
+	}
+
+	sub := msg.Body.(*PresenceSubscription)
+	uids := make([]int64, 0, len(sub.uids))
+	m := make(map[int64]bool)
+	for _, uid := range sub.uids {
+		if m[uid] || uid == client.uid {
+			continue
+		}
+		m[uid] = true
+		uids = append(uids, uid)
+	}
+	if len(uids) > PRESENCE_SUBSCRIBE_LIMIT {
+		log.Warningf("uid:%d subscribe presence count:%d exceed limit", client.uid, len(uids))
+		uids = uids[:PRESENCE_SUBSCRIBE_LIMIT]
+	}
+
+	presences, err := LoadPresences(server.redis_pool, client.appid, uids)
+	if err != nil {
+		log.Warning("load presences err:", err)
+		presences = make([]*Presence, 0, len(uids))
+		for _, uid := range uids {
+			presences = append(presences, NewPresence(uid, 0, 0))
+		}
+	}
+
+	route := server.app_route.FindOrAddRoute(client.appid)
+	server.unwatchPresence(client, route)
+	for _, p := range presences {
+		if route.AddPresenceWatcher(p.uid, client.Client(), p.platforms) {
+			server.app.WatchPresence(client.appid, p.uid)
+		}
+	}
+	client.presence_uids = uids
+	log.Infof("uid:%d subscribe presence count:%d", client.uid, len(uids))
+
+	for _, p := range presences {
+		client.EnqueueMessage(&Message{Cmd: MSG_PRESENCE, Version: client.version, Body: p})
+	}
+}
+
+func (server *Server) unwatchPresence(client *Client, route *Route) {
+	for _, uid := range client.presence_uids {
+		if route.RemovePresenceWatcher(uid, client.Client()) {
+			server.app.UnwatchPresence(client.appid, uid)
+		}
+	}
+	client.presence_uids = nil
+}
+
+// 批量查询用户的在线状态
+func GetPresence(w http.ResponseWriter, req *http.Request, redis_pool *redis.Pool) {
+	m, _ := url.ParseQuery(req.URL.RawQuery)
+
+	appid, err := strconv.ParseInt(m.Get("appid"), 10, 64)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid query param", w)
+		return
+	}
+
+	uids := make([]int64, 0, len(m["uid"]))
+	for _, s := range m["uid"] {
+		uid, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			log.Info("error:", err)
+			WriteHttpError(400, "invalid query param", w)
+			return
+		}
+		uids = append(uids, uid)
+	}
+	if len(uids) == 0 || len(uids) > PRESENCE_QUERY_LIMIT {
+		WriteHttpError(400, "invalid uid count", w)
+		return
+	}
+
+	presences, err := LoadPresences(redis_pool, appid, uids)
+	if err != nil {
+		log.Warning("load presences err:", err)
+		WriteHttpError(500, "server internal error", w)
+		return
+	}
+
+	users := make([]interface{}, 0, len(presences))
+	for _, p := range presences {
+		users = append(users, p.Object())
+	}
+	obj := make(map[string]interface{})
+	obj["users"] = users
+	WriteHttpObj(obj, w)
+}
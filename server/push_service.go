@@ -22,6 +22,7 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
@@ -30,29 +31,127 @@ import (
 
 const PUSH_QUEUE_TIMEOUT = 300
 
+// 推送失败之后的重试
+const PUSH_RETRY_COUNT = 3
+const PUSH_RETRY_INTERVAL = 100 * time.Millisecond
+const PUSH_RETRY_MAX_INTERVAL = 5 * time.Second
+
 type Push struct {
+	appid      int64
 	queue_name string
 	content    []byte
 }
 
+type pushRoute struct {
+	worker    *pushWorker
+	app_queue bool
+	queue     string //客服消息的队列名
+}
+
+// 每个sink单独的发送队列, 避免慢的sink阻塞其它的sink
+type pushWorker struct {
+	sink PushSink
+	pwt  chan *Push
+
+	pushed_count  int64
+	dropped_count int64 //队列满时丢弃
+	failed_count  int64 //重试之后依然失败
+	retry_count   int64
+}
+
 type PushService struct {
-	pwt        chan *Push
-	redis_pool *redis.Pool
+	workers         []*pushWorker
+	default_route   *pushRoute
+	routes          map[int64]*pushRoute
+	customer_routes map[customerAppPair]*pushRoute
 }
 
-func NewPushService(redis_pool *redis.Pool) *PushService {
+// 没有配置时, 全部写入redis的固定队列
+func NewPushService(redis_pool *redis.Pool, sinks []*PushSinkConfig, routes []*PushRouteConfig, customer_routes []*CustomerPushRouteConfig) (*PushService, error) {
 	s := &PushService{}
-	s.pwt = make(chan *Push, 10000)
-	s.redis_pool = redis_pool
-	return s
+	s.routes = make(map[int64]*pushRoute)
+	s.customer_routes = make(map[customerAppPair]*pushRoute)
+
+	workers := make(map[string]*pushWorker)
+	redis_worker := newPushWorker(&RedisListSink{name: PUSH_SINK_REDIS, redis_pool: redis_pool})
+	workers[PUSH_SINK_REDIS] = redis_worker
+	s.workers = append(s.workers, redis_worker)
+	for _, config := range sinks {
+		if _, ok := workers[config.Name]; ok {
+			return nil, fmt.Errorf("duplicate push sink:%s", config.Name)
+		}
+		sink, err := NewPushSink(config, redis_pool)
+		if err != nil {
+			return nil, err
+		}
+		w := newPushWorker(sink)
+		workers[config.Name] = w
+		s.workers = append(s.workers, w)
+	}
+
+	s.default_route = &pushRoute{worker: redis_worker}
+	for _, config := range routes {
+		name := config.Sink
+		if name == "" {
+			name = PUSH_SINK_REDIS
+		}
+		w, ok := workers[name]
+		if !ok {
+			return nil, fmt.Errorf("push route sink:%s not found", name)
+		}
+		route := &pushRoute{worker: w, app_queue: config.AppQueue}
+		if len(config.AppIDs) == 0 {
+			s.default_route = route
+		}
+		for _, appid := range config.AppIDs {
+			s.routes[appid] = route
+		}
+	}
+
+	for _, config := range customer_routes {
+		name := config.Sink
+		if name == "" {
+			name = PUSH_SINK_REDIS
+		}
+		w, ok := workers[name]
+		if !ok {
+			return nil, fmt.Errorf("customer push route sink:%s not found", name)
+		}
+		queue := config.Queue
+		if queue == "" {
+			queue = fmt.Sprintf("customer_push_queue_v2_%d_%d", config.SenderAppID, config.ReceiverAppID)
+		}
+		route := &pushRoute{worker: w, queue: queue}
+		s.customer_routes[customerAppPair{config.SenderAppID, config.ReceiverAppID}] = route
+		if config.Bidirectional {
+			s.customer_routes[customerAppPair{config.ReceiverAppID, config.SenderAppID}] = route
+		}
+	}
+	return s, nil
+}
+
+func newPushWorker(sink PushSink) *pushWorker {
+	w := &pushWorker{sink: sink}
+	w.pwt = make(chan *Push, 10000)
+	return w
 }
 
 func (push_service *PushService) Run() {
-	go push_service.Push()
+	for _, w := range push_service.workers {
+		go w.Run()
+	}
 }
 
+func (push_service *PushService) route(appid int64) *pushRoute {
+	if r, ok := push_service.routes[appid]; ok {
+		return r
+	}
+	return push_service.default_route
+}
+
+// 使用单独的推送队列
 func (push_service *PushService) IsROMApp(appid int64) bool {
-	return false
+	return push_service.route(appid).app_queue
 }
 
 // 离线消息入apns队列
@@ -71,7 +170,7 @@ func (push_service *PushService) PublishPeerMessage(appid int64, im *IMMessage)
 		queue_name = "push_queue"
 	}
 
-	push_service.pushChan(queue_name, b)
+	push_service.pushChan(appid, queue_name, b)
 }
 
 func (push_service *PushService) PublishCustomerMessageV2(appid int64, im *CustomerMessageV2) {
@@ -84,6 +183,13 @@ func (push_service *PushService) PublishCustomerMessageV2(appid int64, im *Custo
 	v["content"] = im.content
 
 	b, _ := json.Marshal(v)
+
+	//app对单独配置的推送路由
+	if r, ok := push_service.customer_routes[customerAppPair{im.sender_appid, im.receiver_appid}]; ok {
+		push_service.pushWorkerChan(r.worker, appid, r.queue, b)
+		return
+	}
+
 	var queue_name string
 	if push_service.IsROMApp(appid) {
 		queue_name = fmt.Sprintf("customer_push_queue_v2_%d", appid)
@@ -91,7 +197,7 @@ func (push_service *PushService) PublishCustomerMessageV2(appid int64, im *Custo
 		queue_name = "customer_push_queue_v2"
 	}
 
-	push_service.pushChan(queue_name, b)
+	push_service.pushChan(appid, queue_name, b)
 }
 
 func (push_service *PushService) PublishGroupMessage(appid int64, receivers []int64, im *IMMessage) {
@@ -102,6 +208,17 @@ func (push_service *PushService) PublishGroupMessage(appid int64, receivers []in
 	v["content"] = im.content
 	v["group_id"] = im.receiver
 
+	//接收者中被@的成员
+	mentions := make([]int64, 0)
+	for _, uid := range receivers {
+		if im.IsMentioned(uid) {
+			mentions = append(mentions, uid)
+		}
+	}
+	if len(mentions) > 0 {
+		v["mentions"] = mentions
+	}
+
 	b, _ := json.Marshal(v)
 	var queue_name string
 	if push_service.IsROMApp(appid) {
@@ -110,7 +227,7 @@ func (push_service *PushService) PublishGroupMessage(appid int64, receivers []in
 		queue_name = "group_push_queue"
 	}
 
-	push_service.pushChan(queue_name, b)
+	push_service.pushChan(appid, queue_name, b)
 }
 
 func (push_service *PushService) PublishSystemMessage(appid, receiver int64, sys *SystemMessage) {
@@ -121,44 +238,69 @@ func (push_service *PushService) PublishSystemMessage(appid, receiver int64, sys
 	v["content"] = content
 
 	b, _ := json.Marshal(v)
-	queue_name := "system_push_queue"
+	var queue_name string
+	if push_service.IsROMApp(appid) {
+		queue_name = fmt.Sprintf("system_push_queue_%d", appid)
+	} else {
+		queue_name = "system_push_queue"
+	}
+
+	push_service.pushChan(appid, queue_name, b)
+}
 
-	push_service.pushChan(queue_name, b)
+func (push_service *PushService) pushChan(appid int64, queue_name string, b []byte) {
+	push_service.pushWorkerChan(push_service.route(appid).worker, appid, queue_name, b)
 }
 
-func (push_service *PushService) pushChan(queue_name string, b []byte) {
+func (push_service *PushService) pushWorkerChan(w *pushWorker, appid int64, queue_name string, b []byte) {
 	select {
-	case push_service.pwt <- &Push{queue_name, b}:
+	case w.pwt <- &Push{appid, queue_name, b}:
 	default:
-		log.Warning("rpush message timeout")
+		atomic.AddInt64(&w.dropped_count, 1)
+		log.Warningf("push sink:%s queue full, drop message appid:%d queue:%s", w.sink.Name(), appid, queue_name)
 	}
 }
 
-func (push_service *PushService) PushQueue(ps []*Push) {
-	conn := push_service.redis_pool.Get()
-	defer conn.Close()
-
-	begin := time.Now()
-	conn.Send("MULTI")
-	for _, p := range ps {
-		conn.Send("RPUSH", p.queue_name, p.content)
+func (push_service *PushService) Summary() []map[string]interface{} {
+	r := make([]map[string]interface{}, 0, len(push_service.workers))
+	for _, w := range push_service.workers {
+		obj := make(map[string]interface{})
+		obj["sink"] = w.sink.Name()
+		obj["queue_length"] = len(w.pwt)
+		obj["pushed_count"] = atomic.LoadInt64(&w.pushed_count)
+		obj["dropped_count"] = atomic.LoadInt64(&w.dropped_count)
+		obj["failed_count"] = atomic.LoadInt64(&w.failed_count)
+		obj["retry_count"] = atomic.LoadInt64(&w.retry_count)
+		r = append(r, obj)
 	}
-	_, err := conn.Do("EXEC")
+	return r
+}
 
-	end := time.Now()
-	duration := end.Sub(begin)
-	if err != nil {
-		log.Info("multi rpush error:", err)
-	} else {
-		log.Infof("mmulti rpush:%d time:%s success", len(ps), duration)
-	}
+func (w *pushWorker) PushQueue(ps []*Push) {
+	interval := PUSH_RETRY_INTERVAL
+	for i := 0; ; i++ {
+		err := w.sink.Push(ps)
+		if err == nil {
+			atomic.AddInt64(&w.pushed_count, int64(len(ps)))
+			return
+		}
+		if i >= PUSH_RETRY_COUNT {
+			atomic.AddInt64(&w.failed_count, int64(len(ps)))
+			log.Errorf("push sink:%s drop %d messages err:%s", w.sink.Name(), len(ps), err)
+			return
+		}
 
-	if duration > time.Millisecond*PUSH_QUEUE_TIMEOUT {
-		log.Warning("multi rpush slow:", duration)
+		log.Warningf("push sink:%s err:%s, retry after:%s", w.sink.Name(), err, interval)
+		atomic.AddInt64(&w.retry_count, 1)
+		time.Sleep(interval)
+		interval *= 2
+		if interval > PUSH_RETRY_MAX_INTERVAL {
+			interval = PUSH_RETRY_MAX_INTERVAL
+		}
 	}
 }
 
-func (push_service *PushService) Push() {
+func (w *pushWorker) Run() {
 	//单次入redis队列消息限制
 	const PUSH_LIMIT = 1000
 	const WAIT_TIMEOUT = 500
@@ -168,7 +310,7 @@ func (push_service *PushService) Push() {
 	for !closed {
 		ps = ps[:0]
 		//blocking for first message
-		p := <-push_service.pwt
+		p := <-w.pwt
 		if p == nil {
 			closed = true
 			break
@@ -179,7 +321,7 @@ func (push_service *PushService) Push() {
 	Loop1:
 		for !closed {
 			select {
-			case p := <-push_service.pwt:
+			case p := <-w.pwt:
 				if p == nil {
 					closed = true
 				} else {
@@ -194,12 +336,12 @@ func (push_service *PushService) Push() {
 		}
 
 		if closed {
-			push_service.PushQueue(ps)
+			w.PushQueue(ps)
 			return
 		}
 
 		if len(ps) >= PUSH_LIMIT {
-			push_service.PushQueue(ps)
+			w.PushQueue(ps)
 			continue
 		}
 
@@ -214,7 +356,7 @@ func (push_service *PushService) Push() {
 			}
 			d := end.Sub(now)
 			select {
-			case p := <-push_service.pwt:
+			case p := <-w.pwt:
 				if p == nil {
 					closed = true
 				} else {
@@ -229,7 +371,7 @@ func (push_service *PushService) Push() {
 		}
 
 		if len(ps) > 0 {
-			push_service.PushQueue(ps)
+			w.PushQueue(ps)
 		}
 	}
 }
@@ -0,0 +1,191 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+const PUSH_SINK_REDIS = "redis"
+const PUSH_SINK_WEBHOOK = "webhook"
+const PUSH_SINK_FILE = "file"
+
+const PUSH_WEBHOOK_DEFAULT_TIMEOUT = 5 //秒
+
+// 离线推送消息的出口
+type PushSink interface {
+	Name() string
+	Push(ps []*Push) error
+}
+
+type PushSinkConfig struct {
+	Name    string `toml:"name"`
+	Type    string `toml:"type"`    //redis, webhook, file
+	URL     string `toml:"url"`     //webhook
+	Timeout int    `toml:"timeout"` //webhook超时时间,秒
+	Path    string `toml:"path"`    //file
+}
+
+// appid为空时作为默认的路由
+type PushRouteConfig struct {
+	AppIDs   []int64 `toml:"appids"`
+	Sink     string  `toml:"sink"`
+	AppQueue bool    `toml:"app_queue"` //使用push_queue_{appid}格式的队列名
+}
+
+// 客服消息按照app对选择推送的出口和队列, bidirectional时两个方向都使用此路由
+type CustomerPushRouteConfig struct {
+	SenderAppID   int64  `toml:"sender_appid"`
+	ReceiverAppID int64  `toml:"receiver_appid"`
+	Bidirectional bool   `toml:"bidirectional"`
+	Sink          string `toml:"sink"`
+	Queue         string `toml:"queue"` //默认customer_push_queue_v2_{sender_appid}_{receiver_appid}
+}
+
+func NewPushSink(config *PushSinkConfig, redis_pool *redis.Pool) (PushSink, error) {
+	switch config.Type {
+	case PUSH_SINK_REDIS:
+		return &RedisListSink{name: config.Name, redis_pool: redis_pool}, nil
+	case PUSH_SINK_WEBHOOK:
+		if config.URL == "" {
+			return nil, fmt.Errorf("push sink:%s url is empty", config.Name)
+		}
+		timeout := config.Timeout
+		if timeout <= 0 {
+			timeout = PUSH_WEBHOOK_DEFAULT_TIMEOUT
+		}
+		client := &http.Client{Timeout: time.Duration(timeout) * time.Second}
+		return &WebhookSink{name: config.Name, url: config.URL, client: client}, nil
+	case PUSH_SINK_FILE:
+		if config.Path == "" {
+			return nil, fmt.Errorf("push sink:%s path is empty", config.Name)
+		}
+		return &FileSink{name: config.Name, path: config.Path}, nil
+	default:
+		return nil, fmt.Errorf("push sink:%s unknown type:%s", config.Name, config.Type)
+	}
+}
+
+// 写入redis的list, 由推送服务消费
+type RedisListSink struct {
+	name       string
+	redis_pool *redis.Pool
+}
+
+func (sink *RedisListSink) Name() string {
+	return sink.name
+}
+
+func (sink *RedisListSink) Push(ps []*Push) error {
+	conn := sink.redis_pool.Get()
+	defer conn.Close()
+
+	begin := time.Now()
+	conn.Send("MULTI")
+	for _, p := range ps {
+		conn.Send("RPUSH", p.queue_name, p.content)
+	}
+	_, err := conn.Do("EXEC")
+
+	duration := time.Since(begin)
+	if err != nil {
+		log.Info("multi rpush error:", err)
+		return err
+	}
+	log.Infof("mmulti rpush:%d time:%s success", len(ps), duration)
+
+	if duration > time.Millisecond*PUSH_QUEUE_TIMEOUT {
+		log.Warning("multi rpush slow:", duration)
+	}
+	return nil
+}
+
+// 批量POST到业务服务器, body:[{"queue":"", "appid":0, "content":{}}]
+type WebhookSink struct {
+	name   string
+	url    string
+	client *http.Client
+}
+
+func (sink *WebhookSink) Name() string {
+	return sink.name
+}
+
+func (sink *WebhookSink) Push(ps []*Push) error {
+	type Item struct {
+		Queue   string          `json:"queue"`
+		AppID   int64           `json:"appid"`
+		Content json.RawMessage `json:"content"`
+	}
+	items := make([]*Item, 0, len(ps))
+	for _, p := range ps {
+		items = append(items, &Item{Queue: p.queue_name, AppID: p.appid, Content: p.content})
+	}
+	body, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+
+	resp, err := sink.client.Post(sink.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook:%s status:%d", sink.url, resp.StatusCode)
+	}
+	return nil
+}
+
+// 追加到本地文件, 每行: 队列名 消息内容
+type FileSink struct {
+	name string
+	path string
+}
+
+func (sink *FileSink) Name() string {
+	return sink.name
+}
+
+func (sink *FileSink) Push(ps []*Push) error {
+	file, err := os.OpenFile(sink.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buffer := new(bytes.Buffer)
+	for _, p := range ps {
+		buffer.WriteString(p.queue_name)
+		buffer.WriteByte(' ')
+		buffer.Write(p.content)
+		buffer.WriteByte('\n')
+	}
+	_, err = file.Write(buffer.Bytes())
+	return err
+}
@@ -0,0 +1,181 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/GoBelieveIO/im_service/protocol"
+)
+
+// 空闲的令牌桶回收时间(秒)
+const RATE_LIMIT_IDLE_TIMEOUT = 60
+
+var rateLimitCommands = map[string]int{
+	"im":       MSG_IM,
+	"group_im": MSG_GROUP_IM,
+	"room_im":  MSG_ROOM_IM,
+	"rt":       MSG_RT,
+}
+
+// 每秒发送的消息数量, burst为0时等于rate, rate为0时不限制
+type RateLimitConfig struct {
+	Cmd       string  `toml:"cmd"` //im, group_im, room_im, rt
+	UserRate  float64 `toml:"user_rate"`
+	UserBurst float64 `toml:"user_burst"`
+	AppRate   float64 `toml:"app_rate"`
+	AppBurst  float64 `toml:"app_burst"`
+}
+
+type tokenBucket struct {
+	tokens float64
+	ts     time.Time
+}
+
+func (b *tokenBucket) refill(rate float64, burst float64, now time.Time) {
+	b.tokens += now.Sub(b.ts).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.ts = now
+}
+
+type rateLimitKey struct {
+	cmd   int
+	appid int64
+	uid   int64 //0表示app的限制
+}
+
+// 按照命令配置的用户和app的令牌桶, 只限制本机的连接
+type RateLimiter struct {
+	limits map[int]*RateLimitConfig
+
+	mutex   sync.Mutex
+	buckets map[rateLimitKey]*tokenBucket
+}
+
+func NewRateLimiter(configs []*RateLimitConfig) (*RateLimiter, error) {
+	limiter := &RateLimiter{}
+	limiter.limits = make(map[int]*RateLimitConfig)
+	limiter.buckets = make(map[rateLimitKey]*tokenBucket)
+	for _, config := range configs {
+		cmd, ok := rateLimitCommands[config.Cmd]
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit cmd:%s", config.Cmd)
+		}
+		c := *config
+		if c.UserBurst < c.UserRate {
+			c.UserBurst = c.UserRate
+		}
+		if c.AppBurst < c.AppRate {
+			c.AppBurst = c.AppRate
+		}
+		limiter.limits[cmd] = &c
+	}
+	return limiter, nil
+}
+
+// 补充令牌后返回桶, rate为0时不限制返回nil
+func (limiter *RateLimiter) bucket(k rateLimitKey, rate float64, burst float64, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	b, ok := limiter.buckets[k]
+	if !ok {
+		b = &tokenBucket{tokens: burst, ts: now}
+		limiter.buckets[k] = b
+	}
+	b.refill(rate, burst, now)
+	return b
+}
+
+func (limiter *RateLimiter) Allow(appid int64, uid int64, cmd int) bool {
+	config, ok := limiter.limits[cmd]
+	if !ok {
+		return true
+	}
+
+	now := time.Now()
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	//两个桶都有令牌时才扣除, 被app限制的消息不消耗用户的令牌
+	user_bucket := limiter.bucket(rateLimitKey{cmd, appid, uid}, config.UserRate, config.UserBurst, now)
+	app_bucket := limiter.bucket(rateLimitKey{cmd, appid, 0}, config.AppRate, config.AppBurst, now)
+	if user_bucket != nil && user_bucket.tokens < 1 {
+		return false
+	}
+	if app_bucket != nil && app_bucket.tokens < 1 {
+		return false
+	}
+	if user_bucket != nil {
+		user_bucket.tokens -= 1
+	}
+	if app_bucket != nil {
+		app_bucket.tokens -= 1
+	}
+	return true
+}
+
+func (limiter *RateLimiter) Recycle() {
+	now := time.Now()
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	for k, b := range limiter.buckets {
+		if now.Sub(b.ts) > RATE_LIMIT_IDLE_TIMEOUT*time.Second {
+			delete(limiter.buckets, k)
+		}
+	}
+}
+
+func (limiter *RateLimiter) RecycleLoop() {
+	ticker := time.NewTicker(RATE_LIMIT_IDLE_TIMEOUT * time.Second)
+	for range ticker.C {
+		limiter.Recycle()
+	}
+}
+
+// 返回false表示消息被限制, 连续被限制的次数达到rate_limit_disconnect时断开连接
+func (server *Server) checkRateLimit(client *Client, msg *Message) bool {
+	if server.rate_limiter == nil || client.uid == 0 {
+		return true
+	}
+	if server.rate_limiter.Allow(client.appid, client.uid, msg.Cmd) {
+		atomic.StoreInt32(&client.rate_limited, 0)
+		return true
+	}
+
+	atomic.AddInt64(&server.server_summary.rate_limited_count, 1)
+	ack := &Message{Cmd: MSG_ACK, Version: client.version, Body: &MessageACK{seq: int32(msg.Seq), status: ACK_RATE_LIMITED}}
+	client.EnqueueMessage(ack)
+
+	count := atomic.AddInt32(&client.rate_limited, 1)
+	log.Infof("client:%d %d cmd:%s rate limited count:%d", client.appid, client.uid, Command(msg.Cmd), count)
+	if server.rate_limit_disconnect > 0 && int(count) >= server.rate_limit_disconnect {
+		log.Warningf("client:%d %d rate limited too many times, disconnect", client.appid, client.uid)
+		atomic.AddInt64(&server.server_summary.rate_limit_disconnect_count, 1)
+		client.close()
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/GoBelieveIO/im_service/protocol"
+)
+
+func TestTokenBucketRefill(t *testing.T) {
+	now := time.Now()
+	b := &tokenBucket{tokens: 0, ts: now}
+	b.refill(2, 5, now.Add(time.Second))
+	if b.tokens != 2 {
+		t.Errorf("tokens:%v, expect 2", b.tokens)
+	}
+	b.refill(2, 5, now.Add(10*time.Second))
+	if b.tokens != 5 {
+		t.Errorf("tokens:%v, expect burst 5", b.tokens)
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	configs := []*RateLimitConfig{{Cmd: "im", UserRate: 1, UserBurst: 2, AppRate: 1, AppBurst: 3}}
+	limiter, err := NewRateLimiter(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !limiter.Allow(1, 1, MSG_IM) || !limiter.Allow(1, 1, MSG_IM) {
+		t.Fatal("burst should be allowed")
+	}
+	if limiter.Allow(1, 1, MSG_IM) {
+		t.Error("user bucket should be empty")
+	}
+	//app桶剩余1个令牌
+	if !limiter.Allow(1, 2, MSG_IM) {
+		t.Error("user 2 should be allowed")
+	}
+	//app桶已空, 被app限制的消息不能消耗用户3的令牌
+	if limiter.Allow(1, 3, MSG_IM) {
+		t.Error("app bucket should be empty")
+	}
+	b := limiter.buckets[rateLimitKey{MSG_IM, 1, 3}]
+	if b == nil || b.tokens < 2 {
+		t.Errorf("user 3 tokens consumed:%+v", b)
+	}
+	//未配置的命令不限制
+	if !limiter.Allow(1, 1, MSG_GROUP_IM) {
+		t.Error("group_im should not be limited")
+	}
+}
+
+func TestRateLimiterInvalidCmd(t *testing.T) {
+	_, err := NewRateLimiter([]*RateLimitConfig{{Cmd: "unknown", UserRate: 1}})
+	if err == nil {
+		t.Error("expect error for invalid cmd")
+	}
+}
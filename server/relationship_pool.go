@@ -20,7 +20,6 @@
 package server
 
 import (
-	"database/sql"
 	"errors"
 	"fmt"
 	"strconv"
@@ -29,7 +28,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
 	"github.com/gomodule/redigo/redis"
 
 	log "github.com/sirupsen/logrus"
@@ -72,25 +70,40 @@ type RelationshipPool struct {
 	dirty         bool
 	last_entry_id string
 	action_id     int64
-	db            *sql.DB
+	store         RelationshipStore
 	redis_pool    *redis.Pool
 	redis_config  *RedisConfig
+
+	//两个用户成为好友时调用
+	friend_observer func(appid, uid, friend_uid int64)
 }
 
 func NewRelationshipPool(mysqldb_datasource string, redis_pool *redis.Pool) *RelationshipPool {
-	rp := &RelationshipPool{}
-	rp.items = &sync.Map{}
-
-	db, err := sql.Open("mysql", mysqldb_datasource)
+	store, err := NewRelationshipStore(STORE_MYSQL, mysqldb_datasource, "")
 	if err != nil {
 		log.Fatal("open db:", err)
 	}
-	rp.db = db
+	return NewRelationshipPoolWithStore(store, redis_pool)
+}
+
+func NewRelationshipPoolWithStore(store RelationshipStore, redis_pool *redis.Pool) *RelationshipPool {
+	rp := &RelationshipPool{}
+	rp.items = &sync.Map{}
+	rp.store = store
 	rp.redis_pool = redis_pool
 	return rp
 }
 
+func (rp *RelationshipPool) SetFriendObserver(observer func(appid, uid, friend_uid int64)) {
+	rp.friend_observer = observer
+}
+
 func (rp *RelationshipPool) GetRelationship(appid, uid, friend_uid int64) Relationship {
+	if !rp.store.Cacheable() {
+		rs, _ := rp.store.GetRelationship(appid, uid, friend_uid)
+		return rs
+	}
+
 	reverse := false
 	if uid > friend_uid {
 		reverse = true
@@ -115,7 +128,7 @@ func (rp *RelationshipPool) GetRelationship(appid, uid, friend_uid int64) Relati
 		}
 	}
 
-	rs, err := GetRelationship(rp.db, appid, uid, friend_uid)
+	rs, err := rp.store.GetRelationship(appid, uid, friend_uid)
 	if err != nil {
 		return NoneRelationship
 	}
@@ -246,6 +259,12 @@ func (rp *RelationshipPool) HandleFriend(event *RelationshipEvent) {
 
 	rp.SetMyFriend(appid, uid, friend_uid, is_friend)
 
+	if is_friend && rp.friend_observer != nil {
+		rs := rp.GetRelationship(appid, uid, friend_uid)
+		if rs.IsMyFriend() && rs.IsYourFriend() {
+			go rp.friend_observer(appid, uid, friend_uid)
+		}
+	}
 }
 
 func (rp *RelationshipPool) HandleBlacklist(event *RelationshipEvent) {
@@ -308,7 +327,7 @@ func (rp *RelationshipPool) ReloadRelation() {
 			continue
 		}
 
-		rs, err := GetRelationship(rp.db, appid, uid, friend_uid)
+		rs, err := rp.store.GetRelationship(appid, uid, friend_uid)
 		if err != nil {
 			log.Warning("get relationship err:", err)
 			continue
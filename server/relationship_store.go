@@ -0,0 +1,207 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// 好友和黑名单关系的存储, 关系的变化通过relationship_stream通知
+type RelationshipStore interface {
+	GetRelationship(appid int64, uid int64, friend_uid int64) (Relationship, error)
+
+	//返回false时RelationshipPool不缓存读取的关系
+	Cacheable() bool
+}
+
+func NewRelationshipStore(store_type string, mysqldb_datasource string, url string) (RelationshipStore, error) {
+	switch store_type {
+	case "", STORE_MYSQL:
+		db, err := sql.Open("mysql", mysqldb_datasource)
+		if err != nil {
+			return nil, err
+		}
+		return &MySQLRelationshipStore{db: db}, nil
+	case STORE_HTTP:
+		if url == "" {
+			return nil, errors.New("relationship store url is empty")
+		}
+		return NewHTTPRelationshipStore(url), nil
+	case STORE_MEMORY:
+		store := NewMemoryRelationshipStore()
+		//memory时url为初始关系数据的json文件
+		if url != "" {
+			err := store.LoadFile(url)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown relationship store:%s", store_type)
+	}
+}
+
+type MySQLRelationshipStore struct {
+	db *sql.DB
+}
+
+func (store *MySQLRelationshipStore) GetRelationship(appid int64, uid int64, friend_uid int64) (Relationship, error) {
+	return GetRelationship(store.db, appid, uid, friend_uid)
+}
+
+func (store *MySQLRelationshipStore) Cacheable() bool {
+	return true
+}
+
+// 关系数据由用户服务提供
+// GET {url}/relationship?appid=&uid=&friend_uid=
+// {"my_friend":, "your_friend":, "in_my_blacklist":, "in_your_blacklist":}
+type HTTPRelationshipStore struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTPRelationshipStore(url string) *HTTPRelationshipStore {
+	client := &http.Client{Timeout: STORE_HTTP_TIMEOUT * time.Second}
+	return &HTTPRelationshipStore{url: url, client: client}
+}
+
+func (store *HTTPRelationshipStore) GetRelationship(appid int64, uid int64, friend_uid int64) (Relationship, error) {
+	url := fmt.Sprintf("%s/relationship?appid=%d&uid=%d&friend_uid=%d", store.url, appid, uid, friend_uid)
+	resp, err := store.client.Get(url)
+	if err != nil {
+		return NoneRelationship, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return NoneRelationship, fmt.Errorf("get relationship status:%d", resp.StatusCode)
+	}
+
+	var r struct {
+		MyFriend        bool `json:"my_friend"`
+		YourFriend      bool `json:"your_friend"`
+		InMyBlacklist   bool `json:"in_my_blacklist"`
+		InYourBlacklist bool `json:"in_your_blacklist"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return NoneRelationship, err
+	}
+	return NewRelationship(r.MyFriend, r.YourFriend, r.InMyBlacklist, r.InYourBlacklist), nil
+}
+
+func (store *HTTPRelationshipStore) Cacheable() bool {
+	return true
+}
+
+type relationshipKey struct {
+	appid      int64
+	uid        int64
+	friend_uid int64
+}
+
+// 内存中的单向关系, 用于测试和单机部署
+// RelationshipPool不缓存此存储的关系, 修改立即生效
+type MemoryRelationshipStore struct {
+	mutex     sync.Mutex
+	friends   map[relationshipKey]bool
+	blacklist map[relationshipKey]bool
+}
+
+func NewMemoryRelationshipStore() *MemoryRelationshipStore {
+	store := &MemoryRelationshipStore{}
+	store.friends = make(map[relationshipKey]bool)
+	store.blacklist = make(map[relationshipKey]bool)
+	return store
+}
+
+func (store *MemoryRelationshipStore) GetRelationship(appid int64, uid int64, friend_uid int64) (Relationship, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	k := relationshipKey{appid, uid, friend_uid}
+	r := relationshipKey{appid, friend_uid, uid}
+	return NewRelationship(store.friends[k], store.friends[r], store.blacklist[k], store.blacklist[r]), nil
+}
+
+func (store *MemoryRelationshipStore) Cacheable() bool {
+	return false
+}
+
+// {"friends":[{"appid":, "uid":, "friend_uid":}], "blacklist":[{"appid":, "uid":, "friend_uid":}]}
+// friends为单向关系, 互为好友需要两条记录
+func (store *MemoryRelationshipStore) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	type item struct {
+		AppID     int64 `json:"appid"`
+		UID       int64 `json:"uid"`
+		FriendUID int64 `json:"friend_uid"`
+	}
+	var f struct {
+		Friends   []item `json:"friends"`
+		Blacklist []item `json:"blacklist"`
+	}
+	err = json.Unmarshal(data, &f)
+	if err != nil {
+		return err
+	}
+	for _, r := range f.Friends {
+		store.SetFriend(r.AppID, r.UID, r.FriendUID, true)
+	}
+	for _, r := range f.Blacklist {
+		store.SetBlacklist(r.AppID, r.UID, r.FriendUID, true)
+	}
+	return nil
+}
+
+// uid添加friend_uid为好友
+func (store *MemoryRelationshipStore) SetFriend(appid int64, uid int64, friend_uid int64, is_friend bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	k := relationshipKey{appid, uid, friend_uid}
+	if is_friend {
+		store.friends[k] = true
+	} else {
+		delete(store.friends, k)
+	}
+}
+
+// uid把friend_uid加入黑名单
+func (store *MemoryRelationshipStore) SetBlacklist(appid int64, uid int64, friend_uid int64, is_blacklist bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	k := relationshipKey{appid, uid, friend_uid}
+	if is_blacklist {
+		store.blacklist[k] = true
+	} else {
+		delete(store.blacklist, k)
+	}
+}
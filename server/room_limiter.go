@@ -0,0 +1,175 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 聊天室消息的默认采样间隔, 超过频率限制后每sample条消息只发送一条
+const ROOM_DEFAULT_SAMPLE_RATE = 10
+
+// 聊天室丢弃计数的保留时间(秒)和最多记录的聊天室数量
+const ROOM_DROPS_IDLE_TIMEOUT = 3600
+const ROOM_DROPS_LIMIT = 10000
+
+type roomDrops struct {
+	sampled int64 //超过频率限制未发送的消息数量
+	dropped int64 //客户端队列满丢弃的消息数量, 每个客户端单独计数
+	ts      int64 //最近一次丢弃的时间
+}
+
+// 聊天室消息的频率限制和丢弃计数, 频率限制只作用于本机的客户端
+type RoomLimiter struct {
+	rate_limit  int64 //每个聊天室每秒发送的消息数量, 0表示不限制
+	sample_rate int64
+
+	mutex   sync.Mutex
+	window  int64 //当前的秒
+	counts  map[RouteID]int64
+	drops   map[RouteID]*roomDrops
+	pruned  int64 //上次清理丢弃计数的时间
+	sampled int64
+	dropped int64
+}
+
+func NewRoomLimiter() *RoomLimiter {
+	limiter := &RoomLimiter{}
+	limiter.sample_rate = ROOM_DEFAULT_SAMPLE_RATE
+	limiter.counts = make(map[RouteID]int64)
+	limiter.drops = make(map[RouteID]*roomDrops)
+	return limiter
+}
+
+func (limiter *RoomLimiter) SetRateLimit(rate_limit int, sample_rate int) {
+	if sample_rate <= 0 {
+		sample_rate = ROOM_DEFAULT_SAMPLE_RATE
+	}
+	atomic.StoreInt64(&limiter.sample_rate, int64(sample_rate))
+	atomic.StoreInt64(&limiter.rate_limit, int64(rate_limit))
+}
+
+// 超过频率限制后按照采样间隔发送, 返回false表示消息被丢弃
+func (limiter *RoomLimiter) Allow(appid int64, room_id int64) bool {
+	rate_limit := atomic.LoadInt64(&limiter.rate_limit)
+	if rate_limit <= 0 {
+		return true
+	}
+	sample_rate := atomic.LoadInt64(&limiter.sample_rate)
+
+	now := time.Now().Unix()
+	k := RouteID{AppID: appid, ID: room_id}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	if now != limiter.window {
+		limiter.window = now
+		limiter.counts = make(map[RouteID]int64)
+	}
+	count := limiter.counts[k] + 1
+	limiter.counts[k] = count
+	if count <= rate_limit || (count-rate_limit)%sample_rate == 0 {
+		return true
+	}
+	if drops := limiter.roomDrops(k, now); drops != nil {
+		drops.sampled++
+	}
+	limiter.sampled++
+	return false
+}
+
+// 客户端队列中被丢弃的聊天室消息
+func (limiter *RoomLimiter) AddDrop(appid int64, room_id int64, count int64) {
+	now := time.Now().Unix()
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	if drops := limiter.roomDrops(RouteID{AppID: appid, ID: room_id}, now); drops != nil {
+		drops.dropped += count
+	}
+	limiter.dropped += count
+}
+
+// 聊天室数量达到上限时只计入总数, 返回nil
+func (limiter *RoomLimiter) roomDrops(k RouteID, now int64) *roomDrops {
+	if now-limiter.pruned >= 60 {
+		limiter.prune(now)
+	}
+	drops, ok := limiter.drops[k]
+	if !ok {
+		if len(limiter.drops) >= ROOM_DROPS_LIMIT {
+			return nil
+		}
+		drops = &roomDrops{}
+		limiter.drops[k] = drops
+	}
+	drops.ts = now
+	return drops
+}
+
+// 删除长时间没有丢弃消息的聊天室
+func (limiter *RoomLimiter) prune(now int64) {
+	limiter.pruned = now
+	for k, drops := range limiter.drops {
+		if now-drops.ts > ROOM_DROPS_IDLE_TIMEOUT {
+			delete(limiter.drops, k)
+		}
+	}
+}
+
+func (limiter *RoomLimiter) DropCount() (int64, int64) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return limiter.sampled, limiter.dropped
+}
+
+// 丢弃消息最多的limit个聊天室
+func (limiter *RoomLimiter) GetDrops(appid int64, limit int) []map[string]interface{} {
+	limiter.mutex.Lock()
+	room_ids := make([]int64, 0)
+	drops := make(map[int64]roomDrops)
+	for k, d := range limiter.drops {
+		if k.AppID == appid {
+			room_ids = append(room_ids, k.ID)
+			drops[k.ID] = *d
+		}
+	}
+	limiter.mutex.Unlock()
+
+	total := func(room_id int64) int64 {
+		return drops[room_id].sampled + drops[room_id].dropped
+	}
+	sort.Slice(room_ids, func(i, j int) bool { return total(room_ids[i]) > total(room_ids[j]) })
+	if len(room_ids) > limit {
+		room_ids = room_ids[:limit]
+	}
+
+	objs := make([]map[string]interface{}, 0, len(room_ids))
+	for _, room_id := range room_ids {
+		obj := make(map[string]interface{})
+		obj["room_id"] = room_id
+		obj["sampled"] = drops[room_id].sampled
+		obj["dropped"] = drops[room_id].dropped
+		objs = append(objs, obj)
+	}
+	return objs
+}
@@ -0,0 +1,60 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"testing"
+)
+
+func TestRoomLimiterSample(t *testing.T) {
+	limiter := NewRoomLimiter()
+	limiter.SetRateLimit(2, 3)
+	allowed := 0
+	for i := 0; i < 8; i++ {
+		if limiter.Allow(1, 100) {
+			allowed++
+		}
+	}
+	//前2条和超出之后的第3,6条
+	if allowed != 4 {
+		t.Errorf("allowed:%d, expect 4", allowed)
+	}
+	sampled, _ := limiter.DropCount()
+	if sampled != 4 {
+		t.Errorf("sampled:%d, expect 4", sampled)
+	}
+}
+
+func TestRoomLimiterPrune(t *testing.T) {
+	limiter := NewRoomLimiter()
+	limiter.AddDrop(1, 100, 5)
+	limiter.drops[RouteID{AppID: 1, ID: 100}].ts -= ROOM_DROPS_IDLE_TIMEOUT + 1
+	limiter.pruned = 0
+	limiter.AddDrop(1, 200, 1)
+
+	drops := limiter.GetDrops(1, 10)
+	if len(drops) != 1 || drops[0]["room_id"] != int64(200) {
+		t.Errorf("drops:%v", drops)
+	}
+	_, dropped := limiter.DropCount()
+	if dropped != 6 {
+		t.Errorf("dropped:%d, expect 6", dropped)
+	}
+}
@@ -0,0 +1,150 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/GoBelieveIO/im_service/protocol"
+)
+
+// 聊天室成员分页的默认数量和最大数量
+const ROOM_MEMBERS_DEFAULT_LIMIT = 100
+const ROOM_MEMBERS_MAX_LIMIT = 500
+
+// 成员列表来自聊天室所属的route server, 只有聊天室中的用户可以获取
+func (server *Server) HandleGetRoomMembers(client *Client, msg *Message) {
+	req := msg.Body.(*RoomMembersRequest)
+	if client.uid == 0 {
+		log.Warning("client has't been authenticated")
+		return
+	}
+	if req.room_id == 0 || !client.IsInRoom(req.room_id) {
+		log.Warningf("client:%d isn't in room:%d", client.uid, req.room_id)
+		return
+	}
+
+	offset := int(req.offset)
+	limit := int(req.limit)
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 {
+		limit = ROOM_MEMBERS_DEFAULT_LIMIT
+	} else if limit > ROOM_MEMBERS_MAX_LIMIT {
+		limit = ROOM_MEMBERS_MAX_LIMIT
+	}
+
+	total, uids, err := server.app.QueryRoomMembers(client.appid, req.room_id, offset, limit)
+	if err != nil {
+		log.Warningf("query room:%d members err:%s", req.room_id, err)
+		return
+	}
+
+	next_offset := offset + len(uids)
+	if len(uids) == 0 || next_offset >= total {
+		next_offset = -1
+	}
+	content, _ := json.Marshal(uids)
+	m := &RoomMembers{
+		room_id:     req.room_id,
+		total:       int32(total),
+		next_offset: int32(next_offset),
+		content:     string(content),
+	}
+	client.EnqueueMessage(&Message{Cmd: MSG_ROOM_MEMBERS, Body: m})
+}
+
+func (server *Server) HandleGetRoomMemberCount(client *Client, msg *Message) {
+	room_id := msg.Body.(*Room).RoomID()
+	if client.uid == 0 {
+		log.Warning("client has't been authenticated")
+		return
+	}
+	if room_id == 0 || !client.IsInRoom(room_id) {
+		log.Warningf("client:%d isn't in room:%d", client.uid, room_id)
+		return
+	}
+
+	total, _, err := server.app.QueryRoomMembers(client.appid, room_id, 0, 0)
+	if err != nil {
+		log.Warningf("query room:%d members err:%s", room_id, err)
+		return
+	}
+	c := &RoomMemberCount{room_id: room_id, count: int32(total)}
+	client.EnqueueMessage(&Message{Cmd: MSG_ROOM_MEMBER_COUNT, Body: c})
+}
+
+// GET /get_room_members?appid=&room_id=&offset=&limit=
+func GetRoomMembers(w http.ResponseWriter, req *http.Request, app *App) {
+	m, _ := url.ParseQuery(req.URL.RawQuery)
+
+	appid, err := strconv.ParseInt(m.Get("appid"), 10, 64)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid query param", w)
+		return
+	}
+
+	room_id, err := strconv.ParseInt(m.Get("room_id"), 10, 64)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid query param", w)
+		return
+	}
+
+	offset, limit := 0, ROOM_MEMBERS_DEFAULT_LIMIT
+	if m.Get("offset") != "" {
+		offset, err = strconv.Atoi(m.Get("offset"))
+		if err != nil || offset < 0 {
+			WriteHttpError(400, "invalid query param", w)
+			return
+		}
+	}
+	if m.Get("limit") != "" {
+		limit, err = strconv.Atoi(m.Get("limit"))
+		if err != nil || limit < 0 || limit > ROOM_MEMBERS_MAX_LIMIT {
+			WriteHttpError(400, "invalid query param", w)
+			return
+		}
+	}
+
+	total, uids, err := app.QueryRoomMembers(appid, room_id, offset, limit)
+	if err != nil {
+		log.Warning("query room members err:", err)
+		WriteHttpError(500, "server internal error", w)
+		return
+	}
+
+	next_offset := offset + len(uids)
+	if len(uids) == 0 || next_offset >= total {
+		next_offset = -1
+	}
+	obj := make(map[string]interface{})
+	obj["total"] = total
+	obj["members"] = uids
+	obj["next_offset"] = next_offset
+	WriteHttpObj(obj, w)
+}
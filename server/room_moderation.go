@@ -0,0 +1,369 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bitly/go-simplejson"
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/GoBelieveIO/im_service/protocol"
+)
+
+// 慢速模式配置在im中的缓存时间, 变化时通过route server通知订阅了聊天室的im
+const ROOM_SLOW_MODE_CACHE_TTL = 60
+
+const ROOM_CONTROL_KICK = 1
+const ROOM_CONTROL_BAN = 2
+const ROOM_CONTROL_SLOW_MODE = 3
+
+type roomSlowMode struct {
+	seconds int64
+	ts      int64 //加载的时间
+}
+
+// 聊天室的踢人, 封禁和慢速模式
+// 状态保存在redis中, 变化通过route server转发给所有订阅了此聊天室的im
+type RoomModeration struct {
+	app        *App
+	app_route  *AppRoute
+	redis_pool *redis.Pool
+
+	mutex      sync.Mutex
+	slow_modes map[RouteID]*roomSlowMode
+}
+
+func NewRoomModeration(app *App, app_route *AppRoute, redis_pool *redis.Pool) *RoomModeration {
+	m := &RoomModeration{}
+	m.app = app
+	m.app_route = app_route
+	m.redis_pool = redis_pool
+	m.slow_modes = make(map[RouteID]*roomSlowMode)
+	return m
+}
+
+func roomKey(appid int64, room_id int64) string {
+	return fmt.Sprintf("rooms_%d_%d", appid, room_id)
+}
+
+// 有序集合, score为封禁的截止时间, 0表示永久封禁
+func roomBansKey(appid int64, room_id int64) string {
+	return fmt.Sprintf("room_bans_%d_%d", appid, room_id)
+}
+
+func roomSlowModeKey(appid int64, room_id int64, uid int64) string {
+	return fmt.Sprintf("room_slow_%d_%d_%d", appid, room_id, uid)
+}
+
+func (m *RoomModeration) IsBanned(appid int64, room_id int64, uid int64) (bool, error) {
+	conn := m.redis_pool.Get()
+	defer conn.Close()
+
+	until, err := redis.Int64(conn.Do("ZSCORE", roomBansKey(appid, room_id), uid))
+	if err == redis.ErrNil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return until == 0 || until > time.Now().Unix(), nil
+}
+
+func (m *RoomModeration) loadSlowMode(appid int64, room_id int64) (int64, error) {
+	conn := m.redis_pool.Get()
+	defer conn.Close()
+
+	seconds, err := redis.Int64(conn.Do("HGET", roomKey(appid, room_id), "slow_mode"))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return seconds, err
+}
+
+func (m *RoomModeration) getSlowMode(appid int64, room_id int64) int64 {
+	id := RouteID{AppID: appid, ID: room_id}
+	now := time.Now().Unix()
+
+	m.mutex.Lock()
+	s, ok := m.slow_modes[id]
+	m.mutex.Unlock()
+	if ok && now-s.ts < ROOM_SLOW_MODE_CACHE_TTL {
+		return s.seconds
+	}
+
+	seconds, err := m.loadSlowMode(appid, room_id)
+	if err != nil {
+		log.Warningf("load room:%d slow mode err:%s", room_id, err)
+		if ok {
+			return s.seconds
+		}
+		return 0
+	}
+	m.setSlowMode(appid, room_id, seconds)
+	return seconds
+}
+
+func (m *RoomModeration) setSlowMode(appid int64, room_id int64, seconds int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.slow_modes[RouteID{AppID: appid, ID: room_id}] = &roomSlowMode{seconds: seconds, ts: time.Now().Unix()}
+}
+
+// 返回false表示在慢速模式的间隔内已经发送过消息, 使用redis保证在所有im上的限制
+func (m *RoomModeration) CheckSlowMode(appid int64, room_id int64, uid int64) bool {
+	seconds := m.getSlowMode(appid, room_id)
+	if seconds <= 0 {
+		return true
+	}
+
+	conn := m.redis_pool.Get()
+	defer conn.Close()
+
+	_, err := redis.String(conn.Do("SET", roomSlowModeKey(appid, room_id, uid), 1, "EX", seconds, "NX"))
+	if err == redis.ErrNil {
+		return false
+	} else if err != nil {
+		log.Warning("set slow mode key err:", err)
+	}
+	return true
+}
+
+func (m *RoomModeration) Kick(appid int64, room_id int64, uid int64) {
+	m.publish(appid, room_id, &RoomControl{room_id: room_id, uid: uid, action: ROOM_CONTROL_KICK})
+}
+
+// duration: 封禁的时长(秒), 0表示永久封禁
+func (m *RoomModeration) Ban(appid int64, room_id int64, uid int64, duration int64) error {
+	var until int64
+	now := time.Now().Unix()
+	if duration > 0 {
+		until = now + duration
+	}
+
+	conn := m.redis_pool.Get()
+	defer conn.Close()
+
+	key := roomBansKey(appid, room_id)
+	_, err := conn.Do("ZADD", key, until, uid)
+	if err != nil {
+		return err
+	}
+	//删除过期的封禁
+	_, err = conn.Do("ZREMRANGEBYSCORE", key, 1, now)
+	if err != nil {
+		log.Warning("zremrangebyscore err:", err)
+	}
+
+	m.publish(appid, room_id, &RoomControl{room_id: room_id, uid: uid, action: ROOM_CONTROL_BAN, value: until})
+	return nil
+}
+
+func (m *RoomModeration) Unban(appid int64, room_id int64, uid int64) error {
+	conn := m.redis_pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("ZREM", roomBansKey(appid, room_id), uid)
+	return err
+}
+
+// seconds为0时关闭慢速模式
+func (m *RoomModeration) SetSlowMode(appid int64, room_id int64, seconds int64) error {
+	conn := m.redis_pool.Get()
+	defer conn.Close()
+
+	var err error
+	if seconds > 0 {
+		_, err = conn.Do("HSET", roomKey(appid, room_id), "slow_mode", seconds)
+	} else {
+		_, err = conn.Do("HDEL", roomKey(appid, room_id), "slow_mode")
+	}
+	if err != nil {
+		return err
+	}
+
+	m.publish(appid, room_id, &RoomControl{room_id: room_id, action: ROOM_CONTROL_SLOW_MODE, value: seconds})
+	return nil
+}
+
+// 本机直接处理, 其它im通过route server接收
+func (m *RoomModeration) publish(appid int64, room_id int64, c *RoomControl) {
+	msg := &Message{Cmd: MSG_ROOM_CONTROL, Version: DEFAULT_VERSION, Body: c}
+	m.app.PublishRoomMessage(appid, room_id, msg)
+	m.HandleControl(appid, c)
+}
+
+func (m *RoomModeration) HandleControl(appid int64, c *RoomControl) {
+	log.Infof("room control appid:%d room id:%d uid:%d action:%d value:%d", appid, c.room_id, c.uid, c.action, c.value)
+	switch c.action {
+	case ROOM_CONTROL_KICK, ROOM_CONTROL_BAN:
+		m.kickClients(appid, c.room_id, c.uid)
+	case ROOM_CONTROL_SLOW_MODE:
+		m.setSlowMode(appid, c.room_id, c.value)
+	default:
+		log.Warning("unknown room control action:", c.action)
+	}
+}
+
+// 用户在此im上的所有连接离开聊天室
+func (m *RoomModeration) kickClients(appid int64, room_id int64, uid int64) {
+	route := m.app_route.FindRoute(appid)
+	if route == nil {
+		return
+	}
+	clients := route.FindRoomClientSet(room_id)
+	for c := range clients {
+		if c.uid != uid {
+			continue
+		}
+
+		c.room_mutex.Lock()
+		in_room := c.isInRoom(room_id)
+		if in_room {
+			m.app.leaveRoom(c, room_id)
+		}
+		c.room_mutex.Unlock()
+
+		if !in_room {
+			continue
+		}
+		if c.version >= CHANGED_NOTIFICATION_VERSION {
+			room := Room(room_id)
+			c.EnqueueNonBlockMessage(&Message{Cmd: MSG_ROOM_KICKED, Body: &room})
+		} else {
+			//旧版本的客户端再发送聊天室消息时收到ACK_NOT_ROOM_MEMBER
+			log.Infof("client:%d version:%d kicked from room:%d without notification", c.uid, c.version, room_id)
+		}
+	}
+}
+
+var errInvalidRoomRequest = errors.New("invalid request")
+
+func readRoomModerationRequest(req *http.Request) (*simplejson.Json, int64, int64, int64, error) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+
+	obj, err := simplejson.NewJson(body)
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+
+	appid, err := obj.Get("appid").Int64()
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	room_id, err := obj.Get("room_id").Int64()
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	if room_id == 0 {
+		return nil, 0, 0, 0, errInvalidRoomRequest
+	}
+	uid := obj.Get("uid").MustInt64(0)
+	return obj, appid, room_id, uid, nil
+}
+
+// body: {"appid":, "room_id":, "uid":}
+func KickRoomMember(w http.ResponseWriter, req *http.Request, m *RoomModeration) {
+	_, appid, room_id, uid, err := readRoomModerationRequest(req)
+	if err != nil || uid == 0 {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+
+	m.Kick(appid, room_id, uid)
+	log.Infof("kick room:%d member:%d", room_id, uid)
+	w.WriteHeader(200)
+}
+
+// body: {"appid":, "room_id":, "uid":, "duration":秒}
+func BanRoomMember(w http.ResponseWriter, req *http.Request, m *RoomModeration) {
+	obj, appid, room_id, uid, err := readRoomModerationRequest(req)
+	if err != nil || uid == 0 {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+	duration := obj.Get("duration").MustInt64(0)
+	if duration < 0 {
+		WriteHttpError(400, "invalid duration", w)
+		return
+	}
+
+	err = m.Ban(appid, room_id, uid, duration)
+	if err != nil {
+		log.Warningf("ban room:%d member:%d err:%s", room_id, uid, err)
+		WriteHttpError(500, "server internal error", w)
+		return
+	}
+	log.Infof("ban room:%d member:%d duration:%d", room_id, uid, duration)
+	w.WriteHeader(200)
+}
+
+// body: {"appid":, "room_id":, "uid":}
+func UnbanRoomMember(w http.ResponseWriter, req *http.Request, m *RoomModeration) {
+	_, appid, room_id, uid, err := readRoomModerationRequest(req)
+	if err != nil || uid == 0 {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+
+	err = m.Unban(appid, room_id, uid)
+	if err != nil {
+		log.Warningf("unban room:%d member:%d err:%s", room_id, uid, err)
+		WriteHttpError(500, "server internal error", w)
+		return
+	}
+	log.Infof("unban room:%d member:%d", room_id, uid)
+	w.WriteHeader(200)
+}
+
+// body: {"appid":, "room_id":, "seconds":}, seconds为0时关闭慢速模式
+func SetRoomSlowMode(w http.ResponseWriter, req *http.Request, m *RoomModeration) {
+	obj, appid, room_id, _, err := readRoomModerationRequest(req)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid json format", w)
+		return
+	}
+	seconds := obj.Get("seconds").MustInt64(0)
+	if seconds < 0 {
+		WriteHttpError(400, "invalid seconds", w)
+		return
+	}
+
+	err = m.SetSlowMode(appid, room_id, seconds)
+	if err != nil {
+		log.Warningf("set room:%d slow mode err:%s", room_id, err)
+		WriteHttpError(500, "server internal error", w)
+		return
+	}
+	log.Infof("set room:%d slow mode:%d", room_id, seconds)
+	w.WriteHeader(200)
+}
@@ -27,6 +27,12 @@ import (
 	. "github.com/GoBelieveIO/im_service/protocol"
 )
 
+// 协议版本4开始一个连接可以同时进入多个聊天室, 之前的版本进入新的聊天室时离开之前的聊天室
+const MULTI_ROOM_VERSION = 4
+
+// 一个连接最多同时进入的聊天室数量
+const MAX_CLIENT_ROOMS = 8
+
 func (server *Server) HandleEnterRoom(client *Client, msg *Message) {
 	room := msg.Body.(*Room)
 
@@ -37,21 +43,73 @@ func (server *Server) HandleEnterRoom(client *Client, msg *Message) {
 
 	room_id := room.RoomID()
 	log.Info("enter room id:", room_id)
-	if room_id == 0 || client.room_id == room_id {
+	if room_id == 0 || client.IsInRoom(room_id) {
 		return
 	}
+
+	if server.room_moderation != nil {
+		banned, err := server.room_moderation.IsBanned(client.appid, room_id, client.uid)
+		if err != nil {
+			log.Warning("load room ban err:", err)
+		}
+		if banned {
+			log.Infof("client:%d is banned from room:%d", client.uid, room_id)
+			ack := &Message{Cmd: MSG_ACK, Body: &MessageACK{seq: int32(msg.Seq), status: ACK_ROOM_BANNED}}
+			client.EnqueueMessage(ack)
+			return
+		}
+	}
+
+	client.room_mutex.Lock()
+	if client.version < MULTI_ROOM_VERSION {
+		for _, id := range client.room_ids {
+			server.app.leaveRoom(client, id)
+		}
+	} else if len(client.room_ids) >= MAX_CLIENT_ROOMS {
+		client.room_mutex.Unlock()
+		log.Warningf("client:%d rooms exceed limit", client.uid)
+		ack := &Message{Cmd: MSG_ACK, Body: &MessageACK{seq: int32(msg.Seq), status: ACK_ROOM_LIMIT}}
+		client.EnqueueMessage(ack)
+		return
+	}
+
+	client.room_ids = append(client.room_ids, room_id)
 	route := server.app_route.FindOrAddRoute(client.appid)
-	if client.room_id > 0 {
-		channel := server.app.GetRoomChannel(client.room_id)
-		channel.UnsubscribeRoom(client.appid, client.room_id)
+	route.AddRoomClient(room_id, client.Client())
+	server.app.SubscribeRoom(client.appid, room_id)
+	server.app.SubscribeRoomMember(client.appid, room_id, client.uid)
+	client.room_mutex.Unlock()
 
-		route.RemoveRoomClient(client.room_id, client.Client())
+	server.sendRoomBacklog(client, room_id)
+}
+
+// 调用者持有client.room_mutex
+func (app *App) leaveRoom(client *Client, room_id int64) {
+	route := app.app_route.FindOrAddRoute(client.appid)
+	route.RemoveRoomClient(room_id, client.Client())
+	app.UnsubscribeRoom(client.appid, room_id)
+	app.UnsubscribeRoomMember(client.appid, room_id, client.uid)
+
+	room_ids := make([]int64, 0, len(client.room_ids))
+	for _, id := range client.room_ids {
+		if id != room_id {
+			room_ids = append(room_ids, id)
+		}
 	}
+	client.room_ids = room_ids
+}
 
-	client.room_id = room_id
-	route.AddRoomClient(client.room_id, client.Client())
-	channel := server.app.GetRoomChannel(client.room_id)
-	channel.SubscribeRoom(client.appid, client.room_id)
+// 先订阅再补发, 订阅之后收到的消息可能会重复
+func (server *Server) sendRoomBacklog(client *Client, room_id int64) {
+	msgs, err := server.app.QueryRoomBacklog(client.appid, room_id)
+	if err != nil {
+		log.Warningf("query room:%d backlog err:%s", room_id, err)
+		return
+	}
+	for _, msg := range msgs {
+		m := &Message{Cmd: msg.Cmd, Version: msg.Version, Flag: msg.Flag | MESSAGE_FLAG_BACKLOG, Body: msg.Body}
+		client.EnqueueNonBlockMessage(m)
+	}
 }
 
 func (server *Server) HandleLeaveRoom(client *Client, msg *Message) {
@@ -66,15 +124,13 @@ func (server *Server) HandleLeaveRoom(client *Client, msg *Message) {
 	if room_id == 0 {
 		return
 	}
-	if client.room_id != room_id {
+	client.room_mutex.Lock()
+	defer client.room_mutex.Unlock()
+	if !client.isInRoom(room_id) {
 		return
 	}
 
-	route := server.app_route.FindOrAddRoute(client.appid)
-	route.RemoveRoomClient(client.room_id, client.Client())
-	channel := server.app.GetRoomChannel(client.room_id)
-	channel.UnsubscribeRoom(client.appid, client.room_id)
-	client.room_id = 0
+	server.app.leaveRoom(client, room_id)
 }
 
 func (server *Server) HandleRoomIM(client *Client, msg *Message) {
@@ -86,8 +142,10 @@ func (server *Server) HandleRoomIM(client *Client, msg *Message) {
 		return
 	}
 	room_id := room_im.receiver
-	if room_id != client.room_id {
-		log.Warningf("room id:%d is't client's room id:%d\n", room_id, client.room_id)
+	if !client.IsInRoom(room_id) {
+		log.Warningf("client:%d isn't in room:%d", client.uid, room_id)
+		ack := &Message{Cmd: MSG_ACK, Body: &MessageACK{seq: int32(seq), status: ACK_NOT_ROOM_MEMBER}}
+		client.EnqueueMessage(ack)
 		return
 	}
 
@@ -97,6 +155,17 @@ func (server *Server) HandleRoomIM(client *Client, msg *Message) {
 		return
 	}
 
+	if server.room_moderation != nil && !server.room_moderation.CheckSlowMode(client.appid, room_id, client.uid) {
+		log.Infof("room id:%d client:%d, %d slow mode", room_id, client.appid, client.uid)
+		ack := &Message{Cmd: MSG_ACK, Body: &MessageACK{seq: int32(seq), status: ACK_ROOM_SLOW_MODE}}
+		client.EnqueueMessage(ack)
+		return
+	}
+
+	if !server.filterContent(client, seq, MSG_ROOM_IM, room_id, &room_im.content) {
+		return
+	}
+
 	m := &Message{Cmd: MSG_ROOM_IM, Body: room_im, BodyData: room_im.ToData()}
 
 	server.SendRoomMessage(client, room_id, m)
@@ -24,6 +24,9 @@ type Route struct {
 	mutex        sync.Mutex
 	clients      map[int64]ClientSet
 	room_clients map[int64]ClientSet
+
+	presence_watchers map[int64]ClientSet //uid:订阅该用户在线状态的客户端
+	presences         map[int64]int32     //被订阅用户最近的在线平台
 }
 
 func NewRoute(appid int64) *Route {
@@ -31,6 +34,8 @@ func NewRoute(appid int64) *Route {
 	route.appid = appid
 	route.clients = make(map[int64]ClientSet)
 	route.room_clients = make(map[int64]ClientSet)
+	route.presence_watchers = make(map[int64]ClientSet)
+	route.presences = make(map[int64]int32)
 	return route
 }
 
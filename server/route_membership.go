@@ -0,0 +1,220 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// route server地址列表的检查间隔
+const ROUTE_MEMBERSHIP_INTERVAL = 10 * time.Second
+
+type RouteID struct {
+	AppID int64
+	ID    int64
+}
+
+// channel上的用户和聊天室的订阅计数
+// 用户计数的低16位表示总数量 高16位表示online的数量
+type RouteSubscriptions struct {
+	Users       map[RouteID]int
+	Platforms   map[RouteID]map[int8]int //用户在各个平台上的连接数量
+	Rooms       map[RouteID]int
+	RoomMembers map[RouteID]map[int64]int //聊天室成员在此im上的连接数量
+	Watches     map[RouteID]int           //订阅了用户在线状态的连接数量
+}
+
+func NewRouteSubscriptions() *RouteSubscriptions {
+	return &RouteSubscriptions{
+		Users:       make(map[RouteID]int),
+		Platforms:   make(map[RouteID]map[int8]int),
+		Rooms:       make(map[RouteID]int),
+		RoomMembers: make(map[RouteID]map[int64]int),
+		Watches:     make(map[RouteID]int),
+	}
+}
+
+// 支持动态增加和删除的route server
+type DynamicRouteChannel interface {
+	RouteChannel
+	Subscriptions() *RouteSubscriptions
+	ResetSubscriptions(subs *RouteSubscriptions)
+	Close()
+}
+
+// 使用一致性hash选择route server, 之后可以通过UpdateRouteChannels调整节点
+// new_route_channel返回已经启动的channel
+func (app *App) EnableDynamicRoute(new_route_channel func(addr string) RouteChannel) {
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+
+	addrs := make([]string, 0, len(app.route_channels))
+	for _, c := range app.route_channels {
+		addrs = append(addrs, c.Address())
+	}
+	app.route_ring = NewHashRing(addrs, DEFAULT_HASH_RING_REPLICAS)
+	app.new_route_channel = new_route_channel
+}
+
+// 替换route server节点, 所属节点变化的用户和聊天室重新订阅
+// 只能在一个goroutine中调用
+func (app *App) UpdateRouteChannels(addrs []string) {
+	if app.new_route_channel == nil || len(addrs) == 0 {
+		return
+	}
+	sort.Strings(addrs)
+
+	current := make(map[string]RouteChannel)
+	for _, c := range app.route_channels {
+		current[c.Address()] = c
+	}
+
+	channels := make([]RouteChannel, 0, len(addrs))
+	added := make([]RouteChannel, 0)
+	for _, addr := range addrs {
+		if c, ok := current[addr]; ok {
+			channels = append(channels, c)
+			delete(current, addr)
+		} else {
+			c := app.new_route_channel(addr)
+			channels = append(channels, c)
+			added = append(added, c)
+		}
+	}
+
+	if len(added) == 0 && len(current) == 0 {
+		return
+	}
+
+	//先关闭移除的节点, 避免写锁等待阻塞在这些节点上的订阅
+	//这期间发往这些节点的消息由App.Publish*记录日志后丢弃
+	for _, c := range current {
+		if dc, ok := c.(DynamicRouteChannel); ok {
+			dc.Close()
+		}
+	}
+
+	app.sub_mutex.Lock()
+	defer app.sub_mutex.Unlock()
+
+	//当前所有的订阅, 全部节点都订阅了超级群的用户
+	users := make(map[RouteID]int)
+	platforms := make(map[RouteID]map[int8]int)
+	rooms := make(map[RouteID]int)
+	room_members := make(map[RouteID]map[int64]int)
+	watches := make(map[RouteID]int)
+	for _, c := range app.route_channels {
+		dc, ok := c.(DynamicRouteChannel)
+		if !ok {
+			log.Warningf("route channel:%s can't be resubscribed", c.Address())
+			continue
+		}
+		subs := dc.Subscriptions()
+		for id, count := range subs.Users {
+			users[id] = count
+		}
+		for id, p := range subs.Platforms {
+			if len(p) > 0 {
+				platforms[id] = p
+			}
+		}
+		for id, count := range subs.Rooms {
+			rooms[id] = count
+		}
+		for id, members := range subs.RoomMembers {
+			room_members[id] = members
+		}
+		for id, count := range subs.Watches {
+			watches[id] = count
+		}
+	}
+
+	app.mutex.Lock()
+	app.route_channels = channels
+	if app.shared_group_route {
+		app.group_route_channels = channels
+	}
+	app.route_ring = NewHashRing(addrs, DEFAULT_HASH_RING_REPLICAS)
+
+	resubs := make(map[RouteChannel]*RouteSubscriptions)
+	for _, c := range channels {
+		resubs[c] = NewRouteSubscriptions()
+	}
+	for id, count := range users {
+		//在线平台只订阅到用户所属的route server
+		owner := resubs[app.getChannel(id.ID)]
+		owner.Users[id] = count
+		if p, ok := platforms[id]; ok {
+			owner.Platforms[id] = p
+		}
+		if app.shared_group_route {
+			for _, subs := range resubs {
+				subs.Users[id] = count
+			}
+		}
+	}
+	for id, count := range rooms {
+		resubs[app.getChannel(id.ID)].Rooms[id] = count
+	}
+	for id, members := range room_members {
+		resubs[app.getChannel(id.ID)].RoomMembers[id] = members
+	}
+	for id, count := range watches {
+		resubs[app.getChannel(id.ID)].Watches[id] = count
+	}
+	app.mutex.Unlock()
+
+	//重新订阅可能阻塞在某个route server上, 不能持有app.mutex
+	for c, subs := range resubs {
+		if dc, ok := c.(DynamicRouteChannel); ok {
+			dc.ResetSubscriptions(subs)
+		}
+	}
+
+	removed := make([]string, 0, len(current))
+	for addr := range current {
+		removed = append(removed, addr)
+	}
+	log.Infof("route channels:%v added:%d removed:%v", addrs, len(added), removed)
+}
+
+// 从redis的集合中读取route server的地址
+func WatchRouteAddrs(app *App, redis_pool *redis.Pool, key string) {
+	for {
+		time.Sleep(ROUTE_MEMBERSHIP_INTERVAL)
+
+		conn := redis_pool.Get()
+		addrs, err := redis.Strings(conn.Do("SMEMBERS", key))
+		conn.Close()
+		if err != nil {
+			log.Warning("smembers err:", err)
+			continue
+		}
+		if len(addrs) == 0 {
+			//避免误删除全部的节点
+			continue
+		}
+		app.UpdateRouteChannels(addrs)
+	}
+}
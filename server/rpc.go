@@ -22,8 +22,10 @@ package server
 import (
 	"context"
 	"net/rpc"
+	"sync"
 	"time"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/jackc/puddle"
 
 	"github.com/GoBelieveIO/im_service/storage"
@@ -34,9 +36,32 @@ import (
 
 const MAX_STORAGE_RPC_POOL_SIZE = 100
 
+// 用户迁移过程中写入被拒绝时的重试, 等待的时间超过ims冻结用户的有效时间
+const STORAGE_MIGRATING_TIMEOUT = (storage.FREEZE_LEASE + 2) * time.Second
+const STORAGE_MIGRATING_INTERVAL = 100 * time.Millisecond
+
+// 用户迁移之后更新路由重试的次数
+const STORAGE_MOVED_RETRY = 3
+
 type RPCStorage struct {
+	rpc_addrs       []string
 	rpc_pools       []*puddle.Pool
 	group_rpc_pools []*puddle.Pool
+
+	//rpc_addrs中前active_count个节点参与路由, 之后是备用节点
+	//备用节点只接收迁移过来的用户, 迁移完成之后再加入storage_rpc_addrs
+	active_count int
+
+	//为nil时使用uid % active_count
+	ring *HashRing
+
+	//显式指定所在节点的用户(已经迁移的用户)
+	mutex  sync.RWMutex
+	owners map[int64]int
+
+	range_migration RangeMigration
+
+	redis_pool *redis.Pool
 }
 
 func NewRPCPool(addr string) *puddle.Pool {
@@ -53,11 +78,14 @@ func NewRPCPool(addr string) *puddle.Pool {
 	return pool
 }
 
-func NewRPCStorage(storage_rpc_addrs []string, group_storage_rpc_addrs []string) *RPCStorage {
+func NewRPCStorage(storage_rpc_addrs []string, standby_rpc_addrs []string, group_storage_rpc_addrs []string, consistent_hash bool, redis_pool *redis.Pool) *RPCStorage {
 	r := &RPCStorage{}
 
-	rpc_pools := make([]*puddle.Pool, 0, len(storage_rpc_addrs))
-	for _, addr := range storage_rpc_addrs {
+	addrs := make([]string, 0, len(storage_rpc_addrs)+len(standby_rpc_addrs))
+	addrs = append(addrs, storage_rpc_addrs...)
+	addrs = append(addrs, standby_rpc_addrs...)
+	rpc_pools := make([]*puddle.Pool, 0, len(addrs))
+	for _, addr := range addrs {
 		pool := NewRPCPool(addr)
 		rpc_pools = append(rpc_pools, pool)
 	}
@@ -70,15 +98,25 @@ func NewRPCStorage(storage_rpc_addrs []string, group_storage_rpc_addrs []string)
 			group_rpc_pools = append(group_rpc_pools, pool)
 		}
 	} else {
-		group_rpc_pools = rpc_pools
+		group_rpc_pools = rpc_pools[:len(storage_rpc_addrs)]
 	}
 
+	r.rpc_addrs = addrs
 	r.rpc_pools = rpc_pools
+	r.active_count = len(storage_rpc_addrs)
 	r.group_rpc_pools = group_rpc_pools
-
+	if consistent_hash {
+		r.ring = NewHashRing(storage_rpc_addrs, DEFAULT_HASH_RING_REPLICAS)
+	}
+	r.owners = make(map[int64]int)
+	r.redis_pool = redis_pool
+	if redis_pool != nil {
+		r.loadStorageOwners()
+	}
 	return r
 }
 
+// 用户迁移到其它节点时返回ERR_USER_MOVED, 调用者需要转换同步点之后重试
 func (rpc_s *RPCStorage) SyncMessage(appid int64, uid int64, device_id int64, last_msgid int64) (*storage.PeerHistoryMessage, error) {
 	dc, err := rpc_s.GetStorageRPCClient(uid)
 
@@ -98,9 +136,14 @@ func (rpc_s *RPCStorage) SyncMessage(appid int64, uid int64, device_id int64, la
 	err = dc.Value().(*rpc.Client).Call("RPCStorage.SyncMessage", s, &resp)
 	if err != nil {
 		log.Warning("sync message err:", err)
+		rpc_s.handleStorageError(err)
 		return nil, err
 	}
 
+	resp.Messages, err = rpc_s.resolveGroupMessageRefs(appid, resp.Messages)
+	if err != nil {
+		return nil, err
+	}
 	return &resp, nil
 }
 
@@ -139,12 +182,13 @@ func (rpc_s *RPCStorage) SaveGroupMessage(appid int64, gid int64, device_id int6
 	}
 	defer dc.Release()
 
+	stored := storedMessage(msg)
 	gm := &storage.GroupMessage{
 		AppID:    appid,
 		GroupID:  gid,
 		DeviceID: device_id,
-		Cmd:      int32(msg.Cmd),
-		Raw:      msg.ToData(),
+		Cmd:      int32(stored.Cmd),
+		Raw:      stored.ToData(),
 	}
 
 	var resp storage.HistoryMessageID
@@ -166,23 +210,19 @@ func (rpc_s *RPCStorage) SavePeerGroupMessage(appid int64, members []int64, devi
 		return nil, nil
 	}
 
-	dc, err := rpc_s.GetStorageRPCClient(members[0])
-	if err != nil {
-		return nil, nil
-	}
-	defer dc.Release()
-
+	stored := storedMessage(m)
 	pm := &storage.PeerGroupMessage{
 		AppID:    appid,
 		Members:  members,
 		DeviceID: device_id,
-		Cmd:      int32(m.Cmd),
-		Raw:      m.ToData(),
+		Cmd:      int32(stored.Cmd),
+		Raw:      stored.ToData(),
 	}
 
 	var resp storage.GroupHistoryMessageID
 
-	err = dc.Value().(*rpc.Client).Call("RPCStorage.SavePeerGroupMessage", pm, &resp)
+	//成员按照所在节点分批,路由变化后由调用者重新分批
+	err := rpc_s.callPeerStorage(members[0], "RPCStorage.SavePeerGroupMessage", pm, &resp, false)
 	if err != nil {
 		log.Error("save peer group message err:", err)
 		return nil, err
@@ -194,22 +234,17 @@ func (rpc_s *RPCStorage) SavePeerGroupMessage(appid int64, members []int64, devi
 }
 
 func (rpc_s *RPCStorage) SaveMessage(appid int64, uid int64, device_id int64, m *Message) (int64, int64, error) {
-	dc, err := rpc_s.GetStorageRPCClient(uid)
-	if err != nil {
-		return 0, 0, err
-	}
-	defer dc.Release()
-
+	stored := storedMessage(m)
 	pm := &storage.PeerMessage{
 		AppID:    appid,
 		Uid:      uid,
 		DeviceID: device_id,
-		Cmd:      int32(m.Cmd),
-		Raw:      m.ToData(),
+		Cmd:      int32(stored.Cmd),
+		Raw:      stored.ToData(),
 	}
 
 	var resp storage.HistoryMessageID
-	err = dc.Value().(*rpc.Client).Call("RPCStorage.SavePeerMessage", pm, &resp)
+	err := rpc_s.callPeerStorage(uid, "RPCStorage.SavePeerMessage", pm, &resp, true)
 	if err != nil {
 		log.Error("save peer message err:", err)
 		return 0, 0, err
@@ -222,12 +257,6 @@ func (rpc_s *RPCStorage) SaveMessage(appid int64, uid int64, device_id int64, m
 }
 
 func (rpc_s *RPCStorage) GetLatestMessage(appid int64, uid int64, limit int32) ([]*storage.HistoryMessage, error) {
-	dc, err := rpc_s.GetStorageRPCClient(uid)
-	if err != nil {
-		return nil, err
-	}
-	defer dc.Release()
-
 	s := &storage.HistoryRequest{
 		AppID: appid,
 		Uid:   uid,
@@ -235,25 +264,124 @@ func (rpc_s *RPCStorage) GetLatestMessage(appid int64, uid int64, limit int32) (
 	}
 
 	var resp storage.LatestMessage
-	err = dc.Value().(*rpc.Client).Call("RPCStorage.GetLatestMessage", s, &resp)
+	err := rpc_s.callPeerStorage(uid, "RPCStorage.GetLatestMessage", s, &resp, true)
 	if err != nil {
 		return nil, err
 	}
 
-	return resp.Messages, nil
+	return rpc_s.resolveGroupMessageRefs(appid, resp.Messages)
 }
 
-// 获取是否接收到新消息,只会返回0/1
-func (rpc_s *RPCStorage) GetNewCount(appid int64, uid int64, last_msgid int64) (int64, error) {
-	dc, err := rpc_s.GetStorageRPCClient(uid)
+func (rpc_s *RPCStorage) LoadGroupMessages(appid int64, gid int64, msgids []int64) ([]*storage.HistoryMessage, error) {
+	dc, err := rpc_s.GetGroupStorageRPCClient(gid)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	defer dc.Release()
 
+	r := &storage.GroupMessageRequest{
+		AppID:   appid,
+		GroupID: gid,
+		MsgIDs:  msgids,
+	}
+
+	var resp storage.LatestMessage
+	err = dc.Value().(*rpc.Client).Call("RPCStorage.LoadGroupMessages", r, &resp)
+	if err != nil {
+		log.Warning("load group messages err:", err)
+		return nil, err
+	}
+	return resp.Messages, nil
+}
+
+// im和ims之间按照DEFAULT_VERSION编码, 群消息的@成员列表使用单独的消息类型保存
+func storedMessage(m *Message) *Message {
+	if im, ok := m.Body.(*IMMessage); ok && m.Cmd == MSG_GROUP_IM && len(im.mentions) > 0 {
+		return &Message{Cmd: MSG_GROUP_IM_MENTION, Version: DEFAULT_VERSION, Flag: m.Flag, Body: &MentionIMMessage{*im}}
+	}
+	if m.Version != DEFAULT_VERSION {
+		return &Message{Cmd: m.Cmd, Version: DEFAULT_VERSION, Flag: m.Flag, Body: m.Body, BodyData: m.BodyData}
+	}
+	return m
+}
+
+// 解析从ims读取的消息, MSG_GROUP_IM_MENTION还原为带有@成员列表的MSG_GROUP_IM
+func decodeHistoryMessage(hm *storage.HistoryMessage) *Message {
+	m := &Message{Cmd: int(hm.Cmd), Version: DEFAULT_VERSION}
+	m.FromData(hm.Raw)
+	if im, ok := m.Body.(*MentionIMMessage); ok {
+		return &Message{Cmd: MSG_GROUP_IM, Version: MENTION_VERSION, Body: &im.IMMessage}
+	}
+	return m
+}
+
+func NewGroupMessageRef(gid int64, msgid int64) *Message {
+	ref := &storage.GroupMessageRef{GroupID: gid, MsgID: msgid}
+	return &Message{Cmd: MSG_GROUP_IM_REF, Version: DEFAULT_VERSION, Body: ref}
+}
+
+// 个人消息队列中的群消息引用替换为群组消息队列中的消息, 消息id保持不变
+// 找不到的消息(已被删除)和读取失败的群组直接忽略, 不影响其它消息的同步
+func (rpc_s *RPCStorage) resolveGroupMessageRefs(appid int64, messages []*storage.HistoryMessage) ([]*storage.HistoryMessage, error) {
+	refs := make(map[int64][]int64)
+	for _, hm := range messages {
+		if hm.Cmd != MSG_GROUP_IM_REF {
+			continue
+		}
+		m := &Message{Cmd: int(hm.Cmd), Version: DEFAULT_VERSION}
+		if !m.FromData(hm.Raw) {
+			continue
+		}
+		ref := m.Body.(*storage.GroupMessageRef)
+		refs[ref.GroupID] = append(refs[ref.GroupID], ref.MsgID)
+	}
+	if len(refs) == 0 {
+		return messages, nil
+	}
+
+	type refKey struct {
+		gid   int64
+		msgid int64
+	}
+	resolved := make(map[refKey]*storage.HistoryMessage)
+	for gid, msgids := range refs {
+		r, err := rpc_s.LoadGroupMessages(appid, gid, msgids)
+		if err != nil {
+			log.Warningf("load group:%d messages:%d err:%s, skip refs", gid, len(msgids), err)
+			continue
+		}
+		for _, gm := range r {
+			resolved[refKey{gid, gm.MsgID}] = gm
+		}
+	}
+
+	result := make([]*storage.HistoryMessage, 0, len(messages))
+	for _, hm := range messages {
+		if hm.Cmd != MSG_GROUP_IM_REF {
+			result = append(result, hm)
+			continue
+		}
+		m := &Message{Cmd: int(hm.Cmd), Version: DEFAULT_VERSION}
+		if !m.FromData(hm.Raw) {
+			log.Warning("invalid group message ref:", hm.MsgID)
+			continue
+		}
+		ref := m.Body.(*storage.GroupMessageRef)
+		gm, ok := resolved[refKey{ref.GroupID, ref.MsgID}]
+		if !ok {
+			log.Warningf("can't resolve group message ref:%d group:%d msgid:%d", hm.MsgID, ref.GroupID, ref.MsgID)
+			continue
+		}
+		result = append(result, &storage.HistoryMessage{MsgID: hm.MsgID, DeviceID: hm.DeviceID, Cmd: gm.Cmd, Raw: gm.Raw})
+	}
+	return result, nil
+}
+
+// 获取是否接收到新消息,只会返回0/1
+func (rpc_s *RPCStorage) GetNewCount(appid int64, uid int64, last_msgid int64) (int64, error) {
 	var count int64
 	sync_key := storage.SyncHistory{AppID: appid, Uid: uid, LastMsgID: last_msgid}
-	err = dc.Value().(*rpc.Client).Call("RPCStorage.GetNewCount", sync_key, &count)
+	err := rpc_s.callPeerStorage(uid, "RPCStorage.GetNewCount", sync_key, &count, true)
 
 	if err != nil {
 		return 0, err
@@ -261,25 +389,78 @@ func (rpc_s *RPCStorage) GetNewCount(appid int64, uid int64, last_msgid int64) (
 	return count, nil
 }
 
-// 个人消息／普通群消息／客服消息
-func (rpc_s *RPCStorage) GetStorageRPCClient(uid int64) (*puddle.Resource, error) {
+// 用户迁移时会短暂的拒绝写入, 等待迁移完成或者冻结过期
+// 迁移完成之后更新路由, reroute为false时由调用者重试
+func (rpc_s *RPCStorage) callPeerStorage(uid int64, method string, args interface{}, reply interface{}, reroute bool) error {
+	deadline := time.Now().Add(STORAGE_MIGRATING_TIMEOUT)
+	moved := 0
+	for {
+		dc, err := rpc_s.GetStorageRPCClient(uid)
+		if err != nil {
+			return err
+		}
+		err = dc.Value().(*rpc.Client).Call(method, args, reply)
+		dc.Release()
+		if err == nil {
+			return nil
+		}
+
+		if storage.IsUserMigratingError(err) {
+			if time.Now().After(deadline) {
+				return err
+			}
+			time.Sleep(STORAGE_MIGRATING_INTERVAL)
+			continue
+		}
+		if !rpc_s.handleStorageError(err) || !reroute {
+			return err
+		}
+		moved++
+		if moved >= STORAGE_MOVED_RETRY {
+			return err
+		}
+	}
+}
+
+// 返回路由是否已经更新
+func (rpc_s *RPCStorage) handleStorageError(err error) bool {
+	uid, addr, ok := storage.ParseUserMovedError(err)
+	if !ok {
+		return false
+	}
+	return rpc_s.SetStorageOwner(uid, addr)
+}
+
+func (rpc_s *RPCStorage) getStorageIndex(uid int64) int {
+	rpc_s.mutex.RLock()
+	index, ok := rpc_s.owners[uid]
+	rpc_s.mutex.RUnlock()
+	if ok {
+		return index
+	}
+
+	if rpc_s.ring != nil {
+		return rpc_s.ring.Get(uid)
+	}
 	if uid < 0 {
 		uid = -uid
 	}
-	index := uid % int64(len(rpc_s.rpc_pools))
+	return int(uid % int64(rpc_s.active_count))
+}
+
+// 个人消息／普通群消息／客服消息
+func (rpc_s *RPCStorage) GetStorageRPCClient(uid int64) (*puddle.Resource, error) {
+	index := rpc_s.getStorageIndex(uid)
 	pool := rpc_s.rpc_pools[index]
 	return rpc_s.AcquireResource(pool)
 }
 
 func (rpc_s *RPCStorage) GetStorageRPCIndex(uid int64) int64 {
-	if uid < 0 {
-		uid = -uid
-	}
-	index := uid % int64(len(rpc_s.rpc_pools))
-	return index
+	return int64(rpc_s.getStorageIndex(uid))
 }
 
 // 超级群消息
+// 超级群的消息队列不支持迁移, 不使用一致性hash
 func (rpc_s *RPCStorage) GetGroupStorageRPCClient(group_id int64) (*puddle.Resource, error) {
 	if group_id < 0 {
 		group_id = -group_id
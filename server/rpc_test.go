@@ -0,0 +1,111 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"testing"
+
+	. "github.com/GoBelieveIO/im_service/protocol"
+	"github.com/GoBelieveIO/im_service/storage"
+)
+
+func TestGroupMessageRefEncoding(t *testing.T) {
+	ref := NewGroupMessageRef(10, 1<<40+3)
+	buff := ref.ToData()
+	if len(buff) != 16 {
+		t.Fatalf("ref data length:%d", len(buff))
+	}
+
+	m := &Message{Cmd: MSG_GROUP_IM_REF, Version: DEFAULT_VERSION}
+	if !m.FromData(buff) {
+		t.Fatal("decode group message ref failure")
+	}
+	r := m.Body.(*storage.GroupMessageRef)
+	if r.GroupID != 10 || r.MsgID != 1<<40+3 {
+		t.Errorf("ref group:%d msgid:%d", r.GroupID, r.MsgID)
+	}
+
+	m = &Message{Cmd: MSG_GROUP_IM_REF, Version: DEFAULT_VERSION}
+	if m.FromData(buff[:15]) {
+		t.Error("decode truncated ref")
+	}
+}
+
+func TestIMMessageMentionEncoding(t *testing.T) {
+	im := &IMMessage{sender: 1, receiver: 100, timestamp: 1000, msgid: 7, mentions: []int64{2, 3}, content: "hello"}
+
+	m := &Message{Cmd: MSG_GROUP_IM, Version: MENTION_VERSION}
+	if !m.FromData(im.ToData(MENTION_VERSION)) {
+		t.Fatal("decode mention version failure")
+	}
+	r := m.Body.(*IMMessage)
+	if r.sender != 1 || r.receiver != 100 || r.timestamp != 1000 || r.msgid != 7 || r.content != "hello" {
+		t.Errorf("message:%+v", r)
+	}
+	if len(r.mentions) != 2 || !r.IsMentioned(2) || !r.IsMentioned(3) {
+		t.Errorf("mentions:%v", r.mentions)
+	}
+
+	//旧版本的格式不包含@成员列表
+	m = &Message{Cmd: MSG_GROUP_IM, Version: DEFAULT_VERSION}
+	if !m.FromData(im.ToData(DEFAULT_VERSION)) {
+		t.Fatal("decode default version failure")
+	}
+	r = m.Body.(*IMMessage)
+	if r.content != "hello" || len(r.mentions) != 0 {
+		t.Errorf("content:%s mentions:%v", r.content, r.mentions)
+	}
+
+	m = &Message{Cmd: MSG_GROUP_IM, Version: MENTION_VERSION}
+	if m.FromData(im.ToData(MENTION_VERSION)[:30]) {
+		t.Error("decode truncated mentions")
+	}
+}
+
+func TestStoredMentionMessage(t *testing.T) {
+	im := &IMMessage{sender: 1, receiver: 100, timestamp: 1000, mentions: []int64{2}, content: "hello"}
+	m := &Message{Cmd: MSG_GROUP_IM, Version: groupMessageVersion(im), Body: im}
+	if m.Version != MENTION_VERSION {
+		t.Errorf("version:%d", m.Version)
+	}
+
+	stored := storedMessage(m)
+	if stored.Cmd != MSG_GROUP_IM_MENTION || stored.Version != DEFAULT_VERSION {
+		t.Fatalf("stored cmd:%d version:%d", stored.Cmd, stored.Version)
+	}
+
+	hm := &storage.HistoryMessage{MsgID: 1, Cmd: int32(stored.Cmd), Raw: stored.ToData()}
+	r := decodeHistoryMessage(hm)
+	if r.Cmd != MSG_GROUP_IM {
+		t.Fatalf("decoded cmd:%d", r.Cmd)
+	}
+	gm := r.Body.(*IMMessage)
+	if gm.content != "hello" || !gm.IsMentioned(2) {
+		t.Errorf("content:%s mentions:%v", gm.content, gm.mentions)
+	}
+
+	//没有@成员的群消息保持原来的格式
+	im = &IMMessage{sender: 1, receiver: 100, timestamp: 1000, content: "hello"}
+	m = &Message{Cmd: MSG_GROUP_IM, Version: groupMessageVersion(im), Body: im}
+	stored = storedMessage(m)
+	if stored.Cmd != MSG_GROUP_IM || stored.Version != DEFAULT_VERSION {
+		t.Errorf("stored cmd:%d version:%d", stored.Cmd, stored.Version)
+	}
+}
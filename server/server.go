@@ -24,9 +24,7 @@ import (
 	"time"
 
 	"github.com/GoBelieveIO/im_service/storage"
-	"github.com/bitly/go-simplejson"
 	"github.com/gomodule/redigo/redis"
-	"github.com/importcjj/sensitive"
 
 	log "github.com/sirupsen/logrus"
 
@@ -42,7 +40,7 @@ type MessageHandler func(*Client, *Message)
 type Server struct {
 	handlers map[int]MessageHandler
 
-	filter         *sensitive.Filter
+	word_filter    *WordFilter //为nil时不过滤关键词
 	redis_pool     *redis.Pool
 	app            *App
 	app_route      *AppRoute
@@ -51,7 +49,7 @@ type Server struct {
 
 	friend_permission bool //验证好友关系
 	enable_blacklist  bool //验证是否在对方的黑名单中
-	kefu_appid        int64
+	customer_apps     *CustomerApps
 
 	relationship_pool *RelationshipPool
 	sync_c            chan *storage.SyncHistory
@@ -59,12 +57,23 @@ type Server struct {
 	group_manager *GroupManager
 	group_sync_c  chan *storage.SyncGroupHistory
 
+	room_moderation *RoomModeration //为nil时不检查聊天室的封禁和慢速模式
+
+	customer_service *CustomerService //为nil时顾客的消息直接发送给receiver
+
+	message_requests *MessageRequests //为nil时禁止给非好友发送消息
+
+	moderation_hook *ModerationHook //消息保存之前的审核接口
+
+	rate_limiter          *RateLimiter //为nil时不限制发送频率
+	rate_limit_disconnect int          //连续被限制的次数达到此值时断开连接, 0不断开
+
 	auth Auth
 }
 
 func NewServer(
 	group_manager *GroupManager,
-	filter *sensitive.Filter,
+	word_filter *WordFilter,
 	redis_pool *redis.Pool,
 	server_summary *ServerSummary,
 	relationship_pool *RelationshipPool,
@@ -76,7 +85,7 @@ func NewServer(
 	app *App,
 	enable_blacklist bool,
 	friend_permission bool,
-	kefu_appid int64) *Server {
+	customer_apps *CustomerApps) *Server {
 	s := &Server{}
 	s.handlers = make(map[int]MessageHandler)
 	s.handlers[MSG_AUTH_TOKEN] = s.HandleAuthToken
@@ -99,8 +108,15 @@ func NewServer(
 
 	s.handlers[MSG_CUSTOMER_V2] = s.HandleCustomerMessageV2
 
+	s.handlers[MSG_SUBSCRIBE_PRESENCE] = s.HandleSubscribePresence
+
+	s.handlers[MSG_GET_GROUP_INFO] = s.HandleGetGroupInfo
+	s.handlers[MSG_GET_GROUP_MEMBERS] = s.HandleGetGroupMembers
+	s.handlers[MSG_GET_ROOM_MEMBERS] = s.HandleGetRoomMembers
+	s.handlers[MSG_GET_ROOM_MEMBER_COUNT] = s.HandleGetRoomMemberCount
+
 	s.group_manager = group_manager
-	s.filter = filter
+	s.word_filter = word_filter
 	s.redis_pool = redis_pool
 	s.server_summary = server_summary
 	s.relationship_pool = relationship_pool
@@ -112,12 +128,15 @@ func NewServer(
 	s.app = app
 	s.enable_blacklist = enable_blacklist
 	s.friend_permission = friend_permission
-	s.kefu_appid = kefu_appid
+	s.customer_apps = customer_apps
 
 	return s
 }
 
 func (server *Server) onClientMessage(client *Client, msg *Message) {
+	if !server.checkRateLimit(client, msg) {
+		return
+	}
 	if h, ok := server.handlers[msg.Cmd]; ok {
 		h(client, msg)
 	} else {
@@ -144,9 +163,33 @@ func (server *Server) RemoveClient(client *Client) {
 	if is_delete {
 		atomic.AddInt64(&server.server_summary.clientset_count, -1)
 	}
-	if client.room_id > 0 {
-		route.RemoveRoomClient(client.room_id, client)
+	client.room_mutex.Lock()
+	for _, room_id := range client.room_ids {
+		route.RemoveRoomClient(room_id, client)
 	}
+	client.room_mutex.Unlock()
+	server.unwatchPresence(client, route)
+}
+
+func (server *Server) SetRoomModeration(m *RoomModeration) {
+	server.room_moderation = m
+}
+
+func (server *Server) SetRateLimiter(limiter *RateLimiter, disconnect int) {
+	server.rate_limiter = limiter
+	server.rate_limit_disconnect = disconnect
+}
+
+func (server *Server) SetModerationHook(hook *ModerationHook) {
+	server.moderation_hook = hook
+}
+
+func (server *Server) SetMessageRequests(r *MessageRequests) {
+	server.message_requests = r
+}
+
+func (server *Server) SetCustomerService(cs *CustomerService) {
+	server.customer_service = cs
 }
 
 func (server *Server) AuthToken(client *Client, token string) (int64, int64, int, bool, error) {
@@ -201,38 +244,18 @@ func (server *Server) SendRoomMessage(client *Client, room_id int64, msg *Messag
 
 func (server *Server) Logout(client *Client) {
 	if client.uid > 0 {
-		channel := server.app.GetChannel(client.uid)
-		channel.Unsubscribe(client.appid, client.uid, client.online)
-
-		for _, c := range server.app.group_route_channels {
-			if c == channel {
-				continue
-			}
-
-			c.Unsubscribe(client.appid, client.uid, client.online)
-		}
+		server.app.UnsubscribeUser(client.appid, client.uid, client.platform_id, client.online)
 	}
 
-	if client.room_id > 0 {
-		channel := server.app.GetRoomChannel(client.room_id)
-		channel.UnsubscribeRoom(client.appid, client.room_id)
-		route := server.app_route.FindOrAddRoute(client.appid)
-		route.RemoveRoomClient(client.room_id, client.Client())
+	client.room_mutex.Lock()
+	for _, room_id := range client.room_ids {
+		server.app.leaveRoom(client, room_id)
 	}
+	client.room_mutex.Unlock()
 }
 
 func (server *Server) Login(client *Client) {
-	channel := server.app.GetChannel(client.uid)
-
-	channel.Subscribe(client.appid, client.uid, client.online)
-
-	for _, c := range server.app.group_route_channels {
-		if c == channel {
-			continue
-		}
-
-		c.Subscribe(client.appid, client.uid, client.online)
-	}
+	server.app.SubscribeUser(client.appid, client.uid, client.platform_id, client.online)
 
 	SetUserUnreadCount(server.redis_pool, client.appid, client.uid, 0)
 }
@@ -311,38 +334,40 @@ func (server *Server) HandleACK(client *Client, msg *Message) {
 	log.Info("ack:", ack.seq)
 }
 
-// 过滤敏感词
-func FilterDirtyWord(filter *sensitive.Filter, msg *IMMessage) {
-	if filter == nil {
-		log.Info("filter is null")
-		return
-	}
-
-	obj, err := simplejson.NewJson([]byte(msg.content))
-	if err != nil {
-		log.Info("filter dirty word, can't decode json")
-		return
-	}
-
-	text, err := obj.Get("text").String()
-	if err != nil {
-		log.Info("filter dirty word, can't get text")
-		return
+// 过滤消息内容中的关键词并调用审核接口, 返回false表示消息被拒绝, 已经回复ack
+func (server *Server) filterContent(client *Client, seq int, cmd int, receiver int64, content *string) bool {
+	c := *content
+	if server.word_filter != nil {
+		var rejected bool
+		var flagged []string
+		c, rejected, flagged = server.word_filter.Check(client.appid, c)
+		if rejected {
+			log.Infof("message %d-%d contains sensitive word, rejected", client.uid, receiver)
+			ack := &Message{Cmd: MSG_ACK, Version: client.version, Body: &MessageACK{seq: int32(seq), status: ACK_SENSITIVE_WORD}}
+			client.EnqueueMessage(ack)
+			return false
+		}
+		if len(flagged) > 0 {
+			server.word_filter.Flag(client.appid, cmd, client.uid, receiver, c, flagged)
+		}
 	}
 
-	if exist, _ := filter.FindIn(text); exist {
-		t := filter.RemoveNoise(text)
-		replacedText := filter.Replace(t, '*')
-
-		obj.Set("text", replacedText)
-		c, err := obj.Encode()
+	if server.moderation_hook != nil && server.moderation_hook.Enabled(cmd) {
+		var allowed bool
+		var err error
+		c, allowed, err = server.moderation_hook.Check(client.appid, cmd, client.uid, receiver, c)
 		if err != nil {
-			log.Errorf("json encode err:%s", err)
-			return
+			log.Warningf("moderation message %d-%d err:%s, allowed:%t", client.uid, receiver, err, allowed)
+		}
+		if !allowed {
+			log.Infof("message %d-%d rejected by moderation", client.uid, receiver)
+			ack := &Message{Cmd: MSG_ACK, Version: client.version, Body: &MessageACK{seq: int32(seq), status: ACK_MODERATION_REJECTED}}
+			client.EnqueueMessage(ack)
+			return false
 		}
-		msg.content = string(c)
-		log.Infof("filter dirty word, replace text %s with %s", text, replacedText)
 	}
+	*content = c
+	return true
 }
 
 func SyncKeyService(redis_pool *redis.Pool,
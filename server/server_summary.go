@@ -6,6 +6,11 @@ type ServerSummary struct {
 	clientset_count   int64 //重复uid的client对象不计数
 	in_message_count  int64
 	out_message_count int64
+
+	rate_limited_count          int64 //被限制发送的消息数量
+	rate_limit_disconnect_count int64 //被限制次数过多断开的连接数量
+
+	group_notification_dropped_count int64 //队列满丢弃的群通知事件数量
 }
 
 func NewServerSummary() *ServerSummary {
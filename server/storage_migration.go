@@ -0,0 +1,501 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/rpc"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/GoBelieveIO/im_service/storage"
+)
+
+// uid:ims地址
+const STORAGE_OWNERS_KEY = "storage_owners"
+
+// 迁移前后的消息id对应关系, 用于转换客户端的同步点
+const STORAGE_MIGRATION_EXPIRE = 30 * 24 * 3600
+
+const MIGRATION_BATCH_COUNT = 1000
+
+// 单个用户迁移的消息数量上限, 超过时放弃迁移, 不会截断消息队列
+const MIGRATION_DEFAULT_LIMIT = 10000
+
+func (rpc_s *RPCStorage) loadStorageOwners() {
+	conn := rpc_s.redis_pool.Get()
+	defer conn.Close()
+
+	owners, err := redis.StringMap(conn.Do("HGETALL", STORAGE_OWNERS_KEY))
+	if err != nil {
+		log.Warning("load storage owners err:", err)
+		return
+	}
+
+	for k, addr := range owners {
+		uid, err := strconv.ParseInt(k, 10, 64)
+		if err != nil {
+			continue
+		}
+		rpc_s.SetStorageOwner(uid, addr)
+	}
+	log.Info("storage owners:", len(rpc_s.owners))
+}
+
+func (rpc_s *RPCStorage) storageAddrIndex(addr string) int {
+	for i, a := range rpc_s.rpc_addrs {
+		if a == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+func (rpc_s *RPCStorage) SetStorageOwner(uid int64, addr string) bool {
+	index := rpc_s.storageAddrIndex(addr)
+	if index == -1 {
+		log.Warningf("storage address:%s of uid:%d not configured", addr, uid)
+		return false
+	}
+
+	rpc_s.mutex.Lock()
+	defer rpc_s.mutex.Unlock()
+	rpc_s.owners[uid] = index
+	return true
+}
+
+func (rpc_s *RPCStorage) IsMovedUser(uid int64) bool {
+	rpc_s.mutex.RLock()
+	defer rpc_s.mutex.RUnlock()
+	_, ok := rpc_s.owners[uid]
+	return ok
+}
+
+// 客户端迁移之后的第一次同步, 把旧节点的消息id转换为新节点的消息id
+func (rpc_s *RPCStorage) TranslateSyncKey(appid int64, uid int64, device_id int64, sync_key int64) int64 {
+	if sync_key == 0 || rpc_s.redis_pool == nil || !rpc_s.IsMovedUser(uid) {
+		return sync_key
+	}
+
+	conn := rpc_s.redis_pool.Get()
+	defer conn.Close()
+
+	key := fmt.Sprintf("storage_migration_%d_%d", appid, uid)
+	device_field := fmt.Sprintf("device_%d", device_id)
+	reply, err := redis.Values(conn.Do("HMGET", key, "migrated_at", device_field, sync_key))
+	if err != nil {
+		log.Warning("hmget error:", err)
+		return sync_key
+	}
+
+	var migrated_at, translated, new_key int64
+	_, err = redis.Scan(reply, &migrated_at, &translated, &new_key)
+	if err != nil {
+		log.Warning("scan error:", err)
+		return sync_key
+	}
+	if migrated_at == 0 || translated != 0 {
+		return sync_key
+	}
+
+	_, err = conn.Do("HSET", key, device_field, 1)
+	if err != nil {
+		log.Warning("hset error:", err)
+	}
+	//同步点早于迁移的消息,重新同步全部迁移的消息
+	log.Infof("translate sync key appid:%d uid:%d device:%d %d->%d", appid, uid, device_id, sync_key, new_key)
+	return new_key
+}
+
+func (rpc_s *RPCStorage) callStorage(index int, method string, args interface{}, reply interface{}) error {
+	dc, err := rpc_s.AcquireResource(rpc_s.rpc_pools[index])
+	if err != nil {
+		return err
+	}
+	defer dc.Release()
+	return dc.Value().(*rpc.Client).Call(method, args, reply)
+}
+
+// 迁移用户所有appid下的离线消息队列到addr节点
+// 迁移过程中源节点拒绝该用户的写入, im会等待迁移完成之后写入新的节点
+func (rpc_s *RPCStorage) MigrateUser(uid int64, addr string, limit int) error {
+	dst := rpc_s.storageAddrIndex(addr)
+	if dst == -1 {
+		return fmt.Errorf("storage address:%s not configured", addr)
+	}
+	src := rpc_s.getStorageIndex(uid)
+	if src == dst {
+		return fmt.Errorf("uid:%d already in %s", uid, addr)
+	}
+
+	var frozen storage.MigrationUser
+	err := rpc_s.callStorage(src, "RPCStorage.FreezeUser", &storage.MigrationUser{Uid: uid}, &frozen)
+	if err != nil {
+		return err
+	}
+
+	abort := func(err error) error {
+		var r int
+		e := rpc_s.callStorage(src, "RPCStorage.ReleaseUser", &storage.MigrationUser{Uid: uid}, &r)
+		if e != nil {
+			log.Warningf("unfreeze uid:%d err:%s", uid, e)
+		}
+		return err
+	}
+
+	//清除目标节点上之前迁移失败残留的消息, 重复迁移不会产生重复的消息
+	var r int
+	err = rpc_s.callStorage(dst, "RPCStorage.ResetPeerUser", &storage.MigrationUser{Uid: uid}, &r)
+	if err != nil {
+		return abort(err)
+	}
+
+	msgids := make(map[int64]map[int64]int64)
+	for appid, last_id := range frozen.LastIDs {
+		m, err := rpc_s.migrateQueue(src, dst, appid, uid, last_id, limit)
+		if err != nil {
+			return abort(err)
+		}
+		msgids[appid] = m
+	}
+
+	for appid, m := range msgids {
+		err = rpc_s.saveMigration(appid, uid, m)
+		if err != nil {
+			return abort(err)
+		}
+	}
+
+	//源节点确认冻结没有过期并且之后没有新的写入,之后的请求都转到新的节点
+	release := &storage.MigrationUser{Uid: uid, Address: addr, LastIDs: frozen.LastIDs}
+	err = rpc_s.callStorage(src, "RPCStorage.ReleaseUser", release, &r)
+	if err != nil {
+		return abort(err)
+	}
+	rpc_s.SetStorageOwner(uid, addr)
+
+	conn := rpc_s.redis_pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("HSET", STORAGE_OWNERS_KEY, uid, addr)
+	if err != nil {
+		//旧节点会返回ERR_USER_MOVED, 不影响路由
+		log.Warningf("save storage owner uid:%d err:%s", uid, err)
+		return err
+	}
+	log.Infof("migrate uid:%d from:%s to:%s", uid, rpc_s.rpc_addrs[src], addr)
+	return nil
+}
+
+// 返回旧消息id:新消息id
+func (rpc_s *RPCStorage) migrateQueue(src int, dst int, appid int64, uid int64, last_id int64, limit int) (map[int64]int64, error) {
+	batches := make([][]*storage.HistoryMessage, 0)
+	count := 0
+	for last_id > 0 {
+		if count >= limit {
+			return nil, fmt.Errorf("uid:%d appid:%d messages exceed migration limit:%d", uid, appid, limit)
+		}
+		req := &storage.ExportRequest{AppID: appid, Uid: uid, LastID: last_id, Limit: MIGRATION_BATCH_COUNT}
+		var resp storage.ExportMessage
+		err := rpc_s.callStorage(src, "RPCStorage.ExportPeerMessages", req, &resp)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Messages) == 0 {
+			break
+		}
+		batches = append(batches, resp.Messages)
+		count += len(resp.Messages)
+		last_id = resp.NextID
+	}
+
+	msgids := make(map[int64]int64)
+	for i := len(batches) - 1; i >= 0; i-- {
+		m := &storage.ImportMessage{AppID: appid, Uid: uid, Messages: batches[i]}
+		var resp storage.ImportMessageID
+		err := rpc_s.callStorage(dst, "RPCStorage.ImportPeerMessages", m, &resp)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.MessageIDs) != len(batches[i]) {
+			return nil, fmt.Errorf("import message count:%d != %d", len(resp.MessageIDs), len(batches[i]))
+		}
+		for j, hm := range batches[i] {
+			msgids[hm.MsgID] = resp.MessageIDs[j]
+		}
+	}
+	log.Infof("migrate appid:%d uid:%d messages:%d", appid, uid, len(msgids))
+	return msgids, nil
+}
+
+func (rpc_s *RPCStorage) saveMigration(appid int64, uid int64, msgids map[int64]int64) error {
+	conn := rpc_s.redis_pool.Get()
+	defer conn.Close()
+
+	key := fmt.Sprintf("storage_migration_%d_%d", appid, uid)
+	conn.Send("MULTI")
+	conn.Send("DEL", key)
+	args := redis.Args{}.Add(key).Add("migrated_at").Add(time.Now().Unix())
+	for old_msgid, msgid := range msgids {
+		args = args.Add(old_msgid).Add(msgid)
+	}
+	conn.Send("HSET", args...)
+	conn.Send("EXPIRE", key, STORAGE_MIGRATION_EXPIRE)
+	_, err := conn.Do("EXEC")
+	if err != nil {
+		return err
+	}
+
+	//服务端保存的同步点
+	sync_key := GetSyncKey(rpc_s.redis_pool, appid, uid)
+	if sync_key > 0 {
+		SaveSyncKey(rpc_s.redis_pool, appid, uid, msgids[sync_key])
+	}
+	return nil
+}
+
+// 按照hash范围迁移的进度, 同一时间只能有一个迁移任务
+type RangeMigration struct {
+	mutex       sync.Mutex
+	address     string
+	running     bool
+	migrated    int
+	failed      []int64
+	err         error
+	started_at  int64
+	finished_at int64
+}
+
+func (rm *RangeMigration) start(addr string) bool {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	if rm.running {
+		return false
+	}
+	rm.address = addr
+	rm.running = true
+	rm.migrated = 0
+	rm.failed = make([]int64, 0)
+	rm.err = nil
+	rm.started_at = time.Now().Unix()
+	rm.finished_at = 0
+	return true
+}
+
+func (rm *RangeMigration) progress(uid int64, err error) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	if err != nil {
+		rm.failed = append(rm.failed, uid)
+	} else {
+		rm.migrated++
+	}
+}
+
+func (rm *RangeMigration) finish(err error) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	rm.running = false
+	rm.err = err
+	rm.finished_at = time.Now().Unix()
+}
+
+func (rm *RangeMigration) status() map[string]interface{} {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	obj := make(map[string]interface{})
+	obj["address"] = rm.address
+	obj["running"] = rm.running
+	obj["migrated"] = rm.migrated
+	obj["failed"] = append([]int64{}, rm.failed...)
+	obj["started_at"] = rm.started_at
+	obj["finished_at"] = rm.finished_at
+	if rm.err != nil {
+		obj["error"] = rm.err.Error()
+	}
+	return obj
+}
+
+func (rpc_s *RPCStorage) standbyIndex(addr string) (int, error) {
+	if rpc_s.ring == nil {
+		return -1, errors.New("storage hash ring disabled")
+	}
+	dst := rpc_s.storageAddrIndex(addr)
+	if dst == -1 {
+		return -1, fmt.Errorf("storage address:%s not configured", addr)
+	}
+	if dst < rpc_s.active_count {
+		return -1, fmt.Errorf("storage address:%s is not standby", addr)
+	}
+	return dst, nil
+}
+
+// 在后台迁移备用节点加入hash环之后负责的全部用户, 进度通过RangeMigrationStatus查询
+func (rpc_s *RPCStorage) StartMigrateRange(addr string, limit int) error {
+	_, err := rpc_s.standbyIndex(addr)
+	if err != nil {
+		return err
+	}
+	if !rpc_s.range_migration.start(addr) {
+		return errors.New("range migration is running")
+	}
+	go func() {
+		err := rpc_s.MigrateRange(addr, limit)
+		if err != nil {
+			log.Warningf("migrate range to:%s err:%s", addr, err)
+		}
+		rpc_s.range_migration.finish(err)
+	}()
+	return nil
+}
+
+func (rpc_s *RPCStorage) RangeMigrationStatus() map[string]interface{} {
+	return rpc_s.range_migration.status()
+}
+
+// 迁移备用节点加入hash环之后负责的全部用户, 每个用户的结果记录在range_migration中
+// 迁移期间新用户的消息仍然写入原来的节点, 加入hash环之前需要再次执行直到没有需要迁移的用户
+func (rpc_s *RPCStorage) MigrateRange(addr string, limit int) error {
+	_, err := rpc_s.standbyIndex(addr)
+	if err != nil {
+		return err
+	}
+
+	addrs := make([]string, 0, rpc_s.active_count+1)
+	addrs = append(addrs, rpc_s.rpc_addrs[:rpc_s.active_count]...)
+	addrs = append(addrs, addr)
+	ring := NewHashRing(addrs, DEFAULT_HASH_RING_REPLICAS)
+	target := len(addrs) - 1
+
+	for src := 0; src < rpc_s.active_count; src++ {
+		var cursor int64
+		for {
+			req := &storage.UserListRequest{Cursor: cursor, Limit: MIGRATION_BATCH_COUNT}
+			var resp storage.UserList
+			err := rpc_s.callStorage(src, "RPCStorage.ListPeerUsers", req, &resp)
+			if err != nil {
+				return err
+			}
+			for _, uid := range resp.Uids {
+				//显式指定到其它节点的用户不迁移
+				if ring.Get(uid) != target || rpc_s.getStorageIndex(uid) != src {
+					continue
+				}
+				err = rpc_s.MigrateUser(uid, addr, limit)
+				if err != nil {
+					log.Warningf("migrate uid:%d err:%s", uid, err)
+				}
+				rpc_s.range_migration.progress(uid, err)
+			}
+			if len(resp.Uids) < MIGRATION_BATCH_COUNT {
+				break
+			}
+			cursor = resp.Uids[len(resp.Uids)-1]
+		}
+		log.Infof("migrate range from:%s to:%s finished", rpc_s.rpc_addrs[src], addr)
+	}
+	return nil
+}
+
+// 迁移用户的离线消息到其它ims节点
+func MigrateStorageUser(w http.ResponseWriter, req *http.Request, rpc_storage *RPCStorage) {
+	m, _ := url.ParseQuery(req.URL.RawQuery)
+
+	uid, err := strconv.ParseInt(m.Get("uid"), 10, 64)
+	if err != nil {
+		log.Info("error:", err)
+		WriteHttpError(400, "invalid query param", w)
+		return
+	}
+
+	addr := m.Get("address")
+	if addr == "" {
+		WriteHttpError(400, "invalid query param", w)
+		return
+	}
+
+	limit := MIGRATION_DEFAULT_LIMIT
+	if m.Get("limit") != "" {
+		n, err := strconv.ParseInt(m.Get("limit"), 10, 64)
+		if err != nil || n <= 0 {
+			WriteHttpError(400, "invalid query param", w)
+			return
+		}
+		limit = int(n)
+	}
+
+	if rpc_storage.redis_pool == nil {
+		WriteHttpError(400, "redis not configured", w)
+		return
+	}
+
+	err = rpc_storage.MigrateUser(uid, addr, limit)
+	if err != nil {
+		log.Warningf("migrate uid:%d err:%s", uid, err)
+		WriteHttpError(400, err.Error(), w)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// 在后台迁移备用节点在hash环上负责的全部用户, 通过/migrate_storage_range_status查询进度
+func MigrateStorageRange(w http.ResponseWriter, req *http.Request, rpc_storage *RPCStorage) {
+	m, _ := url.ParseQuery(req.URL.RawQuery)
+
+	addr := m.Get("address")
+	if addr == "" {
+		WriteHttpError(400, "invalid query param", w)
+		return
+	}
+
+	limit := MIGRATION_DEFAULT_LIMIT
+	if m.Get("limit") != "" {
+		n, err := strconv.ParseInt(m.Get("limit"), 10, 64)
+		if err != nil || n <= 0 {
+			WriteHttpError(400, "invalid query param", w)
+			return
+		}
+		limit = int(n)
+	}
+
+	if rpc_storage.redis_pool == nil {
+		WriteHttpError(400, "redis not configured", w)
+		return
+	}
+
+	err := rpc_storage.StartMigrateRange(addr, limit)
+	if err != nil {
+		log.Warningf("migrate range to:%s err:%s", addr, err)
+		WriteHttpError(400, err.Error(), w)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// 查询按照hash范围迁移的进度
+func MigrateStorageRangeStatus(w http.ResponseWriter, req *http.Request, rpc_storage *RPCStorage) {
+	WriteHttpObj(rpc_storage.RangeMigrationStatus(), w)
+}
@@ -0,0 +1,252 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bitly/go-simplejson"
+	"github.com/gomodule/redigo/redis"
+	"github.com/importcjj/sensitive"
+	log "github.com/sirupsen/logrus"
+)
+
+const WORD_ACTION_MASK = "mask"
+const WORD_ACTION_REJECT = "reject"
+const WORD_ACTION_FLAG = "flag" //正常发送, 消息写入审核队列
+
+// 待审核的消息队列和最大长度
+const WORD_REVIEW_QUEUE = "sensitive_review_queue"
+const WORD_REVIEW_QUEUE_LIMIT = 10000
+
+// 等待写入审核队列的消息数量, 超过时丢弃
+const WORD_REVIEW_PENDING_LIMIT = 1000
+
+// appids为空时作用于所有的app
+type WordListConfig struct {
+	AppIDs []int64 `toml:"appids"`
+	File   string  `toml:"file"`
+	Action string  `toml:"action"` //mask(默认), reject, flag
+}
+
+type wordList struct {
+	appids map[int64]bool
+	action string
+	file   string
+	mtime  time.Time
+	filter *sensitive.Filter
+}
+
+func (l *wordList) match(appid int64) bool {
+	return len(l.appids) == 0 || l.appids[appid]
+}
+
+// 按照app配置的关键词字典, 字典文件修改之后可以重新加载
+type WordFilter struct {
+	configs    []*WordListConfig
+	redis_pool *redis.Pool
+	review_c   chan []byte
+
+	mutex sync.RWMutex
+	lists []*wordList
+}
+
+// word_file为旧的全局字典, 替换为*
+func NewWordFilter(word_file string, configs []*WordListConfig, redis_pool *redis.Pool) *WordFilter {
+	f := &WordFilter{}
+	if len(word_file) > 0 {
+		f.configs = append(f.configs, &WordListConfig{File: word_file, Action: WORD_ACTION_MASK})
+	}
+	f.configs = append(f.configs, configs...)
+	f.redis_pool = redis_pool
+	f.review_c = make(chan []byte, WORD_REVIEW_PENDING_LIMIT)
+	return f
+}
+
+func loadWordList(config *WordListConfig) (*wordList, error) {
+	info, err := os.Stat(config.File)
+	if err != nil {
+		return nil, err
+	}
+	filter := sensitive.New()
+	err = filter.LoadWordDict(config.File)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &wordList{}
+	l.appids = make(map[int64]bool)
+	for _, appid := range config.AppIDs {
+		l.appids[appid] = true
+	}
+	l.action = config.Action
+	if l.action != WORD_ACTION_REJECT && l.action != WORD_ACTION_FLAG {
+		l.action = WORD_ACTION_MASK
+	}
+	l.file = config.File
+	l.mtime = info.ModTime()
+	l.filter = filter
+	return l, nil
+}
+
+// 加载失败的字典保留之前的版本
+func (f *WordFilter) Reload() {
+	f.mutex.RLock()
+	old_lists := f.lists
+	f.mutex.RUnlock()
+
+	lists := make([]*wordList, 0, len(f.configs))
+	for i, config := range f.configs {
+		l, err := loadWordList(config)
+		if err != nil {
+			log.Warningf("load word file:%s err:%s", config.File, err)
+			if i < len(old_lists) && old_lists[i] != nil {
+				l = old_lists[i]
+			}
+		}
+		lists = append(lists, l)
+	}
+
+	f.mutex.Lock()
+	f.lists = lists
+	f.mutex.Unlock()
+	log.Infof("load word files:%d", len(lists))
+}
+
+// 字典文件修改之后重新加载
+func (f *WordFilter) modified() bool {
+	f.mutex.RLock()
+	lists := f.lists
+	f.mutex.RUnlock()
+
+	for i, config := range f.configs {
+		info, err := os.Stat(config.File)
+		if err != nil {
+			continue
+		}
+		if i >= len(lists) || lists[i] == nil || !info.ModTime().Equal(lists[i].mtime) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *WordFilter) Watch(interval int) {
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	for range ticker.C {
+		if f.modified() {
+			f.Reload()
+		}
+	}
+}
+
+func (f *WordFilter) filterText(appid int64, text string) (string, bool, []string) {
+	f.mutex.RLock()
+	lists := f.lists
+	f.mutex.RUnlock()
+
+	var flagged []string
+	for _, l := range lists {
+		if l == nil || !l.match(appid) {
+			continue
+		}
+		if exist, _ := l.filter.FindIn(text); !exist {
+			continue
+		}
+		switch l.action {
+		case WORD_ACTION_REJECT:
+			return text, true, nil
+		case WORD_ACTION_FLAG:
+			flagged = append(flagged, l.filter.FindAll(text)...)
+		default:
+			text = l.filter.Replace(l.filter.RemoveNoise(text), '*')
+		}
+	}
+	return text, false, flagged
+}
+
+// json格式的消息只检查text字段, 其它格式检查整个内容
+// 不再区分MESSAGE_FLAG_TEXT, 非文本消息的text字段同样会被检查
+// 返回替换之后的内容, 是否拒绝发送和需要审核的关键词
+func (f *WordFilter) Check(appid int64, content string) (string, bool, []string) {
+	obj, err := simplejson.NewJson([]byte(content))
+	if err != nil {
+		return f.filterText(appid, content)
+	}
+
+	text, err := obj.Get("text").String()
+	if err != nil {
+		return content, false, nil
+	}
+	t, rejected, flagged := f.filterText(appid, text)
+	if rejected || t == text {
+		return content, rejected, flagged
+	}
+
+	obj.Set("text", t)
+	c, err := obj.Encode()
+	if err != nil {
+		log.Errorf("json encode err:%s", err)
+		return content, false, flagged
+	}
+	log.Infof("filter dirty word, replace text %s with %s", text, t)
+	return string(c), false, flagged
+}
+
+// 在发送消息的路径上调用, 异步写入审核队列
+func (f *WordFilter) Flag(appid int64, cmd int, sender int64, receiver int64, content string, words []string) {
+	obj := make(map[string]interface{})
+	obj["appid"] = appid
+	obj["cmd"] = cmd
+	obj["sender"] = sender
+	obj["receiver"] = receiver
+	obj["content"] = content
+	obj["words"] = words
+	obj["timestamp"] = time.Now().Unix()
+	b, _ := json.Marshal(obj)
+
+	select {
+	case f.review_c <- b:
+	default:
+		log.Warning("review queue is full, discard flagged message")
+	}
+}
+
+func (f *WordFilter) pushReview(b []byte) {
+	conn := f.redis_pool.Get()
+	defer conn.Close()
+
+	conn.Send("LPUSH", WORD_REVIEW_QUEUE, b)
+	conn.Send("LTRIM", WORD_REVIEW_QUEUE, 0, WORD_REVIEW_QUEUE_LIMIT-1)
+	_, err := conn.Do("")
+	if err != nil {
+		log.Warning("push review queue err:", err)
+	}
+}
+
+// 写入审核队列, 由业务服务器读取
+func (f *WordFilter) ReviewLoop() {
+	for b := range f.review_c {
+		f.pushReview(b)
+	}
+}
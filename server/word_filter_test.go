@@ -0,0 +1,94 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeWordFile(t *testing.T, name string, words string) string {
+	p := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(p, []byte(words), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestWordFilterCheck(t *testing.T) {
+	mask_file := writeWordFile(t, "mask.txt", "长者\n")
+	reject_file := writeWordFile(t, "reject.txt", "广告\n")
+	flag_file := writeWordFile(t, "flag.txt", "审核\n")
+
+	configs := []*WordListConfig{
+		{File: mask_file},
+		{AppIDs: []int64{7}, File: reject_file, Action: WORD_ACTION_REJECT},
+		{File: flag_file, Action: WORD_ACTION_FLAG},
+	}
+	f := NewWordFilter("", configs, nil)
+	f.Reload()
+
+	c, rejected, flagged := f.Check(1, `{"text":"长者"}`)
+	if rejected || len(flagged) > 0 || c != `{"text":"**"}` {
+		t.Errorf("mask:%s %v %v", c, rejected, flagged)
+	}
+
+	//非json的内容检查整个文本
+	c, _, _ = f.Check(1, "长者")
+	if c != "**" {
+		t.Errorf("plain text mask:%s", c)
+	}
+
+	//reject只作用于配置的app
+	_, rejected, _ = f.Check(7, `{"text":"广告"}`)
+	if !rejected {
+		t.Error("app 7 should be rejected")
+	}
+	_, rejected, _ = f.Check(8, `{"text":"广告"}`)
+	if rejected {
+		t.Error("app 8 should not be rejected")
+	}
+
+	c, rejected, flagged = f.Check(1, `{"text":"需要审核"}`)
+	if rejected || len(flagged) != 1 || flagged[0] != "审核" || c != `{"text":"需要审核"}` {
+		t.Errorf("flag:%s %v %v", c, rejected, flagged)
+	}
+
+	//没有text字段的json不检查
+	c, rejected, _ = f.Check(7, `{"image":"广告"}`)
+	if rejected || c != `{"image":"广告"}` {
+		t.Errorf("no text:%s %v", c, rejected)
+	}
+}
+
+func TestWordFilterReloadKeepsOld(t *testing.T) {
+	p := writeWordFile(t, "mask.txt", "长者\n")
+	f := NewWordFilter(p, nil, nil)
+	f.Reload()
+
+	os.Remove(p)
+	f.Reload()
+	c, _, _ := f.Check(1, "长者")
+	if c != "**" {
+		t.Errorf("old word list should be kept:%s", c)
+	}
+}
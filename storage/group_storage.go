@@ -145,7 +145,7 @@ func (storage *GroupStorage) LoadGroupHistoryMessages(appid int64, uid int64, gi
 		}
 
 		m := storage.LoadMessage(off.msgid)
-		if msgid == 0 && m.Cmd == MSG_GROUP_IM {
+		if msgid == 0 && (m.Cmd == MSG_GROUP_IM || m.Cmd == MSG_GROUP_IM_MENTION) {
 			//不取入群之前的消息
 			im := m.Body.(MessageTime)
 			if im.Timestamp() < ts {
@@ -165,6 +165,66 @@ func (storage *GroupStorage) LoadGroupHistoryMessages(appid int64, uid int64, gi
 	return c, last_msgid
 }
 
+// 加载指定id的群组消息, 消息之后的MSG_GROUP_OFFLINE用于校验消息所属的群组
+func (storage *GroupStorage) LoadGroupMessage(appid int64, gid int64, msgid int64) *Message {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	block_NO := storage.getBlockNO(msgid)
+	offset := storage.getBlockOffset(msgid)
+
+	file := storage.getFile(block_NO)
+	if file == nil {
+		log.Warning("can not get file", block_NO)
+		return nil
+	}
+
+	_, err := file.Seek(int64(offset), os.SEEK_SET)
+	if err != nil {
+		log.Warning("seek file err:", err)
+		return nil
+	}
+
+	msg := storage.ReadMessage(file)
+	if msg == nil {
+		log.Warning("read message failure")
+		return nil
+	}
+
+	off_m := storage.ReadMessage(file)
+	if off_m == nil {
+		file = storage.getFile(block_NO + 1)
+		if file == nil {
+			log.Warning("can not get file", block_NO+1)
+			return nil
+		}
+
+		_, err := file.Seek(HEADER_SIZE, os.SEEK_SET)
+		if err != nil {
+			log.Warning("seek file err:", err)
+			return nil
+		}
+
+		off_m = storage.ReadMessage(file)
+		if off_m == nil {
+			log.Warning("read message failure")
+			return nil
+		}
+	}
+
+	off, ok := off_m.Body.(*OfflineMessage)
+	if !ok || off_m.Cmd != MSG_GROUP_OFFLINE {
+		log.Warning("invalid message cmd:", off_m.Cmd)
+		return nil
+	}
+
+	if off.msgid != msgid || off.appid != appid || off.receiver != gid {
+		log.Warningf("invalid group message:%d appid:%d gid:%d", msgid, appid, gid)
+		return nil
+	}
+	return msg
+}
+
 func (storage *GroupStorage) createGroupIndex() {
 	log.Info("create group message index begin:", time.Now().UnixNano())
 
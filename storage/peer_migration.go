@@ -0,0 +1,353 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/GoBelieveIO/im_service/protocol"
+)
+
+// 用户消息队列在ims节点之间迁移
+// 1. FreezeUser: 源节点拒绝该用户新的写入, 冻结在FREEZE_LEASE秒之后自动失效
+// 2. ResetUser: 目标节点清除之前迁移失败残留的消息队列
+// 3. LoadPeerChain/ImportPeerMessages: 复制消息队列到目标节点
+// 4. ReleaseUser: 源节点确认冻结没有过期并且队列没有变化后, 记录用户已经迁移到目标节点,
+// 之后所有读写请求都返回ERR_USER_MOVED, im据此更新路由
+
+const MOVED_USERS_FILE_NAME = "peer_moved"
+
+// 冻结的有效时间(秒), 迁移的协调者异常退出时用户最多这么长时间不能写入
+// im等待迁移完成的时间需要超过这个值
+const FREEZE_LEASE = 10
+
+const ERR_USER_MIGRATING = "user migrating"
+const ERR_USER_MOVED = "user moved"
+
+func NewUserMovedError(uid int64, addr string) error {
+	return fmt.Errorf("%s:%d:%s", ERR_USER_MOVED, uid, addr)
+}
+
+// rpc返回的错误只保留了错误字符串
+func ParseUserMovedError(err error) (int64, string, bool) {
+	if err == nil {
+		return 0, "", false
+	}
+	arr := strings.SplitN(err.Error(), ":", 3)
+	if len(arr) != 3 || arr[0] != ERR_USER_MOVED {
+		return 0, "", false
+	}
+	uid, e := strconv.ParseInt(arr[1], 10, 64)
+	if e != nil {
+		return 0, "", false
+	}
+	return uid, arr[2], true
+}
+
+func IsUserMigratingError(err error) bool {
+	return err != nil && err.Error() == ERR_USER_MIGRATING
+}
+
+func (storage *PeerStorage) checkUser(uid int64) error {
+	if addr, ok := storage.moved[uid]; ok {
+		return NewUserMovedError(uid, addr)
+	}
+	if storage.isFrozen(uid) {
+		return errors.New(ERR_USER_MIGRATING)
+	}
+	return nil
+}
+
+// 过期的冻结直接删除, 之后的ReleaseUser会失败
+func (storage *PeerStorage) isFrozen(uid int64) bool {
+	expire, ok := storage.frozen[uid]
+	if !ok {
+		return false
+	}
+	if time.Now().Unix() < expire {
+		return true
+	}
+	delete(storage.frozen, uid)
+	log.Warningf("user:%d freeze expired", uid)
+	return false
+}
+
+// 迁移中的用户依然可以读取消息
+func (storage *PeerStorage) CheckMoved(uid int64) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	if addr, ok := storage.moved[uid]; ok {
+		return NewUserMovedError(uid, addr)
+	}
+	return nil
+}
+
+func (storage *PeerStorage) SavePeerMessageIfOwned(appid int64, uid int64, device_id int64, msg *Message) (int64, int64, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	if err := storage.checkUser(uid); err != nil {
+		return 0, 0, err
+	}
+	msgid, prev_msgid := storage.savePeerMessage(appid, uid, device_id, msg)
+	return msgid, prev_msgid, nil
+}
+
+// 任意一个成员不属于当前节点,整批消息都不写入
+func (storage *PeerStorage) SavePeerGroupMessageIfOwned(appid int64, members []int64, device_id int64, msg *Message) ([]int64, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	for _, uid := range members {
+		if err := storage.checkUser(uid); err != nil {
+			return nil, err
+		}
+	}
+
+	r := make([]int64, 0, len(members)*2)
+	for _, uid := range members {
+		msgid, prev_msgid := storage.savePeerMessage(appid, uid, device_id, msg)
+		r = append(r, msgid)
+		r = append(r, prev_msgid)
+	}
+	return r, nil
+}
+
+// 冻结用户的写入, 返回用户在各个appid下的最新离线消息id
+func (storage *PeerStorage) FreezeUser(uid int64) (map[int64]int64, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if addr, ok := storage.moved[uid]; ok {
+		return nil, NewUserMovedError(uid, addr)
+	}
+	storage.frozen[uid] = time.Now().Unix() + FREEZE_LEASE
+
+	last_ids := make(map[int64]int64)
+	for id, index := range storage.message_index {
+		if id.uid == uid {
+			last_ids[id.appid] = index.last_id
+		}
+	}
+	log.Infof("freeze user:%d %v", uid, last_ids)
+	return last_ids, nil
+}
+
+// 源节点确认冻结之后没有新的写入
+// addr为空表示放弃迁移,恢复写入
+func (storage *PeerStorage) ReleaseUser(uid int64, addr string, last_ids map[int64]int64) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if addr == "" {
+		delete(storage.frozen, uid)
+		log.Infof("unfreeze user:%d", uid)
+		return nil
+	}
+
+	//冻结过期之后可能已经有新的写入
+	if !storage.isFrozen(uid) {
+		return fmt.Errorf("user:%d not frozen", uid)
+	}
+
+	for id, index := range storage.message_index {
+		if id.uid == uid && index.last_id != last_ids[id.appid] {
+			return fmt.Errorf("user:%d appid:%d queue changed %d != %d", uid, id.appid, index.last_id, last_ids[id.appid])
+		}
+	}
+
+	err := storage.appendMovedUser(uid, addr)
+	if err != nil {
+		return err
+	}
+	storage.moved[uid] = addr
+	delete(storage.frozen, uid)
+	log.Infof("user:%d moved to:%s", uid, addr)
+	return nil
+}
+
+// 按照uid的顺序返回uid大于cursor的最多limit个用户, 不包括已经迁移走的用户
+func (storage *PeerStorage) ListUsers(cursor int64, limit int) []int64 {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	users := make(map[int64]bool)
+	for id := range storage.message_index {
+		if id.uid <= cursor {
+			continue
+		}
+		if _, ok := storage.moved[id.uid]; ok {
+			continue
+		}
+		users[id.uid] = true
+	}
+
+	uids := make([]int64, 0, len(users))
+	for uid := range users {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	if len(uids) > limit {
+		uids = uids[:limit]
+	}
+	return uids
+}
+
+// 从last_id开始,沿着离线消息队列向前读取最多count条消息
+// 返回的消息按照时间顺序排列, 以及下一次读取的起始位置
+func (storage *PeerStorage) LoadPeerChain(appid int64, uid int64, last_id int64, count int) ([]*EMessage, int64) {
+	if last_id == 0 {
+		last_id, _ = storage.GetLastMessageID(appid, uid)
+	}
+
+	messages := make([]*EMessage, 0, 10)
+	for last_id > 0 && len(messages) < count {
+		msg := storage.LoadMessage(last_id)
+		if msg == nil {
+			break
+		}
+
+		off, ok := msg.Body.(*OfflineMessage)
+		if !ok {
+			log.Warning("invalid message cmd:", msg.Cmd)
+			break
+		}
+		last_id = off.prev_msgid
+
+		msg = storage.LoadMessage(off.msgid)
+		if msg == nil {
+			break
+		}
+		if msg.Cmd == MSG_GROUP_IM ||
+			msg.Cmd == MSG_GROUP_IM_REF ||
+			msg.Cmd == MSG_GROUP_IM_MENTION ||
+			msg.Cmd == MSG_GROUP_NOTIFICATION ||
+			msg.Cmd == MSG_IM ||
+			msg.Cmd == MSG_CUSTOMER_V2 ||
+			msg.Cmd == MSG_SYSTEM {
+			emsg := &EMessage{MsgId: off.msgid, DeviceId: off.device_id, Msg: msg}
+			messages = append(messages, emsg)
+		}
+	}
+
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, last_id
+}
+
+// 按照顺序写入从其它节点迁移过来的消息, 返回新的消息id
+func (storage *PeerStorage) ImportPeerMessages(appid int64, uid int64, messages []*EMessage) ([]int64, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if storage.isFrozen(uid) {
+		return nil, errors.New(ERR_USER_MIGRATING)
+	}
+
+	//用户迁回当前节点
+	if _, ok := storage.moved[uid]; ok {
+		err := storage.appendMovedUser(uid, "")
+		if err != nil {
+			return nil, err
+		}
+		delete(storage.moved, uid)
+	}
+
+	msgids := make([]int64, 0, len(messages))
+	for _, emsg := range messages {
+		msgid, _ := storage.savePeerMessage(appid, uid, emsg.DeviceId, emsg.Msg)
+		msgids = append(msgids, msgid)
+	}
+	return msgids, nil
+}
+
+// 迁入之前清除用户在当前节点上的消息队列
+// 用户不属于当前节点, 这些消息是之前迁移失败残留的副本或者迁走之前的旧数据, 完整的队列在源节点上
+func (storage *PeerStorage) ResetUser(uid int64) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if storage.isFrozen(uid) {
+		return errors.New(ERR_USER_MIGRATING)
+	}
+
+	for id := range storage.message_index {
+		if id.uid == uid {
+			delete(storage.message_index, id)
+		}
+	}
+	log.Infof("reset user:%d", uid)
+	return nil
+}
+
+// 每行: uid address, address为空表示用户迁回
+func (storage *PeerStorage) appendMovedUser(uid int64, addr string) error {
+	path := fmt.Sprintf("%s/%s", storage.root, MOVED_USERS_FILE_NAME)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintf(file, "%d %s\n", uid, addr)
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func (storage *PeerStorage) readMovedUsers() {
+	path := fmt.Sprintf("%s/%s", storage.root, MOVED_USERS_FILE_NAME)
+	file, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatal("open file:", err)
+		}
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		uid, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			log.Warning("invalid moved user:", scanner.Text())
+			continue
+		}
+		if len(fields) == 1 {
+			delete(storage.moved, uid)
+		} else {
+			storage.moved[uid] = fields[1]
+		}
+	}
+	log.Info("moved users:", len(storage.moved))
+}
@@ -56,17 +56,27 @@ type PeerStorage struct {
 	//消息索引全部放在内存中,在程序退出时,再全部保存到文件中，
 	//如果索引文件不存在或上次保存失败，则在程序启动的时候，从消息DB中重建索引，这需要遍历每一条消息
 	message_index map[UserID]*UserIndex //记录每个用户最近的消息ID
+
+	frozen map[int64]int64  //迁移中的用户,拒绝写入, uid:冻结到期的时间
+	moved  map[int64]string //已经迁移到其它节点的用户
 }
 
 func NewPeerStorage(f *StorageFile) *PeerStorage {
 	storage := &PeerStorage{StorageFile: f}
 	storage.message_index = make(map[UserID]*UserIndex)
+	storage.frozen = make(map[int64]int64)
+	storage.moved = make(map[int64]string)
 	return storage
 }
 
 func (storage *PeerStorage) SavePeerMessage(appid int64, uid int64, device_id int64, msg *Message) (int64, int64) {
 	storage.mutex.Lock()
 	defer storage.mutex.Unlock()
+	return storage.savePeerMessage(appid, uid, device_id, msg)
+}
+
+// save without lock
+func (storage *PeerStorage) savePeerMessage(appid int64, uid int64, device_id int64, msg *Message) (int64, int64) {
 	msgid := storage.saveMessage(msg)
 
 	user_index := storage.getPeerIndex(appid, uid)
@@ -194,6 +204,8 @@ func (storage *PeerStorage) LoadHistoryMessages(appid int64, receiver int64, syn
 			break
 		}
 		if msg.Cmd == MSG_GROUP_IM ||
+			msg.Cmd == MSG_GROUP_IM_REF ||
+			msg.Cmd == MSG_GROUP_IM_MENTION ||
 			msg.Cmd == MSG_GROUP_NOTIFICATION ||
 			msg.Cmd == MSG_IM ||
 			msg.Cmd == MSG_CUSTOMER_V2 ||
@@ -316,6 +328,8 @@ func (storage *PeerStorage) LoadHistoryMessagesV3(appid int64, receiver int64, s
 			break
 		}
 		if msg.Cmd == MSG_GROUP_IM ||
+			msg.Cmd == MSG_GROUP_IM_REF ||
+			msg.Cmd == MSG_GROUP_IM_MENTION ||
 			msg.Cmd == MSG_GROUP_NOTIFICATION ||
 			msg.Cmd == MSG_IM ||
 			msg.Cmd == MSG_CUSTOMER_V2 ||
@@ -379,6 +393,8 @@ func (storage *PeerStorage) LoadLatestMessages(appid int64, receiver int64, limi
 			break
 		}
 		if msg.Cmd == MSG_GROUP_IM ||
+			msg.Cmd == MSG_GROUP_IM_REF ||
+			msg.Cmd == MSG_GROUP_IM_MENTION ||
 			msg.Cmd == MSG_GROUP_NOTIFICATION ||
 			msg.Cmd == MSG_IM ||
 			msg.Cmd == MSG_CUSTOMER_V2 {
@@ -394,7 +410,8 @@ func (storage *PeerStorage) LoadLatestMessages(appid int64, receiver int64, limi
 }
 
 func (client *PeerStorage) isGroupMessage(msg *Message) bool {
-	return msg.Cmd == MSG_GROUP_IM || msg.Flag&MESSAGE_FLAG_GROUP != 0
+	return msg.Cmd == MSG_GROUP_IM || msg.Cmd == MSG_GROUP_IM_REF ||
+		msg.Cmd == MSG_GROUP_IM_MENTION || msg.Flag&MESSAGE_FLAG_GROUP != 0
 }
 
 func (storage *PeerStorage) GetNewCount(appid int64, uid int64, last_received_id int64) int {
@@ -45,6 +45,13 @@ type GroupMessage struct {
 }
 
 
+// 加载大群保存在群组消息队列中的消息
+type GroupMessageRequest struct {
+	AppID     int64
+	GroupID   int64
+	MsgIDs    []int64
+}
+
 type SyncHistory struct {
 	AppID     int64
 	Uid       int64
@@ -96,6 +103,45 @@ type LatestMessage struct {
 	Messages []*HistoryMessage
 }
 
+//用户迁移
+type MigrationUser struct {
+	Uid       int64
+	Address   string          //迁移的目标节点, 为空表示放弃迁移
+	LastIDs   map[int64]int64 //appid:离线消息id
+}
+
+type ExportRequest struct {
+	AppID     int64
+	Uid       int64
+	LastID    int64
+	Limit     int32
+}
+
+type ExportMessage struct {
+	Messages  []*HistoryMessage
+	NextID    int64
+}
+
+type ImportMessage struct {
+	AppID     int64
+	Uid       int64
+	Messages  []*HistoryMessage
+}
+
+type ImportMessageID struct {
+	MessageIDs []int64
+}
+
+//按照hash范围迁移时遍历节点上的用户
+type UserListRequest struct {
+	Cursor    int64  //上一页最后的uid
+	Limit     int32
+}
+
+type UserList struct {
+	Uids      []int64
+}
+
 
 type RPCStorage interface {
 	SyncMessage(sync_key *SyncHistory, result *PeerHistoryMessage) error
@@ -108,9 +154,23 @@ type RPCStorage interface {
 
 	SaveGroupMessage(m *GroupMessage, result *HistoryMessageID) error
 
+	LoadGroupMessages(r *GroupMessageRequest, result *LatestMessage) error
+
 	GetNewCount(sync_key *SyncHistory, new_count *int64) error
 
 	GetLatestMessage(r *HistoryRequest, l *LatestMessage) error
 
+	FreezeUser(u *MigrationUser, result *MigrationUser) error
+
+	ExportPeerMessages(r *ExportRequest, result *ExportMessage) error
+
+	ImportPeerMessages(m *ImportMessage, result *ImportMessageID) error
+
+	ReleaseUser(u *MigrationUser, result *int) error
+
+	ResetPeerUser(u *MigrationUser, result *int) error
+
+	ListPeerUsers(r *UserListRequest, result *UserList) error
+
 	Ping(int, *int) error
 }
@@ -40,6 +40,8 @@ func NewStorage(root string, ewt chan *EMessage) *Storage {
 
 	storage := &Storage{f, ps, gs}
 
+	storage.readMovedUsers()
+
 	r1 := storage.readPeerIndex()
 	r2 := storage.readGroupIndex()
 	storage.last_saved_id = storage.last_id
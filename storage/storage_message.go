@@ -31,6 +31,7 @@ func init() {
 
 	protocol.RegisterMessageCreator(protocol.MSG_GROUP_OFFLINE, func() IMessage { return new(OfflineMessage) })
 	protocol.RegisterMessageCreator(protocol.MSG_OFFLINE_V4, func() IMessage { return new(OfflineMessage) })
+	protocol.RegisterMessageCreator(protocol.MSG_GROUP_IM_REF, func() IMessage { return new(GroupMessageRef) })
 	protocol.RegisterMessageCreator(protocol.MSG_OFFLINE_V3_, func() IMessage { return new(IgnoreMessage) })
 	protocol.RegisterMessageCreator(protocol.MSG_OFFLINE_V2_, func() IMessage { return new(IgnoreMessage) })
 	protocol.RegisterMessageCreator(protocol.MSG_GROUP_IM_LIST_, func() IMessage { return new(IgnoreMessage) })
@@ -210,3 +211,26 @@ func (off *OfflineMessage) FromData(buff []byte) bool {
 	binary.Read(buffer, binary.BigEndian, &off.prev_batch_msgid)
 	return true
 }
+
+// 大群的消息只在群组消息队列中保存一次, 个人消息队列中保存消息的引用
+type GroupMessageRef struct {
+	GroupID int64
+	MsgID   int64 //群组消息队列中的消息id
+}
+
+func (ref *GroupMessageRef) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, ref.GroupID)
+	binary.Write(buffer, binary.BigEndian, ref.MsgID)
+	return buffer.Bytes()
+}
+
+func (ref *GroupMessageRef) FromData(buff []byte) bool {
+	if len(buff) < 16 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &ref.GroupID)
+	binary.Read(buffer, binary.BigEndian, &ref.MsgID)
+	return true
+}